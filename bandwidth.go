@@ -0,0 +1,224 @@
+// Parses bandwidth files as published by bandwidth authorities.
+
+package zoossh
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The annotation that CollecTor puts in front of archived bandwidth files.
+// Files taken directly from a bandwidth authority lack it.
+var bandwidthFileMatcher = MatchAnnotationMajor("bandwidth-file", "1")
+
+// bandwidthFileTerminators separate the header of a bandwidth file from its
+// relay lines.  Version 1.0.0 files have neither a header nor a terminator,
+// and some older generators wrote four rather than five '=' characters.  See
+// bandwidth-file-spec.txt, Section 2.
+var bandwidthFileTerminators = map[string]bool{"=====": true, "====": true}
+
+// BandwidthEntry represents a relay line of a bandwidth file.
+type BandwidthEntry struct {
+	// The relay's fingerprint, taken from the "node_id" key.
+	Fingerprint Fingerprint
+
+	// The relay's nickname, taken from the "nick" key.
+	Nickname string
+
+	// The relay's measured bandwidth, taken from the "bw" key.  It uses the
+	// same unit as the bandwidth weights of a consensus.
+	Bandwidth uint64
+
+	// All remaining keys of the relay line, e.g., "master_key_ed25519" or
+	// "error_circ".  Generators add new keys all the time, so we keep them
+	// rather than dropping them.
+	Extra map[string]string
+}
+
+// BandwidthFile represents a bandwidth file as defined in
+// bandwidth-file-spec.txt.
+type BandwidthFile struct {
+	// The time at which the file was generated, taken from its first line.
+	Timestamp time.Time
+
+	// The header's key=value lines, e.g., "version" and "software".  The map
+	// is empty for version 1.0.0 files.
+	Header map[string]string
+
+	// A map from relay fingerprint to the relay's entry.
+	Entries map[Fingerprint]*BandwidthEntry
+}
+
+// NewBandwidthFile serves as a constructor and returns a pointer to a freshly
+// allocated and empty BandwidthFile struct.
+func NewBandwidthFile() *BandwidthFile {
+
+	return &BandwidthFile{
+		Header:  make(map[string]string),
+		Entries: make(map[Fingerprint]*BandwidthEntry),
+	}
+}
+
+// Get returns the entry for the given fingerprint and a boolean value
+// indicating if the entry could be found.
+func (bf *BandwidthFile) Get(fingerprint Fingerprint) (*BandwidthEntry, bool) {
+
+	entry, exists := bf.Entries[SanitiseFingerprint(fingerprint)]
+	return entry, exists
+}
+
+// isBandwidthRelayLine returns true if the given line is a relay line rather
+// than a header line.  We need this to tell where the relay lines of version
+// 1.0.0 files start, which lack a terminator.
+func isBandwidthRelayLine(line string) bool {
+
+	for _, word := range strings.Fields(line) {
+		if strings.HasPrefix(word, "node_id=") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// parseBandwidthEntry parses the space-separated key=value pairs of a relay
+// line.
+func parseBandwidthEntry(line string) (*BandwidthEntry, error) {
+
+	entry := &BandwidthEntry{Extra: make(map[string]string)}
+	var haveBandwidth bool
+
+	for _, word := range strings.Fields(line) {
+		keyValue := strings.SplitN(word, "=", 2)
+		if len(keyValue) != 2 || keyValue[0] == "" {
+			return nil, fmt.Errorf("expected key=value pair but got %q", word)
+		}
+
+		switch keyValue[0] {
+		case "node_id":
+			fingerprint, err := NormalizeFingerprint(keyValue[1])
+			if err != nil {
+				return nil, err
+			}
+			entry.Fingerprint = fingerprint
+		case "nick":
+			entry.Nickname = keyValue[1]
+		case "bw":
+			bw, err := strconv.ParseUint(keyValue[1], 10, 64)
+			if err != nil {
+				return nil, err
+			}
+			entry.Bandwidth = bw
+			haveBandwidth = true
+		default:
+			entry.Extra[keyValue[0]] = keyValue[1]
+		}
+	}
+
+	if entry.Fingerprint == "" {
+		return nil, fmt.Errorf("missing node_id")
+	}
+	if !haveBandwidth {
+		return nil, fmt.Errorf("missing bw")
+	}
+
+	return entry, nil
+}
+
+// parseBandwidthFile parses the bandwidth file that is read from the given
+// io.Reader.  The file may start with a type annotation.
+func parseBandwidthFile(r io.Reader) (*BandwidthFile, error) {
+
+	bandwidthFile := NewBandwidthFile()
+	scanner := bufio.NewScanner(r)
+	lineNum := 0
+	inHeader := true
+
+	nextLine := func() (string, bool) {
+		if !scanner.Scan() {
+			return "", false
+		}
+		lineNum++
+		return strings.TrimSuffix(scanner.Text(), "\r"), true
+	}
+
+	line, ok := nextLine()
+	if ok && strings.HasPrefix(line, "@type ") {
+		annotation, err := parseAnnotation(line)
+		if err != nil {
+			return nil, err
+		}
+		if !bandwidthFileMatcher(annotation) {
+			return nil, fmt.Errorf("unexpected file annotation: %s", annotation)
+		}
+		line, ok = nextLine()
+	}
+	if !ok {
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("missing bandwidth file timestamp")
+	}
+
+	timestamp, err := strconv.ParseInt(strings.TrimSpace(line), 10, 64)
+	if err != nil {
+		return nil, newParseError(lineNum, line, "timestamp", err)
+	}
+	bandwidthFile.Timestamp = time.Unix(timestamp, 0).UTC()
+
+	for line, ok = nextLine(); ok; line, ok = nextLine() {
+
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+
+		if inHeader {
+			if bandwidthFileTerminators[line] {
+				inHeader = false
+				continue
+			}
+			if !isBandwidthRelayLine(line) {
+				keyValue := strings.SplitN(line, "=", 2)
+				if len(keyValue) != 2 || keyValue[0] == "" {
+					return nil, newParseError(lineNum, line, "header",
+						fmt.Errorf("expected key=value pair"))
+				}
+				bandwidthFile.Header[keyValue[0]] = keyValue[1]
+				continue
+			}
+			inHeader = false
+		}
+
+		entry, err := parseBandwidthEntry(line)
+		if err != nil {
+			return nil, newParseError(lineNum, line, "relay", err)
+		}
+		bandwidthFile.Entries[entry.Fingerprint] = entry
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return bandwidthFile, nil
+}
+
+// ParseBandwidthFile parses the given bandwidth file and returns its header
+// and relay entries.  Both files archived by CollecTor, which start with a type
+// annotation, and files taken directly from a bandwidth authority are
+// supported.
+func ParseBandwidthFile(fileName string) (*BandwidthFile, error) {
+
+	fd, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+
+	return parseBandwidthFile(fd)
+}
@@ -0,0 +1,78 @@
+// Tests functions from "bandwidth.go".
+
+package zoossh
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseBandwidthFile(t *testing.T) {
+
+	// Only run this test if the bandwidth file is there.
+	if _, err := os.Stat(bandwidthFile); os.IsNotExist(err) {
+		t.Skipf("skipping because of missing %s", bandwidthFile)
+	}
+
+	bf, err := ParseBandwidthFile(bandwidthFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bf.Timestamp.Equal(time.Unix(1523911758, 0)) {
+		t.Errorf("Parsed timestamp %s incorrectly.", bf.Timestamp)
+	}
+	if bf.Header["version"] != "1.2.0" || bf.Header["software"] != "sbws" || len(bf.Header) != 5 {
+		t.Errorf("Header parsed incorrectly: %v", bf.Header)
+	}
+	if len(bf.Entries) != 2 {
+		t.Fatalf("Expected 2 entries but got %d.", len(bf.Entries))
+	}
+
+	entry, found := bf.Get("68a483e05a2abdca6da5a3ef8db5177638a27f80")
+	if !found {
+		t.Fatal("Entry not found.")
+	}
+	if entry.Nickname != "Test" || entry.Bandwidth != 38000 {
+		t.Errorf("Entry parsed incorrectly: %+v", entry)
+	}
+	if entry.Extra["bw_mean"] != "1127824" || entry.Extra["time"] != "2018-05-08T16:13:26" {
+		t.Errorf("Unknown keys parsed incorrectly: %v", entry.Extra)
+	}
+	if _, exists := entry.Extra["node_id"]; exists {
+		t.Error("Known key ended up in the map of unknown keys.")
+	}
+}
+
+func TestParseBandwidthFileVersion100(t *testing.T) {
+
+	// Version 1.0.0 files have neither an annotation nor a header.
+	raw := "1523911758\n" +
+		"node_id=$68A483E05A2ABDCA6DA5A3EF8DB5177638A27F80 bw=760 nick=Test measured_at=1523911725\n"
+
+	bf, err := parseBandwidthFile(strings.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bf.Header) != 0 {
+		t.Errorf("Expected empty header but got %v.", bf.Header)
+	}
+	if entry, found := bf.Get("68A483E05A2ABDCA6DA5A3EF8DB5177638A27F80"); !found || entry.Bandwidth != 760 {
+		t.Error("Entry not parsed.")
+	}
+
+	for _, raw := range []string{
+		"",
+		"@type server-descriptor 1.0\n1523911758\n",
+		"yesterday\n",
+		"1523911758\nfoo\n",
+		"1523911758\n=====\nbw=760 nick=Test\n",
+		"1523911758\n=====\nnode_id=$68A483E05A2ABDCA6DA5A3EF8DB5177638A27F80 bw=lots\n",
+	} {
+		if _, err := parseBandwidthFile(strings.NewReader(raw)); err == nil {
+			t.Errorf("Invalid bandwidth file %q did not raise an error.", raw)
+		}
+	}
+}
@@ -0,0 +1,230 @@
+// Parses files containing bridge network statuses.
+
+package zoossh
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"time"
+)
+
+var bridgeStatusAnnotations = map[Annotation]bool{
+	// The file formats we currently (try to) support.
+	Annotation{"bridge-network-status", "1", "0"}: true,
+	Annotation{"bridge-network-status", "1", "1"}: true,
+	Annotation{"bridge-network-status", "1", "2"}: true,
+}
+
+// Sanitised bridge descriptors of any minor version share the format that we
+// (try to) support.
+var bridgeDescriptorMatcher = MatchAnnotationMajor("bridge-server-descriptor", "1")
+
+// The address that sanitised bridge network statuses use instead of a bridge's
+// real IPv4 address.
+var bridgePlaceholderAddress = net.IPv4(127, 0, 0, 1)
+
+// BridgeNetworkStatus represents a bridge network status as published by the
+// bridge authority and sanitised by CollecTor.  Its router statuses are held
+// in the embedded Consensus.  Bridge network statuses lack validity times, so
+// only the embedded Consensus' MetaInfo map is populated.
+type BridgeNetworkStatus struct {
+	*Consensus
+
+	// The single field of a "published" line.
+	Published time.Time
+}
+
+// ParseRawBridgeStatus parses a raw router status (in string format) that is
+// part of a bridge network status.  Fields that were redacted during
+// sanitisation, such as the bridge's 127.0.0.1 placeholder address, are left
+// zero-valued.
+func ParseRawBridgeStatus(rawStatus string) (Fingerprint, GetStatus, error) {
+
+	fingerprint, getStatus, err := ParseRawStatus(rawStatus)
+	if err != nil {
+		return "", nil, err
+	}
+
+	status := getStatus()
+	if status.Address.IPv4Address.Equal(bridgePlaceholderAddress) {
+		status.Address.IPv4Address = nil
+	}
+
+	return fingerprint, getStatus, nil
+}
+
+// extractBridgeStatusEntry is a bufio.SplitFunc that extracts individual
+// router statuses of a bridge network status.  Unlike consensuses, bridge
+// network statuses lack a footer, so the last status ends with the document.
+func extractBridgeStatusEntry(data []byte, atEOF bool) (advance int, token []byte, err error) {
+
+	if atEOF && bytes.HasPrefix(data, []byte("r ")) &&
+		!bytes.Contains(data, []byte("\nr ")) && footerIndex(data) < 0 {
+		return len(data), data, bufio.ErrFinalToken
+	}
+
+	return extractStatusEntryOrFooter(data, atEOF)
+}
+
+// extractBridgeStatusHeader reads the header of the bridge network status in
+// the given bufio.Reader, i.e., everything up to the first router status, and
+// writes it to the given bridge network status.  It returns the number of
+// lines that it read.
+func extractBridgeStatusHeader(br *bufio.Reader, s *BridgeNetworkStatus) (int, error) {
+
+	numLines := 0
+	publishedLine := 0
+
+	for {
+		next, err := br.Peek(2)
+		if err == io.EOF || bytes.Equal(next, []byte("r ")) {
+			break
+		} else if err != nil {
+			return numLines, err
+		}
+
+		line, err := br.ReadSlice('\n')
+		if err != nil && err != io.EOF {
+			return numLines, err
+		}
+		numLines++
+
+		split := bytes.SplitN(bytes.TrimSpace(line), []byte(" "), 2)
+		key := string(split[0])
+		if len(split) == 2 {
+			s.MetaInfo[key] = split[1]
+		} else {
+			s.MetaInfo[key] = []byte{}
+		}
+		if key == "published" {
+			publishedLine = numLines
+		}
+	}
+
+	if publishedLine == 0 {
+		return numLines, errors.New("bridge network status lacks \"published\" line")
+	}
+
+	published := string(s.MetaInfo["published"])
+	var err error
+	s.Published, err = time.Parse(publishedTimeLayout, published)
+	if err != nil {
+		return numLines, newParseError(publishedLine, "published "+published, "published", err)
+	}
+
+	return numLines, nil
+}
+
+// parseBridgeStatusUnchecked parses a document of type
+// "bridge-network-status".  The input should be without a type annotation;
+// i.e., the type annotation should already have been read and checked to be
+// the correct type.  The given settings apply to parsing.
+func parseBridgeStatusUnchecked(r io.Reader, options *parseOptions) (*BridgeNetworkStatus, error) {
+
+	status := &BridgeNetworkStatus{Consensus: NewConsensus()}
+	status.MetaInfo = make(map[string][]byte)
+
+	br := bufio.NewReader(r)
+
+	// The type annotation took up the first line.
+	numLines, err := extractBridgeStatusHeader(br, status)
+	if err != nil {
+		return nil, offsetParseError(err, 1)
+	}
+
+	_, err = parseStatusEntries(br, status.Consensus, extractBridgeStatusEntry, ParseRawBridgeStatus, numLines+2,
+		options)
+	if err != nil {
+		return nil, err
+	}
+
+	return status, nil
+}
+
+// parseBridgeStatus is a wrapper around parseBridgeStatusUnchecked that first
+// reads and checks the type annotation to make sure it belongs to
+// bridgeStatusAnnotations.
+func parseBridgeStatus(r io.Reader, options *parseOptions) (*BridgeNetworkStatus, error) {
+
+	r, err := readAndCheckAnnotation(r, bridgeStatusAnnotations)
+	if err != nil {
+		return nil, err
+	}
+
+	return parseBridgeStatusUnchecked(r, options)
+}
+
+// ParseBridgeStatusFile parses the given file and returns a bridge network
+// status if parsing was successful.  If there were any errors, an error string
+// is returned.
+func ParseBridgeStatusFile(fileName string) (*BridgeNetworkStatus, error) {
+
+	return ParseBridgeStatusFileWithOptions(fileName)
+}
+
+// ParseBridgeStatusFileWithOptions works like ParseBridgeStatusFile but applies
+// the given options.
+func ParseBridgeStatusFileWithOptions(fileName string, opts ...ParseOption) (*BridgeNetworkStatus, error) {
+
+	fd, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+
+	return parseBridgeStatus(fd, newParseOptions(opts))
+}
+
+// extractBridgeDescriptor is a bufio.SplitFunc that extracts individual
+// sanitised bridge descriptors.  Sanitisation removes the signature of bridge
+// descriptors, so a bridge descriptor ends where the next one begins, or with
+// the document.
+var extractBridgeDescriptor = extractByKeyword("router")
+
+// parseBridgeDescriptorUnchecked parses a document of type
+// "bridge-server-descriptor".  The input should be without a type annotation;
+// i.e., the type annotation should already have been read and checked to be
+// the correct type.  The given settings apply to parsing.
+func parseBridgeDescriptorUnchecked(r io.Reader, options *parseOptions) (*RouterDescriptors, error) {
+
+	var descriptors = NewRouterDescriptors()
+
+	if err := parseDescriptorInto(r, extractBridgeDescriptor, parseRawDescriptorFull, descriptors, options); err != nil {
+		return nil, err
+	}
+
+	return descriptors, nil
+}
+
+// ParseBridgeDescriptorFile parses the given file containing sanitised bridge
+// descriptors and returns a pointer to RouterDescriptors containing the bridge
+// descriptors.  Sanitised bridge descriptors are keyed by the hashed
+// fingerprint of the bridge and contain masked addresses, such as 10.x.x.x,
+// which are kept as they are.  If there were any errors, an error string is
+// returned.
+func ParseBridgeDescriptorFile(fileName string) (*RouterDescriptors, error) {
+
+	return ParseBridgeDescriptorFileWithOptions(fileName)
+}
+
+// ParseBridgeDescriptorFileWithOptions works like ParseBridgeDescriptorFile but
+// applies the given options.
+func ParseBridgeDescriptorFileWithOptions(fileName string, opts ...ParseOption) (*RouterDescriptors, error) {
+
+	fd, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+
+	r, err := readAndMatchAnnotation(fd, bridgeDescriptorMatcher)
+	if err != nil {
+		return nil, err
+	}
+
+	return parseBridgeDescriptorUnchecked(r, newParseOptions(opts))
+}
@@ -0,0 +1,118 @@
+// Tests functions from "bridge.go".
+
+package zoossh
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestParseBridgeStatusFile(t *testing.T) {
+
+	// Only run this test if the bridge network status file is there.
+	if _, err := os.Stat(bridgeStatusFile); os.IsNotExist(err) {
+		t.Skipf("skipping because of missing %s", bridgeStatusFile)
+	}
+
+	status, err := ParseBridgeStatusFile(bridgeStatusFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if status.Length() != 3 {
+		t.Errorf("Expected 3 bridge statuses but got %d.", status.Length())
+	}
+
+	if !status.Published.Equal(time.Date(2017, time.April, 15, 0, 0, 0, 0, time.UTC)) {
+		t.Error("Publication time of bridge network status parsed incorrectly.")
+	}
+
+	bridge, found := status.Get("9B94CD0B7B8057EAF21BA7F023B7A1C8CA9CE645")
+	if !found {
+		t.Fatal("Bridge status not found.")
+	}
+
+	// The placeholder address must not make it into the router status.
+	if bridge.Address.IPv4Address != nil {
+		t.Errorf("Expected redacted IPv4 address but got %s.", bridge.Address.IPv4Address)
+	}
+	if bridge.Address.IPv4ORPort != 9001 || bridge.Address.IPv6ORPort != 9001 {
+		t.Error("Ports of bridge status parsed incorrectly.")
+	}
+	if !bridge.Flags.Guard || bridge.Bandwidth != 1280 {
+		t.Error("Bridge status parsed incorrectly.")
+	}
+
+	// The last bridge status isn't followed by a footer.
+	if _, found := status.Get("CCEF02AA454C0AB0FE1AC68304F6D8C4220C1912"); !found {
+		t.Error("Last bridge status not found.")
+	}
+
+	if _, err := ParseConsensusFile(bridgeStatusFile); err == nil {
+		t.Error("Consensus parser accepted bridge network status.")
+	}
+
+	objs, err := ParseUnknownFile(bridgeStatusFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := objs.(*BridgeNetworkStatus); !ok {
+		t.Errorf("Expected *BridgeNetworkStatus but got %T.", objs)
+	}
+}
+
+func TestParseBridgeDescriptorFile(t *testing.T) {
+
+	// Only run this test if the bridge descriptors file is there.
+	if _, err := os.Stat(bridgeDescriptorFile); os.IsNotExist(err) {
+		t.Skipf("skipping because of missing %s", bridgeDescriptorFile)
+	}
+
+	descriptors, err := ParseBridgeDescriptorFile(bridgeDescriptorFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if descriptors.Length() != 2 {
+		t.Errorf("Expected 2 bridge descriptors but got %d.", descriptors.Length())
+	}
+
+	desc, found := descriptors.Get("00408EC8DA1E2AB279DF2F332C79AF389AB85D02")
+	if !found {
+		t.Fatal("Bridge descriptor not found.")
+	}
+	if desc.DistributionRequest != "https" {
+		t.Errorf("Expected distribution request \"https\" but got %q.", desc.DistributionRequest)
+	}
+	if desc.Address.String() != "10.94.227.130" || desc.ORPort != 443 {
+		t.Error("Masked address of bridge descriptor parsed incorrectly.")
+	}
+	if !desc.ServesDirectory() || !desc.HiddenServiceDir {
+		t.Error("Bridge descriptor parsed incorrectly.")
+	}
+	if desc.MasterKeyEd25519 != "wbmRfKPFyxiNd6t1BHVO5tCqWSf/e8lyKZvpqXA/kxs" {
+		t.Errorf("Parsed master key %q of bridge descriptor incorrectly.", desc.MasterKeyEd25519)
+	}
+
+	// The last bridge descriptor isn't followed by a signature.
+	desc, found = descriptors.Get("12B49D5C01CA5C41E6E00B049D336EDF3A0B41DC")
+	if !found {
+		t.Fatal("Last bridge descriptor not found.")
+	}
+	if desc.BandwidthObs != 52109 || desc.DistributionRequest != "" {
+		t.Error("Last bridge descriptor parsed incorrectly.")
+	}
+
+	if _, err := ParseDescriptorFile(bridgeDescriptorFile); err == nil {
+		t.Error("Descriptor parser accepted bridge descriptors.")
+	}
+
+	objs, err := ParseUnknownFile(bridgeDescriptorFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if objs.Length() != 2 {
+		t.Errorf("Expected 2 bridge descriptors but got %d.", objs.Length())
+	}
+}
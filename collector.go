@@ -0,0 +1,96 @@
+// Parses the index of the files that CollecTor publishes.
+
+package zoossh
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+)
+
+// The layout of the "last_modified" timestamps in CollecTor's index.
+const collecTorTimeLayout = "2006-01-02 15:04"
+
+// CollecTorFile represents a file that CollecTor's index lists.
+type CollecTorFile struct {
+	// The file's path relative to the index' base URL, e.g.,
+	// "recent/relay-descriptors/consensuses/2017-04-15-00-00-00-consensus".
+	Path string
+
+	Size         int64
+	LastModified time.Time
+
+	// The types of the descriptors in the file, e.g.,
+	// "network-status-consensus-3 1.0".  Older indexes don't list types.
+	Types []string
+
+	// The SHA-256 digest of the file.  It is nil if the index lacks it.
+	SHA256 []byte
+}
+
+// collecTorDirectory mirrors a directory of CollecTor's index.json.
+type collecTorDirectory struct {
+	Path        string               `json:"path"`
+	Directories []collecTorDirectory `json:"directories"`
+	Files       []struct {
+		Path         string   `json:"path"`
+		Size         int64    `json:"size"`
+		LastModified string   `json:"last_modified"`
+		Types        []string `json:"types"`
+		SHA256       string   `json:"sha256"`
+	} `json:"files"`
+}
+
+// ParseCollecTorIndex parses CollecTor's index, i.e., the file index/index.json,
+// and returns the files that it lists, in the order in which they appear.  The
+// package doesn't fetch anything itself, but a caller can download the files,
+// e.g., from https://collector.torproject.org/, and parse them using
+// ParseUnknownBytes.  Compressed indexes such as index.json.gz have to be
+// decompressed first.
+func ParseCollecTorIndex(r io.Reader) ([]CollecTorFile, error) {
+
+	var index collecTorDirectory
+	if err := json.NewDecoder(r).Decode(&index); err != nil {
+		return nil, fmt.Errorf("could not decode CollecTor index: %s", err)
+	}
+
+	var files []CollecTorFile
+	var walk func(dir *collecTorDirectory, prefix string) error
+	walk = func(dir *collecTorDirectory, prefix string) error {
+		for _, f := range dir.Files {
+			file := CollecTorFile{
+				Path:  prefix + f.Path,
+				Size:  f.Size,
+				Types: f.Types,
+			}
+
+			var err error
+			if file.LastModified, err = time.Parse(collecTorTimeLayout, f.LastModified); err != nil {
+				return fmt.Errorf("%s: %s", file.Path, err)
+			}
+			if f.SHA256 != "" {
+				if file.SHA256, err = base64.StdEncoding.DecodeString(f.SHA256); err != nil {
+					return fmt.Errorf("%s: malformed SHA-256 digest: %s", file.Path, err)
+				}
+			}
+			files = append(files, file)
+		}
+
+		for i := range dir.Directories {
+			sub := &dir.Directories[i]
+			if err := walk(sub, prefix+sub.Path+"/"); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	// The top-level path is the base URL rather than a directory.
+	if err := walk(&index, ""); err != nil {
+		return nil, err
+	}
+
+	return files, nil
+}
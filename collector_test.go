@@ -0,0 +1,76 @@
+// Tests functions from "collector.go".
+
+package zoossh
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseCollecTorIndex(t *testing.T) {
+
+	digest := sha256.Sum256([]byte("foo"))
+
+	index := `{
+  "index_created": "2017-04-15 01:02",
+  "build_revision": "4a0fa8d",
+  "path": "https://collector.torproject.org",
+  "directories": [{
+    "path": "recent",
+    "directories": [{
+      "path": "relay-descriptors",
+      "directories": [{
+        "path": "consensuses",
+        "files": [{
+          "path": "2017-04-15-00-00-00-consensus",
+          "size": 2311436,
+          "last_modified": "2017-04-15 00:05",
+          "types": ["network-status-consensus-3 1.0"],
+          "first_published": "2017-04-15 00:00",
+          "last_published": "2017-04-15 00:00",
+          "sha256": "LCa0a2j/xo/5m0U8HTBBNBNCLXBkg7+g+YpeiGJm564="
+        }]
+      }]
+    }]
+  }],
+  "files": [{
+    "path": "index.json",
+    "size": 1234,
+    "last_modified": "2017-04-15 01:02"
+  }]
+}`
+
+	files, err := ParseCollecTorIndex(strings.NewReader(index))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 {
+		t.Fatalf("Expected 2 files but got %d.", len(files))
+	}
+
+	if files[0].Path != "index.json" || files[0].SHA256 != nil || files[0].Types != nil {
+		t.Errorf("Top-level file parsed incorrectly: %+v", files[0])
+	}
+
+	consensus := files[1]
+	if consensus.Path != "recent/relay-descriptors/consensuses/2017-04-15-00-00-00-consensus" ||
+		consensus.Size != 2311436 ||
+		!consensus.LastModified.Equal(time.Date(2017, time.April, 15, 0, 5, 0, 0, time.UTC)) ||
+		len(consensus.Types) != 1 || consensus.Types[0] != "network-status-consensus-3 1.0" ||
+		!bytes.Equal(consensus.SHA256, digest[:]) {
+		t.Errorf("Consensus parsed incorrectly: %+v", consensus)
+	}
+
+	for _, malformed := range []string{
+		`{"files": [`,
+		`{"files": [{"path": "foo", "last_modified": "yesterday"}]}`,
+		`{"files": [{"path": "foo", "last_modified": "2017-04-15 01:02", "sha256": "!"}]}`,
+	} {
+		if _, err := ParseCollecTorIndex(strings.NewReader(malformed)); err == nil {
+			t.Errorf("Malformed index %q did not cause an error.", malformed)
+		}
+	}
+}
@@ -5,18 +5,35 @@ package zoossh
 import (
 	"bufio"
 	"bytes"
+	"container/list"
+	"context"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"hash"
 	"io"
 	"net"
 	"os"
+	"path/filepath"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
+// The layout of the valid-after time that CollecTor encodes in the names of
+// consensus files, e.g., "2017-04-15-00-00-00-consensus".
+const collectorFileTimeLayout = "2006-01-02-15-04-05"
+
+// The first consensus method whose consensuses contain shared randomness
+// values, i.e., Tor's MIN_METHOD_FOR_SHARED_RANDOM.  See dir-spec.txt, Section
+// 3.8.1.
+const minSharedRandConsensusMethod = 23
+
 var consensusAnnotations = map[Annotation]bool{
 	// The file format we currently (try to) support.
 	Annotation{"network-status-consensus-3", "1", "0"}: true,
@@ -62,10 +79,16 @@ type RouterStatus struct {
 	// The single fields of an "s" line.
 	Flags RouterFlags
 
-	// The single fields of a "v" line.
+	// The single fields of a "v" line.  TorVersion holds the version number
+	// while RawVersion holds the line's complete value, e.g., "Tor 0.4.7.13".
+	// See ParsedVersion.
 	TorVersion string
+	RawVersion string
 
-	// The single fields of a "w" line.
+	// The single fields of a "w" line.  In a consensus, Bandwidth is the
+	// measured bandwidth if there is one, and the advertised bandwidth
+	// otherwise.  In a vote, Bandwidth is the advertised bandwidth and
+	// Measured the bandwidth that the authority measured.
 	Bandwidth  uint64
 	Measured   uint64
 	Unmeasured bool
@@ -73,6 +96,54 @@ type RouterStatus struct {
 	// The single fields of a "p" line.
 	Accept   bool
 	PortList string
+
+	// The relay's ed25519 identity key from an "id ed25519" line.  The key is
+	// kept in its unpadded base64 encoding, as found in the document.  It is
+	// empty if the line is missing or says "none".
+	Ed25519Identity string
+
+	// The lines that the parser does not understand, in the order in which
+	// they appear.  Newer versions of Tor may add lines that we don't know
+	// about yet.  The slice is nil if all lines were understood.
+	Unrecognized []string
+
+	// The country code of the relay's IPv4 address.  It is not part of the
+	// consensus but set by EnrichCountry, and Equals ignores it.
+	CountryCode string
+}
+
+// DirSource represents a directory authority as listed in the "dir-source"
+// section of a network status document, see dir-spec.txt, Section 3.4.1.
+type DirSource struct {
+	// The single fields of a "dir-source" line.
+	Nickname    string
+	Fingerprint Fingerprint
+	Hostname    string
+	Address     net.IP
+	DirPort     uint16
+	ORPort      uint16
+
+	// The single field of the authority's "contact" line.
+	Contact string
+
+	// The digest of the authority's vote, which only consensuses have.
+	VoteDigest string
+}
+
+// ConsensusSignature represents a directory authority's signature from the
+// footer of a network status document.
+type ConsensusSignature struct {
+	// The digest algorithm, "sha1" unless given otherwise.
+	Algorithm string
+
+	// The fingerprint of the authority's identity key.
+	IdentityFingerprint Fingerprint
+
+	// The hex-encoded digest of the authority's signing key.
+	SigningKeyDigest string
+
+	// The decoded signature block.
+	Signature []byte
 }
 
 type Consensus struct {
@@ -84,13 +155,70 @@ type Consensus struct {
 	FreshUntil time.Time
 	ValidUntil time.Time
 
-	// Shared randomness
+	// The single field of the "consensus-method" line, which determines the
+	// lines that a consensus may contain.  Votes list the methods that they
+	// support in a "consensus-methods" line instead, so the field is zero for
+	// votes.
+	ConsensusMethod int
+
+	// Shared randomness.  Either value is nil if the consensus lacks the
+	// respective line, e.g., only the current value exists during the first
+	// shared randomness period.
 	SharedRandPrevious []byte
 	SharedRandCurrent  []byte
 
+	// The directory authorities of the "dir-source" sections, in the order
+	// in which they appear.  Consensuses list all authorities whose votes
+	// were taken into account, and votes only the voting authority.
+	DirSources []DirSource
+
+	// The network-wide parameters of the "params" line, e.g.,
+	// "CircuitPriorityHalflifeMsec" mapped to 30000.  The map is empty for
+	// consensuses that lack the line.  See Param.
+	Params map[string]int
+
+	// The footer's "bandwidth-weights" line, mapping weight names such as
+	// "Wgg" to their value.  The values are scaled by 10,000.
+	BandwidthWeights map[string]int64
+
 	// A map from relay fingerprint to a function which returns the relay
 	// status.
 	RouterStatuses map[Fingerprint]GetStatus
+
+	// Guards the caches below, which read methods fill in on demand, so
+	// that they may be called concurrently.
+	cacheMutex sync.Mutex
+
+	// Indices from nicknames (as is and in lower case) to fingerprints.  They
+	// are built on demand and invalidated by Set.
+	nicknameIndex       map[string][]Fingerprint
+	foldedNicknameIndex map[string][]Fingerprint
+
+	// The summed up bandwidth of all running relays, which is computed on
+	// demand and invalidated by Set.
+	runningBandwidth      uint64
+	runningBandwidthValid bool
+
+	// The valid-after times of the consensuses that router statuses were
+	// taken from by MergeConsensus.  Router statuses that lack an entry
+	// belong to this consensus' ValidAfter.  See statusValidAfterOf.
+	statusValidAfter map[Fingerprint]time.Time
+
+	// The "shared-rand-commit" lines of a vote's authority section.  See
+	// Vote.SharedRandCommits.
+	sharedRandCommits []SharedRandCommit
+
+	// Structural problems of the router status entries that were found
+	// while parsing with WithEntryStructureCheck.  See CheckEntryStructure.
+	entryErrors []error
+
+	// The line number of the first router status if the consensus was
+	// created by ParseConsensusHeader.  See ParseConsensusEntries.
+	firstEntryLine int
+
+	// The SHA-256 digest of the document's signed portion, which is
+	// computed while parsing.  See ComputeSHA256Digest.
+	sha256Digest []byte
 }
 
 // String implements the String as well as the Object interface.  It returns
@@ -113,6 +241,62 @@ func (s *RouterStatus) GetFingerprint() Fingerprint {
 	return s.Fingerprint
 }
 
+// Equals implements the Object interface.  It returns true if the given object
+// is a router status whose fields are equal to the fields of this router
+// status.  IP addresses and times are compared by value, regardless of their
+// representation.
+func (s *RouterStatus) Equals(other Object) bool {
+
+	o, ok := other.(*RouterStatus)
+	if !ok || s == nil || o == nil {
+		return ok && s == o
+	}
+
+	return s.Nickname == o.Nickname &&
+		s.Fingerprint == o.Fingerprint &&
+		s.Digest == o.Digest &&
+		s.Publication.Equal(o.Publication) &&
+		s.Address.Equals(o.Address) &&
+		s.Flags == o.Flags &&
+		s.TorVersion == o.TorVersion &&
+		s.RawVersion == o.RawVersion &&
+		s.Bandwidth == o.Bandwidth &&
+		s.Measured == o.Measured &&
+		s.Unmeasured == o.Unmeasured &&
+		s.Accept == o.Accept &&
+		s.PortList == o.PortList &&
+		s.Ed25519Identity == o.Ed25519Identity &&
+		stringsEqual(s.Unrecognized, o.Unrecognized)
+}
+
+// IsBandwidthMeasured returns true if bandwidth authorities measured the
+// relay's bandwidth.  In a vote, that is the case if the "w" line contains a
+// Measured value.  In a consensus, that is the case if the "w" line lacks
+// "Unmeasured=1".  Note that consensuses older than consensus method 17 never
+// mark relays as unmeasured.
+func (s *RouterStatus) IsBandwidthMeasured() bool {
+
+	return !s.Unmeasured
+}
+
+// ParsedVersion parses the relay's "v" line.  If the relay runs Tor, the
+// version and true are returned.  If the line is missing, or the relay runs
+// other software or a version that we cannot make sense of, nil and false are
+// returned.
+func (s *RouterStatus) ParsedVersion() (*TorVersion, bool) {
+
+	if !strings.HasPrefix(s.RawVersion, "Tor ") {
+		return nil, false
+	}
+
+	version, err := ParseTorVersion(strings.TrimPrefix(s.RawVersion, "Tor "))
+	if err != nil {
+		return nil, false
+	}
+
+	return version, true
+}
+
 // Length implements the ObjectSet interface.  It returns the length of the
 // consensus.
 func (c *Consensus) Length() int {
@@ -168,7 +352,8 @@ func NewConsensus() *Consensus {
 }
 
 // ToSlice converts the given consensus to a slice.  Consensus meta information
-// is lost.
+// is lost.  The slice holds functions that parse router statuses on demand;
+// use Statuses to get parsed router statuses instead.
 func (c *Consensus) ToSlice() []GetStatus {
 
 	length := c.Length()
@@ -199,9 +384,260 @@ func (c *Consensus) Get(fingerprint Fingerprint) (*RouterStatus, bool) {
 // to the consensus.
 func (c *Consensus) Set(fingerprint Fingerprint, status *RouterStatus) {
 
-	c.RouterStatuses[SanitiseFingerprint(fingerprint)] = func() *RouterStatus {
+	fingerprint = SanitiseFingerprint(fingerprint)
+	c.RouterStatuses[fingerprint] = func() *RouterStatus {
 		return status
 	}
+	delete(c.statusValidAfter, fingerprint)
+
+	c.invalidateCaches()
+}
+
+// invalidateCaches discards the caches that read methods build on demand, so
+// that they are rebuilt after the consensus was modified.
+func (c *Consensus) invalidateCaches() {
+
+	c.cacheMutex.Lock()
+	defer c.cacheMutex.Unlock()
+
+	c.nicknameIndex = nil
+	c.foldedNicknameIndex = nil
+	c.runningBandwidthValid = false
+}
+
+// buildNicknameIndices maps all nicknames in the consensus to the fingerprints
+// of the relays that use them.  Fingerprints are sorted, so lookups return
+// router statuses in a deterministic order.  The caller must hold cacheMutex.
+func (c *Consensus) buildNicknameIndices() {
+
+	c.nicknameIndex = make(map[string][]Fingerprint)
+	c.foldedNicknameIndex = make(map[string][]Fingerprint)
+
+	for _, fingerprint := range c.sortedFingerprints() {
+		status := c.RouterStatuses[fingerprint]()
+		if status == nil {
+			continue
+		}
+		folded := strings.ToLower(status.Nickname)
+		c.nicknameIndex[status.Nickname] = append(c.nicknameIndex[status.Nickname], fingerprint)
+		c.foldedNicknameIndex[folded] = append(c.foldedNicknameIndex[folded], fingerprint)
+	}
+}
+
+// sortedFingerprints returns the fingerprints of all router statuses in the
+// consensus in ascending order.
+func (c *Consensus) sortedFingerprints() []Fingerprint {
+
+	fingerprints := make([]string, 0, len(c.RouterStatuses))
+	for fingerprint := range c.RouterStatuses {
+		fingerprints = append(fingerprints, string(fingerprint))
+	}
+	sort.Strings(fingerprints)
+
+	sorted := make([]Fingerprint, len(fingerprints))
+	for i, fingerprint := range fingerprints {
+		sorted[i] = Fingerprint(fingerprint)
+	}
+
+	return sorted
+}
+
+// lookupNickname returns the router statuses of the given fingerprints.
+func (c *Consensus) lookupNickname(fingerprints []Fingerprint) []*RouterStatus {
+
+	var statuses []*RouterStatus
+
+	for _, fingerprint := range fingerprints {
+		if status, exists := c.Get(fingerprint); exists {
+			statuses = append(statuses, status)
+		}
+	}
+
+	return statuses
+}
+
+// GetByNickname returns all router statuses whose nickname matches the given
+// nickname.  Matching is case-sensitive.  Nicknames are not unique, so there
+// can be more than one match.  The first call builds an index over all
+// nicknames which makes subsequent calls cheap.  The index is rebuilt after
+// the consensus was modified using Set, but not if RouterStatuses was modified
+// directly.
+func (c *Consensus) GetByNickname(nickname string) []*RouterStatus {
+
+	c.cacheMutex.Lock()
+	if c.nicknameIndex == nil {
+		c.buildNicknameIndices()
+	}
+	fingerprints := c.nicknameIndex[nickname]
+	c.cacheMutex.Unlock()
+
+	return c.lookupNickname(fingerprints)
+}
+
+// GetByNicknameFold works like GetByNickname but matches nicknames
+// case-insensitively.
+func (c *Consensus) GetByNicknameFold(nickname string) []*RouterStatus {
+
+	c.cacheMutex.Lock()
+	if c.foldedNicknameIndex == nil {
+		c.buildNicknameIndices()
+	}
+	fingerprints := c.foldedNicknameIndex[strings.ToLower(nickname)]
+	c.cacheMutex.Unlock()
+
+	return c.lookupNickname(fingerprints)
+}
+
+// GetByFingerprintPrefix returns all router statuses whose fingerprint starts
+// with the given prefix, ordered by fingerprint.  The prefix is sanitised like
+// fingerprints are, so it may be in lower case.  An empty prefix matches all
+// router statuses.
+func (c *Consensus) GetByFingerprintPrefix(prefix string) []*RouterStatus {
+
+	var statuses []*RouterStatus
+
+	prefix = string(SanitiseFingerprint(Fingerprint(prefix)))
+
+	// Only the matching fingerprints need sorting, which is cheap for all but
+	// very short prefixes.
+	var fingerprints []Fingerprint
+	for fingerprint := range c.RouterStatuses {
+		if strings.HasPrefix(string(fingerprint), prefix) {
+			fingerprints = append(fingerprints, fingerprint)
+		}
+	}
+	sort.Slice(fingerprints, func(i, j int) bool {
+		return fingerprints[i] < fingerprints[j]
+	})
+
+	for _, fingerprint := range fingerprints {
+		if status := c.RouterStatuses[fingerprint](); status != nil {
+			statuses = append(statuses, status)
+		}
+	}
+
+	return statuses
+}
+
+// GetByAddress returns all router statuses whose IPv4 address or IPv6 OR
+// address falls into the given network, ordered by fingerprint.  Use a /32 or
+// /128 network to look up a single address.  The function scans all router
+// statuses.
+func (c *Consensus) GetByAddress(ipnet *net.IPNet) []*RouterStatus {
+
+	var statuses []*RouterStatus
+
+	for _, fingerprint := range c.sortedFingerprints() {
+		status := c.RouterStatuses[fingerprint]()
+		if status == nil {
+			continue
+		}
+		if (status.Address.IPv4Address != nil && ipnet.Contains(status.Address.IPv4Address)) ||
+			(status.Address.IPv6Address != nil && ipnet.Contains(status.Address.IPv6Address)) {
+			statuses = append(statuses, status)
+		}
+	}
+
+	return statuses
+}
+
+// UnmeasuredRelays returns the router statuses whose "w" line says
+// "Unmeasured=1", i.e., relays whose consensus weight is based on their
+// self-reported bandwidth because no bandwidth authority measured them.  The
+// statuses are ordered by fingerprint.
+func (c *Consensus) UnmeasuredRelays() []*RouterStatus {
+
+	var unmeasured []*RouterStatus
+
+	for _, fingerprint := range c.sortedFingerprints() {
+		status := c.RouterStatuses[fingerprint]()
+		if status != nil && status.Unmeasured {
+			unmeasured = append(unmeasured, status)
+		}
+	}
+
+	return unmeasured
+}
+
+// ExitsTo returns the running relays that allow exiting to the given address
+// and port, ordered by fingerprint.  Relays with the BadExit flag are left
+// out.  If the given object set holds a relay's router descriptor, the
+// descriptor's exit policy decides, see RouterDescriptor.AllowsExitTo.
+// Otherwise, the summarised exit policy of the relay's "p" line decides, which
+// only applies to IPv4 addresses.  The object set may be nil.  Descriptors'
+// exit policies are compiled when the descriptors are parsed, so repeated
+// calls only evaluate them.
+func (c *Consensus) ExitsTo(ip net.IP, port uint16, descriptors ObjectSet) []*RouterStatus {
+
+	var exits []*RouterStatus
+
+	for _, fingerprint := range c.sortedFingerprints() {
+		status := c.RouterStatuses[fingerprint]()
+		if status == nil || !status.Flags.Running || status.Flags.BadExit {
+			continue
+		}
+
+		if descriptors != nil {
+			if obj, found := descriptors.GetObject(fingerprint); found {
+				if desc, ok := obj.(*RouterDescriptor); ok {
+					if desc.AllowsExitTo(ip, port) {
+						exits = append(exits, status)
+					}
+					continue
+				}
+			}
+		}
+
+		if ip.To4() != nil && status.allowsPort(port) {
+			exits = append(exits, status)
+		}
+	}
+
+	return exits
+}
+
+// allowsPort returns true if the summarised exit policy of the router status'
+// "p" line allows exiting to the given port.  Statuses without a well-formed
+// "p" line don't allow exiting at all.
+func (s *RouterStatus) allowsPort(port uint16) bool {
+
+	policy := "reject"
+	if s.Accept {
+		policy = "accept"
+	}
+
+	summary, err := parseExitPolicySummary([]string{policy, s.PortList})
+	if err != nil {
+		return false
+	}
+
+	return summary.AllowsPort(port)
+}
+
+// Ed25519Collisions returns the ed25519 identities that more than one router
+// status in the consensus claims, mapped to the fingerprints of these router
+// statuses in ascending order.  A consensus should never contain such
+// collisions, so any returned identity indicates an anomaly.  Router statuses
+// lacking an ed25519 identity are ignored.
+func (c *Consensus) Ed25519Collisions() map[string][]Fingerprint {
+
+	identities := make(map[string][]Fingerprint)
+	for _, fingerprint := range c.sortedFingerprints() {
+		status := c.RouterStatuses[fingerprint]()
+		if status == nil || status.Ed25519Identity == "" {
+			continue
+		}
+		identities[status.Ed25519Identity] = append(identities[status.Ed25519Identity], fingerprint)
+	}
+
+	collisions := make(map[string][]Fingerprint)
+	for identity, fingerprints := range identities {
+		if len(fingerprints) > 1 {
+			collisions[identity] = fingerprints
+		}
+	}
+
+	return collisions
 }
 
 // Subtract removes all routers which are part of the given consensus b from
@@ -240,6 +676,141 @@ func (c *Consensus) Intersect(b *Consensus) *Consensus {
 	return intersection
 }
 
+// Filter returns a new consensus that holds only the router statuses for which
+// the given predicate returns true.  The new consensus has the same validity
+// period, shared randomness, meta information, parameters, and bandwidth
+// weights as the original consensus, which is left unmodified.  The router
+// statuses themselves are shared between both consensuses.
+func (c *Consensus) Filter(pred func(*RouterStatus) bool) *Consensus {
+
+	var filtered = NewConsensus()
+	filtered.copyHeader(c)
+
+	for fingerprint, getStatus := range c.RouterStatuses {
+		if status := getStatus(); status != nil && pred(status) {
+			filtered.RouterStatuses[fingerprint] = getStatus
+		}
+	}
+
+	return filtered
+}
+
+// copyHeader replaces the consensus' validity period, consensus method, shared
+// randomness, meta information, parameters, authorities, and bandwidth weights
+// with copies of those of the given consensus.
+func (c *Consensus) copyHeader(other *Consensus) {
+
+	c.MetaInfo = nil
+	if other.MetaInfo != nil {
+		c.MetaInfo = make(map[string][]byte, len(other.MetaInfo))
+		for key, value := range other.MetaInfo {
+			c.MetaInfo[key] = append([]byte(nil), value...)
+		}
+	}
+	c.ValidAfter = other.ValidAfter
+	c.FreshUntil = other.FreshUntil
+	c.ValidUntil = other.ValidUntil
+	c.ConsensusMethod = other.ConsensusMethod
+	c.SharedRandPrevious = nil
+	if other.SharedRandPrevious != nil {
+		c.SharedRandPrevious = append([]byte(nil), other.SharedRandPrevious...)
+	}
+	c.SharedRandCurrent = nil
+	if other.SharedRandCurrent != nil {
+		c.SharedRandCurrent = append([]byte(nil), other.SharedRandCurrent...)
+	}
+	c.DirSources = append([]DirSource(nil), other.DirSources...)
+	c.Params = nil
+	if other.Params != nil {
+		c.Params = make(map[string]int, len(other.Params))
+		for name, value := range other.Params {
+			c.Params[name] = value
+		}
+	}
+	c.BandwidthWeights = nil
+	if other.BandwidthWeights != nil {
+		c.BandwidthWeights = make(map[string]int64, len(other.BandwidthWeights))
+		for name, weight := range other.BandwidthWeights {
+			c.BandwidthWeights[name] = weight
+		}
+	}
+}
+
+// MergeConsensus merges the router statuses of the consensus from into the
+// consensus into, which is modified in place while from is left untouched.
+// Relays that only one consensus lists end up in the merged consensus.  For
+// relays that both list, the router status that was taken from the consensus
+// with the later valid-after time wins.  Merged consensuses remember the
+// valid-after time of each router status, so merging three or more
+// consensuses compares the age of each router status rather than that of the
+// consensuses.  If from is newer, into also takes over its validity period,
+// consensus method, shared randomness, meta information, parameters,
+// authorities, and bandwidth weights.  On equal valid-after times, into is
+// considered newer, i.e., its router statuses and header are kept.  Unlike
+// Merge, which keeps existing router statuses regardless of their age, this
+// makes it safe to combine consensuses of overlapping time ranges in any
+// order.
+func MergeConsensus(into *Consensus, from *Consensus) {
+
+	// Remember the age of into's own router statuses before its header, and
+	// thus its valid-after time, changes.
+	if into.statusValidAfter == nil {
+		into.statusValidAfter = make(map[Fingerprint]time.Time)
+	}
+	for fingerprint := range into.RouterStatuses {
+		into.statusValidAfter[fingerprint] = into.statusValidAfterOf(fingerprint)
+	}
+
+	for fingerprint, getStatus := range from.RouterStatuses {
+		validAfter := from.statusValidAfterOf(fingerprint)
+		if _, exists := into.RouterStatuses[fingerprint]; !exists ||
+			validAfter.After(into.statusValidAfter[fingerprint]) {
+			into.RouterStatuses[fingerprint] = getStatus
+			into.statusValidAfter[fingerprint] = validAfter
+		}
+	}
+	if from.ValidAfter.After(into.ValidAfter) {
+		into.copyHeader(from)
+	}
+
+	into.invalidateCaches()
+	into.sha256Digest = nil
+}
+
+// statusValidAfterOf returns the valid-after time of the consensus that the
+// router status with the given fingerprint was taken from.
+func (c *Consensus) statusValidAfterOf(fingerprint Fingerprint) time.Time {
+
+	if validAfter, ok := c.statusValidAfter[fingerprint]; ok {
+		return validAfter
+	}
+
+	return c.ValidAfter
+}
+
+// EnrichCountry sets the CountryCode of every router status to the country
+// code that the given lookup function returns for the relay's IPv4 address.
+// That keeps zoossh free of a GeoIP dependency while allowing callers to plug
+// in any database they like.  Relays whose address cannot be looked up get an
+// empty country code, so calling the method again simply overwrites previous
+// results.  Router statuses are parsed once and kept, so the country codes
+// also stick in lazily parsed consensuses.
+func (c *Consensus) EnrichCountry(lookup func(net.IP) string) {
+
+	for fingerprint, getStatus := range c.RouterStatuses {
+		status := getStatus()
+		if status == nil {
+			continue
+		}
+
+		status.CountryCode = ""
+		if status.Address.IPv4Address != nil {
+			status.CountryCode = lookup(status.Address.IPv4Address)
+		}
+		c.RouterStatuses[fingerprint] = func() *RouterStatus { return status }
+	}
+}
+
 // Implement the Stringer interface for pretty printing.
 func (address RouterAddress) String() string {
 	var ipV4stringAddress []string
@@ -263,9 +834,28 @@ func (address RouterAddress) String() string {
 	return ipV4Join + "," + ipV6Join
 }
 
+// Equals checks whether the two given router addresses are equal.  IP
+// addresses are compared by value, so an IPv4 address in its 4-byte and its
+// 16-byte representation is considered equal.
+func (address RouterAddress) Equals(other RouterAddress) bool {
+
+	return address.IPv4Address.Equal(other.IPv4Address) &&
+		address.IPv4ORPort == other.IPv4ORPort &&
+		address.IPv4DirPort == other.IPv4DirPort &&
+		address.IPv6Address.Equal(other.IPv6Address) &&
+		address.IPv6ORPort == other.IPv6ORPort
+}
+
 // Implement the Stringer interface for pretty printing.
 func (flags RouterFlags) String() string {
 
+	return fmt.Sprint(strings.Join(flags.names(), "|"))
+}
+
+// names returns the names of all flags that are set, in the order in which
+// they appear in the RouterFlags struct.
+func (flags RouterFlags) names() []string {
+
 	var stringFlags []string
 
 	if flags.Authority {
@@ -305,7 +895,7 @@ func (flags RouterFlags) String() string {
 		stringFlags = append(stringFlags, "V2Dir")
 	}
 
-	return fmt.Sprint(strings.Join(stringFlags, "|"))
+	return stringFlags
 }
 
 func parseRouterFlags(flags []string) *RouterFlags {
@@ -344,13 +934,60 @@ func parseRouterFlags(flags []string) *RouterFlags {
 	return routerFlags
 }
 
-func parseIPv6AddressAndPort(addressAndPort string) (address net.IP, port uint16) {
+// bits returns the router flags as a bit mask, one bit per flag in the order
+// in which they are declared in RouterFlags.
+func (flags RouterFlags) bits() uint16 {
+
+	var bits uint16
+
+	for i, set := range []bool{flags.Authority, flags.BadExit, flags.Exit,
+		flags.Fast, flags.Guard, flags.HSDir, flags.Named, flags.Stable,
+		flags.Running, flags.Unnamed, flags.Valid, flags.V2Dir} {
+		if set {
+			bits |= 1 << uint(i)
+		}
+	}
+
+	return bits
+}
+
+// routerFlagsFromBits turns a bit mask as returned by RouterFlags.bits back
+// into router flags.
+func routerFlagsFromBits(bits uint16) RouterFlags {
+
+	isSet := func(i uint) bool {
+		return bits&(1<<i) != 0
+	}
+
+	return RouterFlags{
+		Authority: isSet(0),
+		BadExit:   isSet(1),
+		Exit:      isSet(2),
+		Fast:      isSet(3),
+		Guard:     isSet(4),
+		HSDir:     isSet(5),
+		Named:     isSet(6),
+		Stable:    isSet(7),
+		Running:   isSet(8),
+		Unnamed:   isSet(9),
+		Valid:     isSet(10),
+		V2Dir:     isSet(11),
+	}
+}
+
+func parseIPv6AddressAndPort(addressAndPort string) (address net.IP, port uint16, err error) {
 	var ipV6regex = regexp.MustCompile(`\[(.*?)\]`)
 	var ipV6portRegex = regexp.MustCompile(`\]:(.*)`)
-	address = net.ParseIP(ipV6regex.FindStringSubmatch(addressAndPort)[1])
-	port = StringToPort(ipV6portRegex.FindStringSubmatch(addressAndPort)[1])
 
-	return address, port
+	addressMatch := ipV6regex.FindStringSubmatch(addressAndPort)
+	portMatch := ipV6portRegex.FindStringSubmatch(addressAndPort)
+	if addressMatch == nil || portMatch == nil {
+		return nil, 0, fmt.Errorf("expected \"[address]:port\"")
+	}
+	address = net.ParseIP(addressMatch[1])
+	port = StringToPort(portMatch[1])
+
+	return address, port, nil
 }
 
 // LazyParseRawStatus parses a raw router status (in string format) and returns
@@ -359,87 +996,319 @@ func parseIPv6AddressAndPort(addressAndPort string) (address net.IP, port uint16
 // delayed until the returned function is executed.
 func LazyParseRawStatus(rawStatus string) (Fingerprint, GetStatus, error) {
 
+	return LazyParseRawStatusWithOptions(rawStatus)
+}
+
+// LazyParseRawStatusWithOptions works like LazyParseRawStatus but applies the
+// given options once the router status is parsed.
+func LazyParseRawStatusWithOptions(rawStatus string, opts ...ParseOption) (Fingerprint, GetStatus, error) {
+
+	options := newParseOptions(opts)
+
 	// Delay parsing of the router status until this function is executed.
+	// Malformed router statuses result in nil.
 	getStatus := func() *RouterStatus {
-		_, f, _ := ParseRawStatus(rawStatus)
+		_, f, err := parseRawStatusWithOptions(rawStatus, options)
+		if err != nil {
+			logParse(LogWarn, "dropping malformed router status: %s", err)
+			return nil
+		}
 		return f()
 	}
 
-	lines := strings.Split(rawStatus, "\n")
-
-	// Only pull out the fingerprint.
-	for _, line := range lines {
-		words := strings.Split(line, " ")
-		if words[0] == "r" {
-			fingerprint, err := Base64ToString(words[2])
-			return SanitiseFingerprint(Fingerprint(fingerprint)), getStatus, err
-		}
+	fingerprint, err := extractStatusFingerprint(rawStatus)
+	if err != nil {
+		return "", nil, err
 	}
 
-	return "", nil, fmt.Errorf("could not extract relay fingerprint")
+	return fingerprint, getStatus, nil
 }
 
-// ParseRawStatus parses a raw router status (in string format) and returns the
-// router's fingerprint, a function which returns a RouterStatus, and an error
-// if there were any during parsing.
-func ParseRawStatus(rawStatus string) (Fingerprint, GetStatus, error) {
-
-	var status = new(RouterStatus)
+// extractStatusFingerprint pulls the fingerprint out of the given raw router
+// status without parsing the rest of it.
+func extractStatusFingerprint(rawStatus string) (Fingerprint, error) {
 
 	lines := strings.Split(rawStatus, "\n")
 
-	// Go over raw statuses line by line and extract the fields we are
-	// interested in.
-	for _, line := range lines {
+	for i, line := range lines {
+		words := strings.Fields(line)
+		if len(words) > 0 && words[0] == "r" {
+			if len(words) < 3 {
+				return "", newParseError(i+1, line, words[0], fmt.Errorf("missing fingerprint"))
+			}
+			fingerprint, err := NormalizeFingerprint(words[2])
+			if err != nil {
+				return "", newParseError(i+1, line, words[0], err)
+			}
+			return fingerprint, nil
+		}
+	}
 
-		words := strings.Split(line, " ")
+	return "", fmt.Errorf("could not extract relay fingerprint")
+}
 
-		switch words[0] {
+// filteredStatusParser returns a status parser that only parses the router
+// statuses whose fingerprint is in the given set.  All other router statuses
+// are skipped by returning a nil GetStatus, which parseStatusEntries ignores.
+func filteredStatusParser(want map[Fingerprint]bool) func(string) (Fingerprint, GetStatus, error) {
 
-		case "r":
-			status.Nickname = words[1]
-			fingerprint, err := Base64ToString(words[2])
-			if err != nil {
-				return "", nil, err
-			}
-			status.Fingerprint = SanitiseFingerprint(Fingerprint(fingerprint))
+	return func(rawStatus string) (Fingerprint, GetStatus, error) {
+		fingerprint, err := extractStatusFingerprint(rawStatus)
+		if err != nil {
+			return "", nil, err
+		}
+		if !want[fingerprint] {
+			return fingerprint, nil, nil
+		}
+		return ParseRawStatus(rawStatus)
+	}
+}
 
-			status.Digest, err = Base64ToString(words[3])
-			if err != nil {
-				return "", nil, err
-			}
+// statusCache is a least recently used cache of parsed router statuses.  It
+// bounds the number of router statuses that lazily parsed consensuses keep in
+// memory.  It is safe for concurrent use.
+type statusCache struct {
+	sync.Mutex
+	capacity int
+	entries  map[Fingerprint]*list.Element
+	order    *list.List
+}
 
-			time, _ := time.Parse(publishedTimeLayout, strings.Join(words[4:6], " "))
-			status.Publication = time
-			status.Address.IPv4Address = net.ParseIP(words[6])
-			status.Address.IPv4ORPort = StringToPort(words[7])
-			status.Address.IPv4DirPort = StringToPort(words[8])
+type statusCacheEntry struct {
+	fingerprint Fingerprint
+	status      *RouterStatus
+}
 
-		case "a":
-			status.Address.IPv6Address, status.Address.IPv6ORPort = parseIPv6AddressAndPort(words[1])
+// newStatusCache returns a statusCache that holds at most capacity router
+// statuses.
+func newStatusCache(capacity int) *statusCache {
 
-		case "s":
-			status.Flags = *parseRouterFlags(words[1:])
+	return &statusCache{
+		capacity: capacity,
+		entries:  make(map[Fingerprint]*list.Element),
+		order:    list.New(),
+	}
+}
 
-		case "v":
-			status.TorVersion = words[2]
+// get returns the cached router status for the given fingerprint and marks it
+// as most recently used.
+func (sc *statusCache) get(fingerprint Fingerprint) (*RouterStatus, bool) {
 
-		case "w":
-			bwExpr := words[1]
-			values := strings.Split(bwExpr, "=")
-			status.Bandwidth, _ = strconv.ParseUint(values[1], 10, 64)
+	sc.Lock()
+	defer sc.Unlock()
 
-		case "p":
-			if words[1] == "accept" {
-				status.Accept = true
-			} else {
-				status.Accept = false
-			}
-			status.PortList = strings.Join(words[2:], " ")
-		}
+	element, exists := sc.entries[fingerprint]
+	if !exists {
+		return nil, false
 	}
+	sc.order.MoveToFront(element)
 
-	return status.Fingerprint, func() *RouterStatus { return status }, nil
+	return element.Value.(*statusCacheEntry).status, true
+}
+
+// add caches the given router status and evicts the least recently used
+// router status if the cache is full.
+func (sc *statusCache) add(fingerprint Fingerprint, status *RouterStatus) {
+
+	sc.Lock()
+	defer sc.Unlock()
+
+	if element, exists := sc.entries[fingerprint]; exists {
+		element.Value.(*statusCacheEntry).status = status
+		sc.order.MoveToFront(element)
+		return
+	}
+
+	sc.entries[fingerprint] = sc.order.PushFront(&statusCacheEntry{fingerprint, status})
+	if sc.order.Len() > sc.capacity {
+		oldest := sc.order.Back()
+		sc.order.Remove(oldest)
+		delete(sc.entries, oldest.Value.(*statusCacheEntry).fingerprint)
+	}
+}
+
+// cachingStatusParser returns a status parser that works like
+// LazyParseRawStatus but keeps parsed router statuses in the given cache, so
+// only evicted router statuses are parsed again.
+func cachingStatusParser(cache *statusCache) func(string) (Fingerprint, GetStatus, error) {
+
+	return func(rawStatus string) (Fingerprint, GetStatus, error) {
+
+		fingerprint, parse, err := LazyParseRawStatus(rawStatus)
+		if err != nil {
+			return "", nil, err
+		}
+
+		getStatus := func() *RouterStatus {
+			if status, cached := cache.get(fingerprint); cached {
+				return status
+			}
+			status := parse()
+			if status != nil {
+				cache.add(fingerprint, status)
+			}
+			return status
+		}
+
+		return fingerprint, getStatus, nil
+	}
+}
+
+// ParseRawStatus parses a raw router status (in string format) and returns the
+// router's fingerprint, a function which returns a RouterStatus, and an error
+// if there were any during parsing.  Malformed lines result in a *ParseError
+// whose line number is relative to the given string.
+func ParseRawStatus(rawStatus string) (Fingerprint, GetStatus, error) {
+
+	return ParseRawStatusWithOptions(rawStatus)
+}
+
+// ParseRawStatusWithOptions works like ParseRawStatus but applies the given
+// options.  In strict mode, router statuses whose lines are unrecognised,
+// missing, repeated, or out of order result in a *ParseError.
+func ParseRawStatusWithOptions(rawStatus string, opts ...ParseOption) (Fingerprint, GetStatus, error) {
+
+	return parseRawStatusWithOptions(rawStatus, newParseOptions(opts))
+}
+
+// parseRawStatusWithOptions implements ParseRawStatusWithOptions.
+func parseRawStatusWithOptions(rawStatus string, options *parseOptions) (Fingerprint, GetStatus, error) {
+
+	if options.strict {
+		if errs := checkEntryStructure(rawStatus, 1, true); len(errs) > 0 {
+			return "", nil, errs[0]
+		}
+	}
+
+	return parseRawStatus(rawStatus, false)
+}
+
+// parseRawStatus implements ParseRawStatus.  If vote is true, the router
+// status is interpreted as part of a vote rather than a consensus.
+func parseRawStatus(rawStatus string, vote bool) (Fingerprint, GetStatus, error) {
+
+	var status = new(RouterStatus)
+
+	lines := strings.Split(rawStatus, "\n")
+
+	// Go over raw statuses line by line and extract the fields we are
+	// interested in.
+	for i, line := range lines {
+
+		// Split on any run of whitespace, so unusual spacing doesn't shift
+		// the fields of a line.
+		words := strings.Fields(line)
+		if len(words) == 0 {
+			continue
+		}
+
+		// Wraps the given error in a ParseError for the current line.
+		fail := func(err error) (Fingerprint, GetStatus, error) {
+			return "", nil, newParseError(i+1, line, words[0], err)
+		}
+
+		switch words[0] {
+
+		case "r":
+			if len(words) < 9 {
+				return fail(fmt.Errorf("expected 9 fields but got %d", len(words)))
+			}
+			status.Nickname = words[1]
+			fingerprint, err := NormalizeFingerprint(words[2])
+			if err != nil {
+				return fail(err)
+			}
+			status.Fingerprint = fingerprint
+
+			status.Digest, err = Base64ToString(words[3])
+			if err != nil {
+				return fail(err)
+			}
+
+			time, err := time.Parse(publishedTimeLayout, strings.Join(words[4:6], " "))
+			if err != nil {
+				return fail(err)
+			}
+			status.Publication = time
+			status.Address.IPv4Address = net.ParseIP(words[6])
+			status.Address.IPv4ORPort = StringToPort(words[7])
+			status.Address.IPv4DirPort = StringToPort(words[8])
+
+		case "a":
+			if len(words) < 2 {
+				return fail(fmt.Errorf("missing address"))
+			}
+			var err error
+			status.Address.IPv6Address, status.Address.IPv6ORPort, err = parseIPv6AddressAndPort(words[1])
+			if err != nil {
+				return fail(err)
+			}
+
+		case "s":
+			status.Flags = *parseRouterFlags(words[1:])
+
+		case "v":
+			if len(words) > 2 {
+				status.TorVersion = words[2]
+			}
+			status.RawVersion = strings.Join(words[1:], " ")
+
+		case "w":
+			if len(words) < 2 {
+				return fail(fmt.Errorf("missing bandwidth"))
+			}
+			// Votes tell us that a relay is unmeasured by omitting its
+			// measurement rather than by saying "Unmeasured=1".
+			status.Unmeasured = vote
+			for _, bwExpr := range words[1:] {
+				values := strings.Split(bwExpr, "=")
+				if len(values) != 2 {
+					return fail(fmt.Errorf("expected key=value pair"))
+				}
+				value, err := strconv.ParseUint(values[1], 10, 64)
+				if err != nil {
+					logParse(LogDebug, "treating malformed %q value of %s as 0: %s", values[0], status.Fingerprint, err)
+				}
+				switch values[0] {
+				case "Bandwidth":
+					status.Bandwidth = value
+				case "Measured":
+					status.Measured = value
+					status.Unmeasured = false
+				case "Unmeasured":
+					status.Unmeasured = value == 1
+				}
+			}
+
+		case "p":
+			if len(words) < 2 {
+				return fail(fmt.Errorf("missing exit policy"))
+			}
+			if words[1] == "accept" {
+				status.Accept = true
+			} else {
+				status.Accept = false
+			}
+			status.PortList = strings.Join(words[2:], " ")
+
+		case "id":
+			if len(words) < 3 {
+				return fail(fmt.Errorf("expected 3 fields but got %d", len(words)))
+			}
+			if words[1] == "ed25519" && words[2] != "none" {
+				status.Ed25519Identity = words[2]
+			}
+
+		default:
+			// Lines that the specification defines but that we don't store,
+			// e.g., "pr", are not unrecognised.
+			if _, known := statusLineOrder[words[0]]; !known && !unorderedStatusLines[words[0]] {
+				status.Unrecognized = append(status.Unrecognized, line)
+			}
+		}
+	}
+
+	return status.Fingerprint, func() *RouterStatus { return status }, nil
 }
 
 // extractStatusEntry is a bufio.SplitFunc that extracts individual network
@@ -464,14 +1333,14 @@ func extractStatusEntry(data []byte, atEOF bool) (advance int, token []byte, err
 	}
 
 	end := bytes.Index(data[start:], []byte("\nr "))
-	if end >= 0 {
+	footer := footerIndex(data[start:])
+	if end >= 0 && (footer < 0 || end+1 < footer) {
 		return start + end + 1, data[start : start+end+1], nil
 	}
-	end = bytes.Index(data[start:], []byte("directory-signature"))
-	if end >= 0 {
-		// "directory-signature" means this is the last status; stop
-		// scanning.
-		return start + end, data[start : start+end], bufio.ErrFinalToken
+	if footer >= 0 {
+		// "directory-footer" or "directory-signature" means this is the last
+		// status; stop scanning.
+		return start + footer, data[start : start+footer], bufio.ErrFinalToken
 	}
 	if atEOF {
 		return start, nil, fmt.Errorf("cannot find the end of status entry: \"\\nr \" or \"directory-signature\"")
@@ -480,58 +1349,286 @@ func extractStatusEntry(data []byte, atEOF bool) (advance int, token []byte, err
 	return 0, nil, nil
 }
 
+// isConsensusFooter returns true if the given data starts with the footer of a
+// consensus.  Older consensuses lack the "directory-footer" line and their
+// footer starts with the first "directory-signature" line.
+func isConsensusFooter(data []byte) bool {
+
+	return bytes.HasPrefix(data, []byte("directory-footer")) ||
+		bytes.HasPrefix(data, []byte("directory-signature"))
+}
+
+// footerIndex returns the index of the line in data that starts the consensus
+// footer, or -1 if data contains no such line.  Keywords only count at the
+// beginning of a line.
+func footerIndex(data []byte) int {
+
+	if isConsensusFooter(data) {
+		return 0
+	}
+
+	index := -1
+	for _, keyword := range [][]byte{[]byte("\ndirectory-footer"), []byte("\ndirectory-signature")} {
+		if i := bytes.Index(data, keyword); i >= 0 && (index < 0 || i+1 < index) {
+			index = i + 1
+		}
+	}
+
+	return index
+}
+
+// extractStatusEntryOrFooter is a bufio.SplitFunc that extracts individual
+// network status entries just like extractStatusEntry.  Instead of stopping
+// after the last status entry, it then extracts the consensus footer as final
+// token.
+func extractStatusEntryOrFooter(data []byte, atEOF bool) (advance int, token []byte, err error) {
+
+	if isConsensusFooter(data) {
+		if !atEOF {
+			// Request the rest of the document.
+			return 0, nil, nil
+		}
+		return len(data), data, bufio.ErrFinalToken
+	}
+
+	// Skip to the footer if no status entry precedes it, e.g., because the
+	// consensus lists no relays.  Otherwise, the footer's lines would be
+	// mistaken for a status entry.
+	if footer := footerIndex(data); footer > 0 && !bytes.HasPrefix(data, []byte("r ")) {
+		if entry := bytes.Index(data, []byte("\nr ")); entry < 0 || footer < entry {
+			return footer, nil, nil
+		}
+	}
+
+	advance, token, err = extractStatusEntry(data, atEOF)
+	if err == bufio.ErrFinalToken {
+		// The footer is still to come.
+		err = nil
+	}
+
+	return advance, token, err
+}
+
+// extractFooter parses the given consensus footer and writes the information
+// we are interested in to the given consensus.  It returns the footer's
+// signatures.
+func extractFooter(rawFooter string, c *Consensus) ([]ConsensusSignature, error) {
+
+	var signatures []ConsensusSignature
+	var signature *ConsensusSignature
+	var encoded []string
+
+	for i, line := range strings.Split(rawFooter, "\n") {
+
+		words := strings.Split(line, " ")
+
+		switch words[0] {
+
+		case "bandwidth-weights":
+			weights, err := parseBandwidthWeights(words[1:])
+			if err != nil {
+				return nil, newParseError(i+1, line, words[0], err)
+			}
+			c.BandwidthWeights = weights
+
+		case "directory-signature":
+			sig, err := parseSignatureLine(words[1:])
+			if err != nil {
+				return nil, newParseError(i+1, line, words[0], err)
+			}
+			signature = sig
+			encoded = nil
+
+		case "-----BEGIN":
+			continue
+
+		case "-----END":
+			if signature == nil {
+				continue
+			}
+			sig, err := base64.StdEncoding.DecodeString(strings.Join(encoded, ""))
+			if err != nil {
+				return nil, newParseError(i+1, line, "directory-signature", err)
+			}
+			signature.Signature = sig
+			signatures = append(signatures, *signature)
+			signature = nil
+
+		default:
+			if signature != nil {
+				encoded = append(encoded, line)
+			}
+		}
+	}
+
+	if signature != nil {
+		return nil, fmt.Errorf("signature of %s lacks its signature block", signature.IdentityFingerprint)
+	}
+
+	return signatures, nil
+}
+
+// parseSignatureLine parses the arguments of a "directory-signature" line.
+// The algorithm is optional and defaults to "sha1".
+func parseSignatureLine(args []string) (*ConsensusSignature, error) {
+
+	signature := &ConsensusSignature{Algorithm: "sha1"}
+
+	switch len(args) {
+	case 2:
+	case 3:
+		signature.Algorithm = args[0]
+		args = args[1:]
+	default:
+		return nil, fmt.Errorf("expected 2 or 3 arguments but got %d", len(args))
+	}
+
+	signature.IdentityFingerprint = SanitiseFingerprint(Fingerprint(args[0]))
+	signature.SigningKeyDigest = strings.ToUpper(args[1])
+
+	return signature, nil
+}
+
+// parseBandwidthWeights parses the key=value pairs of a "bandwidth-weights"
+// line.
+func parseBandwidthWeights(pairs []string) (map[string]int64, error) {
+
+	weights := make(map[string]int64)
+
+	for _, pair := range pairs {
+		keyValue := strings.SplitN(pair, "=", 2)
+		if len(keyValue) != 2 {
+			return nil, fmt.Errorf("expected key=value pair but got %q", pair)
+		}
+		value, err := strconv.ParseInt(keyValue[1], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		weights[keyValue[0]] = value
+	}
+
+	return weights, nil
+}
+
+// parseParams parses the value of a "params" line, i.e., space-separated
+// key=value pairs whose values are 32-bit signed integers.
+func parseParams(line string) (map[string]int, error) {
+
+	params := make(map[string]int)
+
+	for _, pair := range strings.Fields(line) {
+		keyValue := strings.SplitN(pair, "=", 2)
+		if len(keyValue) != 2 || keyValue[0] == "" {
+			return nil, fmt.Errorf("expected key=value pair but got %q", pair)
+		}
+		value, err := strconv.ParseInt(keyValue[1], 10, 32)
+		if err != nil {
+			return nil, err
+		}
+		params[keyValue[0]] = int(value)
+	}
+
+	return params, nil
+}
+
+// Param returns the value of the network-wide parameter with the given name
+// from the consensus' "params" line, or the given default value if the line
+// doesn't set the parameter.
+func (c *Consensus) Param(name string, def int) int {
+
+	if value, ok := c.Params[name]; ok {
+		return value
+	}
+
+	return def
+}
+
 // extractMetainfo extracts meta information of the open consensus document
 // (such as its validity times) and writes it to the provided consensus struct.
-// It assumes that the type annotation has already been read.
-func extractMetaInfo(r io.Reader, c *Consensus) error {
+// It assumes that the type annotation has already been read.  It returns the
+// number of lines that it read.
+func extractMetaInfo(r io.Reader, c *Consensus) (int, error) {
 
 	br := bufio.NewReader(r)
 	c.MetaInfo = make(map[string][]byte)
 
+	// Remember where we found each key, so we can point to it in case of
+	// errors.
+	lineNums := make(map[string]int)
+	numLines := 0
+
 	// Read the initial metadata. We'll later extract information of particular
 	// interest by name. The weird Reader loop is because scanner reads too much.
 	for line, err := br.ReadSlice('\n'); ; line, err = br.ReadSlice('\n') {
 		if err != nil {
-			return err
+			return numLines, err
 		}
+		numLines++
 
 		// splits to (key, value)
 		split := bytes.SplitN(line, []byte(" "), 2)
 		if len(split) != 2 {
-			return errors.New("malformed metainfo line")
+			return numLines, newParseError(numLines, string(bytes.TrimSpace(line)),
+				string(bytes.TrimSpace(split[0])), errors.New("malformed metainfo line"))
 		}
 
+		// ReadSlice's result is only valid until the next read, so we have
+		// to copy the value.
 		key := string(split[0])
-		c.MetaInfo[key] = bytes.TrimSpace(split[1])
+		c.MetaInfo[key] = append([]byte(nil), bytes.TrimSpace(split[1])...)
+		lineNums[key] = numLines
 
 		// Look ahead to check if we've reached the end of the unique keys.
 		nextKey, err := br.Peek(10)
 		if err != nil {
-			return err
+			return numLines, err
 		}
 		if bytes.Equal(nextKey, []byte("dir-source")) {
 			break
 		}
 	}
 
+	// Wraps the given error in a ParseError for the line containing key.
+	fail := func(key string, err error) (int, error) {
+		value := string(c.MetaInfo[key])
+		return numLines, newParseError(lineNums[key], key+" "+value, key, err)
+	}
+
 	var err error
-	// Define a parser for validity timestamps
+	// Define a parser for validity timestamps, which are always in UTC.
 	parseTime := func(line []byte) (time.Time, error) {
-		return time.Parse("2006-01-02 15:04:05", string(line))
+		return time.ParseInLocation(publishedTimeLayout, string(line), time.UTC)
 	}
 
 	// Extract the validity period of this consensus
 	c.ValidAfter, err = parseTime(c.MetaInfo["valid-after"])
 	if err != nil {
-		return err
+		return fail("valid-after", err)
 	}
 	c.FreshUntil, err = parseTime(c.MetaInfo["fresh-until"])
 	if err != nil {
-		return err
+		return fail("fresh-until", err)
 	}
 	c.ValidUntil, err = parseTime(c.MetaInfo["valid-until"])
 	if err != nil {
-		return err
+		return fail("valid-until", err)
+	}
+
+	if line, ok := c.MetaInfo["consensus-method"]; ok {
+		method, err := strconv.Atoi(string(line))
+		if err != nil || method <= 0 {
+			return fail("consensus-method", errors.New("malformed consensus method"))
+		}
+		c.ConsensusMethod = method
+	}
+
+	c.Params = make(map[string]int)
+	if line, ok := c.MetaInfo["params"]; ok {
+		params, err := parseParams(string(line))
+		if err != nil {
+			return fail("params", err)
+		}
+		c.Params = params
 	}
 
 	// Reads a shared-rand line from the consensus and returns decoded bytes.
@@ -545,22 +1642,108 @@ func extractMetaInfo(r io.Reader, c *Consensus) error {
 		return base64.StdEncoding.DecodeString(string(rand))
 	}
 
-	// Only the newer consensus documents have these values.
+	// Only the newer consensus documents have these values.  Consensuses
+	// that were computed using an older method must not contain them, but we
+	// only warn about that, so that such documents remain usable.
+	for _, key := range []string{"shared-rand-previous-value", "shared-rand-current-value"} {
+		if _, ok := c.MetaInfo[key]; ok && c.ConsensusMethod != 0 && !c.SupportsSharedRand() {
+			logParse(LogWarn, "%q not supported by consensus method %d", key, c.ConsensusMethod)
+		}
+	}
 	if line, ok := c.MetaInfo["shared-rand-previous-value"]; ok {
 		val, err := parseRand(line)
 		if err != nil {
-			return err
+			return fail("shared-rand-previous-value", err)
 		}
 		c.SharedRandPrevious = val
 	}
 	if line, ok := c.MetaInfo["shared-rand-current-value"]; ok {
 		val, err := parseRand(line)
 		if err != nil {
-			return err
+			return fail("shared-rand-current-value", err)
 		}
 		c.SharedRandCurrent = val
 	}
 
+	return numLines, nil
+}
+
+// SupportsSharedRand returns true if the consensus was computed using a
+// consensus method that includes shared randomness values, i.e., method 23 or
+// newer.  Votes don't declare a consensus method, so the function returns
+// false for them.
+func (c *Consensus) SupportsSharedRand() bool {
+
+	return c.ConsensusMethod >= minSharedRandConsensusMethod
+}
+
+// HasSharedRandPrevious returns true if the consensus contains a
+// "shared-rand-previous-value" line.
+func (c *Consensus) HasSharedRandPrevious() bool {
+
+	return c.SharedRandPrevious != nil
+}
+
+// HasSharedRandCurrent returns true if the consensus contains a
+// "shared-rand-current-value" line.
+func (c *Consensus) HasSharedRandCurrent() bool {
+
+	return c.SharedRandCurrent != nil
+}
+
+// IsLive returns true if the consensus is valid at the given time, i.e., if
+// ValidAfter <= t < ValidUntil.
+func (c *Consensus) IsLive(t time.Time) bool {
+
+	return !t.Before(c.ValidAfter) && t.Before(c.ValidUntil)
+}
+
+// Age returns how much time has passed between the consensus' ValidAfter time
+// and the given time.  The age is negative if the consensus is not valid yet.
+func (c *Consensus) Age(now time.Time) time.Duration {
+
+	return now.Sub(c.ValidAfter)
+}
+
+// Validate checks the structural invariants of the consensus: Its validity
+// period must satisfy ValidAfter < FreshUntil <= ValidUntil, it must list at
+// least one directory authority, and every router status must have a
+// fingerprint and a digest.  Lazily parsed router statuses are parsed in the
+// process, and those that turn out to be malformed are reported as well.  The
+// router statuses are checked in the order of their fingerprints.  If any
+// invariant is violated, the returned MultiError lists all violations.
+func (c *Consensus) Validate() error {
+
+	var errs MultiError
+
+	if !c.ValidAfter.Before(c.FreshUntil) {
+		errs = append(errs, fmt.Errorf("valid-after %s is not before fresh-until %s",
+			c.ValidAfter.Format(publishedTimeLayout), c.FreshUntil.Format(publishedTimeLayout)))
+	}
+	if c.ValidUntil.Before(c.FreshUntil) {
+		errs = append(errs, fmt.Errorf("fresh-until %s is after valid-until %s",
+			c.FreshUntil.Format(publishedTimeLayout), c.ValidUntil.Format(publishedTimeLayout)))
+	}
+	if len(c.DirSources) == 0 {
+		errs = append(errs, errors.New("consensus lacks directory authorities"))
+	}
+
+	for _, fingerprint := range c.sortedFingerprints() {
+		status := c.RouterStatuses[fingerprint]()
+		switch {
+		case status == nil:
+			errs = append(errs, fmt.Errorf("router status %s is malformed", fingerprint))
+		case status.Fingerprint == "":
+			errs = append(errs, fmt.Errorf("router status %s lacks a fingerprint", fingerprint))
+		case status.Digest == "":
+			errs = append(errs, fmt.Errorf("router status %s lacks a digest", fingerprint))
+		}
+	}
+
+	if errs != nil {
+		return errs
+	}
+
 	return nil
 }
 
@@ -590,10 +1773,9 @@ func (filter *ObjectFilter) MatchesRouterStatus(status *RouterStatus) bool {
 // correct type.  The function returns a network consensus if parsing was
 // successful.  If there were any errors, an error string is returned.  If the
 // lazy argument is set to true, parsing of the router statuses is delayed until
-// they are accessed.
-func parseConsensusUnchecked(r io.Reader, lazy bool) (*Consensus, error) {
+// they are accessed.  The given settings apply to parsing.
+func parseConsensusUnchecked(r io.Reader, lazy bool, options *parseOptions) (*Consensus, error) {
 
-	var consensus = NewConsensus()
 	var statusParser func(string) (Fingerprint, GetStatus, error)
 
 	if lazy {
@@ -602,14 +1784,332 @@ func parseConsensusUnchecked(r io.Reader, lazy bool) (*Consensus, error) {
 		statusParser = ParseRawStatus
 	}
 
-	err := extractMetaInfo(r, consensus)
+	consensus, _, err := parseNetworkStatusUnchecked(r, statusParser, options)
+	return consensus, err
+}
+
+// parseNetworkStatusUnchecked parses the network status document -- a
+// consensus or a vote -- in the given io.Reader.  The type annotation must
+// already have been read.  Router statuses are parsed using the given status
+// parser and the given settings.  Besides the document, the function returns
+// the signatures found in its footer.
+func parseNetworkStatusUnchecked(r io.Reader, statusParser func(string) (Fingerprint, GetStatus, error),
+	options *parseOptions) (*Consensus, []ConsensusSignature, error) {
+
+	var consensus = NewConsensus()
+	var digester *signedDigester
+	if options.sha256Digest {
+		digester = newSignedDigester(r)
+		r = digester
+	}
+	br := bufio.NewReader(r)
+
+	// The type annotation took up the first line.
+	numLines, err := extractMetaInfo(br, consensus)
+	if err != nil {
+		return nil, nil, offsetParseError(err, 1)
+	}
+
+	numDirLines, err := extractDirSources(br, consensus, numLines+2)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+
+	signatures, err := parseStatusEntries(br, consensus, extractStatusEntryOrFooter, statusParser,
+		numLines+numDirLines+2, options)
+	if err != nil {
+		return nil, nil, err
+	}
+	if digester != nil {
+		consensus.sha256Digest = digester.digest()
+	}
+
+	return consensus, signatures, nil
+}
+
+// signedDigestMarker ends the signed portion of a network status document,
+// which begins with the document's first line and ends with the space that
+// follows the first "directory-signature" keyword.
+const signedDigestMarker = "\ndirectory-signature "
+
+// signedDigester is an io.Reader that computes the SHA-256 digest of the
+// signed portion of the network status document that is read through it.
+// The digest is computed incrementally, so the document isn't kept in memory.
+type signedDigester struct {
+	r    io.Reader
+	hash hash.Hash
+
+	// The last bytes that were read, which may hold the beginning of the
+	// marker, and a buffer to look for the marker across two reads.
+	tail     []byte
+	straddle []byte
+	done     bool
+}
+
+// newSignedDigester returns a signedDigester that reads from the given reader,
+// which must be positioned at the document's first line, i.e., after its type
+// annotation.
+func newSignedDigester(r io.Reader) *signedDigester {
+
+	return &signedDigester{
+		r:        r,
+		hash:     sha256.New(),
+		tail:     make([]byte, 0, len(signedDigestMarker)-1),
+		straddle: make([]byte, 0, 2*len(signedDigestMarker)),
+	}
+}
+
+// Read implements the io.Reader interface.
+func (d *signedDigester) Read(p []byte) (int, error) {
+
+	n, err := d.r.Read(p)
+	if d.done || n == 0 {
+		return n, err
+	}
+
+	// The marker may straddle two reads, so we first look for it in the tail
+	// of the previous read followed by the beginning of this one, which
+	// finds every marker that starts in the tail.
+	keep := len(signedDigestMarker) - 1
+	if len(d.tail) > 0 {
+		head := p[:n]
+		if len(head) > keep {
+			head = head[:keep]
+		}
+		d.straddle = append(append(d.straddle[:0], d.tail...), head...)
+		if i := bytes.Index(d.straddle, []byte(signedDigestMarker)); i >= 0 {
+			d.finish(p[:i+len(signedDigestMarker)-len(d.tail)])
+			return n, err
+		}
 	}
+	if i := bytes.Index(p[:n], []byte(signedDigestMarker)); i >= 0 {
+		d.finish(p[:i+len(signedDigestMarker)])
+		return n, err
+	}
+
+	d.hash.Write(p[:n])
+	if n >= keep {
+		d.tail = append(d.tail[:0], p[n-keep:n]...)
+	} else {
+		// The tail is made up of the old tail and all of this read.
+		d.straddle = append(append(d.straddle[:0], d.tail...), p[:n]...)
+		if len(d.straddle) > keep {
+			d.straddle = d.straddle[len(d.straddle)-keep:]
+		}
+		d.tail = append(d.tail[:0], d.straddle...)
+	}
+
+	return n, err
+}
+
+// finish hashes the given last bytes of the signed portion and stops looking
+// for the marker.
+func (d *signedDigester) finish(last []byte) {
+
+	d.hash.Write(last)
+	d.done = true
+	d.tail, d.straddle = nil, nil
+}
+
+// digest returns the digest of the signed portion, or nil if the document
+// lacks a "directory-signature" line.
+func (d *signedDigester) digest() []byte {
+
+	if !d.done {
+		return nil
+	}
+
+	return d.hash.Sum(nil)
+}
+
+// ComputeSHA256Digest returns the hex-encoded SHA-256 digest of the signed
+// portion of the network status document that the consensus was parsed from,
+// i.e., from its "network-status-version" line up to and including the space
+// that follows the first "directory-signature" keyword, as defined in
+// dir-spec.txt, Section 3.4.1.  Authorities sign this digest in
+// "directory-signature sha256" lines.  The digest is computed while parsing
+// with WithSHA256Digest, so an error is returned if the consensus was parsed
+// without it, if the document lacked a signature, and for
+// consensuses that were not parsed as a whole, e.g., by ParseConsensusHeader,
+// or that were created or modified by Filter, MergeConsensus, or
+// UnmarshalBinary.
+func (c *Consensus) ComputeSHA256Digest() (string, error) {
+
+	if c.sha256Digest == nil {
+		return "", errors.New("digest of signed portion is not available")
+	}
+
+	return hex.EncodeToString(c.sha256Digest), nil
+}
+
+// extractDirSources reads the authority sections that follow the meta
+// information of a network status document, up to its first router status or
+// its footer, and adds the authorities to the given consensus.  The sections
+// start at the given line number.  Lines other than "dir-source", "contact",
+// "vote-digest", and "shared-rand-commit", e.g., the key certificate of a
+// vote, are skipped.  The function returns the number of lines that it read.
+func extractDirSources(br *bufio.Reader, c *Consensus, firstLine int) (int, error) {
+
+	numLines := 0
+
+	for {
+		next, _ := br.Peek(len("directory-"))
+		if len(next) == 0 || bytes.HasPrefix(next, []byte("r ")) ||
+			bytes.HasPrefix(next, []byte("directory-")) {
+			break
+		}
+
+		line, err := br.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return numLines, err
+		}
+		numLines++
+		line = strings.TrimRight(line, "\r\n")
+
+		// Wraps the given error in a ParseError for the current line.
+		fail := func(err error) (int, error) {
+			return numLines, newParseError(firstLine+numLines-1, line, "dir-source", err)
+		}
+
+		words := strings.Fields(line)
+		switch {
+		case len(words) == 0:
+
+		case words[0] == "dir-source":
+			if len(words) < 7 {
+				return fail(fmt.Errorf("expected 7 fields but got %d", len(words)))
+			}
+			address := net.ParseIP(words[4])
+			if address == nil {
+				return fail(fmt.Errorf("invalid address %q", words[4]))
+			}
+			c.DirSources = append(c.DirSources, DirSource{
+				Nickname:    words[1],
+				Fingerprint: SanitiseFingerprint(Fingerprint(words[2])),
+				Hostname:    words[3],
+				Address:     address,
+				DirPort:     StringToPort(words[5]),
+				ORPort:      StringToPort(words[6]),
+			})
+
+		case words[0] == "contact" && len(c.DirSources) > 0:
+			c.DirSources[len(c.DirSources)-1].Contact = strings.Join(words[1:], " ")
+
+		case words[0] == "vote-digest" && len(c.DirSources) > 0 && len(words) > 1:
+			c.DirSources[len(c.DirSources)-1].VoteDigest = words[1]
+
+		case words[0] == "shared-rand-commit":
+			commit, err := parseSharedRandCommit(words[1:])
+			if err != nil {
+				return numLines, newParseError(firstLine+numLines-1, line, "shared-rand-commit", err)
+			}
+			c.sharedRandCommits = append(c.sharedRandCommits, commit)
+		}
+
+		if err == io.EOF {
+			break
+		}
+	}
+
+	return numLines, nil
+}
+
+// The order in which lines must appear in a router status entry, as defined in
+// dir-spec.txt, Section 3.4.1.  The "id" and "m" lines only appear in votes.
+var statusLineOrder = map[string]int{
+	"r": 0, "a": 1, "s": 2, "v": 3, "pr": 4, "w": 5, "p": 6, "id": 7, "m": 8,
+}
+
+// The lines that every router status entry must have.
+var mandatoryStatusLines = []string{"r", "s", "w", "p"}
+
+// The lines of a vote's router status entries whose position we don't check.
+var unorderedStatusLines = map[string]bool{"stats": true}
+
+// checkEntryStructure checks that the given raw router status entry, which is
+// the position-th entry of its document, contains all mandatory lines exactly
+// once and in the order required by the specification.  Unknown lines are
+// ignored unless strict is set.  Line numbers of the returned ParseErrors are
+// relative to the entry.
+func checkEntryStructure(rawStatus string, position int, strict bool) []error {
+
+	var errs []error
+	seen := make(map[string]bool)
+	lastRank := -1
+
+	for i, line := range strings.Split(rawStatus, "\n") {
+		words := strings.Fields(line)
+		if len(words) == 0 {
+			continue
+		}
+		keyword := words[0]
+
+		rank, known := statusLineOrder[keyword]
+		if !known {
+			if strict && !unorderedStatusLines[keyword] {
+				errs = append(errs, newParseError(i+1, line, keyword,
+					fmt.Errorf("router status %d has unrecognised %q line", position, keyword)))
+			}
+			continue
+		}
+
+		// Only "a" and "m" lines may appear more than once.
+		repeatable := keyword == "a" || keyword == "m"
+		switch {
+		case lastRank == -1 && keyword != "r":
+			errs = append(errs, newParseError(i+1, line, keyword,
+				fmt.Errorf("router status %d does not start with an \"r\" line", position)))
+		case rank < lastRank || (seen[keyword] && !repeatable):
+			errs = append(errs, newParseError(i+1, line, keyword,
+				fmt.Errorf("router status %d has %q line out of order", position, keyword)))
+		}
+
+		seen[keyword] = true
+		if rank > lastRank {
+			lastRank = rank
+		}
+	}
+
+	for _, keyword := range mandatoryStatusLines {
+		if !seen[keyword] {
+			errs = append(errs, newParseError(1, strings.SplitN(rawStatus, "\n", 2)[0], keyword,
+				fmt.Errorf("router status %d lacks %q line", position, keyword)))
+		}
+	}
+
+	return errs
+}
+
+// CheckEntryStructure returns the structural problems that were found in the
+// consensus' router status entries while parsing it, i.e., entries whose
+// mandatory "r", "s", "w", or "p" lines are missing, duplicated, or out of
+// order.  Every error is a ParseError whose line number refers to the parsed
+// document and whose message names the entry's position in the document.
+// Entries are only checked if the consensus was parsed with
+// WithEntryStructureCheck, so other consensuses have no problems.
+func (c *Consensus) CheckEntryStructure() []error {
 
-	// We will read raw router statuses from this channel.
+	return append([]error(nil), c.entryErrors...)
+}
+
+// parseStatusEntries dissects the router statuses and the footer of a network
+// status document using the given extractor, starting at the given line
+// number.  Router statuses are parsed using the given status parser and added
+// to the given consensus, as determined by the given settings.  The function
+// returns the signatures found in the footer.
+func parseStatusEntries(r io.Reader, consensus *Consensus, extractor bufio.SplitFunc,
+	statusParser func(string) (Fingerprint, GetStatus, error), firstLine int,
+	options *parseOptions) ([]ConsensusSignature, error) {
+
+	var signatures []ConsensusSignature
+	position := 0
+	strict := options.strict
+
+	// We will read raw router statuses and, finally, the footer from this
+	// channel.
 	queue := make(chan QueueUnit)
-	go DissectFile(r, extractStatusEntry, queue)
+	go dissectFile(r, extractor, queue, firstLine)
+	duplicates := newDuplicateTracker(options)
 
 	// Parse incoming router statuses until the channel is closed by the remote
 	// end.
@@ -618,33 +2118,66 @@ func parseConsensusUnchecked(r io.Reader, lazy bool) (*Consensus, error) {
 			return nil, unit.Err
 		}
 
+		// Status entries start with "r " while the footer starts with either
+		// "directory-footer" or "directory-signature".
+		if strings.HasPrefix(unit.Blurb, "directory-") {
+			sigs, err := extractFooter(unit.Blurb, consensus)
+			if err != nil {
+				return nil, offsetParseError(err, unit.Line-1)
+			}
+			signatures = append(signatures, sigs...)
+			continue
+		}
+
 		fingerprint, getStatus, err := statusParser(unit.Blurb)
 		if err != nil {
+			return nil, offsetParseError(err, unit.Line-1)
+		}
+
+		// The status parser may skip router statuses that the caller is not
+		// interested in.
+		position++
+		if getStatus == nil {
+			continue
+		}
+
+		if keep, err := duplicates.keep(fingerprint, unit.Line); err != nil {
 			return nil, err
+		} else if !keep {
+			continue
+		}
+
+		if strict || options.checkEntries {
+			for _, err := range checkEntryStructure(unit.Blurb, position, strict) {
+				if strict {
+					return nil, offsetParseError(err, unit.Line-1)
+				}
+				consensus.entryErrors = append(consensus.entryErrors, offsetParseError(err, unit.Line-1))
+			}
 		}
 
 		consensus.RouterStatuses[SanitiseFingerprint(fingerprint)] = getStatus
 	}
 
-	return consensus, nil
+	return signatures, nil
 }
 
 // parseConsensus is a wrapper around parseConsensusUnchecked that first reads
 // and checks the type annotation to make sure it belongs to
 // consensusAnnotations.
-func parseConsensus(r io.Reader, lazy bool) (*Consensus, error) {
+func parseConsensus(r io.Reader, lazy bool, options *parseOptions) (*Consensus, error) {
 
 	r, err := readAndCheckAnnotation(r, consensusAnnotations)
 	if err != nil {
 		return nil, err
 	}
 
-	return parseConsensusUnchecked(r, lazy)
+	return parseConsensusUnchecked(r, lazy, options)
 }
 
 // parseConsensusFile is a wrapper around parseConsensus that opens the named
 // file for parsing.
-func parseConsensusFile(fileName string, lazy bool) (*Consensus, error) {
+func parseConsensusFile(fileName string, lazy bool, options *parseOptions) (*Consensus, error) {
 
 	fd, err := os.Open(fileName)
 	if err != nil {
@@ -652,15 +2185,37 @@ func parseConsensusFile(fileName string, lazy bool) (*Consensus, error) {
 	}
 	defer fd.Close()
 
-	return parseConsensus(fd, lazy)
+	return parseConsensus(fd, lazy, options)
 }
 
 // ParseRawConsensus parses a raw consensus (in string format) and
 // returns a network consensus if parsing was successful.
 func ParseRawConsensus(rawConsensus string, lazy bool) (*Consensus, error) {
+
+	return ParseRawConsensusWithOptions(rawConsensus, lazy)
+}
+
+// ParseRawConsensusWithOptions works like ParseRawConsensus but applies the
+// given options.
+func ParseRawConsensusWithOptions(rawConsensus string, lazy bool, opts ...ParseOption) (*Consensus, error) {
 	r := strings.NewReader(rawConsensus)
 
-	return parseConsensus(r, lazy)
+	return parseConsensus(r, lazy, newParseOptions(opts))
+}
+
+// ParseConsensusBytes parses the consensus in the given byte slice, including
+// its type annotation, and returns a network consensus if parsing was
+// successful.  Router statuses are parsed right away.
+func ParseConsensusBytes(b []byte) (*Consensus, error) {
+
+	return ParseConsensusBytesWithOptions(b)
+}
+
+// ParseConsensusBytesWithOptions works like ParseConsensusBytes but applies the
+// given options.
+func ParseConsensusBytesWithOptions(b []byte, opts ...ParseOption) (*Consensus, error) {
+
+	return parseConsensus(bytes.NewReader(b), false, newParseOptions(opts))
 }
 
 // LazilyParseConsensusFile parses the given file and returns a network
@@ -670,7 +2225,45 @@ func ParseRawConsensus(rawConsensus string, lazy bool) (*Consensus, error) {
 // recommended as long as you won't access more than ~50% of all statuses.
 func LazilyParseConsensusFile(fileName string) (*Consensus, error) {
 
-	return parseConsensusFile(fileName, true)
+	return LazilyParseConsensusFileWithOptions(fileName)
+}
+
+// LazilyParseConsensusFileWithOptions works like LazilyParseConsensusFile but
+// applies the given options.
+func LazilyParseConsensusFileWithOptions(fileName string, opts ...ParseOption) (*Consensus, error) {
+
+	return parseConsensusFile(fileName, true, newParseOptions(opts))
+}
+
+// LazilyParseConsensusFileWithCache works like LazilyParseConsensusFile but
+// keeps up to capacity parsed router statuses in memory.  Once that many
+// router statuses are held, the least recently used one is discarded and parsed
+// again on its next access.  That bounds memory usage when randomly accessing
+// a large consensus while avoiding to parse frequently accessed router
+// statuses over and over.
+func LazilyParseConsensusFileWithCache(fileName string, capacity int) (*Consensus, error) {
+
+	return LazilyParseConsensusFileWithCacheWithOptions(fileName, capacity)
+}
+
+// LazilyParseConsensusFileWithCacheWithOptions works like
+// LazilyParseConsensusFileWithCache but applies the given options.
+func LazilyParseConsensusFileWithCacheWithOptions(fileName string, capacity int, opts ...ParseOption) (*Consensus, error) {
+
+	fd, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+
+	r, err := readAndCheckAnnotation(fd, consensusAnnotations)
+	if err != nil {
+		return nil, err
+	}
+
+	consensus, _, err := parseNetworkStatusUnchecked(r, cachingStatusParser(newStatusCache(capacity)),
+		newParseOptions(opts))
+	return consensus, err
 }
 
 // ParseConsensusFile parses the given file and returns a network consensus if
@@ -680,5 +2273,345 @@ func LazilyParseConsensusFile(fileName string) (*Consensus, error) {
 // long as you will access most of all statuses.
 func ParseConsensusFile(fileName string) (*Consensus, error) {
 
-	return parseConsensusFile(fileName, false)
+	return ParseConsensusFileWithOptions(fileName)
+}
+
+// ParseConsensusFileWithOptions works like ParseConsensusFile but applies the
+// given options.
+func ParseConsensusFileWithOptions(fileName string, opts ...ParseOption) (*Consensus, error) {
+
+	return parseConsensusFile(fileName, false, newParseOptions(opts))
+}
+
+// ParseConsensusFileNoAnnotation works like ParseConsensusFile but for files
+// that lack a type annotation, e.g., consensuses that didn't come from
+// CollecTor.  The file must start with the "network-status-version 3" line of
+// a consensus; otherwise, an error is returned.
+func ParseConsensusFileNoAnnotation(fileName string) (*Consensus, error) {
+
+	return ParseConsensusFileNoAnnotationWithOptions(fileName)
+}
+
+// ParseConsensusFileNoAnnotationWithOptions works like
+// ParseConsensusFileNoAnnotation but applies the given options.
+func ParseConsensusFileNoAnnotationWithOptions(fileName string, opts ...ParseOption) (*Consensus, error) {
+
+	fd, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+
+	annotation, r, err := guessAnnotation(fd)
+	if err != nil {
+		return nil, err
+	}
+	if !consensusAnnotations[*annotation] {
+		return nil, fmt.Errorf("%s is not a consensus but looks like %s", fileName, annotation.Type)
+	}
+
+	// The parser expects the first line to be the type annotation.
+	consensus, err := parseConsensusUnchecked(r, false, newParseOptions(opts))
+	if err != nil {
+		return nil, offsetParseError(err, -1)
+	}
+
+	return consensus, nil
+}
+
+// ParseConsensusFileFiltered parses the given file just like
+// ParseConsensusFile, but only the router statuses whose fingerprint is in the
+// given allow-list.  All other router statuses are skipped after looking at
+// their fingerprint, which is much faster than parsing all of them and
+// filtering afterwards if the allow-list is small.  The resulting consensus
+// only contains the requested relays that are present in the file.
+func ParseConsensusFileFiltered(fileName string, want map[Fingerprint]bool) (*Consensus, error) {
+
+	return ParseConsensusFileFilteredWithOptions(fileName, want)
+}
+
+// ParseConsensusFileFilteredWithOptions works like ParseConsensusFileFiltered
+// but applies the given options.
+func ParseConsensusFileFilteredWithOptions(fileName string, want map[Fingerprint]bool, opts ...ParseOption) (*Consensus, error) {
+
+	normalized := make(map[Fingerprint]bool, len(want))
+	for fingerprint, wanted := range want {
+		if wanted {
+			normalized[SanitiseFingerprint(fingerprint)] = true
+		}
+	}
+
+	fd, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+
+	r, err := readAndCheckAnnotation(fd, consensusAnnotations)
+	if err != nil {
+		return nil, err
+	}
+
+	consensus, _, err := parseNetworkStatusUnchecked(r, filteredStatusParser(normalized), newParseOptions(opts))
+	return consensus, err
+}
+
+// LoadConsensusChecked parses the given file just like ParseConsensusFile but
+// additionally verifies that the consensus' valid-after time matches the time
+// that is encoded in the file name, as done by CollecTor, e.g.,
+// "2017-04-15-00-00-00-consensus".  An error is returned if the file name
+// does not encode a time or if the times differ, which indicates a renamed or
+// corrupt file.
+func LoadConsensusChecked(fileName string) (*Consensus, error) {
+
+	return LoadConsensusCheckedWithOptions(fileName)
+}
+
+// LoadConsensusCheckedWithOptions works like LoadConsensusChecked but applies
+// the given options.
+func LoadConsensusCheckedWithOptions(fileName string, opts ...ParseOption) (*Consensus, error) {
+
+	baseName := filepath.Base(fileName)
+	if len(baseName) < len(collectorFileTimeLayout) {
+		return nil, fmt.Errorf("file name %q does not encode a valid-after time", baseName)
+	}
+	fileTime, err := time.Parse(collectorFileTimeLayout, baseName[:len(collectorFileTimeLayout)])
+	if err != nil {
+		return nil, fmt.Errorf("file name %q does not encode a valid-after time: %s", baseName, err)
+	}
+
+	consensus, err := ParseConsensusFileWithOptions(fileName, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	if !consensus.ValidAfter.Equal(fileTime) {
+		return nil, fmt.Errorf("valid-after time %s does not match file name %q",
+			consensus.ValidAfter.Format(publishedTimeLayout), baseName)
+	}
+
+	return consensus, nil
+}
+
+// ParseConsensusHeader parses the type annotation and the header of the
+// consensus in the given io.Reader, but none of its router statuses.  It
+// returns the consensus, whose validity times and meta information are set,
+// and an io.Reader that is positioned at the first "r" line.  That lets
+// callers decide whether a consensus is worth parsing before spending time on
+// its router statuses, which can be parsed by passing both return values to
+// ParseConsensusEntries.  Note that the bandwidth weights are part of the
+// footer, so they are only set by ParseConsensusEntries.
+func ParseConsensusHeader(r io.Reader) (*Consensus, io.Reader, error) {
+
+	r, err := readAndCheckAnnotation(r, consensusAnnotations)
+	if err != nil {
+		return nil, nil, err
+	}
+	// readAndCheckAnnotation returned a bufio.Reader, so extractMetaInfo
+	// won't read ahead of us.
+	br := bufio.NewReader(r)
+
+	consensus := NewConsensus()
+	numLines, err := extractMetaInfo(br, consensus)
+	if err != nil {
+		return nil, nil, offsetParseError(err, 1)
+	}
+	// Account for the type annotation.
+	numLines++
+
+	numDirLines, err := extractDirSources(br, consensus, numLines+1)
+	if err != nil {
+		return nil, nil, err
+	}
+	consensus.firstEntryLine = numLines + numDirLines + 1
+
+	return consensus, br, nil
+}
+
+// ParseConsensusEntries parses the router statuses and the footer in the given
+// io.Reader and adds them to the given consensus.  It is meant to continue
+// where ParseConsensusHeader left off and expects the io.Reader and the
+// consensus that ParseConsensusHeader returned.
+func ParseConsensusEntries(r io.Reader, c *Consensus) error {
+
+	return ParseConsensusEntriesWithOptions(r, c)
+}
+
+// ParseConsensusEntriesWithOptions works like ParseConsensusEntries but applies
+// the given options.
+func ParseConsensusEntriesWithOptions(r io.Reader, c *Consensus, opts ...ParseOption) error {
+
+	firstLine := c.firstEntryLine
+	if firstLine == 0 {
+		firstLine = 1
+	}
+
+	_, err := parseStatusEntries(r, c, extractStatusEntryOrFooter, ParseRawStatus, firstLine, newParseOptions(opts))
+	return err
+}
+
+// ParseConsensusLazyWithHeader parses the header of the consensus in the given
+// file and returns the consensus, whose validity times and meta information
+// are set but which has no router statuses, along with a channel that streams
+// the consensus' raw router statuses.  That lets callers check the consensus'
+// validity period before they process its router statuses one by one, e.g.,
+// using ParseRawStatus, without building a map of all of them.  The footer is
+// parsed in the background, and the consensus' bandwidth weights are only set
+// right before the channel is closed, so they must not be accessed before.
+// Errors are passed in the Err field of the last unit.  Callers that stop
+// reading early, e.g., because they reject the validity period, must cancel
+// the given context, so that the goroutines behind the channel terminate and
+// close the file.  The channel is closed without the footer in that case.
+func ParseConsensusLazyWithHeader(ctx context.Context, fileName string) (*Consensus, <-chan QueueUnit, error) {
+
+	fd, err := os.Open(fileName)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	consensus, r, err := ParseConsensusHeader(fd)
+	if err != nil {
+		fd.Close()
+		return nil, nil, err
+	}
+
+	units := make(chan QueueUnit)
+	entries := make(chan QueueUnit)
+	go dissectFileUntil(r, extractStatusEntryOrFooter, units, consensus.firstEntryLine, ctx.Done())
+
+	go func() {
+		defer close(entries)
+		// The dissecting goroutine stops reading once the context is
+		// cancelled, and the file may only be closed after that.
+		defer fd.Close()
+		defer func() {
+			for range units {
+			}
+		}()
+
+		// The footer is parsed into a consensus of its own, so the caller
+		// can use the returned consensus in the meantime.
+		footer := NewConsensus()
+		send := func(unit QueueUnit) bool {
+			select {
+			case entries <- unit:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		}
+
+		for unit := range units {
+			if unit.Err == nil && strings.HasPrefix(unit.Blurb, "directory-") {
+				if _, err := extractFooter(unit.Blurb, footer); err != nil {
+					send(QueueUnit{"", offsetParseError(err, unit.Line-1), unit.Line})
+					return
+				}
+				continue
+			}
+			if !send(unit) {
+				return
+			}
+		}
+		if ctx.Err() == nil {
+			consensus.BandwidthWeights = footer.BandwidthWeights
+		}
+	}()
+
+	return consensus, entries, nil
+}
+
+// readValidAfter reads the header of the consensus in the given file until it
+// finds the "valid-after" line, and returns the line's time.  The rest of the
+// file is not read.
+func readValidAfter(fileName string) (time.Time, error) {
+
+	fd, err := os.Open(fileName)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer fd.Close()
+
+	r, err := readAndCheckAnnotation(fd, consensusAnnotations)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "valid-after ") {
+			return time.ParseInLocation(publishedTimeLayout,
+				strings.TrimSpace(strings.TrimPrefix(line, "valid-after ")), time.UTC)
+		}
+		// The header is over once the authorities or relays begin.
+		if strings.HasPrefix(line, "dir-source ") || strings.HasPrefix(line, "r ") {
+			break
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return time.Time{}, err
+	}
+
+	return time.Time{}, fmt.Errorf("missing valid-after line")
+}
+
+// DedupConsensusFiles parses the given consensus files, skipping files whose
+// consensus has the same valid-after time as a file that came earlier, which
+// happens when archives overlap.  Only the header of duplicates is read.  The
+// consensuses are returned in the order of the given files.  Any error aborts
+// parsing.
+func DedupConsensusFiles(paths []string) ([]*Consensus, error) {
+
+	return DedupConsensusFilesWithOptions(paths)
+}
+
+// DedupConsensusFilesWithOptions works like DedupConsensusFiles but applies the
+// given options.
+func DedupConsensusFilesWithOptions(paths []string, opts ...ParseOption) ([]*Consensus, error) {
+
+	var consensuses []*Consensus
+	seen := make(map[time.Time]bool)
+
+	for _, path := range paths {
+		validAfter, err := readValidAfter(path)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse %s: %s", path, err)
+		}
+		if seen[validAfter] {
+			logParse(LogDebug, "skipping %s, which duplicates the consensus valid after %s",
+				path, validAfter.Format(publishedTimeLayout))
+			continue
+		}
+		seen[validAfter] = true
+
+		consensus, err := ParseConsensusFileWithOptions(path, opts...)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse %s: %s", path, err)
+		}
+		consensuses = append(consensuses, consensus)
+	}
+
+	return consensuses, nil
+}
+
+// ParseConsensusWithSignatures parses the consensus in the given io.Reader
+// including its type annotation.  In addition to the consensus, it returns
+// the signatures of its footer, so they can be verified without reading the
+// document a second time.
+func ParseConsensusWithSignatures(r io.Reader) (*Consensus, []ConsensusSignature, error) {
+
+	return ParseConsensusWithSignaturesWithOptions(r)
+}
+
+// ParseConsensusWithSignaturesWithOptions works like
+// ParseConsensusWithSignatures but applies the given options.
+func ParseConsensusWithSignaturesWithOptions(r io.Reader, opts ...ParseOption) (*Consensus, []ConsensusSignature, error) {
+
+	r, err := readAndCheckAnnotation(r, consensusAnnotations)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return parseNetworkStatusUnchecked(r, ParseRawStatus, newParseOptions(opts))
 }
@@ -4,11 +4,21 @@ package zoossh
 
 import (
 	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
 	"io/ioutil"
+	"net"
 	"os"
+	"path/filepath"
 	"reflect"
+	"runtime"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -82,6 +92,65 @@ func BenchmarkLConsensusParsingAndGetting(b *testing.B) {
 	}
 }
 
+// allowList returns the fingerprints of the first n router statuses in the
+// consensus file, in the order of their fingerprints.
+func allowList(tb testing.TB, n int) map[Fingerprint]bool {
+
+	consensus, err := LazilyParseConsensusFile(consensusFile)
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	want := make(map[Fingerprint]bool)
+	for _, fingerprint := range consensus.sortedFingerprints()[:n] {
+		want[fingerprint] = true
+	}
+
+	return want
+}
+
+// Benchmark the time it takes to parse 50 router statuses of a consensus file.
+// Compare with BenchmarkConsensusParsingThenFiltering.
+func BenchmarkConsensusParsingFiltered(b *testing.B) {
+
+	// Only run this benchmark if the consensus file is there.
+	if _, err := os.Stat(consensusFile); os.IsNotExist(err) {
+		b.Skipf("skipping because of missing %s", consensusFile)
+	}
+
+	want := allowList(b, 50)
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if _, err := ParseConsensusFileFiltered(consensusFile, want); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// Benchmark the time it takes to parse a consensus file and then filter it
+// down to 50 router statuses.
+func BenchmarkConsensusParsingThenFiltering(b *testing.B) {
+
+	// Only run this benchmark if the consensus file is there.
+	if _, err := os.Stat(consensusFile); os.IsNotExist(err) {
+		b.Skipf("skipping because of missing %s", consensusFile)
+	}
+
+	want := allowList(b, 50)
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		consensus, err := ParseConsensusFile(consensusFile)
+		if err != nil {
+			b.Fatal(err)
+		}
+		consensus.Filter(func(s *RouterStatus) bool { return want[s.Fingerprint] })
+	}
+}
+
 func TestConsensusOperations(t *testing.T) {
 
 	validFingerprint1 := Fingerprint("aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa")
@@ -179,6 +248,392 @@ p reject 1-65535`)
 	}
 }
 
+func TestComputeSHA256Digest(t *testing.T) {
+
+	// Only run this test if the consensus file is there.
+	if _, err := os.Stat(consensusFile); os.IsNotExist(err) {
+		t.Skipf("skipping because of missing %s", consensusFile)
+	}
+
+	raw, err := ioutil.ReadFile(consensusFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := bytes.Index(raw, []byte("network-status-version"))
+	end := bytes.Index(raw, []byte("\ndirectory-signature ")) + len("\ndirectory-signature ")
+	sum := sha256.Sum256(raw[start:end])
+	expected := hex.EncodeToString(sum[:])
+
+	consensus, err := ParseConsensusFileWithOptions(consensusFile, WithSHA256Digest(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if digest, err := consensus.ComputeSHA256Digest(); err != nil || digest != expected {
+		t.Errorf("Expected digest %s but got %s (%v).", expected, digest, err)
+	}
+
+	// The marker must be found even if it is split across reads.
+	for _, size := range []int{1, 3, 20, 21, 22, 4096} {
+		r := &chunkReader{r: bytes.NewReader(raw), size: size}
+		consensus, _, err = ParseConsensusWithSignaturesWithOptions(r, WithSHA256Digest(true))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if digest, err := consensus.ComputeSHA256Digest(); err != nil || digest != expected {
+			t.Errorf("Expected digest %s for reads of %d bytes but got %s (%v).", expected, size, digest, err)
+		}
+	}
+
+	// The digest is only computed on request.
+	consensus, err = ParseConsensusFile(consensusFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := consensus.ComputeSHA256Digest(); err == nil {
+		t.Error("Consensus parsed without WithSHA256Digest has a digest.")
+	}
+
+	if _, err := consensus.Filter(func(*RouterStatus) bool { return true }).ComputeSHA256Digest(); err == nil {
+		t.Error("Filtered consensus has a digest.")
+	}
+	if _, err := NewConsensus().ComputeSHA256Digest(); err == nil {
+		t.Error("Empty consensus has a digest.")
+	}
+}
+
+func TestValidate(t *testing.T) {
+
+	// Only run this test if the consensus file is there.
+	if _, err := os.Stat(consensusFile); os.IsNotExist(err) {
+		t.Skipf("skipping because of missing %s", consensusFile)
+	}
+
+	consensus, err := LazilyParseConsensusFile(consensusFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := consensus.Validate(); err != nil {
+		t.Fatalf("Valid consensus failed validation: %s", err)
+	}
+
+	consensus.FreshUntil = consensus.ValidUntil.Add(time.Hour)
+	consensus.DirSources = nil
+	consensus.Set("AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA", &RouterStatus{Fingerprint: "AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA"})
+	consensus.Set("BBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBB", &RouterStatus{Digest: "foo"})
+	consensus.RouterStatuses["CCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCC"] = func() *RouterStatus { return nil }
+
+	errs, ok := consensus.Validate().(MultiError)
+	if !ok || len(errs) != 5 {
+		t.Fatalf("Expected 5 errors but got %v.", errs)
+	}
+	for i, substr := range []string{"fresh-until", "authorities", "AAAA", "BBBB", "CCCC"} {
+		if !strings.Contains(errs[i].Error(), substr) {
+			t.Errorf("Expected error %d to mention %q but got %q.", i, substr, errs[i])
+		}
+	}
+
+	if err := NewConsensus().Validate(); err == nil {
+		t.Error("Empty consensus passed validation.")
+	}
+}
+
+func TestConsensusFilter(t *testing.T) {
+
+	// Only run this test if the consensus file is there.
+	if _, err := os.Stat(consensusFile); os.IsNotExist(err) {
+		t.Skipf("skipping because of missing %s", consensusFile)
+	}
+
+	consensus, err := ParseConsensusFile(consensusFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	length := consensus.Length()
+
+	exits := consensus.Filter(func(s *RouterStatus) bool { return s.Flags.Exit })
+	if exits.Length() == 0 || exits.Length() >= length {
+		t.Fatalf("Unexpected number of exit relays %d out of %d.", exits.Length(), length)
+	}
+	for obj := range exits.Iterate(nil) {
+		if !obj.(*RouterStatus).Flags.Exit {
+			t.Errorf("Non-exit relay %s passed the filter.", obj.GetFingerprint())
+		}
+	}
+
+	if !exits.ValidAfter.Equal(consensus.ValidAfter) || !exits.ValidUntil.Equal(consensus.ValidUntil) ||
+		!reflect.DeepEqual(exits.MetaInfo, consensus.MetaInfo) ||
+		!reflect.DeepEqual(exits.BandwidthWeights, consensus.BandwidthWeights) {
+		t.Error("Filtered consensus lacks the original's metadata.")
+	}
+
+	// Modifying the filtered consensus must leave the original alone.
+	exits.MetaInfo["valid-after"] = []byte("foo")
+	exits.BandwidthWeights["Wgg"] = -1
+	exits.Set("AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA", &RouterStatus{})
+	if consensus.Length() != length || string(consensus.MetaInfo["valid-after"]) == "foo" ||
+		consensus.BandwidthWeights["Wgg"] == -1 {
+		t.Error("Original consensus was modified.")
+	}
+
+	if none := consensus.Filter(func(*RouterStatus) bool { return false }); none.Length() != 0 {
+		t.Errorf("Expected empty consensus but got %d router statuses.", none.Length())
+	}
+}
+
+func TestMergeConsensus(t *testing.T) {
+
+	older, newer := NewConsensus(), NewConsensus()
+	older.ValidAfter = time.Date(2017, 4, 15, 0, 0, 0, 0, time.UTC)
+	older.ConsensusMethod = 25
+	newer.ValidAfter = older.ValidAfter.Add(time.Hour)
+	newer.ConsensusMethod = 26
+	newer.BandwidthWeights = map[string]int64{"Wgg": 5000}
+
+	older.Set("AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA", &RouterStatus{Nickname: "old"})
+	older.Set("BBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBB", &RouterStatus{Nickname: "old"})
+	newer.Set("BBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBB", &RouterStatus{Nickname: "new"})
+	newer.Set("CCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCC", &RouterStatus{Nickname: "new"})
+
+	check := func(merged *Consensus) {
+		expected := map[Fingerprint]string{
+			"AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA": "old",
+			"BBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBB": "new",
+			"CCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCC": "new",
+		}
+		if merged.Length() != len(expected) {
+			t.Fatalf("Expected %d router statuses but got %d.", len(expected), merged.Length())
+		}
+		for fingerprint, nickname := range expected {
+			if status, found := merged.Get(fingerprint); !found || status.Nickname != nickname {
+				t.Errorf("Expected %s to be taken from the %s consensus.", fingerprint, nickname)
+			}
+		}
+		if !merged.ValidAfter.Equal(newer.ValidAfter) || merged.ConsensusMethod != 26 ||
+			merged.BandwidthWeights["Wgg"] != 5000 {
+			t.Error("Merged consensus lacks the newer consensus' header.")
+		}
+	}
+
+	// The order of merging must not matter.
+	merged := older.Filter(func(*RouterStatus) bool { return true })
+	MergeConsensus(merged, newer)
+	check(merged)
+	merged = newer.Filter(func(*RouterStatus) bool { return true })
+	MergeConsensus(merged, older)
+	check(merged)
+	if newer.Length() != 2 || older.Length() != 2 {
+		t.Error("Merged consensus was modified.")
+	}
+
+	// Consensuses with the same valid-after time favour the target.
+	merged = older.Filter(func(*RouterStatus) bool { return true })
+	same := newer.Filter(func(*RouterStatus) bool { return true })
+	same.ValidAfter = older.ValidAfter
+	MergeConsensus(merged, same)
+	if status, _ := merged.Get("BBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBB"); status.Nickname != "old" || merged.ConsensusMethod != 25 {
+		t.Error("Merging a consensus with the same valid-after time replaced the target's data.")
+	}
+
+	// Three consensuses, merged out of order.  The relay that the newest
+	// consensus lacks must be taken from the middle one.
+	first, second, third := NewConsensus(), NewConsensus(), NewConsensus()
+	first.ValidAfter = older.ValidAfter
+	second.ValidAfter = first.ValidAfter.Add(time.Hour)
+	third.ValidAfter = first.ValidAfter.Add(2 * time.Hour)
+	first.Set("AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA", &RouterStatus{Nickname: "first"})
+	second.Set("AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA", &RouterStatus{Nickname: "second"})
+	third.Set("BBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBB", &RouterStatus{Nickname: "third"})
+	for _, order := range [][]*Consensus{{first, third, second}, {third, first, second}, {second, third, first}} {
+		merged := NewConsensus()
+		merged.ValidAfter = first.ValidAfter.Add(-time.Hour)
+		for _, consensus := range order {
+			MergeConsensus(merged, consensus)
+		}
+		if status, _ := merged.Get("AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA"); status == nil || status.Nickname != "second" {
+			t.Errorf("Merging out of order kept stale router status %+v.", status)
+		}
+		if !merged.ValidAfter.Equal(third.ValidAfter) || merged.Length() != 2 {
+			t.Error("Merging out of order resulted in the wrong header or relays.")
+		}
+	}
+
+	// The valid-after times of router statuses survive a binary round trip,
+	// which relies on the statuses' fingerprints.
+	for _, consensus := range []*Consensus{first, second, third} {
+		for fingerprint, getStatus := range consensus.RouterStatuses {
+			getStatus().Fingerprint = fingerprint
+		}
+	}
+	merged = NewConsensus()
+	MergeConsensus(merged, first)
+	MergeConsensus(merged, third)
+	data, err := merged.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded := &Consensus{}
+	if err := decoded.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+	MergeConsensus(decoded, second)
+	if status, _ := decoded.Get("AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA"); status == nil || status.Nickname != "second" {
+		t.Errorf("Merging after a binary round trip kept stale router status %+v.", status)
+	}
+}
+
+func TestEnrichCountry(t *testing.T) {
+
+	// Only run this test if the consensus file is there.
+	if _, err := os.Stat(consensusFile); os.IsNotExist(err) {
+		t.Skipf("skipping because of missing %s", consensusFile)
+	}
+
+	consensus, err := LazilyParseConsensusFile(consensusFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	consensus.Set("AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA", &RouterStatus{})
+
+	// Pretend that addresses with an even first octet are in Germany and
+	// that the others cannot be looked up.
+	lookup := func(ip net.IP) string {
+		if ip.To4()[0]%2 == 0 {
+			return "de"
+		}
+		return ""
+	}
+
+	// Enriching twice must yield the same result.
+	for i := 0; i < 2; i++ {
+		consensus.EnrichCountry(lookup)
+
+		german := 0
+		for obj := range consensus.Iterate(nil) {
+			status := obj.(*RouterStatus)
+			expected := ""
+			if status.Address.IPv4Address != nil {
+				expected = lookup(status.Address.IPv4Address)
+			}
+			if status.CountryCode != expected {
+				t.Fatalf("Router status %s has country code %q, expected %q.",
+					status.Fingerprint, status.CountryCode, expected)
+			}
+			if status.CountryCode == "de" {
+				german++
+			}
+		}
+		if german == 0 {
+			t.Error("No relay was enriched with a country code.")
+		}
+	}
+
+	consensus.EnrichCountry(func(net.IP) string { return "" })
+	for obj := range consensus.Iterate(nil) {
+		if code := obj.(*RouterStatus).CountryCode; code != "" {
+			t.Fatalf("Country code %q was not reset.", code)
+		}
+	}
+}
+
+func TestDirSources(t *testing.T) {
+
+	// Only run this test if the consensus file is there.
+	if _, err := os.Stat(consensusFile); os.IsNotExist(err) {
+		t.Skipf("skipping because of missing %s", consensusFile)
+	}
+
+	consensus, err := ParseConsensusFile(consensusFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []struct {
+		nickname    string
+		fingerprint Fingerprint
+	}{
+		{"tor26", "14C131DFC5C6F93646BE72FA1401C02A8DF2E8B4"},
+		{"longclaw", "23D15D965BC35114467363C165C4F724B64B4F66"},
+		{"maatuska", "49015F787433103580E3B66A1707A00E60F2D15B"},
+		{"dannenberg", "585769C78764D58426B8B52B6651A5A71137189A"},
+		{"urras", "80550987E1D626E3EBA5E5E75A458DE0626D088C"},
+		{"moria1", "D586D18309DED4CD6D57C18FDB97EFA96D330566"},
+		{"dizum", "E8A9C45EDE6D711294FADF8E7951F4DE6CA56B58"},
+		{"gabelmoo", "ED03BB616EB2F60BEC80151114BB25CEF515B226"},
+		{"Faravahar", "EFCBE720AB3A82B99F9E953CD5BF50F7EEFC7B97"},
+	}
+	if len(consensus.DirSources) != len(expected) {
+		t.Fatalf("Expected %d authorities but got %d.", len(expected), len(consensus.DirSources))
+	}
+	for i, dirSource := range consensus.DirSources {
+		if dirSource.Nickname != expected[i].nickname || dirSource.Fingerprint != expected[i].fingerprint {
+			t.Errorf("Expected authority %s (%s) but got %s (%s).", expected[i].nickname,
+				expected[i].fingerprint, dirSource.Nickname, dirSource.Fingerprint)
+		}
+	}
+
+	longclaw := consensus.DirSources[1]
+	if longclaw.Hostname != "longclaw.riseup.net" || !longclaw.Address.Equal(net.ParseIP("199.254.238.52")) ||
+		longclaw.DirPort != 80 || longclaw.ORPort != 443 ||
+		longclaw.VoteDigest != "4CB2C84108A2B82F9D01DB92BF6E730E635BF1FE" ||
+		!strings.HasPrefix(longclaw.Contact, "Riseup Networks") {
+		t.Errorf("Authority parsed incorrectly: %+v", longclaw)
+	}
+
+	// Malformed "dir-source" lines are reported with their line number.
+	raw, err := ioutil.ReadFile(consensusFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	broken := bytes.Replace(raw, []byte(" 86.59.21.38 86.59.21.38 80 443"), []byte(" 86.59.21.38 foo 80 443"), 1)
+	_, err = ParseConsensusBytes(broken)
+	if parseErr, ok := err.(*ParseError); !ok || parseErr.Line != 13 {
+		t.Errorf("Expected error in line 13 but got %v.", err)
+	}
+}
+
+func TestParseConsensusFileFiltered(t *testing.T) {
+
+	// Only run this test if the consensus file is there.
+	if _, err := os.Stat(consensusFile); os.IsNotExist(err) {
+		t.Skipf("skipping because of missing %s", consensusFile)
+	}
+
+	expected, err := ParseConsensusFile(consensusFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := allowList(t, 3)
+	// Lower case fingerprints must work, too, and fingerprints that aren't
+	// in the consensus must be ignored.
+	want["9695dfc35ffeb861329b9f1ab04c46397020ce31"] = true
+	want["AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA"] = true
+	// Fingerprints that map to false are not wanted.
+	fingerprints := expected.sortedFingerprints()
+	want[fingerprints[len(fingerprints)-1]] = false
+
+	consensus, err := ParseConsensusFileFiltered(consensusFile, want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if consensus.Length() != 4 {
+		t.Fatalf("Expected 4 router statuses but got %d.", consensus.Length())
+	}
+	for fingerprint := range consensus.RouterStatuses {
+		status, _ := consensus.Get(fingerprint)
+		expectedStatus, _ := expected.Get(fingerprint)
+		if !status.Equals(expectedStatus) {
+			t.Errorf("Router status %s differs from the one of the full consensus.", fingerprint)
+		}
+	}
+
+	if !consensus.ValidAfter.Equal(expected.ValidAfter) ||
+		!reflect.DeepEqual(consensus.BandwidthWeights, expected.BandwidthWeights) ||
+		len(consensus.DirSources) != len(expected.DirSources) {
+		t.Error("Header or footer of filtered consensus parsed incorrectly.")
+	}
+}
+
 func TestExtractStatusEntry(t *testing.T) {
 
 	goodStatusEntry := `r seele AAoQ1DAR6kkoo19hBAX5K0QztNw bdrzhG0Kk/8DUsnSdmzj7DjFQjY 2014-12-08 12:27:05 73.15.150.172 9001 0
@@ -291,7 +746,7 @@ func TestExtractMetaInfo(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	err = extractMetaInfo(r, consensus)
+	_, err = extractMetaInfo(r, consensus)
 	if err != nil {
 		t.Errorf("unable to extractMetaInfo with error: %v", err)
 	}
@@ -306,6 +761,43 @@ func TestExtractMetaInfo(t *testing.T) {
 	}
 }
 
+func TestConsensusIsLive(t *testing.T) {
+
+	c := NewConsensus()
+	c.ValidAfter = time.Date(2014, time.December, 8, 16, 0, 0, 0, time.UTC)
+	c.FreshUntil = time.Date(2014, time.December, 8, 17, 0, 0, 0, time.UTC)
+	c.ValidUntil = time.Date(2014, time.December, 8, 19, 0, 0, 0, time.UTC)
+
+	// A timestamp in a different time zone must be compared by instant.
+	cet := time.FixedZone("CET", 60*60)
+
+	tests := []struct {
+		t    time.Time
+		live bool
+	}{
+		{c.ValidAfter.Add(-time.Second), false},
+		{c.ValidAfter, true},
+		{c.FreshUntil, true},
+		{c.ValidUntil.Add(-time.Second), true},
+		{c.ValidUntil, false},
+		{time.Date(2014, time.December, 8, 17, 30, 0, 0, cet), true},
+		{time.Date(2014, time.December, 8, 20, 0, 0, 0, cet), false},
+	}
+
+	for _, test := range tests {
+		if live := c.IsLive(test.t); live != test.live {
+			t.Errorf("IsLive(%s) returned %t, expected %t.", test.t, live, test.live)
+		}
+	}
+
+	if age := c.Age(c.ValidAfter.Add(90 * time.Minute)); age != 90*time.Minute {
+		t.Errorf("Expected age of 90 minutes but got %s.", age)
+	}
+	if age := c.Age(c.ValidAfter.Add(-time.Hour)); age != -time.Hour {
+		t.Errorf("Expected age of -1 hour but got %s.", age)
+	}
+}
+
 func TestExtractSharedRandom(t *testing.T) {
 	expectedPrev := "CMiqEw+6Dsot433qR+5WOEcDABGgJDbFozSFmudJlRg="
 	expectedCurr := "bf6tbPKCMgt2fHCUcJ2FqKLtM6EER3E5uu4CVtE2erg="
@@ -326,7 +818,7 @@ func TestExtractSharedRandom(t *testing.T) {
 		t.Error(err)
 	}
 
-	err = extractMetaInfo(r, c)
+	_, err = extractMetaInfo(r, c)
 	if err != nil {
 		t.Error(err)
 	}
@@ -345,73 +837,438 @@ func TestExtractSharedRandom(t *testing.T) {
 	}
 }
 
-func TestConsensusToSlice(t *testing.T) {
+func TestSharedRandPresence(t *testing.T) {
 
-	// Only run this test if the consensus file is there.
-	if _, err := os.Stat(consensusFile); os.IsNotExist(err) {
-		t.Skipf("skipping because of missing %s", consensusFile)
+	tests := []struct {
+		fileName string
+		previous bool
+		current  bool
+	}{
+		{sharedRandBothFile, true, true},
+		{sharedRandCurrentOnlyFile, false, true},
+		{sharedRandNeitherFile, false, false},
 	}
 
-	consensus, err := ParseConsensusFile(consensusFile)
-	if err != nil {
-		t.Fatal(err)
-	}
+	for _, test := range tests {
+		if _, err := os.Stat(test.fileName); os.IsNotExist(err) {
+			t.Skipf("skipping because of missing %s", test.fileName)
+		}
 
-	consensusSlice := consensus.ToSlice()
-	if consensus.Length() != len(consensusSlice) {
-		t.Error("Consensus slice length differs from map length.")
-	}
+		c, err := ParseConsensusFile(test.fileName)
+		if err != nil {
+			t.Fatalf("Failed to parse %s: %v", test.fileName, err)
+		}
 
-	for _, getStatus := range consensusSlice {
-		status := getStatus()
-		if _, found := consensus.Get(status.Fingerprint); !found {
-			t.Error("Router status in slice not found in map.")
+		if c.HasSharedRandPrevious() != test.previous {
+			t.Errorf("%s: expected previous value to be present: %t", test.fileName, test.previous)
+		}
+		if c.HasSharedRandCurrent() != test.current {
+			t.Errorf("%s: expected current value to be present: %t", test.fileName, test.current)
+		}
+		if test.current && base64.StdEncoding.EncodeToString(c.SharedRandCurrent) !=
+			"bf6tbPKCMgt2fHCUcJ2FqKLtM6EER3E5uu4CVtE2erg=" {
+			t.Errorf("%s: current random value did not match expected value", test.fileName)
+		}
+		if c.Length() != 1 {
+			t.Errorf("%s: expected 1 router status but got %d", test.fileName, c.Length())
 		}
 	}
 }
 
-func TestParseIPv6AddressAndPort(t *testing.T) {
+func TestConsensusMethod(t *testing.T) {
 
-	_, getStatus, err := ParseRawStatus(`r Karlstad0 m5TNC3uAV+ryG6fwI7ehyMqc5kU f1g9KQhgS0r6+H/7dzAJOpi6lG8 2014-12-08 06:57:54 193.11.166.194 9000 80
-a [2002:470:6e:80d::2]:22
-s Fast Guard HSDir Running Stable V2Dir Valid
-v Tor 0.2.4.23
-w Bandwidth=2670
-p reject 1-65535`)
-	if err != nil {
-		t.Error(err)
+	// Only run this test if the consensus file is there.
+	if _, err := os.Stat(sharedRandBothFile); os.IsNotExist(err) {
+		t.Skipf("skipping because of missing %s", sharedRandBothFile)
 	}
 
-	if getStatus().Address.IPv6Address.String() != "2002:470:6e:80d::2" {
-		t.Error("Failes to Parse IPv6 Address correctly.")
+	raw, err := ioutil.ReadFile(sharedRandBothFile)
+	if err != nil {
+		t.Fatal(err)
 	}
 
-	if getStatus().Address.IPv6ORPort != StringToPort("22") {
-		t.Error("Failes to Parse IPv6 Port correctly.")
+	c, err := ParseRawConsensus(string(raw), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.ConsensusMethod != 25 || !c.SupportsSharedRand() {
+		t.Errorf("Expected consensus method 25 with shared randomness but got %d.", c.ConsensusMethod)
 	}
-}
 
-func TestPrintIPv6AddressAndPort(t *testing.T) {
+	// Consensus method 23 introduced shared randomness values.
+	c, err = ParseRawConsensus(strings.Replace(string(raw), "consensus-method 25", "consensus-method 23", 1), false)
+	if err != nil || !c.SupportsSharedRand() || !c.HasSharedRandCurrent() {
+		t.Errorf("Shared randomness values of consensus method 23 resulted in %v.", err)
+	}
 
-	_, getStatus0, err := ParseRawStatus(`r Karlstad0 m5TNC3uAV+ryG6fwI7ehyMqc5kU f1g9KQhgS0r6+H/7dzAJOpi6lG8 2014-12-08 06:57:54 193.11.166.194 9000 80
-a [2002:470:6e:80d::2]:22
-s Fast Guard HSDir Running Stable V2Dir Valid
-v Tor 0.2.4.23
-w Bandwidth=2670
-p reject 1-65535`)
-	if err != nil {
-		t.Error(err)
+	// Older consensus methods did not include them, which we only warn
+	// about.
+	var warnings []string
+	SetParseLogger(func(level, msg string) {
+		if level == LogWarn {
+			warnings = append(warnings, msg)
+		}
+	})
+	defer SetParseLogger(nil)
+	c, err = ParseRawConsensus(strings.Replace(string(raw), "consensus-method 25", "consensus-method 22", 1), false)
+	if err != nil || c.SupportsSharedRand() || !c.HasSharedRandCurrent() {
+		t.Errorf("Shared randomness values of consensus method 22 resulted in %v.", err)
+	}
+	if len(warnings) != 2 || !strings.Contains(warnings[0], "consensus method 22") {
+		t.Errorf("Expected warnings about consensus method 22 but got %q.", warnings)
 	}
+	SetParseLogger(nil)
 
-	if getStatus0().Address.String() != "193.11.166.194|9000|80,2002:470:6e:80d::2|22" {
-		t.Error("Failed to pretty print IP addresses", getStatus0().Address.String())
+	_, err = ParseRawConsensus(strings.Replace(string(raw), "consensus-method 25", "consensus-method foo", 1), false)
+	if parseErr, ok := err.(*ParseError); !ok || parseErr.Field != "consensus-method" {
+		t.Errorf("Malformed consensus method resulted in %v.", err)
 	}
 
-	_, getStatus1, err := ParseRawStatus(`r Karlstad0 m5TNC3uAV+ryG6fwI7ehyMqc5kU f1g9KQhgS0r6+H/7dzAJOpi6lG8 2014-12-08 06:57:54 193.11.166.194 9000 80
-s Fast Guard HSDir Running Stable V2Dir Valid
-v Tor 0.2.4.23
-w Bandwidth=2670
-p reject 1-65535`)
+	// Votes declare the consensus methods they support instead.
+	if _, err := os.Stat(voteFile); os.IsNotExist(err) {
+		t.Skipf("skipping because of missing %s", voteFile)
+	}
+	vote, err := ParseVoteFile(voteFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vote.ConsensusMethod != 0 || vote.SupportsSharedRand() {
+		t.Errorf("Expected no consensus method in vote but got %d.", vote.ConsensusMethod)
+	}
+}
+
+func TestConsensusParams(t *testing.T) {
+
+	// Only run this test if the consensus file is there.
+	if _, err := os.Stat(sharedRandBothFile); os.IsNotExist(err) {
+		t.Skipf("skipping because of missing %s", sharedRandBothFile)
+	}
+
+	raw, err := ioutil.ReadFile(sharedRandBothFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(string(raw), "\n")
+	var paramsLine string
+	for _, line := range lines {
+		if strings.HasPrefix(line, "params ") {
+			paramsLine = line
+			break
+		}
+	}
+	if paramsLine == "" {
+		t.Fatalf("%s lacks a \"params\" line.", sharedRandBothFile)
+	}
+
+	c, err := ParseRawConsensus(strings.Replace(string(raw), paramsLine, "params CircuitPriorityHalflifeMsec=30000 foo=-5", 1), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.Params) != 2 || c.Param("CircuitPriorityHalflifeMsec", 0) != 30000 || c.Param("foo", 0) != -5 {
+		t.Errorf("Parameters parsed incorrectly: %v", c.Params)
+	}
+	if c.Param("bar", 42) != 42 {
+		t.Error("Missing parameter did not result in default value.")
+	}
+
+	// Old consensuses lack the line.
+	c, err = ParseRawConsensus(strings.Replace(string(raw), paramsLine+"\n", "", 1), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Params == nil || len(c.Params) != 0 || c.Param("foo", 1) != 1 {
+		t.Errorf("Expected no parameters but got %v.", c.Params)
+	}
+
+	for _, params := range []string{"params foo", "params foo=bar", "params foo=4294967296", "params =1"} {
+		_, err = ParseRawConsensus(strings.Replace(string(raw), paramsLine, params, 1), false)
+		if parseErr, ok := err.(*ParseError); !ok || parseErr.Field != "params" {
+			t.Errorf("Malformed line %q resulted in %v.", params, err)
+		}
+	}
+}
+
+func TestCheckEntryStructure(t *testing.T) {
+
+	// Only run this test if the consensus file is there.
+	if _, err := os.Stat(sharedRandNeitherFile); os.IsNotExist(err) {
+		t.Skipf("skipping because of missing %s", sharedRandNeitherFile)
+	}
+
+	raw, err := ioutil.ReadFile(sharedRandNeitherFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := ParseRawConsensusWithOptions(string(raw), false, WithEntryStructureCheck(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if errs := c.CheckEntryStructure(); len(errs) != 0 {
+		t.Errorf("Well-formed consensus has structural problems: %v", errs)
+	}
+
+	// Move the "s" line behind the "w" line and remove the "p" line.
+	malformed := strings.Replace(string(raw), "\ns Running Stable V2Dir Valid\n", "\n", 1)
+	malformed = strings.Replace(malformed, "\nw Bandwidth=25\n", "\nw Bandwidth=25\ns Running Stable V2Dir Valid\n", 1)
+	malformed = strings.Replace(malformed, "\np reject 1-65535\n", "\n", 1)
+
+	// Entries aren't checked by default.
+	c, err = ParseRawConsensus(malformed, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if errs := c.CheckEntryStructure(); len(errs) != 0 {
+		t.Errorf("Unchecked consensus has structural problems: %v", errs)
+	}
+
+	c, err = ParseRawConsensusWithOptions(malformed, false, WithEntryStructureCheck(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	errs := c.CheckEntryStructure()
+	if len(errs) != 2 {
+		t.Fatalf("Expected 2 structural problems but got %d: %v", len(errs), errs)
+	}
+
+	rLine := strings.Count(malformed[:strings.Index(malformed, "\nr seele")+1], "\n") + 1
+	if parseErr, ok := errs[0].(*ParseError); !ok || parseErr.Field != "s" || parseErr.Line != rLine+4 {
+		t.Errorf("Unexpected error for out-of-order line: %v", errs[0])
+	}
+	if parseErr, ok := errs[1].(*ParseError); !ok || parseErr.Field != "p" || parseErr.Line != rLine {
+		t.Errorf("Unexpected error for missing line: %v", errs[1])
+	}
+	if !strings.Contains(errs[1].Error(), "router status 1 ") {
+		t.Errorf("Error does not name the entry's position: %v", errs[1])
+	}
+}
+
+func TestParseConsensusCRLF(t *testing.T) {
+
+	// Only run this test if the consensus file is there.
+	if _, err := os.Stat(sharedRandConsensusFile); os.IsNotExist(err) {
+		t.Skipf("skipping because of missing %s", sharedRandConsensusFile)
+	}
+
+	raw, err := ioutil.ReadFile(sharedRandConsensusFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected, err := ParseConsensusBytes(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := ParseConsensusBytes(bytes.Replace(raw, []byte("\n"), []byte("\r\n"), -1))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(c.MetaInfo, expected.MetaInfo) {
+		t.Error("Meta information of CRLF consensus differs.")
+	}
+	if !reflect.DeepEqual(c.BandwidthWeights, expected.BandwidthWeights) {
+		t.Error("Bandwidth weights of CRLF consensus differ.")
+	}
+	if c.Length() != expected.Length() {
+		t.Fatalf("Expected %d router statuses but got %d.", expected.Length(), c.Length())
+	}
+	for fingerprint := range expected.RouterStatuses {
+		status, _ := c.Get(fingerprint)
+		expectedStatus, _ := expected.Get(fingerprint)
+		if !status.Equals(expectedStatus) {
+			t.Fatalf("Router status %s of CRLF consensus differs.", fingerprint)
+		}
+	}
+}
+
+func TestUnrecognizedStatusLines(t *testing.T) {
+
+	entry := "r seele AAoQ1DAR6kkoo19hBAX5K0QztNw e8UPqNui1/oIBcXrqQYnWTRrYS0 2017-04-14 10:41:26 67.164.109.21 9001 0\n" +
+		"s Running Stable V2Dir Valid\n" +
+		"v Tor 0.2.9.10\n" +
+		"w Bandwidth=25\n" +
+		"p reject 1-65535\n"
+
+	_, getStatus, err := ParseRawStatus(entry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if unrecognized := getStatus().Unrecognized; unrecognized != nil {
+		t.Errorf("Expected no unrecognized lines but got %q.", unrecognized)
+	}
+
+	// Lines that the specification defines aren't reported, even if we
+	// don't store them.
+	entry = strings.Replace(entry, "w Bandwidth=25\n",
+		"pr Cons=1-2 Link=1-4\nw Bandwidth=25\nfuture-line foo bar\n", 1) +
+		"m 25,26 sha256=AAAA\nstats wfu=0.9\nanother-line\n"
+	_, getStatus, err = ParseRawStatus(entry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"future-line foo bar", "another-line"}
+	if unrecognized := getStatus().Unrecognized; !reflect.DeepEqual(unrecognized, expected) {
+		t.Errorf("Expected unrecognized lines %q but got %q.", expected, unrecognized)
+	}
+
+	// Real consensuses have no unrecognized lines.
+	if _, err := os.Stat(consensusFile); os.IsNotExist(err) {
+		t.Skipf("skipping because of missing %s", consensusFile)
+	}
+	consensus, err := ParseConsensusFile(consensusFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for fingerprint, getStatus := range consensus.RouterStatuses {
+		if unrecognized := getStatus().Unrecognized; unrecognized != nil {
+			t.Fatalf("Router status %s has unrecognized lines %q.", fingerprint, unrecognized)
+		}
+	}
+}
+
+func TestParsedVersion(t *testing.T) {
+
+	entry := "r seele AAoQ1DAR6kkoo19hBAX5K0QztNw e8UPqNui1/oIBcXrqQYnWTRrYS0 2017-04-14 10:41:26 67.164.109.21 9001 0\n" +
+		"v Tor 0.4.7.13\n"
+
+	_, getStatus, err := ParseRawStatus(entry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	status := getStatus()
+	version, ok := status.ParsedVersion()
+	if !ok || *version != (TorVersion{0, 4, 7, 13, ""}) || status.RawVersion != "Tor 0.4.7.13" {
+		t.Errorf("Version parsed incorrectly: %v (%t), %q", version, ok, status.RawVersion)
+	}
+
+	for _, line := range []string{"v git-0123456789abcdef\n", "v Foo 1.2.3\n", "v Tor foo\n", ""} {
+		_, getStatus, err = ParseRawStatus(strings.Replace(entry, "v Tor 0.4.7.13\n", line, 1))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if version, ok := getStatus().ParsedVersion(); ok {
+			t.Errorf("Line %q resulted in version %s.", line, version)
+		}
+	}
+}
+
+func TestExitsTo(t *testing.T) {
+
+	consensus := NewConsensus()
+	for i, policy := range []string{"accept 80,443", "reject 1-65535", "accept 80", "accept 443", "accept 80"} {
+		status := &RouterStatus{
+			Fingerprint: Fingerprint(fmt.Sprintf("%040X", 5-i)),
+			Flags:       RouterFlags{Running: true},
+		}
+		words := strings.Fields(policy)
+		status.Accept = words[0] == "accept"
+		status.PortList = words[1]
+		consensus.Set(status.Fingerprint, status)
+	}
+
+	// Relay 5's descriptor rejects the destination although its "p" line
+	// accepts it, relay 4's descriptor accepts it although its "p" line
+	// rejects it, and relay 3 is not running.
+	descriptors := NewRouterDescriptors()
+	for fingerprint, policy := range map[Fingerprint]string{
+		"0000000000000000000000000000000000000005": "reject 192.0.2.0/24:*\naccept *:*\n",
+		"0000000000000000000000000000000000000004": "accept 192.0.2.1:80\nreject *:*\n",
+	} {
+		_, getDesc, err := ParseRawDescriptor("router foo 1.2.3.4 9001 0 0\n" + policy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		descriptors.Set(fingerprint, getDesc())
+	}
+	status, _ := consensus.Get("0000000000000000000000000000000000000003")
+	status.Flags.Running = false
+
+	var fingerprints []Fingerprint
+	for _, status := range consensus.ExitsTo(net.ParseIP("192.0.2.1"), 80, descriptors) {
+		fingerprints = append(fingerprints, status.Fingerprint)
+	}
+	expected := []Fingerprint{"0000000000000000000000000000000000000001", "0000000000000000000000000000000000000004"}
+	if !reflect.DeepEqual(fingerprints, expected) {
+		t.Errorf("Expected exits %v but got %v.", expected, fingerprints)
+	}
+
+	// Without descriptors, the "p" lines decide.
+	if exits := consensus.ExitsTo(net.ParseIP("192.0.2.1"), 443, nil); len(exits) != 2 {
+		t.Errorf("Expected 2 exits to port 443 but got %d.", len(exits))
+	}
+	if exits := consensus.ExitsTo(net.ParseIP("2001:db8::1"), 443, nil); len(exits) != 0 {
+		t.Errorf("Expected no IPv6 exits but got %d.", len(exits))
+	}
+}
+
+func TestConsensusToSlice(t *testing.T) {
+
+	// Only run this test if the consensus file is there.
+	if _, err := os.Stat(consensusFile); os.IsNotExist(err) {
+		t.Skipf("skipping because of missing %s", consensusFile)
+	}
+
+	consensus, err := ParseConsensusFile(consensusFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	consensusSlice := consensus.ToSlice()
+	if consensus.Length() != len(consensusSlice) {
+		t.Error("Consensus slice length differs from map length.")
+	}
+
+	for _, getStatus := range consensusSlice {
+		status := getStatus()
+		if _, found := consensus.Get(status.Fingerprint); !found {
+			t.Error("Router status in slice not found in map.")
+		}
+	}
+}
+
+func TestParseIPv6AddressAndPort(t *testing.T) {
+
+	_, getStatus, err := ParseRawStatus(`r Karlstad0 m5TNC3uAV+ryG6fwI7ehyMqc5kU f1g9KQhgS0r6+H/7dzAJOpi6lG8 2014-12-08 06:57:54 193.11.166.194 9000 80
+a [2002:470:6e:80d::2]:22
+s Fast Guard HSDir Running Stable V2Dir Valid
+v Tor 0.2.4.23
+w Bandwidth=2670
+p reject 1-65535`)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if getStatus().Address.IPv6Address.String() != "2002:470:6e:80d::2" {
+		t.Error("Failes to Parse IPv6 Address correctly.")
+	}
+
+	if getStatus().Address.IPv6ORPort != StringToPort("22") {
+		t.Error("Failes to Parse IPv6 Port correctly.")
+	}
+}
+
+func TestPrintIPv6AddressAndPort(t *testing.T) {
+
+	_, getStatus0, err := ParseRawStatus(`r Karlstad0 m5TNC3uAV+ryG6fwI7ehyMqc5kU f1g9KQhgS0r6+H/7dzAJOpi6lG8 2014-12-08 06:57:54 193.11.166.194 9000 80
+a [2002:470:6e:80d::2]:22
+s Fast Guard HSDir Running Stable V2Dir Valid
+v Tor 0.2.4.23
+w Bandwidth=2670
+p reject 1-65535`)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if getStatus0().Address.String() != "193.11.166.194|9000|80,2002:470:6e:80d::2|22" {
+		t.Error("Failed to pretty print IP addresses", getStatus0().Address.String())
+	}
+
+	_, getStatus1, err := ParseRawStatus(`r Karlstad0 m5TNC3uAV+ryG6fwI7ehyMqc5kU f1g9KQhgS0r6+H/7dzAJOpi6lG8 2014-12-08 06:57:54 193.11.166.194 9000 80
+s Fast Guard HSDir Running Stable V2Dir Valid
+v Tor 0.2.4.23
+w Bandwidth=2670
+p reject 1-65535`)
 	if err != nil {
 		t.Error(err)
 	}
@@ -460,3 +1317,774 @@ func TestParseRawConsensus(t *testing.T) {
 		t.Error("Expected getting the consensus data from the file or string made from said file to be the same.")
 	}
 }
+
+func TestConsensusParseError(t *testing.T) {
+
+	// The "r" line of the second router status lacks its ports.
+	malformed := `@type network-status-consensus-3 1.0
+network-status-version 3
+vote-status consensus
+valid-after 2014-12-08 16:00:00
+fresh-until 2014-12-08 17:00:00
+valid-until 2014-12-08 19:00:00
+dir-source tor26 14C131DFC5C6F93646BE72FA1401C02A8DF2E8B4 86.59.21.38 86.59.21.38 80 443
+r seele AAoQ1DAR6kkoo19hBAX5K0QztNw bdrzhG0Kk/8DUsnSdmzj7DjFQjY 2014-12-08 12:27:05 73.15.150.172 9001 0
+s Fast Running Stable Valid
+r Karlstad0 m5TNC3uAV+ryG6fwI7ehyMqc5kU f1g9KQhgS0r6+H/7dzAJOpi6lG8 2014-12-08 06:57:54 193.11.166.194
+s Fast Running Stable Valid
+directory-signature 14C131DFC5C6F93646BE72FA1401C02A8DF2E8B4 97BF711E3CAA259C6E9E7B6091C5B330417FCFED
+`
+
+	_, err := ParseRawConsensus(malformed, false)
+	if err == nil {
+		t.Fatal("Malformed consensus did not raise an error.")
+	}
+
+	parseErr, ok := err.(*ParseError)
+	if !ok {
+		t.Fatalf("Expected *ParseError but got %T.", err)
+	}
+
+	if parseErr.Line != 10 || parseErr.Field != "r" {
+		t.Errorf("Expected error in line 10 and field \"r\" but got %s.", parseErr)
+	}
+
+	// Malformed validity times are reported as well.
+	_, err = ParseRawConsensus(strings.Replace(malformed, "fresh-until 2014-12-08", "fresh-until 2014-13-08", 1), false)
+	parseErr, ok = err.(*ParseError)
+	if !ok {
+		t.Fatalf("Expected *ParseError but got %T.", err)
+	}
+
+	if parseErr.Line != 5 || parseErr.Field != "fresh-until" {
+		t.Errorf("Expected error in line 5 and field \"fresh-until\" but got %s.", parseErr)
+	}
+}
+
+func TestGetByNickname(t *testing.T) {
+
+	consensus := NewConsensus()
+	consensus.Set("AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA",
+		&RouterStatus{Nickname: "Unnamed", Fingerprint: "AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA"})
+	consensus.Set("BBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBB",
+		&RouterStatus{Nickname: "Unnamed", Fingerprint: "BBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBB"})
+	consensus.Set("CCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCC",
+		&RouterStatus{Nickname: "unnamed", Fingerprint: "CCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCC"})
+
+	statuses := consensus.GetByNickname("Unnamed")
+	if len(statuses) != 2 {
+		t.Fatalf("Expected two relays sharing a nickname but got %d.", len(statuses))
+	}
+	if statuses[0].Fingerprint != "AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA" ||
+		statuses[1].Fingerprint != "BBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBB" {
+		t.Error("Got unexpected relays for nickname.")
+	}
+
+	if len(consensus.GetByNicknameFold("UNNAMED")) != 3 {
+		t.Error("Case-insensitive nickname lookup failed.")
+	}
+
+	if len(consensus.GetByNickname("nonexistent")) != 0 {
+		t.Error("Found relays for non-existing nickname.")
+	}
+
+	// Modifying the consensus must be reflected in subsequent lookups.
+	consensus.Set("DDDDDDDDDDDDDDDDDDDDDDDDDDDDDDDDDDDDDDDD",
+		&RouterStatus{Nickname: "Unnamed", Fingerprint: "DDDDDDDDDDDDDDDDDDDDDDDDDDDDDDDDDDDDDDDD"})
+	if len(consensus.GetByNickname("Unnamed")) != 3 {
+		t.Error("Nickname index was not invalidated after Set.")
+	}
+
+	// The index is built on demand, which must be safe for concurrent
+	// lookups.  Run with -race to check.
+	consensus.Set("EEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEE",
+		&RouterStatus{Nickname: "Unnamed", Fingerprint: "EEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEE"})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if len(consensus.GetByNickname("Unnamed")) != 4 || len(consensus.GetByNicknameFold("unnamed")) != 5 {
+				t.Error("Concurrent nickname lookup failed.")
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestGetByFingerprintPrefix(t *testing.T) {
+
+	consensus := NewConsensus()
+	for _, fingerprint := range []Fingerprint{
+		"000A10D43011EA4928A35F610405F92B4433B4DC",
+		"000A2A1B2C3D4E5F60718293A4B5C6D7E8F90A1B",
+		"00A0000000000000000000000000000000000000",
+		"9B94CD0B7B8057EAF21BA7F023B7A1C8CA9CE645",
+	} {
+		consensus.Set(fingerprint, &RouterStatus{Fingerprint: fingerprint})
+	}
+
+	statuses := consensus.GetByFingerprintPrefix(" 000a")
+	if len(statuses) != 2 {
+		t.Fatalf("Expected 2 relays for prefix but got %d.", len(statuses))
+	}
+	if statuses[0].Fingerprint != "000A10D43011EA4928A35F610405F92B4433B4DC" ||
+		statuses[1].Fingerprint != "000A2A1B2C3D4E5F60718293A4B5C6D7E8F90A1B" {
+		t.Error("Got unexpected relays for prefix.")
+	}
+
+	if len(consensus.GetByFingerprintPrefix("9B94CD0B7B8057EAF21BA7F023B7A1C8CA9CE645")) != 1 {
+		t.Error("Full fingerprint did not match its relay.")
+	}
+	if len(consensus.GetByFingerprintPrefix("FF")) != 0 {
+		t.Error("Found relays for non-existing prefix.")
+	}
+	if len(consensus.GetByFingerprintPrefix("")) != 4 {
+		t.Error("Empty prefix did not match all relays.")
+	}
+}
+
+func TestConsensusFooter(t *testing.T) {
+
+	// Only run this test if the consensus file is there.
+	if _, err := os.Stat(consensusFile); os.IsNotExist(err) {
+		t.Skipf("skipping because of missing %s", consensusFile)
+	}
+
+	consensus, err := ParseConsensusFile(consensusFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(consensus.BandwidthWeights) != 19 {
+		t.Errorf("Expected 19 bandwidth weights but got %d.", len(consensus.BandwidthWeights))
+	}
+
+	if consensus.BandwidthWeights["Wgg"] != 6150 || consensus.BandwidthWeights["Wme"] != 0 {
+		t.Error("Bandwidth weights parsed incorrectly.")
+	}
+}
+
+func TestEd25519Identity(t *testing.T) {
+
+	rawStatus := `r PDrelay1 AAoQ1DAR6kkoo19hBAX5K0QztNw bdrzhG0Kk/8DUsnSdmzj7DjFQjY 2017-04-14 22:27:05 95.215.44.189 8080 0
+s Fast Running Stable Valid
+v Tor 0.3.0.5-rc
+id ed25519 zzKU8Hbd5GpIHeYjzcm/CXbhHVxTLKkZM1UdTPaaDSU
+w Bandwidth=1010
+p reject 1-65535`
+
+	_, getStatus, err := ParseRawStatus(rawStatus)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id := getStatus().Ed25519Identity; id != "zzKU8Hbd5GpIHeYjzcm/CXbhHVxTLKkZM1UdTPaaDSU" {
+		t.Errorf("Unexpected ed25519 identity %q.", id)
+	}
+
+	_, getStatus, err = ParseRawStatus(strings.Replace(rawStatus,
+		"id ed25519 zzKU8Hbd5GpIHeYjzcm/CXbhHVxTLKkZM1UdTPaaDSU", "id ed25519 none", 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id := getStatus().Ed25519Identity; id != "" {
+		t.Errorf("Expected empty ed25519 identity but got %q.", id)
+	}
+
+	_, getStatus, err = ParseRawStatus(strings.Replace(rawStatus,
+		"id ed25519 zzKU8Hbd5GpIHeYjzcm/CXbhHVxTLKkZM1UdTPaaDSU\n", "", 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id := getStatus().Ed25519Identity; id != "" {
+		t.Errorf("Expected empty ed25519 identity but got %q.", id)
+	}
+}
+
+func TestLoadConsensusChecked(t *testing.T) {
+
+	// Only run this test if the consensus file is there.
+	if _, err := os.Stat(sharedRandConsensusFile); os.IsNotExist(err) {
+		t.Skipf("skipping because of missing %s", sharedRandConsensusFile)
+	}
+
+	consensus, err := LoadConsensusChecked(sharedRandConsensusFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if consensus.ValidAfter != time.Date(2017, time.April, 15, 0, 0, 0, 0, time.UTC) {
+		t.Error("ValidAfter time in consensus invalid.")
+	}
+
+	// The same consensus, misfiled under the following hour.
+	dir, err := ioutil.TempDir("", "zoossh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	content, err := ioutil.ReadFile(sharedRandConsensusFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	misfiled := filepath.Join(dir, "2017-04-15-01-00-00-consensus")
+	if err := ioutil.WriteFile(misfiled, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := LoadConsensusChecked(misfiled); err == nil {
+		t.Error("Misfiled consensus did not raise an error.")
+	}
+
+	// File names without a time cannot be checked.
+	if _, err := LoadConsensusChecked(consensusFile); err == nil {
+		t.Error("File name without valid-after time did not raise an error.")
+	}
+}
+
+func TestDedupConsensusFiles(t *testing.T) {
+
+	// Only run this test if the consensus files are there.
+	for _, fileName := range []string{consensusFile, sharedRandBothFile, sharedRandNeitherFile} {
+		if _, err := os.Stat(fileName); os.IsNotExist(err) {
+			t.Skipf("skipping because of missing %s", fileName)
+		}
+	}
+
+	// A duplicate whose router statuses are broken.  We must not get to
+	// parse them.
+	dir, err := ioutil.TempDir("", "zoossh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	content, err := ioutil.ReadFile(sharedRandNeitherFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	broken := filepath.Join(dir, "broken-consensus")
+	content = bytes.Replace(content, []byte("\nr seele"), []byte("\nr"), 1)
+	if err := ioutil.WriteFile(broken, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ParseConsensusFile(broken); err == nil {
+		t.Fatal("Broken consensus did not raise an error.")
+	}
+
+	consensuses, err := DedupConsensusFiles([]string{sharedRandBothFile, consensusFile, broken, sharedRandNeitherFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(consensuses) != 2 {
+		t.Fatalf("Expected 2 consensuses but got %d.", len(consensuses))
+	}
+
+	// The first file with a given valid-after time wins.
+	if !consensuses[0].HasSharedRandPrevious() {
+		t.Error("Expected the first of the duplicates to be returned.")
+	}
+	if consensuses[1].ValidAfter != time.Date(2014, time.December, 8, 16, 0, 0, 0, time.UTC) {
+		t.Error("Expected the second consensus to be the one from 2014.")
+	}
+
+	if _, err := DedupConsensusFiles([]string{broken}); err == nil {
+		t.Error("Broken consensus did not raise an error.")
+	}
+	if _, err := DedupConsensusFiles([]string{serverDescriptorFile}); err == nil {
+		t.Error("Descriptor file did not raise an error.")
+	}
+}
+
+func TestParseConsensusLazyWithHeader(t *testing.T) {
+
+	// Only run this test if the consensus file is there.
+	if _, err := os.Stat(consensusFile); os.IsNotExist(err) {
+		t.Skipf("skipping because of missing %s", consensusFile)
+	}
+
+	expected, err := ParseConsensusFile(consensusFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, entries, err := ParseConsensusLazyWithHeader(context.Background(), consensusFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.ValidAfter.Equal(expected.ValidAfter) || c.Length() != 0 {
+		t.Error("Header parsed incorrectly.")
+	}
+
+	numEntries := 0
+	for unit := range entries {
+		if unit.Err != nil {
+			t.Fatal(unit.Err)
+		}
+		fingerprint, getStatus, err := ParseRawStatus(unit.Blurb)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status, found := expected.Get(fingerprint); !found || !status.Equals(getStatus()) {
+			t.Errorf("Router status %s in line %d streamed incorrectly.", fingerprint, unit.Line)
+		}
+		numEntries++
+	}
+
+	if numEntries != expected.Length() {
+		t.Errorf("Expected %d router statuses but got %d.", expected.Length(), numEntries)
+	}
+	if !reflect.DeepEqual(c.BandwidthWeights, expected.BandwidthWeights) {
+		t.Error("Footer parsed incorrectly.")
+	}
+
+	if _, _, err := ParseConsensusLazyWithHeader(context.Background(), voteFile); err == nil {
+		t.Error("Vote did not cause an error.")
+	}
+
+	// Callers that reject the header cancel the context instead of draining
+	// the channel, which must not leave goroutines behind.
+	numGoroutines := runtime.NumGoroutine()
+	for i := 0; i < 10; i++ {
+		ctx, cancel := context.WithCancel(context.Background())
+		_, entries, err := ParseConsensusLazyWithHeader(ctx, consensusFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		<-entries
+		cancel()
+		for range entries {
+		}
+	}
+	for i := 0; i < 100 && runtime.NumGoroutine() > numGoroutines; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := runtime.NumGoroutine(); n > numGoroutines {
+		t.Errorf("Expected %d goroutines after cancelling but got %d.", numGoroutines, n)
+	}
+}
+
+func TestParseConsensusHeader(t *testing.T) {
+
+	// Only run this test if the consensus file is there.
+	if _, err := os.Stat(sharedRandConsensusFile); os.IsNotExist(err) {
+		t.Skipf("skipping because of missing %s", sharedRandConsensusFile)
+	}
+
+	raw, err := ioutil.ReadFile(sharedRandConsensusFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected, err := ParseConsensusBytes(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, r, err := ParseConsensusHeader(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.ValidAfter.Equal(expected.ValidAfter) || !reflect.DeepEqual(c.MetaInfo, expected.MetaInfo) {
+		t.Error("Header parsed incorrectly.")
+	}
+	if c.Length() != 0 || c.BandwidthWeights != nil {
+		t.Error("Header parsing went beyond the header.")
+	}
+
+	// The reader must be positioned at the first router status.
+	br := bufio.NewReader(r)
+	if next, err := br.Peek(2); err != nil || string(next) != "r " {
+		t.Fatalf("Reader positioned at %q rather than the first router status.", next)
+	}
+
+	if err := ParseConsensusEntries(br, c); err != nil {
+		t.Fatal(err)
+	}
+	if c.Length() != expected.Length() || !reflect.DeepEqual(c.BandwidthWeights, expected.BandwidthWeights) {
+		t.Error("Router statuses or footer parsed incorrectly.")
+	}
+
+	// Errors in router statuses must point to the same line as when parsing
+	// the consensus in one go.
+	broken := bytes.Replace(raw, []byte("\nw Bandwidth="), []byte("\nw Bandwidth=foo "), 1)
+	_, expectedErr := ParseConsensusBytes(broken)
+	c, r, err = ParseConsensusHeader(bytes.NewReader(broken))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ParseConsensusEntries(r, c)
+	if err == nil || expectedErr == nil || err.Error() != expectedErr.Error() {
+		t.Errorf("Got error %v, expected %v.", err, expectedErr)
+	}
+}
+
+func TestParseConsensusWithSignatures(t *testing.T) {
+
+	// Only run this test if the consensus file is there.
+	if _, err := os.Stat(sharedRandConsensusFile); os.IsNotExist(err) {
+		t.Skipf("skipping because of missing %s", sharedRandConsensusFile)
+	}
+
+	fd, err := os.Open(sharedRandConsensusFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fd.Close()
+
+	consensus, signatures, err := ParseConsensusWithSignatures(fd)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if consensus.Length() == 0 {
+		t.Error("Consensus contains no router statuses.")
+	}
+
+	if len(signatures) != 8 {
+		t.Fatalf("Expected 8 signatures but got %d.", len(signatures))
+	}
+
+	signature := signatures[1]
+	if signature.Algorithm != "sha1" {
+		t.Errorf("Expected algorithm sha1 but got %s.", signature.Algorithm)
+	}
+	if signature.IdentityFingerprint != "14C131DFC5C6F93646BE72FA1401C02A8DF2E8B4" {
+		t.Errorf("Unexpected identity fingerprint %s.", signature.IdentityFingerprint)
+	}
+	if signature.SigningKeyDigest != "6741C7CFA8F46BB46136905BFE2F039DEF600F57" {
+		t.Errorf("Unexpected signing key digest %s.", signature.SigningKeyDigest)
+	}
+	if len(signature.Signature) == 0 {
+		t.Error("Signature block is empty.")
+	}
+}
+
+func TestConsensusFooterBoundary(t *testing.T) {
+
+	header := `@type network-status-consensus-3 1.0
+network-status-version 3
+vote-status consensus
+valid-after 2014-12-08 16:00:00
+fresh-until 2014-12-08 17:00:00
+valid-until 2014-12-08 19:00:00
+dir-source tor26 14C131DFC5C6F93646BE72FA1401C02A8DF2E8B4 86.59.21.38 86.59.21.38 80 443
+`
+	entries := `r seele AAoQ1DAR6kkoo19hBAX5K0QztNw bdrzhG0Kk/8DUsnSdmzj7DjFQjY 2014-12-08 12:27:05 73.15.150.172 9001 0
+s Fast Running Stable Valid
+w Bandwidth=20
+r Karlstad0 m5TNC3uAV+ryG6fwI7ehyMqc5kU f1g9KQhgS0r6+H/7dzAJOpi6lG8 2014-12-08 06:57:54 193.11.166.194 9000 80
+s Fast Guard HSDir Running Stable V2Dir Valid
+w Bandwidth=2670
+`
+	footer := `directory-footer
+bandwidth-weights Wbd=0 Wbe=0 Wbg=4200 Wbm=10000 Wdb=10000 Web=10000 Wed=0 Wee=10000 Weg=0 Wem=10000 Wgb=10000 Wgd=0 Wgg=5800 Wgm=5800 Wmb=10000 Wmd=0 Wme=0 Wmg=4200 Wmm=10000
+directory-signature 14C131DFC5C6F93646BE72FA1401C02A8DF2E8B4 97BF711E3CAA259C6E9E7B6091C5B330417FCFED
+-----BEGIN SIGNATURE-----
+SO7Qup8m5J31vWkJ/ZVPBoNssoUs6zg1/VMCpW6BjhOlgOMhmWntQn+9uI21nB9x
+-----END SIGNATURE-----
+`
+
+	consensus, err := ParseRawConsensus(header+entries+footer, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if consensus.Length() != 2 {
+		t.Errorf("Expected 2 router statuses but got %d.", consensus.Length())
+	}
+	if consensus.BandwidthWeights["Wgg"] != 5800 {
+		t.Error("Footer's bandwidth weights parsed incorrectly.")
+	}
+	status, found := consensus.Get("9B94CD0B7B8057EAF21BA7F023B7A1C8CA9CE645")
+	if !found || status.Bandwidth != 2670 {
+		t.Error("Last router status before the footer parsed incorrectly.")
+	}
+
+	// A consensus without router statuses still has a footer.
+	consensus, err = ParseRawConsensus(header+footer, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if consensus.Length() != 0 {
+		t.Errorf("Expected no router statuses but got %d.", consensus.Length())
+	}
+	if consensus.BandwidthWeights["Wgg"] != 5800 {
+		t.Error("Footer's bandwidth weights parsed incorrectly.")
+	}
+}
+
+func TestUnmeasuredRelays(t *testing.T) {
+
+	// Only run this test if the consensus file is there.
+	if _, err := os.Stat(sharedRandConsensusFile); os.IsNotExist(err) {
+		t.Skipf("skipping because of missing %s", sharedRandConsensusFile)
+	}
+
+	consensus, err := ParseConsensusFile(sharedRandConsensusFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	unmeasured := consensus.UnmeasuredRelays()
+	if len(unmeasured) != 90 {
+		t.Errorf("Expected 90 unmeasured relays but got %d.", len(unmeasured))
+	}
+
+	for i, status := range unmeasured {
+		if !status.Unmeasured || status.IsBandwidthMeasured() {
+			t.Errorf("Relay %s is not unmeasured.", status.Fingerprint)
+		}
+		if i > 0 && unmeasured[i-1].Fingerprint >= status.Fingerprint {
+			t.Error("Unmeasured relays are not ordered by fingerprint.")
+		}
+	}
+}
+
+func TestStatusCache(t *testing.T) {
+
+	// Only run this test if the consensus file is there.
+	if _, err := os.Stat(consensusFile); os.IsNotExist(err) {
+		t.Skipf("skipping because of missing %s", consensusFile)
+	}
+
+	expected, err := ParseConsensusFile(consensusFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	consensus, err := LazilyParseConsensusFileWithCache(consensusFile, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Access more router statuses than fit into the cache, twice, so that
+	// evicted statuses are parsed again.
+	fingerprints := expected.sortedFingerprints()[:10]
+	for round := 0; round < 2; round++ {
+		for _, fingerprint := range fingerprints {
+			status, found := consensus.Get(fingerprint)
+			if !found {
+				t.Fatalf("Router status %s not found.", fingerprint)
+			}
+			expectedStatus, _ := expected.Get(fingerprint)
+			if !reflect.DeepEqual(status, expectedStatus) {
+				t.Errorf("Cached router status %s differs from eagerly parsed one.", fingerprint)
+			}
+		}
+	}
+
+	// The cache itself must not grow beyond its capacity.
+	cache := newStatusCache(2)
+	for _, fingerprint := range fingerprints[:3] {
+		cache.add(fingerprint, &RouterStatus{Fingerprint: fingerprint})
+	}
+	if cache.order.Len() != 2 {
+		t.Errorf("Expected 2 cached router statuses but got %d.", cache.order.Len())
+	}
+	if _, cached := cache.get(fingerprints[0]); cached {
+		t.Error("Least recently used router status was not evicted.")
+	}
+	if status, cached := cache.get(fingerprints[2]); !cached || status.Fingerprint != fingerprints[2] {
+		t.Error("Most recently used router status was evicted.")
+	}
+}
+
+func TestEd25519Collisions(t *testing.T) {
+
+	consensus := NewConsensus()
+	consensus.Set("AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA", &RouterStatus{Ed25519Identity: "zzKU8Hbd5GpIHeYjzcm/CXbhHVxTLKkZM1UdTPaaDSU"})
+	consensus.Set("BBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBB", &RouterStatus{Ed25519Identity: "3Bn/Ix5ZnY2FP3ubXpqeXeCi4OEZeUJ9o5+J/r3l0zE"})
+	consensus.Set("CCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCC", &RouterStatus{Ed25519Identity: "zzKU8Hbd5GpIHeYjzcm/CXbhHVxTLKkZM1UdTPaaDSU"})
+	consensus.Set("DDDDDDDDDDDDDDDDDDDDDDDDDDDDDDDDDDDDDDDD", &RouterStatus{})
+	consensus.Set("EEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEE", &RouterStatus{})
+
+	expected := map[string][]Fingerprint{
+		"zzKU8Hbd5GpIHeYjzcm/CXbhHVxTLKkZM1UdTPaaDSU": {
+			"AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA",
+			"CCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCC",
+		},
+	}
+
+	if collisions := consensus.Ed25519Collisions(); !reflect.DeepEqual(collisions, expected) {
+		t.Errorf("Expected collisions %v but got %v.", expected, collisions)
+	}
+}
+
+func TestRouterStatusEquals(t *testing.T) {
+
+	newStatus := func() *RouterStatus {
+		return &RouterStatus{
+			Nickname:    "seele",
+			Fingerprint: "000A10D43011EA4928A35F610405F92B4433B4DC",
+			Publication: time.Date(2014, time.December, 8, 12, 27, 5, 0, time.UTC),
+			Address:     RouterAddress{IPv4Address: net.ParseIP("73.15.150.172"), IPv4ORPort: 9001},
+			Flags:       RouterFlags{Fast: true, Running: true},
+			Bandwidth:   20,
+		}
+	}
+
+	status := newStatus()
+	other := newStatus()
+	// Different representations of the same address and time.
+	other.Address.IPv4Address = other.Address.IPv4Address.To4()
+	other.Publication = other.Publication.In(time.FixedZone("CET", 3600))
+
+	if !status.Equals(other) || !other.Equals(status) {
+		t.Error("Equal router statuses compared unequal.")
+	}
+
+	other.Flags.Guard = true
+	if status.Equals(other) {
+		t.Error("Router statuses with different flags compared equal.")
+	}
+
+	if status.Equals(NewRouterDescriptor()) {
+		t.Error("Router status compared equal to router descriptor.")
+	}
+}
+
+func TestStatusUnusualNickname(t *testing.T) {
+
+	// Nicknames with odd bytes and "r" lines with irregular spacing must not
+	// shift the fingerprint and the remaining fields.
+	raw := "r  s\xc3\xa9e\x01le_-.  AAoQ1DAR6kkoo19hBAX5K0QztNw\tbdrzhG0Kk/8DUsnSdmzj7DjFQjY 2014-12-08 12:27:05 73.15.150.172 9001 0\n" +
+		"s Fast Running\n\n"
+
+	for _, parse := range []func(string) (Fingerprint, GetStatus, error){ParseRawStatus, LazyParseRawStatus} {
+		fingerprint, getStatus, err := parse(raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fingerprint != "000A10D43011EA4928A35F610405F92B4433B4DC" {
+			t.Errorf("Unexpected fingerprint %s.", fingerprint)
+		}
+
+		status := getStatus()
+		if status.Nickname != "s\xc3\xa9e\x01le_-." {
+			t.Errorf("Unexpected nickname %q.", status.Nickname)
+		}
+		if status.Address.IPv4ORPort != 9001 || !status.Flags.Running {
+			t.Error("Router status with unusual nickname parsed incorrectly.")
+		}
+	}
+}
+
+func TestGetByAddress(t *testing.T) {
+
+	consensus := NewConsensus()
+	consensus.Set("AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA", &RouterStatus{
+		Fingerprint: "AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA",
+		Address:     RouterAddress{IPv4Address: net.ParseIP("1.2.3.4")},
+	})
+	consensus.Set("BBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBB", &RouterStatus{
+		Fingerprint: "BBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBB",
+		Address:     RouterAddress{IPv4Address: net.ParseIP("1.2.3.200"), IPv6Address: net.ParseIP("2001:db8::1")},
+	})
+	consensus.Set("CCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCC", &RouterStatus{
+		Fingerprint: "CCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCC",
+		Address:     RouterAddress{IPv4Address: net.ParseIP("1.2.4.1"), IPv6Address: net.ParseIP("2001:db8::2")},
+	})
+
+	tests := []struct {
+		cidr     string
+		expected []Fingerprint
+	}{
+		{"1.2.3.0/24", []Fingerprint{"AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA", "BBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBB"}},
+		{"1.2.4.1/32", []Fingerprint{"CCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCC"}},
+		{"2001:db8::/64", []Fingerprint{"BBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBB", "CCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCC"}},
+		{"2001:db8::1/128", []Fingerprint{"BBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBB"}},
+		{"5.6.7.0/24", nil},
+	}
+
+	for _, test := range tests {
+		_, ipnet, err := net.ParseCIDR(test.cidr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var fingerprints []Fingerprint
+		for _, status := range consensus.GetByAddress(ipnet) {
+			fingerprints = append(fingerprints, status.Fingerprint)
+		}
+		if !reflect.DeepEqual(fingerprints, test.expected) {
+			t.Errorf("%s resulted in %v, expected %v.", test.cidr, fingerprints, test.expected)
+		}
+	}
+}
+
+func TestParseConsensusFileNoAnnotation(t *testing.T) {
+
+	// Only run this test if the consensus files are there.
+	for _, fileName := range []string{consensusFile, voteFile} {
+		if _, err := os.Stat(fileName); os.IsNotExist(err) {
+			t.Skipf("skipping because of missing %s", fileName)
+		}
+	}
+
+	dir, err := ioutil.TempDir("", "zoossh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Writes the given file without its type annotation to the temporary
+	// directory, applying the given replacement.
+	numStripped := 0
+	stripAnnotation := func(fileName, old, new string) string {
+		numStripped++
+		content, err := ioutil.ReadFile(fileName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		content = content[bytes.IndexByte(content, '\n')+1:]
+		content = bytes.Replace(content, []byte(old), []byte(new), 1)
+		stripped := filepath.Join(dir, fmt.Sprintf("%s-%d", filepath.Base(fileName), numStripped))
+		if err := ioutil.WriteFile(stripped, content, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return stripped
+	}
+
+	expected, err := ParseConsensusFile(consensusFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	consensus, err := ParseConsensusFileNoAnnotation(stripAnnotation(consensusFile, "", ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if consensus.Length() != expected.Length() || !consensus.ValidAfter.Equal(expected.ValidAfter) {
+		t.Error("Consensus without annotation parsed incorrectly.")
+	}
+
+	// Line numbers must refer to the file as it is.
+	_, err = ParseConsensusFileNoAnnotation(stripAnnotation(consensusFile, "valid-after 2014", "valid-after foo"))
+	if parseErr, ok := err.(*ParseError); !ok || parseErr.Line != 4 {
+		t.Errorf("Expected parse error in line 4 but got %v.", err)
+	}
+
+	// Votes, old network statuses, and other documents are rejected.
+	for _, fileName := range []string{
+		stripAnnotation(voteFile, "", ""),
+		stripAnnotation(consensusFile, "network-status-version 3", "network-status-version 2"),
+		stripAnnotation(consensusFile, "network-status-version 3", "foo"),
+	} {
+		if _, err := ParseConsensusFileNoAnnotation(fileName); err == nil {
+			t.Errorf("%s did not cause an error.", fileName)
+		}
+	}
+}
+
+// chunkReader is an io.Reader that returns at most size bytes per read.
+type chunkReader struct {
+	r    io.Reader
+	size int
+}
+
+func (cr *chunkReader) Read(p []byte) (int, error) {
+
+	if len(p) > cr.size {
+		p = p[:cr.size]
+	}
+
+	return cr.r.Read(p)
+}
@@ -0,0 +1,87 @@
+// Provides functions to export parsed documents as CSV.
+
+package zoossh
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// csvColumns maps the column names that WriteConsensusCSV understands to
+// functions that turn the respective router status field into a CSV cell.
+var csvColumns = map[string]func(s *RouterStatus) string{
+	"fingerprint": func(s *RouterStatus) string { return string(s.Fingerprint) },
+	"nickname":    func(s *RouterStatus) string { return s.Nickname },
+	"digest":      func(s *RouterStatus) string { return s.Digest },
+	"published":   func(s *RouterStatus) string { return s.Publication.Format(time.RFC3339) },
+	"address": func(s *RouterStatus) string {
+		if s.Address.IPv4Address == nil {
+			return ""
+		}
+		return s.Address.IPv4Address.String()
+	},
+	"orport":  func(s *RouterStatus) string { return strconv.Itoa(int(s.Address.IPv4ORPort)) },
+	"dirport": func(s *RouterStatus) string { return strconv.Itoa(int(s.Address.IPv4DirPort)) },
+	"ipv6address": func(s *RouterStatus) string {
+		if s.Address.IPv6Address == nil {
+			return ""
+		}
+		return s.Address.IPv6Address.String()
+	},
+	"ipv6orport": func(s *RouterStatus) string { return strconv.Itoa(int(s.Address.IPv6ORPort)) },
+	"flags":      func(s *RouterStatus) string { return strings.Join(s.Flags.names(), " ") },
+	"version":    func(s *RouterStatus) string { return s.TorVersion },
+	"bandwidth":  func(s *RouterStatus) string { return strconv.FormatUint(s.Bandwidth, 10) },
+	"measured":   func(s *RouterStatus) string { return strconv.FormatUint(s.Measured, 10) },
+	"unmeasured": func(s *RouterStatus) string { return strconv.FormatBool(s.Unmeasured) },
+	"accept":     func(s *RouterStatus) string { return strconv.FormatBool(s.Accept) },
+	"portlist":   func(s *RouterStatus) string { return s.PortList },
+	"ed25519":    func(s *RouterStatus) string { return s.Ed25519Identity },
+}
+
+// WriteConsensusCSV writes the router statuses of the given consensus to w in
+// CSV format.  The first row is a header containing the given column names,
+// followed by one row per router status, ordered by fingerprint.  The columns
+// appear in the given order.  Valid column names are "fingerprint",
+// "nickname", "digest", "published", "address", "orport", "dirport",
+// "ipv6address", "ipv6orport", "flags", "version", "bandwidth", "measured",
+// "unmeasured", "accept", "portlist", and "ed25519".  Flags are written as a
+// space-separated list in a single cell.  If a column name is unknown, an
+// error is returned before anything is written.
+func WriteConsensusCSV(w io.Writer, c *Consensus, columns []string) error {
+
+	formatters := make([]func(s *RouterStatus) string, len(columns))
+	for i, column := range columns {
+		formatter, ok := csvColumns[column]
+		if !ok {
+			return fmt.Errorf("unknown CSV column %q", column)
+		}
+		formatters[i] = formatter
+	}
+
+	writer := csv.NewWriter(w)
+	if err := writer.Write(columns); err != nil {
+		return err
+	}
+
+	row := make([]string, len(columns))
+	for _, fpr := range c.sortedFingerprints() {
+		status := c.RouterStatuses[fpr]()
+		if status == nil {
+			continue
+		}
+		for i, formatter := range formatters {
+			row[i] = formatter(status)
+		}
+		if err := writer.Write(row); err != nil {
+			return err
+		}
+	}
+
+	writer.Flush()
+	return writer.Error()
+}
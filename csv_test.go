@@ -0,0 +1,50 @@
+// Tests functions from "csv.go".
+
+package zoossh
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+func TestWriteConsensusCSV(t *testing.T) {
+
+	consensus := NewConsensus()
+	consensus.Set("9695DFC35FFEB861329B9F1AB04C46397020CE31", &RouterStatus{
+		Nickname:    "moria1",
+		Fingerprint: "9695DFC35FFEB861329B9F1AB04C46397020CE31",
+		Address:     RouterAddress{IPv4Address: net.ParseIP("128.31.0.34"), IPv4ORPort: 9101},
+		Flags:       RouterFlags{Authority: true, Running: true, Valid: true},
+		Bandwidth:   20,
+	})
+	consensus.Set("000A10D43011EA4928A35F610405F92B4433B4DC", &RouterStatus{
+		Nickname:    "seele",
+		Fingerprint: "000A10D43011EA4928A35F610405F92B4433B4DC",
+		Address:     RouterAddress{IPv4Address: net.ParseIP("73.15.150.172"), IPv4ORPort: 9001},
+		Flags:       RouterFlags{Running: true},
+		Bandwidth:   1000,
+	})
+
+	var buf bytes.Buffer
+	err := WriteConsensusCSV(&buf, consensus, []string{"nickname", "fingerprint", "address", "orport", "bandwidth", "flags"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "nickname,fingerprint,address,orport,bandwidth,flags\n" +
+		"seele,000A10D43011EA4928A35F610405F92B4433B4DC,73.15.150.172,9001,1000,Running\n" +
+		"moria1,9695DFC35FFEB861329B9F1AB04C46397020CE31,128.31.0.34,9101,20,Authority Running Valid\n"
+	if buf.String() != expected {
+		t.Errorf("Unexpected CSV output:\n%s", buf.String())
+	}
+
+	// An unknown column must not result in partial output.
+	buf.Reset()
+	if err := WriteConsensusCSV(&buf, consensus, []string{"nickname", "foo"}); err == nil {
+		t.Error("Unknown column did not raise an error.")
+	}
+	if buf.Len() != 0 {
+		t.Error("Output was written despite unknown column.")
+	}
+}
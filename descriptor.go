@@ -3,9 +3,22 @@
 package zoossh
 
 import (
+	"archive/tar"
+	"bufio"
 	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
 	"fmt"
 	"io"
+	"math"
 	"net"
 	"os"
 	"strconv"
@@ -31,9 +44,209 @@ type ExitPattern struct {
 	PortSpec    string
 }
 
+// PortRange is an inclusive range of ports, e.g., "1-1024".  A single port
+// is represented by a range whose bounds are equal.
+type PortRange struct {
+	Low  uint16
+	High uint16
+}
+
+// exitRule is a compiled "accept" or "reject" line of an exit policy.  A nil
+// network matches all IPv4 addresses.
+type exitRule struct {
+	accept  bool
+	network *net.IPNet
+	ports   PortRange
+}
+
+// parseExitRule compiles the exit pattern of an "accept" or "reject" line,
+// e.g., "*:80", "1.2.3.0/24:1-1024", "1.2.3.4/255.255.255.0:*", or
+// "[2001:db8::]/32:443".
+func parseExitRule(accept bool, pattern string) (exitRule, error) {
+
+	rule := exitRule{accept: accept, ports: PortRange{1, 65535}}
+
+	i := strings.LastIndexByte(pattern, ':')
+	if i < 0 {
+		return rule, fmt.Errorf("missing port in exit pattern %q", pattern)
+	}
+	addrSpec, portSpec := pattern[:i], pattern[i+1:]
+
+	if portSpec != "*" {
+		ports, err := parsePortRange(portSpec)
+		if err != nil {
+			return rule, err
+		}
+		// Like Tor, we treat port 0 as port 1, so a rule for port 0 alone
+		// ends up with an empty range and matches no port.
+		if ports.Low == 0 {
+			ports.Low = 1
+		}
+		rule.ports = ports
+	}
+
+	switch addrSpec {
+	case "*", "*4":
+		return rule, nil
+	case "*6":
+		_, rule.network, _ = net.ParseCIDR("::/0")
+		return rule, nil
+	}
+
+	addr, mask := addrSpec, ""
+	if j := strings.IndexByte(addrSpec, '/'); j >= 0 {
+		addr, mask = addrSpec[:j], addrSpec[j+1:]
+	}
+
+	// IPv6 addresses are enclosed in brackets and can only be followed by
+	// the number of mask bits.
+	if strings.HasPrefix(addr, "[") && strings.HasSuffix(addr, "]") {
+		if mask == "" {
+			mask = "128"
+		}
+		_, network, err := net.ParseCIDR(addr[1:len(addr)-1] + "/" + mask)
+		if err != nil {
+			return rule, fmt.Errorf("invalid IPv6 address in exit pattern %q", pattern)
+		}
+		rule.network = network
+		return rule, nil
+	}
+
+	ip := net.ParseIP(addr).To4()
+	if ip == nil {
+		return rule, fmt.Errorf("invalid IPv4 address in exit pattern %q", pattern)
+	}
+
+	rule.network = &net.IPNet{IP: ip, Mask: net.CIDRMask(32, 32)}
+	if bits, err := strconv.Atoi(mask); err == nil && bits >= 0 && bits <= 32 {
+		rule.network.Mask = net.CIDRMask(bits, 32)
+	} else if maskIP := net.ParseIP(mask).To4(); maskIP != nil {
+		rule.network.Mask = net.IPMask(maskIP)
+	} else if mask != "" {
+		return rule, fmt.Errorf("invalid mask in exit pattern %q", pattern)
+	}
+	rule.network.IP = ip.Mask(rule.network.Mask)
+
+	return rule, nil
+}
+
+// matches returns true if the rule applies to the given IPv4 address and port.
+// Rules for IPv6 networks never match.
+func (rule exitRule) matches(ip net.IP, port uint16) bool {
+
+	return port >= rule.ports.Low && port <= rule.ports.High &&
+		(rule.network == nil || rule.network.Contains(ip))
+}
+
+// ExitPolicySummary is a summarised exit policy as defined in dirspec.txt,
+// Section 2.1.1, e.g., "accept 80,443" or "reject 1-65535".  A relay accepts
+// connections to the listed ports and rejects all others if Accept is true,
+// and the other way round if it is false.
+type ExitPolicySummary struct {
+	Accept bool
+	Ports  []PortRange
+}
+
+// parseExitPolicySummary parses the words of a summarised exit policy, i.e.,
+// "accept" or "reject" followed by a comma-separated list of ports and port
+// ranges.
+func parseExitPolicySummary(words []string) (*ExitPolicySummary, error) {
+
+	if len(words) != 2 {
+		return nil, fmt.Errorf("expected 2 fields but got %d", len(words))
+	}
+
+	summary := new(ExitPolicySummary)
+	switch words[0] {
+	case "accept":
+		summary.Accept = true
+	case "reject":
+		summary.Accept = false
+	default:
+		return nil, fmt.Errorf("expected \"accept\" or \"reject\" but got %q", words[0])
+	}
+
+	for _, entry := range strings.Split(words[1], ",") {
+		ports, err := parsePortRange(entry)
+		if err != nil {
+			return nil, err
+		}
+		summary.Ports = append(summary.Ports, ports)
+	}
+
+	return summary, nil
+}
+
+// parsePortRange parses a single port, e.g., "80", or a range of ports, e.g.,
+// "1-1024".
+func parsePortRange(s string) (PortRange, error) {
+
+	bounds := strings.SplitN(s, "-", 2)
+	low, err := strconv.ParseUint(bounds[0], 10, 16)
+	if err != nil {
+		return PortRange{}, err
+	}
+	high := low
+	if len(bounds) == 2 {
+		if high, err = strconv.ParseUint(bounds[1], 10, 16); err != nil {
+			return PortRange{}, err
+		}
+	}
+	if low > high {
+		return PortRange{}, fmt.Errorf("invalid port range %q", s)
+	}
+
+	return PortRange{uint16(low), uint16(high)}, nil
+}
+
+// AllowsPort returns true if the summarised exit policy allows connections to
+// the given port.
+func (summary *ExitPolicySummary) AllowsPort(port uint16) bool {
+
+	for _, portRange := range summary.Ports {
+		if port >= portRange.Low && port <= portRange.High {
+			return summary.Accept
+		}
+	}
+
+	return !summary.Accept
+}
+
+// Equals checks whether the two given summarised exit policies are equal.
+// Either of them may be nil.
+func (summary *ExitPolicySummary) Equals(other *ExitPolicySummary) bool {
+
+	if summary == nil || other == nil {
+		return summary == other
+	}
+	if summary.Accept != other.Accept || len(summary.Ports) != len(other.Ports) {
+		return false
+	}
+	for i := range summary.Ports {
+		if summary.Ports[i] != other.Ports[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// ORAddress is an additional address and port on which a relay accepts OR
+// connections, as advertised in an "or-address" line.
+type ORAddress struct {
+	Address net.IP
+	Port    uint16
+}
+
 // An (incomplete) router descriptor as defined in dirspec.txt, Section 2.1.1.
 type RouterDescriptor struct {
 
+	// The hex-encoded SHA-1 digest of the descriptor, from the "router" line
+	// up to and including the "router-signature" line.  Consensus entries
+	// reference descriptors by this digest.  It is empty if the descriptor
+	// lacks a "router-signature" line.
+	Digest string
+
 	// The single fields of a "router" line.
 	Nickname  string
 	Address   net.IP
@@ -41,19 +254,33 @@ type RouterDescriptor struct {
 	SOCKSPort uint16
 	DirPort   uint16
 
-	// The single fields of a "bandwidth" line.  All bandwidth values are in
-	// bytes per second.
+	// The single fields of a "bandwidth" line, i.e., the average, burst, and
+	// observed bandwidth.  All bandwidth values are in bytes per second, and
+	// values missing from the line are zero.
 	BandwidthAvg   uint64
 	BandwidthBurst uint64
 	BandwidthObs   uint64
 
-	// The single fields of a "platform" line.
+	// The single fields of a "platform" line.  They hold the same values as
+	// PlatformOS and PlatformTorVersion.
 	OperatingSystem string
 	TorVersion      string
 
+	// The value of the "platform" line, e.g., "Tor 0.4.7.13 on Linux", and
+	// the Tor version and operating system that it names, e.g., "0.4.7.13"
+	// and "Linux".  Either of the latter two is empty if the line doesn't
+	// follow the usual format.  See parsePlatform.
+	Platform           string
+	PlatformTorVersion string
+	PlatformOS         string
+
 	// The single fields of a "published" line.
 	Published time.Time
 
+	// The addresses of all "or-address" lines, in the order in which they
+	// appear.  The slice is nil if there are no such lines.
+	ORAddresses []ORAddress
+
 	// The single fields of an "uptime" line.
 	Uptime uint64
 
@@ -69,19 +296,94 @@ type RouterDescriptor struct {
 	// The single fields of a "contact" line.
 	Contact string
 
-	// The "hidden-service-dir" line.
+	// The "hidden-service-dir" line and the descriptor versions it lists.  If
+	// the line lists no versions, version 2 is implied.
 	HiddenServiceDir bool
-
+	HSDirVersions    []int
+
+	// Set if there is a "tunnelled-dir-server" line, i.e., the relay serves
+	// directory information over its ORPort.
+	TunnelledDirServer bool
+
+	// Set if there is a "caches-extra-info" line, i.e., the relay serves
+	// extra-info documents.
+	CachesExtraInfo bool
+
+	// The timestamp of an "overload-general" line, i.e., when the relay was
+	// last overloaded.  It is nil for descriptors lacking the line.
+	OverloadGeneral *time.Time
+
+	// The single field of a "bridge-distribution-request" line, which only
+	// bridges publish.
+	DistributionRequest string
+
+	// The subprotocol versions of a "proto" line, e.g., "Link" mapped to
+	// versions 1 to 4.  The map is nil for descriptors that predate the line.
+	Protocols map[string][]uint32
+
+	// The base64-encoded ed25519 master identity key of the
+	// "master-key-ed25519" line, as found in the descriptor, i.e., without
+	// padding.  It is empty for descriptors that predate the line.
+	MasterKeyEd25519 string
+
+	// The decoded certificate of the "identity-ed25519" block, in which the
+	// relay's master key certifies its signing key.  It is nil if the
+	// descriptor lacks the block.  See IdentityEd25519Cert.
+	IdentityEd25519 []byte
+
+	// The PEM-encoded keys of the "onion-key" and "signing-key" lines,
+	// including their "-----BEGIN" and "-----END" lines, and the base64-encoded
+	// key of the "ntor-onion-key" line, as found in the descriptor.  The ntor
+	// key is empty for descriptors that predate it.
 	OnionKey     string
 	NTorOnionKey string
 	SigningKey   string
 
+	// The PEM-encoded cross-certificate of the "onion-key-crosscert" line,
+	// including its "-----BEGIN CROSSCERT-----" and "-----END CROSSCERT-----"
+	// lines, i.e., the onion key's signature over the relay's identities.
+	OnionKeyCrossCert string
+
+	// The decoded signature of the "router-signature" line, made with the
+	// signing key over the descriptor's digest.  See VerifySelfSignature.
+	RouterSignature []byte
+
+	// The base64-encoded signature of the "router-sig-ed25519" line, as found
+	// in the descriptor, made with the signing key that the "identity-ed25519"
+	// certificate certifies.  See VerifyEd25519Signature.
+	RouterSigEd25519 string
+
+	// The SHA-256 digest that the "router-sig-ed25519" signature was made
+	// over.  It is nil if the descriptor lacks the line.
+	ed25519Digest []byte
+
 	RawAccept     string
 	RawReject     string
 	RawExitPolicy string
 
 	Accept []*ExitPattern
 	Reject []*ExitPattern
+
+	// The "accept" and "reject" lines, compiled when the descriptor is parsed
+	// so that AllowsExitTo doesn't have to parse them again on every call.
+	exitRules []exitRule
+
+	// The summarised IPv6 exit policy of an "ipv6-policy" line.  It is nil if
+	// the line is missing, in which case the relay doesn't exit to IPv6
+	// addresses at all.  See AllowsV6.
+	ExitPolicyV6 *ExitPolicySummary
+
+	// The keyword lines that the parser does not understand, in the order in
+	// which they appear.  The lines of "-----BEGIN" ... "-----END" blocks are
+	// not included.  The slice is nil if all lines were understood.
+	Unrecognized []string
+}
+
+// ServesDirectory returns true if the relay is a directory cache, i.e., it
+// either has a DirPort or serves directory information over its ORPort.
+func (rd *RouterDescriptor) ServesDirectory() bool {
+
+	return rd.DirPort != 0 || rd.TunnelledDirServer
 }
 
 type RouterDescriptors struct {
@@ -115,6 +417,408 @@ func (rd *RouterDescriptor) GetFingerprint() Fingerprint {
 	return rd.Fingerprint
 }
 
+// Equals implements the Object interface.  It returns true if the given object
+// is a router descriptor whose fields are equal to the fields of this router
+// descriptor.  IP addresses and times are compared by value, regardless of
+// their representation.
+func (rd *RouterDescriptor) Equals(other Object) bool {
+
+	o, ok := other.(*RouterDescriptor)
+	if !ok || rd == nil || o == nil {
+		return ok && rd == o
+	}
+
+	if len(rd.Family) != len(o.Family) {
+		return false
+	}
+	for fingerprint := range rd.Family {
+		if !o.Family[fingerprint] {
+			return false
+		}
+	}
+
+	return rd.Digest == o.Digest &&
+		rd.Nickname == o.Nickname &&
+		rd.Address.Equal(o.Address) &&
+		rd.ORPort == o.ORPort &&
+		rd.SOCKSPort == o.SOCKSPort &&
+		rd.DirPort == o.DirPort &&
+		rd.BandwidthAvg == o.BandwidthAvg &&
+		rd.BandwidthBurst == o.BandwidthBurst &&
+		rd.BandwidthObs == o.BandwidthObs &&
+		rd.OperatingSystem == o.OperatingSystem &&
+		rd.TorVersion == o.TorVersion &&
+		rd.Platform == o.Platform &&
+		rd.PlatformTorVersion == o.PlatformTorVersion &&
+		rd.PlatformOS == o.PlatformOS &&
+		rd.Published.Equal(o.Published) &&
+		orAddressesEqual(rd.ORAddresses, o.ORAddresses) &&
+		rd.Uptime == o.Uptime &&
+		rd.Fingerprint == o.Fingerprint &&
+		rd.Hibernating == o.Hibernating &&
+		rd.Contact == o.Contact &&
+		rd.HiddenServiceDir == o.HiddenServiceDir &&
+		intsEqual(rd.HSDirVersions, o.HSDirVersions) &&
+		rd.TunnelledDirServer == o.TunnelledDirServer &&
+		rd.CachesExtraInfo == o.CachesExtraInfo &&
+		timePtrsEqual(rd.OverloadGeneral, o.OverloadGeneral) &&
+		rd.DistributionRequest == o.DistributionRequest &&
+		protocolsEqual(rd.Protocols, o.Protocols) &&
+		rd.OnionKey == o.OnionKey &&
+		rd.NTorOnionKey == o.NTorOnionKey &&
+		rd.MasterKeyEd25519 == o.MasterKeyEd25519 &&
+		bytes.Equal(rd.IdentityEd25519, o.IdentityEd25519) &&
+		rd.SigningKey == o.SigningKey &&
+		rd.OnionKeyCrossCert == o.OnionKeyCrossCert &&
+		bytes.Equal(rd.RouterSignature, o.RouterSignature) &&
+		rd.RouterSigEd25519 == o.RouterSigEd25519 &&
+		rd.RawAccept == o.RawAccept &&
+		rd.RawReject == o.RawReject &&
+		rd.RawExitPolicy == o.RawExitPolicy &&
+		exitPatternsEqual(rd.Accept, o.Accept) &&
+		exitPatternsEqual(rd.Reject, o.Reject) &&
+		rd.ExitPolicyV6.Equals(o.ExitPolicyV6) &&
+		stringsEqual(rd.Unrecognized, o.Unrecognized)
+}
+
+// timePtrsEqual checks whether the two given times are either both nil or
+// both represent the same instant.
+func timePtrsEqual(a, b *time.Time) bool {
+
+	if a == nil || b == nil {
+		return a == b
+	}
+
+	return a.Equal(*b)
+}
+
+// intsEqual checks whether the two given slices hold the same integers in the
+// same order.
+func intsEqual(a, b []int) bool {
+
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// protocolsEqual checks whether the two given subprotocol maps hold the same
+// versions for the same subprotocols.
+func protocolsEqual(a, b map[string][]uint32) bool {
+
+	if len(a) != len(b) {
+		return false
+	}
+	for name, versions := range a {
+		other, ok := b[name]
+		if !ok || len(versions) != len(other) {
+			return false
+		}
+		for i := range versions {
+			if versions[i] != other[i] {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// orAddressesEqual checks whether the two given slices hold the same OR
+// addresses in the same order.  IP addresses are compared by value.
+func orAddressesEqual(a, b []ORAddress) bool {
+
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !a[i].Address.Equal(b[i].Address) || a[i].Port != b[i].Port {
+			return false
+		}
+	}
+
+	return true
+}
+
+// stringsEqual checks whether the two given slices hold the same strings in
+// the same order.
+func stringsEqual(a, b []string) bool {
+
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// exitPatternsEqual checks whether the two given slices hold equal exit
+// patterns in the same order.
+func exitPatternsEqual(a, b []*ExitPattern) bool {
+
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if *a[i] != *b[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// AllowsV6 returns true if the relay's IPv6 exit policy allows connections to
+// the given IPv6 address and port.  Relays without an "ipv6-policy" line
+// reject all IPv6 traffic, as does Tor by default.  The summarised policy
+// doesn't distinguish between addresses, so only the port matters, as long
+// as the given address is an IPv6 address.
+func (rd *RouterDescriptor) AllowsV6(ip net.IP, port uint16) bool {
+
+	if rd.ExitPolicyV6 == nil || ip == nil || ip.To4() != nil || ip.To16() == nil {
+		return false
+	}
+
+	return rd.ExitPolicyV6.AllowsPort(port)
+}
+
+// AllowsExitTo returns true if the relay's exit policy allows connections to
+// the given address and port.  IPv4 addresses are checked against the
+// "accept" and "reject" lines, the first matching line winning, and addresses
+// that no line matches are allowed.  IPv6 addresses are checked against the
+// "ipv6-policy" line, see AllowsV6.
+func (rd *RouterDescriptor) AllowsExitTo(ip net.IP, port uint16) bool {
+
+	ip4 := ip.To4()
+	if ip4 == nil {
+		return rd.AllowsV6(ip, port)
+	}
+
+	for _, rule := range rd.exitRules {
+		if rule.matches(ip4, port) {
+			return rule.accept
+		}
+	}
+
+	return true
+}
+
+// The private IPv4 networks whose rejection Tor ignores when summarising an
+// exit policy, see policy_summarize in Tor's policies.c.
+var privateExitNetworks = []string{
+	"0.0.0.0/8", "169.254.0.0/16", "127.0.0.0/8", "192.168.0.0/16", "10.0.0.0/8", "172.16.0.0/12",
+}
+
+// Tor considers ports whose rejected addresses add up to more than this value
+// rejected, and caps summaries at this length.
+const (
+	policySummaryRejectCutoff = 1 << 25
+	policySummaryMaxLen       = 1000
+)
+
+// policySummaryItem is a range of ports, the number of IPv4 addresses that
+// are rejected for these ports, and whether the ports count as accepted.
+type policySummaryItem struct {
+	ports       PortRange
+	rejectCount uint64
+	accepted    bool
+}
+
+// PolicySummary summarises the descriptor's IPv4 exit policy in the format of
+// a consensus' "p" line, e.g., "accept 80,443" or "reject 25,119".  It
+// implements Tor's algorithm, see policy_summarize in Tor's policies.c: A port
+// counts as accepted if an "accept *:port" line allows it before lines that
+// reject more than 2^25 non-private addresses for the port.  Of the accepted
+// and the rejected ports, the shorter list wins.  If both lists are longer
+// than Tor's limit of 1000 characters, the accepted ports are cut off at the
+// last port that fits.
+func (rd *RouterDescriptor) PolicySummary() string {
+
+	summary := []policySummaryItem{{ports: PortRange{1, 65535}}}
+
+	// split makes sure that the given port range starts and ends at item
+	// boundaries and returns the index of the range's first item.
+	split := func(ports PortRange) int {
+		i := 0
+		for summary[i].ports.High < ports.Low {
+			i++
+		}
+		if summary[i].ports.Low != ports.Low {
+			item := summary[i]
+			item.ports.Low = ports.Low
+			summary[i].ports.High = ports.Low - 1
+			summary = append(summary[:i+1], append([]policySummaryItem{item}, summary[i+1:]...)...)
+			i++
+		}
+		start := i
+		for summary[i].ports.High < ports.High {
+			i++
+		}
+		if summary[i].ports.High != ports.High {
+			item := summary[i]
+			item.ports.Low = ports.High + 1
+			summary[i].ports.High = ports.High
+			summary = append(summary[:i+1], append([]policySummaryItem{item}, summary[i+1:]...)...)
+		}
+		return start
+	}
+
+	for _, rule := range rd.exitRules {
+		if rule.network != nil && rule.network.IP.To4() == nil || rule.ports.High < rule.ports.Low {
+			continue
+		}
+		maskBits := 0
+		if rule.network != nil {
+			maskBits, _ = rule.network.Mask.Size()
+		}
+
+		if rule.accept {
+			// Only lines that accept all addresses count.
+			if maskBits != 0 {
+				continue
+			}
+			for i := split(rule.ports); i < len(summary) && summary[i].ports.High <= rule.ports.High; i++ {
+				if !summary[i].accepted && summary[i].rejectCount <= policySummaryRejectCutoff {
+					summary[i].accepted = true
+				}
+			}
+		} else {
+			if rule.network != nil && isPrivateExitNetwork(rule.network) {
+				continue
+			}
+			for i := split(rule.ports); i < len(summary) && summary[i].ports.High <= rule.ports.High; i++ {
+				summary[i].rejectCount += 1 << uint(32-maskBits)
+			}
+		}
+	}
+
+	// Merge adjacent items that are both accepted or both rejected.
+	var accepts, rejects []string
+	start := summary[0].ports.Low
+	for i, item := range summary {
+		last := i == len(summary)-1
+		if !last && item.accepted == summary[i+1].accepted {
+			continue
+		}
+		entry := fmt.Sprintf("%d-%d", start, item.ports.High)
+		if start == item.ports.High {
+			entry = fmt.Sprintf("%d", start)
+		}
+		if item.accepted {
+			accepts = append(accepts, entry)
+		} else {
+			rejects = append(rejects, entry)
+		}
+		if !last {
+			start = summary[i+1].ports.Low
+		}
+	}
+
+	if len(accepts) == 0 {
+		return "reject 1-65535"
+	} else if len(rejects) == 0 {
+		return "accept 1-65535"
+	}
+
+	acceptStr, rejectStr := strings.Join(accepts, ","), strings.Join(rejects, ",")
+	maxLen := policySummaryMaxLen - len("accept ")
+	switch {
+	case len(acceptStr) > maxLen && len(rejectStr) > maxLen:
+		return "accept " + acceptStr[:strings.LastIndexByte(acceptStr[:maxLen+1], ',')]
+	case len(rejectStr) < len(acceptStr):
+		return "reject " + rejectStr
+	default:
+		return "accept " + acceptStr
+	}
+}
+
+// isPrivateExitNetwork returns true if the given network is exactly one of
+// privateExitNetworks.
+func isPrivateExitNetwork(network *net.IPNet) bool {
+
+	for _, private := range privateExitNetworks {
+		_, privateNet, _ := net.ParseCIDR(private)
+		if network.IP.Equal(privateNet.IP) && bytes.Equal(network.Mask, privateNet.Mask) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// The ports that IsExit checks.  Tor's Exit flag similarly requires relays to
+// allow exiting to ports 80 and 443.
+var commonExitPorts = []uint16{80, 443}
+
+// IsExit returns true if the descriptor's IPv4 exit policy, as summarised by
+// PolicySummary, allows exiting to any of the common ports 80 and 443.
+func (rd *RouterDescriptor) IsExit() bool {
+
+	summary, err := parseExitPolicySummary(strings.Fields(rd.PolicySummary()))
+	if err != nil {
+		return false
+	}
+
+	for _, port := range commonExitPorts {
+		if summary.AllowsPort(port) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// PartitionExits splits the router descriptors in the given set into exit
+// relays and non-exit relays.  A descriptor is an exit relay if the given
+// function returns true for it.  If the function is nil, IsExit is used.  The
+// two returned sets are new sets, and the given set is left untouched.
+func PartitionExits(descriptors ObjectSet, isExit func(*RouterDescriptor) bool) (exits, nonExits ObjectSet) {
+
+	if isExit == nil {
+		isExit = (*RouterDescriptor).IsExit
+	}
+
+	exitDescs, nonExitDescs := NewRouterDescriptors(), NewRouterDescriptors()
+	for obj := range descriptors.Iterate(nil) {
+		desc, ok := obj.(*RouterDescriptor)
+		if !ok || desc == nil {
+			continue
+		}
+		if isExit(desc) {
+			exitDescs.Set(desc.Fingerprint, desc)
+		} else {
+			nonExitDescs.Set(desc.Fingerprint, desc)
+		}
+	}
+
+	return exitDescs, nonExitDescs
+}
+
+// StartTime returns the time at which the relay was started, i.e., the
+// descriptor's publication time minus its uptime in seconds.  Descriptors
+// without an "uptime" line or with an uptime of zero don't tell us when the
+// relay was started, in which case the publication time and false are
+// returned.
+func (rd *RouterDescriptor) StartTime() (time.Time, bool) {
+
+	// Uptimes that don't fit into a time.Duration are bogus anyway.
+	if rd.Uptime == 0 || rd.Uptime > uint64(math.MaxInt64/int64(time.Second)) {
+		return rd.Published, false
+	}
+
+	return rd.Published.Add(-time.Duration(rd.Uptime) * time.Second), true
+}
+
 // HasFamily returns true if the given relay identified by its fingerprint is
 // part of this relay's family.
 func (rd *RouterDescriptor) HasFamily(fingerprint Fingerprint) bool {
@@ -226,11 +930,30 @@ func (rds *RouterDescriptors) Set(fingerprint Fingerprint, descriptor *RouterDes
 // delayed until the router descriptor is accessed.
 func LazyParseRawDescriptor(rawDescriptor string) (Fingerprint, GetDescriptor, error) {
 
+	return LazyParseRawDescriptorWithOptions(rawDescriptor)
+}
+
+// LazyParseRawDescriptorWithOptions works like LazyParseRawDescriptor but
+// applies the given options.
+func LazyParseRawDescriptorWithOptions(rawDescriptor string, opts ...ParseOption) (Fingerprint, GetDescriptor, error) {
+
+	return lazyParseRawDescriptor(rawDescriptor, newParseOptions(opts))
+}
+
+// lazyParseRawDescriptor implements LazyParseRawDescriptor.  The given settings
+// are used once the descriptor is accessed.
+func lazyParseRawDescriptor(rawDescriptor string, options *parseOptions) (Fingerprint, GetDescriptor, error) {
+
 	var fingerprint Fingerprint
 
 	// Delay parsing of the router descriptor until this function is executed.
+	// Malformed router descriptors result in nil.
 	getDescriptor := func() *RouterDescriptor {
-		_, f, _ := ParseRawDescriptor(rawDescriptor)
+		_, f, err := parseRawDescriptor(rawDescriptor, false, options)
+		if err != nil {
+			logParse(LogWarn, "dropping malformed router descriptor: %s", err)
+			return nil
+		}
 		return f()
 	}
 
@@ -254,16 +977,88 @@ func LazyParseRawDescriptor(rawDescriptor string) (Fingerprint, GetDescriptor, e
 // ParseRawDescriptor parses a raw router descriptor (in string format) and
 // returns the descriptor's fingerprint, a function returning the descriptor,
 // and an error if the descriptor could not be parsed.  In contrast to
-// LazyParseRawDescriptor, parsing is *not* delayed.
+// LazyParseRawDescriptor, parsing is *not* delayed.  Malformed lines result in
+// a *ParseError whose line number is relative to the given string.
 func ParseRawDescriptor(rawDescriptor string) (Fingerprint, GetDescriptor, error) {
 
+	return ParseRawDescriptorWithOptions(rawDescriptor)
+}
+
+// ParseRawDescriptorWithOptions works like ParseRawDescriptor but applies the
+// given options.
+func ParseRawDescriptorWithOptions(rawDescriptor string, opts ...ParseOption) (Fingerprint, GetDescriptor, error) {
+
+	return parseRawDescriptor(rawDescriptor, false, newParseOptions(opts))
+}
+
+// parseRawDescriptorFull parses a raw router descriptor with the given
+// settings, like ParseRawDescriptor.
+func parseRawDescriptorFull(rawDescriptor string, options *parseOptions) (Fingerprint, GetDescriptor, error) {
+
+	return parseRawDescriptor(rawDescriptor, false, options)
+}
+
+// parseRawDescriptorMeta works like parseRawDescriptorFull but skips the
+// descriptor's cryptographic blocks and does not compute its digest.
+func parseRawDescriptorMeta(rawDescriptor string, options *parseOptions) (Fingerprint, GetDescriptor, error) {
+
+	return parseRawDescriptor(rawDescriptor, true, options)
+}
+
+// parseRawDescriptor implements ParseRawDescriptor using the given settings.
+// If metaOnly is set, the lines of "-----BEGIN" ... "-----END" blocks, i.e.,
+// keys, certificates, and signatures, are skipped without being looked at, and
+// the descriptor's Digest is left empty.
+func parseRawDescriptor(rawDescriptor string, metaOnly bool, options *parseOptions) (Fingerprint, GetDescriptor, error) {
+
 	var descriptor = NewRouterDescriptor()
+	strict := options.strict
+
+	// Digests are computed over LF line endings, which is also what files
+	// with CRLF line endings are turned into when they are read.
+	if strings.Contains(rawDescriptor, "\r\n") {
+		rawDescriptor = strings.Replace(rawDescriptor, "\r\n", "\n", -1)
+	}
+	if !metaOnly {
+		descriptor.Digest = descriptorDigest(rawDescriptor)
+		descriptor.ed25519Digest = descriptorEd25519Digest(rawDescriptor)
+	}
 
 	lines := strings.Split(rawDescriptor, "\n")
+	inBlock := false
+
+	// The position of the "master-key-ed25519" line, so that strict mode can
+	// report a master key that doesn't match the identity certificate.
+	var masterKeyLine int
+
+	// The keyword of the most recent line outside a block, which tells us
+	// what the following block holds, and the lines of the current block.
+	var keyword string
+	var block []string
 
 	// Go over raw descriptor line by line and extract the fields we are
 	// interested in.
-	for _, line := range lines {
+	for i, line := range lines {
+
+		// Tolerate raw descriptors with CRLF line endings, so that bare
+		// keyword lines such as "tunnelled-dir-server" are recognised.
+		line = strings.TrimSuffix(line, "\r")
+
+		isBlockLine := inBlock || strings.HasPrefix(line, "-----BEGIN")
+		inBlock = isBlockLine && !strings.HasPrefix(line, "-----END")
+		if isBlockLine {
+			if metaOnly {
+				continue
+			}
+			block = append(block, line)
+			if !inBlock {
+				if err := descriptor.setObject(keyword, block); err != nil {
+					return "", nil, newParseError(i+1, line, keyword, err)
+				}
+				block = nil
+			}
+			continue
+		}
 
 		words := strings.Split(line, " ")
 
@@ -271,10 +1066,28 @@ func ParseRawDescriptor(rawDescriptor string) (Fingerprint, GetDescriptor, error
 		if words[0] == "opt" {
 			words = words[1:]
 		}
+		keyword = words[0]
+
+		// Wraps the given error in a ParseError for the current line.
+		fail := func(err error) (Fingerprint, GetDescriptor, error) {
+			return "", nil, newParseError(i+1, line, words[0], err)
+		}
+
+		// Returns an error if the current line has fewer than the given number
+		// of fields, including the keyword.
+		checkFields := func(num int) error {
+			if len(words) < num {
+				return fmt.Errorf("expected %d fields but got %d", num, len(words))
+			}
+			return nil
+		}
 
 		switch words[0] {
 
 		case "router":
+			if err := checkFields(6); err != nil {
+				return fail(err)
+			}
 			descriptor.Nickname = words[1]
 			descriptor.Address = net.ParseIP(words[2])
 			descriptor.ORPort = StringToPort(words[3])
@@ -282,31 +1095,61 @@ func ParseRawDescriptor(rawDescriptor string) (Fingerprint, GetDescriptor, error
 			descriptor.DirPort = StringToPort(words[5])
 
 		case "platform":
-			for i := 0; i < len(words); i++ {
-				if (strings.TrimSpace(words[i]) == "on") && (i < len(words)-1) {
-					descriptor.OperatingSystem = strings.Join(words[i+1:], " ")
-					descriptor.TorVersion = strings.Join(words[1:i-1], " ")
-					break
-				}
-			}
+			descriptor.Platform = strings.Join(words[1:], " ")
+			descriptor.PlatformTorVersion, descriptor.PlatformOS = parsePlatform(descriptor.Platform)
+			descriptor.TorVersion, descriptor.OperatingSystem = descriptor.PlatformTorVersion, descriptor.PlatformOS
 
 		case "uptime":
-			descriptor.Uptime, _ = strconv.ParseUint(words[1], 10, 64)
+			if err := checkFields(2); err != nil {
+				return fail(err)
+			}
+			descriptor.Uptime = parseUintOrZero(words[0], words[1])
 
 		case "published":
-			time, _ := time.Parse(publishedTimeLayout, strings.Join(words[1:], " "))
+			time, err := time.Parse(publishedTimeLayout, strings.Join(words[1:], " "))
+			if err != nil {
+				return fail(err)
+			}
 			descriptor.Published = time
 
+		case "or-address":
+			if err := checkFields(2); err != nil {
+				return fail(err)
+			}
+			host, port, err := net.SplitHostPort(words[1])
+			if err != nil {
+				return fail(err)
+			}
+			address := net.ParseIP(host)
+			if address == nil {
+				return fail(fmt.Errorf("invalid address %q", host))
+			}
+			descriptor.ORAddresses = append(descriptor.ORAddresses, ORAddress{address, StringToPort(port)})
+
 		case "fingerprint":
 			descriptor.Fingerprint = SanitiseFingerprint(Fingerprint(strings.Join(words[1:], "")))
 
 		case "hibernating":
-			descriptor.Hibernating, _ = strconv.ParseBool(words[1])
+			if err := checkFields(2); err != nil {
+				return fail(err)
+			}
+			var err error
+			if descriptor.Hibernating, err = strconv.ParseBool(words[1]); err != nil {
+				logParse(LogDebug, "treating malformed %q value as false: %s", words[0], err)
+			}
 
 		case "bandwidth":
-			descriptor.BandwidthAvg, _ = strconv.ParseUint(words[1], 10, 64)
-			descriptor.BandwidthBurst, _ = strconv.ParseUint(words[2], 10, 64)
-			descriptor.BandwidthObs, _ = strconv.ParseUint(words[3], 10, 64)
+			// Old descriptors may lack the burst and observed
+			// bandwidth, which we then leave at zero.
+			if err := checkFields(2); err != nil {
+				return fail(err)
+			}
+			values := []*uint64{&descriptor.BandwidthAvg, &descriptor.BandwidthBurst, &descriptor.BandwidthObs}
+			for i, word := range words[1:] {
+				if i < len(values) {
+					*values[i] = parseUintOrZero(words[0], word)
+				}
+			}
 
 		case "family":
 			for _, word := range words[1:] {
@@ -319,20 +1162,550 @@ func ParseRawDescriptor(rawDescriptor string) (Fingerprint, GetDescriptor, error
 
 		case "hidden-service-dir":
 			descriptor.HiddenServiceDir = true
+			versions, err := parseHSDirVersions(words[1:])
+			if err != nil {
+				return fail(err)
+			}
+			descriptor.HSDirVersions = versions
+
+		case "tunnelled-dir-server":
+			descriptor.TunnelledDirServer = true
+
+		case "caches-extra-info":
+			descriptor.CachesExtraInfo = true
+
+		case "overload-general":
+			overloaded, err := parseOverloadTime(words)
+			if err != nil {
+				return fail(err)
+			}
+			descriptor.OverloadGeneral = overloaded
+
+		case "bridge-distribution-request":
+			if err := checkFields(2); err != nil {
+				return fail(err)
+			}
+			descriptor.DistributionRequest = words[1]
+
+		case "proto":
+			protocols, err := parseProtocols(words[1:])
+			if err != nil {
+				return fail(err)
+			}
+			descriptor.Protocols = protocols
+
+		case "onion-key", "signing-key", "onion-key-crosscert", "router-signature", "identity-ed25519",
+			"ntor-onion-key-crosscert":
+			// The key or signature follows in a block.
+
+		case "extra-info-digest", "protocols", "eventdns", "allow-single-hop-exits", "read-history",
+			"write-history", "family-cert", "router-digest", "router-digest-sha256":
+			// Lines that we know but don't store.  See dir-spec.txt, Section
+			// 2.1.1, and, for sanitised bridge descriptors, CollecTor's
+			// format description.
+
+		case "master-key-ed25519":
+			if err := checkFields(2); err != nil {
+				return fail(err)
+			}
+			descriptor.MasterKeyEd25519 = words[1]
+			masterKeyLine = i
+
+		case "router-sig-ed25519":
+			if err := checkFields(2); err != nil {
+				return fail(err)
+			}
+			descriptor.RouterSigEd25519 = words[1]
+
+		case "ntor-onion-key":
+			if err := checkFields(2); err != nil {
+				return fail(err)
+			}
+			if !metaOnly {
+				descriptor.NTorOnionKey = words[1]
+			}
+
+		case "ipv6-policy":
+			summary, err := parseExitPolicySummary(words[1:])
+			if err != nil {
+				return fail(err)
+			}
+			descriptor.ExitPolicyV6 = summary
 
 		case "reject":
+			if err := checkFields(2); err != nil {
+				return fail(err)
+			}
+			rule, err := parseExitRule(false, words[1])
+			if err != nil {
+				return fail(err)
+			}
+			descriptor.exitRules = append(descriptor.exitRules, rule)
 			descriptor.RawReject += words[1] + " "
 			descriptor.RawExitPolicy += words[0] + " " + words[1] + "\n"
 
 		case "accept":
+			if err := checkFields(2); err != nil {
+				return fail(err)
+			}
+			rule, err := parseExitRule(true, words[1])
+			if err != nil {
+				return fail(err)
+			}
+			descriptor.exitRules = append(descriptor.exitRules, rule)
 			descriptor.RawAccept += words[1] + " "
 			descriptor.RawExitPolicy += words[0] + " " + words[1] + "\n"
+
+		default:
+			if line == "" {
+				continue
+			}
+			if strings.HasPrefix(keyword, "@") {
+				continue
+			}
+			if strict {
+				return fail(fmt.Errorf("unrecognised keyword %q", keyword))
+			}
+			descriptor.Unrecognized = append(descriptor.Unrecognized, line)
+		}
+	}
+
+	if strict {
+		if err := checkDescriptorStructure(lines); err != nil {
+			return "", nil, err
+		}
+		// Tor rejects descriptors whose master key differs from the one that
+		// the identity certificate was signed with.
+		if !metaOnly {
+			if err := descriptor.CheckMasterKey(); err != nil {
+				return "", nil, newParseError(masterKeyLine+1, lines[masterKeyLine], "master-key-ed25519", err)
+			}
 		}
 	}
 
 	return descriptor.Fingerprint, func() *RouterDescriptor { return descriptor }, nil
 }
 
+// The lines that every router descriptor must have exactly once.
+var mandatoryDescriptorLines = []string{"router", "bandwidth", "published"}
+
+// checkDescriptorStructure checks that the lines of the given raw descriptor
+// appear as dir-spec.txt, Section 2.1.1, requires: The descriptor starts with
+// a "router" line, optionally followed by an "identity-ed25519" line, ends
+// with a "router-signature" line, optionally preceded by a
+// "router-sig-ed25519" line, and has all mandatory lines exactly once.
+// Sanitised bridge descriptors, which carry a "router-digest" line instead,
+// may lack a signature.  Type annotations and the lines of "-----BEGIN" ...
+// "-----END" blocks are skipped.
+func checkDescriptorStructure(lines []string) error {
+
+	type keywordLine struct {
+		keyword string
+		num     int
+	}
+	var keywords []keywordLine
+	counts := make(map[string]int)
+	inBlock := false
+
+	for i, line := range lines {
+		line = strings.TrimSuffix(line, "\r")
+		isBlockLine := inBlock || strings.HasPrefix(line, "-----BEGIN")
+		inBlock = isBlockLine && !strings.HasPrefix(line, "-----END")
+		if isBlockLine || line == "" || strings.HasPrefix(line, "@") {
+			continue
+		}
+		words := strings.Fields(line)
+		if words[0] == "opt" && len(words) > 1 {
+			words = words[1:]
+		}
+		keywords = append(keywords, keywordLine{words[0], i + 1})
+		counts[words[0]]++
+	}
+
+	if len(keywords) == 0 {
+		return newParseError(1, "", "router", errors.New("empty descriptor"))
+	}
+	fail := func(kl keywordLine, format string, args ...interface{}) error {
+		return newParseError(kl.num, lines[kl.num-1], kl.keyword, fmt.Errorf(format, args...))
+	}
+
+	if keywords[0].keyword != "router" {
+		return fail(keywords[0], "descriptor does not start with a \"router\" line")
+	}
+	for _, keyword := range mandatoryDescriptorLines {
+		if counts[keyword] != 1 {
+			return newParseError(keywords[0].num, lines[keywords[0].num-1], keyword,
+				fmt.Errorf("expected one %q line but got %d", keyword, counts[keyword]))
+		}
+	}
+
+	for i, kl := range keywords {
+		switch kl.keyword {
+		case "identity-ed25519":
+			if i != 1 || counts[kl.keyword] != 1 {
+				return fail(kl, "%q line must directly follow the \"router\" line", kl.keyword)
+			}
+		case "router-sig-ed25519":
+			if i != len(keywords)-2 || keywords[i+1].keyword != "router-signature" {
+				return fail(kl, "%q line must directly precede the \"router-signature\" line", kl.keyword)
+			}
+		case "router-signature":
+			if i != len(keywords)-1 {
+				return fail(kl, "%q line must be the last line", kl.keyword)
+			}
+		}
+	}
+
+	if counts["router-signature"] == 0 && counts["router-digest"] == 0 {
+		last := keywords[len(keywords)-1]
+		return newParseError(last.num, lines[last.num-1], "router-signature",
+			errors.New("descriptor lacks \"router-signature\" line"))
+	}
+
+	return nil
+}
+
+// Ed25519Cert represents an ed25519 certificate in Tor's own format, see
+// cert-spec.txt, Section 2.1.  Descriptors embed the certificate that the
+// relay's master key issued for its signing key in their "identity-ed25519"
+// block.
+type Ed25519Cert struct {
+	Version  uint8
+	CertType uint8
+
+	// The time after which the certificate must not be used anymore.
+	Expiration time.Time
+
+	KeyType      uint8
+	CertifiedKey []byte
+
+	// The key that signed the certificate, taken from the certificate's
+	// signed-with-ed25519-key extension.  It is nil if the certificate lacks
+	// the extension.
+	SigningKey []byte
+
+	Signature []byte
+}
+
+// The size of an ed25519 certificate's fixed-length header, i.e., its version,
+// certificate type, expiration date, key type, certified key, and number of
+// extensions, and the size of its signature.
+const (
+	ed25519CertHeaderLen    = 40
+	ed25519CertSignatureLen = 64
+)
+
+// ParseEd25519Cert parses the given binary ed25519 certificate.  An error is
+// returned if the certificate is truncated or of an unknown version.
+func ParseEd25519Cert(raw []byte) (*Ed25519Cert, error) {
+
+	if len(raw) < ed25519CertHeaderLen+ed25519CertSignatureLen {
+		return nil, fmt.Errorf("truncated ed25519 certificate of %d bytes", len(raw))
+	}
+	if raw[0] != 1 {
+		return nil, fmt.Errorf("unknown ed25519 certificate version %d", raw[0])
+	}
+
+	// The expiration date is given in hours since the epoch.
+	hours := int64(raw[2])<<24 | int64(raw[3])<<16 | int64(raw[4])<<8 | int64(raw[5])
+	cert := &Ed25519Cert{
+		Version:      raw[0],
+		CertType:     raw[1],
+		Expiration:   time.Unix(hours*3600, 0).UTC(),
+		KeyType:      raw[6],
+		CertifiedKey: append([]byte(nil), raw[7:39]...),
+		Signature:    append([]byte(nil), raw[len(raw)-ed25519CertSignatureLen:]...),
+	}
+
+	numExtensions := int(raw[ed25519CertHeaderLen-1])
+	extensions := raw[ed25519CertHeaderLen : len(raw)-ed25519CertSignatureLen]
+	for i := 0; i < numExtensions; i++ {
+		if len(extensions) < 4 {
+			return nil, fmt.Errorf("truncated ed25519 certificate extension")
+		}
+		length := int(extensions[0])<<8 | int(extensions[1])
+		extType := extensions[2]
+		if len(extensions) < 4+length {
+			return nil, fmt.Errorf("truncated ed25519 certificate extension")
+		}
+		if extType == 4 && length == 32 {
+			cert.SigningKey = append([]byte(nil), extensions[4:4+length]...)
+		}
+		extensions = extensions[4+length:]
+	}
+	if len(extensions) != 0 {
+		return nil, fmt.Errorf("%d trailing bytes in ed25519 certificate", len(extensions))
+	}
+
+	return cert, nil
+}
+
+// IdentityEd25519Cert parses the descriptor's "identity-ed25519" certificate.
+// It returns an error if the descriptor lacks the certificate or if the
+// certificate is malformed.
+func (rd *RouterDescriptor) IdentityEd25519Cert() (*Ed25519Cert, error) {
+
+	if rd.IdentityEd25519 == nil {
+		return nil, fmt.Errorf("descriptor lacks ed25519 identity certificate")
+	}
+
+	return ParseEd25519Cert(rd.IdentityEd25519)
+}
+
+// CheckMasterKey returns an error if the descriptor's "master-key-ed25519" line
+// holds a different key than the one that signed its "identity-ed25519"
+// certificate.  Descriptors that lack the line or a well-formed certificate
+// pass the check.  Strict mode runs this check while parsing.
+func (rd *RouterDescriptor) CheckMasterKey() error {
+
+	if rd.MasterKeyEd25519 == "" {
+		return nil
+	}
+	cert, err := rd.IdentityEd25519Cert()
+	if err != nil {
+		return nil
+	}
+
+	masterKey, err := base64.RawStdEncoding.DecodeString(strings.TrimRight(rd.MasterKeyEd25519, "="))
+	if err != nil || !bytes.Equal(masterKey, cert.SigningKey) {
+		return fmt.Errorf("master key does not match identity certificate")
+	}
+
+	return nil
+}
+
+// setObject stores the given block, i.e., the lines from "-----BEGIN" to
+// "-----END", in the field that belongs to the given keyword.  Blocks of
+// keywords that we don't know are discarded.
+func (rd *RouterDescriptor) setObject(keyword string, block []string) error {
+
+	switch keyword {
+	case "onion-key":
+		rd.OnionKey = strings.Join(block, "\n")
+	case "signing-key":
+		rd.SigningKey = strings.Join(block, "\n")
+	case "onion-key-crosscert":
+		rd.OnionKeyCrossCert = strings.Join(block, "\n")
+	case "identity-ed25519":
+		if len(block) < 2 {
+			return fmt.Errorf("truncated certificate")
+		}
+		cert, err := base64.StdEncoding.DecodeString(strings.Join(block[1:len(block)-1], ""))
+		if err != nil {
+			return err
+		}
+		rd.IdentityEd25519 = cert
+	case "router-signature":
+		if len(block) < 2 {
+			return fmt.Errorf("truncated signature")
+		}
+		signature, err := base64.StdEncoding.DecodeString(strings.Join(block[1:len(block)-1], ""))
+		if err != nil {
+			return err
+		}
+		rd.RouterSignature = signature
+	}
+
+	return nil
+}
+
+// VerifySelfSignature checks that the descriptor's "router-signature" is a
+// valid signature of the descriptor's digest, made with the descriptor's own
+// signing key.  It returns an error if the signature is invalid or if the
+// descriptor lacks, or has a malformed, signing key, signature, or digest.
+// Note that this only shows that the descriptor is internally consistent, not
+// that it was published by the relay that it claims to describe.
+func (rd *RouterDescriptor) VerifySelfSignature() error {
+
+	block, _ := pem.Decode([]byte(rd.SigningKey))
+	if block == nil || block.Type != "RSA PUBLIC KEY" {
+		return fmt.Errorf("missing or malformed signing key")
+	}
+	key, err := x509.ParsePKCS1PublicKey(block.Bytes)
+	if err != nil {
+		return fmt.Errorf("malformed signing key: %s", err)
+	}
+
+	if len(rd.RouterSignature) == 0 {
+		return fmt.Errorf("missing router signature")
+	}
+	digest, err := hex.DecodeString(rd.Digest)
+	if err != nil || len(digest) != sha1.Size {
+		return fmt.Errorf("missing or malformed descriptor digest %q", rd.Digest)
+	}
+
+	// Tor signs the bare digest, i.e., without an ASN.1 DigestInfo prefix,
+	// which is why we don't pass a hash function.
+	if err := rsa.VerifyPKCS1v15(key, crypto.Hash(0), digest, rd.RouterSignature); err != nil {
+		return fmt.Errorf("router signature does not match signing key: %s", err)
+	}
+
+	return nil
+}
+
+// ErrNoEd25519Signature is returned by VerifyEd25519Signature for descriptors
+// that lack a "router-sig-ed25519" line.
+var ErrNoEd25519Signature = errors.New("no ed25519 signature")
+
+// VerifyEd25519Signature checks that the descriptor's "router-sig-ed25519" is
+// a valid signature of the descriptor, made with the signing key that the
+// "identity-ed25519" certificate certifies, and that the certificate itself
+// was signed by the relay's master key.  It returns ErrNoEd25519Signature if
+// the descriptor lacks the signature, and another error if the signature or
+// certificate is invalid or malformed.  Descriptors parsed by
+// ParseDescriptorFileMeta cannot be verified.
+func (rd *RouterDescriptor) VerifyEd25519Signature() error {
+
+	if rd.RouterSigEd25519 == "" {
+		return ErrNoEd25519Signature
+	}
+	if rd.ed25519Digest == nil {
+		return fmt.Errorf("missing ed25519 descriptor digest")
+	}
+	signature, err := base64.RawStdEncoding.DecodeString(strings.TrimRight(rd.RouterSigEd25519, "="))
+	if err != nil || len(signature) != ed25519.SignatureSize {
+		return fmt.Errorf("malformed ed25519 signature %q", rd.RouterSigEd25519)
+	}
+
+	cert, err := rd.IdentityEd25519Cert()
+	if err != nil {
+		return err
+	}
+	if len(cert.SigningKey) != ed25519.PublicKeySize || len(cert.CertifiedKey) != ed25519.PublicKeySize {
+		return fmt.Errorf("ed25519 identity certificate lacks keys")
+	}
+	body := rd.IdentityEd25519[:len(rd.IdentityEd25519)-ed25519CertSignatureLen]
+	if !ed25519.Verify(ed25519.PublicKey(cert.SigningKey), body, cert.Signature) {
+		return fmt.Errorf("ed25519 identity certificate does not match master key")
+	}
+
+	if !ed25519.Verify(ed25519.PublicKey(cert.CertifiedKey), rd.ed25519Digest, signature) {
+		return fmt.Errorf("ed25519 signature does not match certified signing key")
+	}
+
+	return nil
+}
+
+// descriptorEd25519Digest returns the SHA-256 digest that a descriptor's
+// "router-sig-ed25519" signature is made over, i.e., over a fixed prefix and
+// the raw descriptor's "router" line up to and including the space following
+// the "router-sig-ed25519" keyword, as defined in dir-spec.txt, Section 2.1.1.
+// If the descriptor lacks either line, nil is returned.
+func descriptorEd25519Digest(rawDescriptor string) []byte {
+
+	start := strings.Index(rawDescriptor, "router ")
+	if start < 0 {
+		return nil
+	}
+
+	marker := "\nrouter-sig-ed25519 "
+	end := strings.Index(rawDescriptor[start:], marker)
+	if end < 0 {
+		return nil
+	}
+
+	digest := sha256.Sum256([]byte("Tor router descriptor signature v1" + rawDescriptor[start:start+end+len(marker)]))
+	return digest[:]
+}
+
+// descriptorDigest returns the hex-encoded SHA-1 digest over the given raw
+// descriptor's "router" line up to and including its "router-signature" line,
+// as defined in dir-spec.txt, Section 2.1.1.  If the descriptor lacks either
+// line, an empty string is returned.
+func descriptorDigest(rawDescriptor string) string {
+
+	start := strings.Index(rawDescriptor, "router ")
+	if start < 0 {
+		return ""
+	}
+
+	marker := "\nrouter-signature\n"
+	end := strings.Index(rawDescriptor[start:], marker)
+	if end < 0 {
+		return ""
+	}
+
+	digest := sha1.Sum([]byte(rawDescriptor[start : start+end+len(marker)]))
+	return hex.EncodeToString(digest[:])
+}
+
+// parsePlatform splits the value of a "platform" line, e.g., "Tor 0.4.7.13 on
+// Linux", into the Tor version and the operating system.  The version is the
+// word following "Tor", so it is empty for other software, and the operating
+// system is everything after the first "on", so it is empty if the line lacks
+// the word.
+func parsePlatform(platform string) (version, operatingSystem string) {
+
+	words := strings.Fields(platform)
+	for i, word := range words {
+		if word == "on" {
+			operatingSystem = strings.Join(words[i+1:], " ")
+			words = words[:i]
+			break
+		}
+	}
+	if len(words) >= 2 && words[0] == "Tor" {
+		version = words[1]
+	}
+
+	return version, operatingSystem
+}
+
+// parseOverloadTime parses the words of an "overload-general" or
+// "overload-fd-exhausted" line, i.e., the keyword, a version, and a
+// timestamp.
+func parseOverloadTime(words []string) (*time.Time, error) {
+
+	if len(words) < 4 {
+		return nil, fmt.Errorf("expected 4 fields but got %d", len(words))
+	}
+	if _, err := strconv.Atoi(words[1]); err != nil {
+		return nil, fmt.Errorf("malformed version %q", words[1])
+	}
+	overloaded, err := time.Parse(publishedTimeLayout, words[2]+" "+words[3])
+	if err != nil {
+		return nil, err
+	}
+
+	return &overloaded, nil
+}
+
+// parseUintOrZero parses the given value of the line with the given keyword
+// as an unsigned integer.  Malformed values are logged and result in 0.
+func parseUintOrZero(keyword, value string) uint64 {
+
+	num, err := strconv.ParseUint(value, 10, 64)
+	if err != nil {
+		logParse(LogDebug, "treating malformed %q value as 0: %s", keyword, err)
+	}
+
+	return num
+}
+
+// parseHSDirVersions parses the version numbers of a "hidden-service-dir" line.
+// If no versions are given, version 2 is implied.
+func parseHSDirVersions(words []string) ([]int, error) {
+
+	var versions []int
+
+	for _, word := range words {
+		if word == "" {
+			continue
+		}
+		version, err := strconv.Atoi(word)
+		if err != nil {
+			return nil, err
+		}
+		versions = append(versions, version)
+	}
+
+	if versions == nil {
+		versions = []int{2}
+	}
+
+	return versions, nil
+}
+
 // extractDescriptor is a bufio.SplitFunc that extracts individual router
 // descriptors.
 func extractDescriptor(data []byte, atEOF bool) (advance int, token []byte, err error) {
@@ -392,56 +1765,89 @@ func (filter *ObjectFilter) MatchesRouterDescriptor(desc *RouterDescriptor) bool
 // function returns a pointer to RouterDescriptors containing the router
 // descriptors.  If there were any errors, an error string is returned.  If the
 // lazy argument is set to true, parsing of the router descriptors is delayed
-// until they are accessed.
-func parseDescriptorUnchecked(r io.Reader, lazy bool) (*RouterDescriptors, error) {
+// until they are accessed.  The given settings apply to parsing.
+func parseDescriptorUnchecked(r io.Reader, lazy bool, options *parseOptions) (*RouterDescriptors, error) {
 
 	var descriptors = NewRouterDescriptors()
-	var descriptorParser func(descriptor string) (Fingerprint, GetDescriptor, error)
+	var descriptorParser = parseRawDescriptorFull
 
 	if lazy {
-		descriptorParser = LazyParseRawDescriptor
-	} else {
-		descriptorParser = ParseRawDescriptor
+		descriptorParser = lazyParseRawDescriptor
 	}
 
+	if err := parseDescriptorInto(r, extractDescriptor, descriptorParser, descriptors, options); err != nil {
+		return nil, err
+	}
+
+	return descriptors, nil
+}
+
+// parseDescriptorInto works like parseDescriptorUnchecked but dissects the
+// input using the given extractor, parses the pieces using the given
+// descriptor parser with the given settings, and adds the parsed router
+// descriptors to the given RouterDescriptors, replacing descriptors with the
+// same fingerprint.  Duplicates within the input are handled as the given
+// settings say.  If there were any errors, the given RouterDescriptors may
+// contain some of the input's descriptors.  The input is no longer read once
+// the function returned.
+func parseDescriptorInto(r io.Reader, extractor bufio.SplitFunc,
+	descriptorParser func(string, *parseOptions) (Fingerprint, GetDescriptor, error), descriptors *RouterDescriptors,
+	options *parseOptions) error {
+
 	// We will read raw router descriptors from this channel.
 	queue := make(chan QueueUnit)
-	go DissectFile(r, extractDescriptor, queue)
+	// The type annotation took up the first line.
+	done := make(chan struct{})
+	go dissectFileUntil(r, extractor, queue, 2, done)
+	// Don't return before the dissecting goroutine stopped reading, so that
+	// callers may release the input, e.g., unmap it, once we returned.
+	defer func() {
+		close(done)
+		for range queue {
+		}
+	}()
+	duplicates := newDuplicateTracker(options)
 
 	// Parse incoming descriptors until the channel is closed by the remote
 	// end.
 	for unit := range queue {
 		if unit.Err != nil {
-			return nil, unit.Err
+			return unit.Err
 		}
 
-		fingerprint, getDescriptor, err := descriptorParser(unit.Blurb)
+		fingerprint, getDescriptor, err := descriptorParser(unit.Blurb, options)
 		if err != nil {
-			return nil, err
+			return offsetParseError(err, unit.Line-1)
+		}
+
+		if keep, err := duplicates.keep(fingerprint, unit.Line); err != nil {
+			return err
+		} else if !keep {
+			continue
 		}
 
 		descriptors.RouterDescriptors[SanitiseFingerprint(fingerprint)] = getDescriptor
 	}
 
-	return descriptors, nil
+	return nil
 }
 
 // parseDescriptor is a wrapper around parseDescriptorUnchecked that first reads
 // and checks the type annotation to make sure it belongs to
 // descriptorAnnotations.
-func parseDescriptor(r io.Reader, lazy bool) (*RouterDescriptors, error) {
+func parseDescriptor(r io.Reader, lazy bool, options *parseOptions) (*RouterDescriptors, error) {
 
 	r, err := readAndCheckAnnotation(r, descriptorAnnotations)
 	if err != nil {
 		return nil, err
 	}
 
-	return parseDescriptorUnchecked(r, lazy)
+	return parseDescriptorUnchecked(r, lazy, options)
 }
 
 // parseDescriptorFile is a wrapper around parseDescriptor that opens the named
 // file for parsing.
-func parseDescriptorFile(fileName string, lazy bool) (*RouterDescriptors, error) {
+func parseDescriptorFile(fileName string, lazy bool, options *parseOptions) (*RouterDescriptors, error) {
 
 	fd, err := os.Open(fileName)
 	if err != nil {
@@ -449,7 +1855,22 @@ func parseDescriptorFile(fileName string, lazy bool) (*RouterDescriptors, error)
 	}
 	defer fd.Close()
 
-	return parseDescriptor(fd, lazy)
+	return parseDescriptor(fd, lazy, options)
+}
+
+// ParseDescriptorBytes parses the router descriptors in the given byte slice,
+// including its type annotation, and returns a pointer to RouterDescriptors
+// containing the router descriptors.  Parsing is *not* delayed.
+func ParseDescriptorBytes(b []byte) (*RouterDescriptors, error) {
+
+	return ParseDescriptorBytesWithOptions(b)
+}
+
+// ParseDescriptorBytesWithOptions works like ParseDescriptorBytes but applies
+// the given options.
+func ParseDescriptorBytesWithOptions(b []byte, opts ...ParseOption) (*RouterDescriptors, error) {
+
+	return parseDescriptor(bytes.NewReader(b), false, newParseOptions(opts))
 }
 
 // LazilyParseDescriptorFile parses the given file and returns a pointer to
@@ -459,7 +1880,14 @@ func parseDescriptorFile(fileName string, lazy bool) (*RouterDescriptors, error)
 // pays off when you know that you will not parse most router descriptors.
 func LazilyParseDescriptorFile(fileName string) (*RouterDescriptors, error) {
 
-	return parseDescriptorFile(fileName, true)
+	return LazilyParseDescriptorFileWithOptions(fileName)
+}
+
+// LazilyParseDescriptorFileWithOptions works like LazilyParseDescriptorFile but
+// applies the given options.
+func LazilyParseDescriptorFileWithOptions(fileName string, opts ...ParseOption) (*RouterDescriptors, error) {
+
+	return parseDescriptorFile(fileName, true, newParseOptions(opts))
 }
 
 // ParseDescriptorFile parses the given file and returns a pointer to
@@ -469,5 +1897,268 @@ func LazilyParseDescriptorFile(fileName string) (*RouterDescriptors, error) {
 // know that you will parse most router descriptors.
 func ParseDescriptorFile(fileName string) (*RouterDescriptors, error) {
 
-	return parseDescriptorFile(fileName, false)
+	return ParseDescriptorFileWithOptions(fileName)
+}
+
+// ParseDescriptorFileWithOptions works like ParseDescriptorFile but applies the
+// given options.
+func ParseDescriptorFileWithOptions(fileName string, opts ...ParseOption) (*RouterDescriptors, error) {
+
+	return parseDescriptorFile(fileName, false, newParseOptions(opts))
+}
+
+// ParseDescriptorFileMmap works like ParseDescriptorFile but memory-maps the
+// given file and parses the mapped bytes, which avoids the read system calls
+// that dominate repeated parses of large descriptor archives.  The mapping is
+// unmapped before the function returns, and the returned descriptors don't
+// refer to it.  If the file cannot be memory-mapped, e.g., because it is
+// empty or the platform doesn't support it, the file is read as usual.
+func ParseDescriptorFileMmap(fileName string) (*RouterDescriptors, error) {
+
+	return ParseDescriptorFileMmapWithOptions(fileName)
+}
+
+// ParseDescriptorFileMmapWithOptions works like ParseDescriptorFileMmap but
+// applies the given options.
+func ParseDescriptorFileMmapWithOptions(fileName string, opts ...ParseOption) (*RouterDescriptors, error) {
+
+	data, unmap, err := mmapFile(fileName)
+	if err != nil {
+		return ParseDescriptorFileWithOptions(fileName, opts...)
+	}
+
+	// Parsing must not be delayed because descriptors are parsed from the
+	// mapped bytes.  The raw descriptors handed to the parser are copies, and
+	// parseDescriptorInto stops reading before it returns, even on errors, so
+	// nothing refers to the mapping once parsing is done.
+	descriptors, err := ParseDescriptorBytesWithOptions(data, opts...)
+	if unmapErr := unmap(); err == nil && unmapErr != nil {
+		return nil, unmapErr
+	}
+
+	return descriptors, err
+}
+
+// ParseDescriptorFileNoAnnotation works like ParseDescriptorFile but for files
+// that lack a type annotation, e.g., descriptors that didn't come from
+// CollecTor.  The file must start with the "router" line of a descriptor;
+// otherwise, an error is returned.
+func ParseDescriptorFileNoAnnotation(fileName string) (*RouterDescriptors, error) {
+
+	return ParseDescriptorFileNoAnnotationWithOptions(fileName)
+}
+
+// ParseDescriptorFileNoAnnotationWithOptions works like
+// ParseDescriptorFileNoAnnotation but applies the given options.
+func ParseDescriptorFileNoAnnotationWithOptions(fileName string, opts ...ParseOption) (*RouterDescriptors, error) {
+
+	fd, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+
+	annotation, r, err := guessAnnotation(fd)
+	if err != nil {
+		return nil, err
+	}
+	if !descriptorAnnotations[*annotation] {
+		return nil, fmt.Errorf("%s does not contain router descriptors but looks like %s", fileName, annotation.Type)
+	}
+
+	// The parser expects the first line to be the type annotation.
+	descriptors, err := parseDescriptorUnchecked(r, false, newParseOptions(opts))
+	if err != nil {
+		return nil, offsetParseError(err, -1)
+	}
+
+	return descriptors, nil
+}
+
+// ParseDescriptorFileMeta works like ParseDescriptorFile but skips the
+// descriptors' keys, certificates, and signatures, which makes parsing faster
+// when only meta data such as nicknames and bandwidth values are of interest.
+// The fields that hold cryptographic material as well as the Digest field are
+// left empty.
+func ParseDescriptorFileMeta(fileName string) (*RouterDescriptors, error) {
+
+	return ParseDescriptorFileMetaWithOptions(fileName)
+}
+
+// ParseDescriptorFileMetaWithOptions works like ParseDescriptorFileMeta but
+// applies the given options.
+func ParseDescriptorFileMetaWithOptions(fileName string, opts ...ParseOption) (*RouterDescriptors, error) {
+
+	fd, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+
+	r, err := readAndCheckAnnotation(fd, descriptorAnnotations)
+	if err != nil {
+		return nil, err
+	}
+
+	var descriptors = NewRouterDescriptors()
+	if err := parseDescriptorInto(r, extractDescriptor, parseRawDescriptorMeta, descriptors,
+		newParseOptions(opts)); err != nil {
+		return nil, err
+	}
+
+	return descriptors, nil
+}
+
+// ParseDescriptorFileLenient works like ParseDescriptorFile but doesn't give
+// up on malformed descriptors.  Instead, it returns the descriptors that it
+// could parse along with an error for each descriptor that it could not
+// parse.  Descriptors are framed by their "router" lines rather than by their
+// signatures, so a descriptor that lacks its signature doesn't swallow the
+// next one.  The returned set is nil only if the file cannot be opened or its
+// type annotation is not that of server descriptors.
+func ParseDescriptorFileLenient(fileName string) (ObjectSet, []error) {
+
+	return ParseDescriptorFileLenientWithOptions(fileName)
+}
+
+// ParseDescriptorFileLenientWithOptions works like ParseDescriptorFileLenient
+// but applies the given options.
+func ParseDescriptorFileLenientWithOptions(fileName string, opts ...ParseOption) (ObjectSet, []error) {
+
+	fd, err := os.Open(fileName)
+	if err != nil {
+		return nil, []error{err}
+	}
+	defer fd.Close()
+
+	r, err := readAndCheckAnnotation(fd, descriptorAnnotations)
+	if err != nil {
+		return nil, []error{err}
+	}
+
+	var errs []error
+	var descriptors = NewRouterDescriptors()
+	queue := make(chan QueueUnit)
+	// The type annotation took up the first line.
+	go dissectFile(r, extractByKeyword("router"), queue, 2)
+	options := newParseOptions(opts)
+	duplicates := newDuplicateTracker(options)
+
+	for unit := range queue {
+		// The scanner stops after an error, so this is the last unit.
+		if unit.Err != nil {
+			errs = append(errs, unit.Err)
+			continue
+		}
+
+		fingerprint, getDescriptor, err := parseRawDescriptorFull(unit.Blurb, options)
+		if err != nil {
+			errs = append(errs, offsetParseError(err, unit.Line-1))
+			continue
+		}
+
+		if keep, err := duplicates.keep(fingerprint, unit.Line); err != nil {
+			errs = append(errs, err)
+			continue
+		} else if !keep {
+			continue
+		}
+
+		descriptors.RouterDescriptors[SanitiseFingerprint(fingerprint)] = getDescriptor
+	}
+
+	return descriptors, errs
+}
+
+// ParseDescriptorFiles parses the given files and merges their router
+// descriptors into a single set.  If several files contain a descriptor for
+// the same relay, the descriptor in the file that comes last wins.  Files
+// whose type annotation is not that of server descriptors are skipped, and
+// reported in a MultiError that is returned along with the merged set.  Any
+// other error aborts parsing.
+func ParseDescriptorFiles(paths []string) (ObjectSet, error) {
+
+	return ParseDescriptorFilesWithOptions(paths)
+}
+
+// ParseDescriptorFilesWithOptions works like ParseDescriptorFiles but applies
+// the given options.
+func ParseDescriptorFilesWithOptions(paths []string, opts ...ParseOption) (ObjectSet, error) {
+
+	var descriptors = NewRouterDescriptors()
+	var skipped MultiError
+	options := newParseOptions(opts)
+
+	for _, path := range paths {
+		err := func() error {
+			fd, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+			defer fd.Close()
+
+			r, err := readAndCheckAnnotation(fd, descriptorAnnotations)
+			if err != nil {
+				logParse(LogWarn, "skipping %s: %s", path, err)
+				skipped = append(skipped, fmt.Errorf("skipped %s: %s", path, err))
+				return nil
+			}
+
+			return parseDescriptorInto(r, extractDescriptor, parseRawDescriptorFull, descriptors, options)
+		}()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if skipped != nil {
+		return descriptors, skipped
+	}
+
+	return descriptors, nil
+}
+
+// ParseDescriptorTar parses the tar archive in the given io.Reader, as
+// distributed by CollecTor, and merges the router descriptors of all its
+// members into a single set.  Members that are not regular files or whose
+// type annotation is not that of server descriptors, e.g., directories and
+// index files, are skipped silently.  To parse a gzipped archive, wrap the
+// reader using gzip.NewReader.
+func ParseDescriptorTar(r io.Reader) (ObjectSet, error) {
+
+	return ParseDescriptorTarWithOptions(r)
+}
+
+// ParseDescriptorTarWithOptions works like ParseDescriptorTar but applies the
+// given options.
+func ParseDescriptorTarWithOptions(r io.Reader, opts ...ParseOption) (ObjectSet, error) {
+
+	var descriptors = NewRouterDescriptors()
+	options := newParseOptions(opts)
+
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		if !header.FileInfo().Mode().IsRegular() {
+			continue
+		}
+
+		member, err := readAndCheckAnnotation(tr, descriptorAnnotations)
+		if err != nil {
+			logParse(LogDebug, "skipping archive member %s: %s", header.Name, err)
+			continue
+		}
+
+		if err := parseDescriptorInto(member, extractDescriptor, parseRawDescriptorFull, descriptors, options); err != nil {
+			return nil, fmt.Errorf("could not parse %s: %s", header.Name, err)
+		}
+	}
+
+	return descriptors, nil
 }
@@ -3,10 +3,21 @@
 package zoossh
 
 import (
+	"archive/tar"
 	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net"
 	"os"
+	"reflect"
 	"strings"
 	"testing"
+	"time"
 )
 
 // The number of unique fingerprints in the descriptor test file.  The number
@@ -23,6 +34,7 @@ func BenchmarkDescriptorParsing(b *testing.B) {
 		b.Skipf("skipping because of missing %s", serverDescriptorFile)
 	}
 
+	b.ReportAllocs()
 	for i := 0; i < b.N; i++ {
 		if _, err := ParseDescriptorFile(serverDescriptorFile); err != nil {
 			b.Fatal(err)
@@ -30,6 +42,23 @@ func BenchmarkDescriptorParsing(b *testing.B) {
 	}
 }
 
+// Benchmark the time it takes to parse a server descriptor file without its
+// cryptographic blocks.  Compare with BenchmarkDescriptorParsing.
+func BenchmarkDescriptorMetaParsing(b *testing.B) {
+
+	// Only run this benchmark if the descriptors file is there.
+	if _, err := os.Stat(serverDescriptorFile); os.IsNotExist(err) {
+		b.Skipf("skipping because of missing %s", serverDescriptorFile)
+	}
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := ParseDescriptorFileMeta(serverDescriptorFile); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
 // Test the function ParseRawDescriptor().
 func TestDescriptorParsing(t *testing.T) {
 
@@ -234,3 +263,1268 @@ func TestDescriptorsToSlice(t *testing.T) {
 		}
 	}
 }
+
+func TestDescriptorParseError(t *testing.T) {
+
+	// The "bandwidth" line in the second descriptor is truncated.
+	malformed := `@type server-descriptor 1.0
+router foo 1.2.3.4 9001 0 0
+fingerprint AAAA AAAA AAAA AAAA AAAA AAAA AAAA AAAA AAAA AAAA
+bandwidth 1 2 3
+router-signature
+-----BEGIN SIGNATURE-----
+-----END SIGNATURE-----
+@type server-descriptor 1.0
+router bar 1.2.3.5 9001 0 0
+fingerprint BBBB BBBB BBBB BBBB BBBB BBBB BBBB BBBB BBBB BBBB
+bandwidth
+router-signature
+-----BEGIN SIGNATURE-----
+-----END SIGNATURE-----
+`
+
+	_, err := parseDescriptor(strings.NewReader(malformed), false, newParseOptions(nil))
+	if err == nil {
+		t.Fatal("Malformed descriptor did not raise an error.")
+	}
+
+	parseErr, ok := err.(*ParseError)
+	if !ok {
+		t.Fatalf("Expected *ParseError but got %T.", err)
+	}
+
+	if parseErr.Line != 11 {
+		t.Errorf("Expected error in line 11 but got line %d.", parseErr.Line)
+	}
+
+	if parseErr.Field != "bandwidth" {
+		t.Errorf("Expected error in field \"bandwidth\" but got %q.", parseErr.Field)
+	}
+
+	if parseErr.Text != "bandwidth" {
+		t.Errorf("Unexpected offending line %q.", parseErr.Text)
+	}
+}
+
+func TestBandwidth(t *testing.T) {
+
+	tests := []struct {
+		line     string
+		expected [3]uint64
+	}{
+		{"bandwidth 20480 40960 16996", [3]uint64{20480, 40960, 16996}},
+		{"bandwidth 20480 40960", [3]uint64{20480, 40960, 0}},
+		{"bandwidth 20480", [3]uint64{20480, 0, 0}},
+		{"bandwidth 20480 40960 16996 1", [3]uint64{20480, 40960, 16996}},
+	}
+	for _, test := range tests {
+		_, getDesc, err := ParseRawDescriptor("router foo 1.2.3.4 9001 0 0\n" + test.line + "\n")
+		if err != nil {
+			t.Fatal(err)
+		}
+		desc := getDesc()
+		got := [3]uint64{desc.BandwidthAvg, desc.BandwidthBurst, desc.BandwidthObs}
+		if got != test.expected {
+			t.Errorf("Line %q was parsed as %v, expected %v.", test.line, got, test.expected)
+		}
+	}
+}
+
+func TestParsePlatform(t *testing.T) {
+
+	tests := []struct {
+		platform string
+		version  string
+		os       string
+	}{
+		{"Tor 0.4.7.13 on Linux", "0.4.7.13", "Linux"},
+		{"Tor 0.2.4.23 (git-a9b6ba8d2fba7bfa) on Windows 8", "0.2.4.23", "Windows 8"},
+		{"Tor 0.4.8.0-alpha-dev on FreeBSD", "0.4.8.0-alpha-dev", "FreeBSD"},
+		{"Tor 0.3.5.8 on Windows 8 [server] {enterprise} {terminal services, single user} {terminal services}",
+			"0.3.5.8", "Windows 8 [server] {enterprise} {terminal services, single user} {terminal services}"},
+		{"Tor 0.2.9.16", "0.2.9.16", ""},
+		{"arti 1.1.0 on Linux", "", "Linux"},
+		{"Tor", "", ""},
+		{"on Linux", "", "Linux"},
+		{"Tor on", "", ""},
+		{"", "", ""},
+	}
+	for _, test := range tests {
+		version, operatingSystem := parsePlatform(test.platform)
+		if version != test.version || operatingSystem != test.os {
+			t.Errorf("Platform %q was parsed as (%q, %q), expected (%q, %q).",
+				test.platform, version, operatingSystem, test.version, test.os)
+		}
+	}
+
+	_, getDesc, err := ParseRawDescriptor("router foo 1.2.3.4 9001 0 0\nplatform Tor 0.4.7.13 on Linux\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	desc := getDesc()
+	if desc.Platform != "Tor 0.4.7.13 on Linux" || desc.PlatformTorVersion != "0.4.7.13" || desc.PlatformOS != "Linux" {
+		t.Errorf("Platform line parsed incorrectly: %q, %q, %q", desc.Platform, desc.PlatformTorVersion, desc.PlatformOS)
+	}
+	if desc.TorVersion != desc.PlatformTorVersion || desc.OperatingSystem != desc.PlatformOS {
+		t.Errorf("Older platform fields parsed incorrectly: %q, %q", desc.TorVersion, desc.OperatingSystem)
+	}
+
+	// Unusual platform lines must not make the parser fail.
+	for _, line := range []string{"platform on Linux", "platform on", "platform", "platform Tor on"} {
+		if _, _, err := ParseRawDescriptor("router foo 1.2.3.4 9001 0 0\n" + line + "\n"); err != nil {
+			t.Errorf("Platform line %q caused an error: %s", line, err)
+		}
+	}
+}
+
+func TestHSDirVersions(t *testing.T) {
+
+	tests := []struct {
+		line     string
+		expected []int
+	}{
+		{"hidden-service-dir", []int{2}},
+		{"hidden-service-dir 2 3", []int{2, 3}},
+		{"opt hidden-service-dir 3", []int{3}},
+		{"hidden-service-dir\r", []int{2}},
+	}
+
+	for _, test := range tests {
+		_, getDesc, err := ParseRawDescriptor("router foo 1.2.3.4 9001 0 0\n" + test.line + "\n")
+		if err != nil {
+			t.Fatal(err)
+		}
+		desc := getDesc()
+
+		if !desc.HiddenServiceDir {
+			t.Errorf("%q did not set HiddenServiceDir.", test.line)
+		}
+		if !reflect.DeepEqual(desc.HSDirVersions, test.expected) {
+			t.Errorf("%q resulted in versions %v, expected %v.", test.line, desc.HSDirVersions, test.expected)
+		}
+	}
+
+	_, getDesc, err := ParseRawDescriptor("router foo 1.2.3.4 9001 0 0\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if desc := getDesc(); desc.HiddenServiceDir || desc.HSDirVersions != nil {
+		t.Error("Descriptor without hidden-service-dir line claims to be an HSDir.")
+	}
+
+	if _, _, err := ParseRawDescriptor("hidden-service-dir two\n"); err == nil {
+		t.Error("Invalid HSDir version did not raise an error.")
+	}
+}
+
+func TestDescriptorProtocols(t *testing.T) {
+
+	raw := "router foo 1.2.3.4 9001 0 0\n" +
+		"protocols Link 1 2 Circuit 1\n" +
+		"proto Cons=1-2 Desc=1-2 DirCache=1 Link=1-3,2-4 LinkAuth=3,1,3 Relay=1-2 Padding=0,63\n"
+	_, getDesc, err := ParseRawDescriptor(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string][]uint32{
+		"Cons":     {1, 2},
+		"Desc":     {1, 2},
+		"DirCache": {1},
+		"Link":     {1, 2, 3, 4},
+		"LinkAuth": {1, 3},
+		"Relay":    {1, 2},
+		"Padding":  {0, 63},
+	}
+	if protocols := getDesc().Protocols; !reflect.DeepEqual(protocols, expected) {
+		t.Errorf("Parsed protocols %v, expected %v.", protocols, expected)
+	}
+
+	// The older "protocols" line must not be mistaken for a "proto" line.
+	_, getDesc, err = ParseRawDescriptor("router foo 1.2.3.4 9001 0 0\nprotocols Link 1 2 Circuit 1\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if protocols := getDesc().Protocols; protocols != nil {
+		t.Errorf("Descriptor without proto line has protocols %v.", protocols)
+	}
+
+	// Huge ranges must be rejected rather than expanded.
+	for _, line := range []string{"proto Link", "proto Link=a", "proto Link=4-1", "proto =1",
+		"proto Link=64", "proto Link=1-4294967295"} {
+		if _, _, err := ParseRawDescriptor(line + "\n"); err == nil {
+			t.Errorf("Invalid line %q did not raise an error.", line)
+		}
+	}
+}
+
+func TestParseDescriptorCRLF(t *testing.T) {
+
+	// Only run this test if the descriptors file is there.
+	if _, err := os.Stat(serverDescriptorFile); os.IsNotExist(err) {
+		t.Skipf("skipping because of missing %s", serverDescriptorFile)
+	}
+
+	raw, err := ioutil.ReadFile(serverDescriptorFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected, err := ParseDescriptorBytes(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	descs, err := ParseDescriptorBytes(bytes.Replace(raw, []byte("\n"), []byte("\r\n"), -1))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if descs.Length() != expected.Length() {
+		t.Fatalf("Expected %d descriptors but got %d.", expected.Length(), descs.Length())
+	}
+	for fingerprint := range expected.RouterDescriptors {
+		desc, _ := descs.Get(fingerprint)
+		expectedDesc, _ := expected.Get(fingerprint)
+		if !desc.Equals(expectedDesc) {
+			t.Fatalf("Descriptor %s of CRLF file differs.", fingerprint)
+		}
+	}
+
+	// Raw descriptors with CRLF line endings have the same digest.
+	descriptor := "router foo 1.2.3.4 9001 0 0\n" +
+		"router-signature\n-----BEGIN SIGNATURE-----\nAAAA\n-----END SIGNATURE-----\n"
+	_, getDesc, err := ParseRawDescriptor(descriptor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, getCRLFDesc, err := ParseRawDescriptor(strings.Replace(descriptor, "\n", "\r\n", -1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if digest := getCRLFDesc().Digest; digest == "" || digest != getDesc().Digest {
+		t.Errorf("Expected digest %q for CRLF descriptor but got %q.", getDesc().Digest, digest)
+	}
+}
+
+func TestParseDescriptorFileMeta(t *testing.T) {
+
+	// Only run this test if the descriptors file is there.
+	if _, err := os.Stat(serverDescriptorFile); os.IsNotExist(err) {
+		t.Skipf("skipping because of missing %s", serverDescriptorFile)
+	}
+
+	expected, err := ParseDescriptorFile(serverDescriptorFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	descs, err := ParseDescriptorFileMeta(serverDescriptorFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Skipping the cryptographic blocks must not make us lose track of where
+	// descriptors begin and end.
+	if descs.Length() != expected.Length() {
+		t.Fatalf("Expected %d descriptors but got %d.", expected.Length(), descs.Length())
+	}
+	for fingerprint := range expected.RouterDescriptors {
+		desc, _ := descs.Get(fingerprint)
+		expectedDesc, _ := expected.Get(fingerprint)
+		if desc.Digest != "" || desc.OnionKey != "" || desc.NTorOnionKey != "" ||
+			desc.SigningKey != "" || desc.RouterSignature != nil {
+			t.Fatalf("Descriptor %s has cryptographic material despite skipping it.", fingerprint)
+		}
+		expectedDesc.Digest = ""
+		expectedDesc.OnionKey = ""
+		expectedDesc.NTorOnionKey = ""
+		expectedDesc.SigningKey = ""
+		expectedDesc.RouterSignature = nil
+		if !desc.Equals(expectedDesc) {
+			t.Fatalf("Descriptor %s differs when skipping cryptographic blocks.", fingerprint)
+		}
+	}
+}
+
+func TestUnrecognizedDescriptorLines(t *testing.T) {
+
+	raw := "router foo 1.2.3.4 9001 0 0\n" +
+		"future-line foo\n" +
+		"identity-ed25519\n" +
+		"-----BEGIN ED25519 CERT-----\n" +
+		"AQQABjXSAdhB9nu5gS8TJwsi3XmQ9JmSkw3vhiAdaPw0cEuZ8yWdAQAgBACdGtuh\n" +
+		"-----END ED25519 CERT-----\n" +
+		"opt another-line\n" +
+		"contact foo\n"
+
+	_, getDesc, err := ParseRawDescriptor(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"future-line foo", "opt another-line"}
+	if unrecognized := getDesc().Unrecognized; !reflect.DeepEqual(unrecognized, expected) {
+		t.Errorf("Expected unrecognized lines %q but got %q.", expected, unrecognized)
+	}
+
+	// Lines that the specification defines aren't reported, even if we don't
+	// store them.
+	_, getDesc, err = ParseRawDescriptor("router foo 1.2.3.4 9001 0 0\ncontact foo\n" +
+		"extra-info-digest AAAA\nprotocols Link 1 2 Circuit 1\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if unrecognized := getDesc().Unrecognized; unrecognized != nil {
+		t.Errorf("Expected no unrecognized lines but got %q.", unrecognized)
+	}
+
+	// Real descriptors have no unrecognized lines.
+	if _, err := os.Stat(serverDescriptorFile); os.IsNotExist(err) {
+		t.Skipf("skipping because of missing %s", serverDescriptorFile)
+	}
+	descs, err := ParseDescriptorFile(serverDescriptorFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for fingerprint, getDesc := range descs.RouterDescriptors {
+		if unrecognized := getDesc().Unrecognized; unrecognized != nil {
+			t.Fatalf("Descriptor %s has unrecognized lines %q.", fingerprint, unrecognized)
+		}
+	}
+}
+
+func TestVerifySelfSignature(t *testing.T) {
+
+	// Only run this test if the descriptors file is there.
+	if _, err := os.Stat(serverDescriptorFile); os.IsNotExist(err) {
+		t.Skipf("skipping because of missing %s", serverDescriptorFile)
+	}
+
+	descs, err := ParseDescriptorFile(serverDescriptorFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for fingerprint, getDesc := range descs.RouterDescriptors {
+		if err := getDesc().VerifySelfSignature(); err != nil {
+			t.Fatalf("Descriptor %s failed verification: %s", fingerprint, err)
+		}
+	}
+
+	desc, _ := descs.Get("C21E1593B7BBAC7005AC5FC9579D0B866DC406AF")
+
+	// Tampering with the descriptor changes its digest.
+	tampered := *desc
+	tampered.Digest = strings.Repeat("0", 40)
+	if err := tampered.VerifySelfSignature(); err == nil {
+		t.Error("Tampered descriptor passed verification.")
+	}
+
+	tampered = *desc
+	tampered.SigningKey = "foo"
+	if err := tampered.VerifySelfSignature(); err == nil {
+		t.Error("Descriptor with malformed signing key passed verification.")
+	}
+
+	tampered = *desc
+	tampered.RouterSignature = nil
+	if err := tampered.VerifySelfSignature(); err == nil {
+		t.Error("Descriptor without signature passed verification.")
+	}
+}
+
+func TestOnionKeys(t *testing.T) {
+
+	crossCert := "-----BEGIN CROSSCERT-----\n" +
+		"PnUZsTDUN8f41pg6iSWmJiFL4ldIOZEKsxAZBBH0ulRKoMS8ezOtStD7YKRMPrwY\n" +
+		"MHvlDYRX3tmCPTbKxY6jDDGUgcE1yXWIrD5L5y9ZkvdwlZBJUqdI6h+/y7/lBY+A\n" +
+		"-----END CROSSCERT-----"
+	raw := "router foo 1.2.3.4 9001 0 0\n" +
+		"ntor-onion-key rMm4JRMf8eB8OKQM3kM2p7bjQ/5RUMhOIPkcWlz8zXE=\n" +
+		"onion-key-crosscert\n" + crossCert + "\n" +
+		"contact foo\n"
+
+	_, getDesc, err := ParseRawDescriptor(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	desc := getDesc()
+
+	if desc.NTorOnionKey != "rMm4JRMf8eB8OKQM3kM2p7bjQ/5RUMhOIPkcWlz8zXE=" {
+		t.Errorf("Unexpected ntor onion key %q.", desc.NTorOnionKey)
+	}
+	if desc.OnionKeyCrossCert != crossCert {
+		t.Errorf("Unexpected onion key cross-certificate %q.", desc.OnionKeyCrossCert)
+	}
+	// The line after the block must be parsed as usual.
+	if desc.Contact != "foo" || desc.Unrecognized != nil {
+		t.Error("Parser got out of step after the cross-certificate.")
+	}
+
+	// Only run the rest of this test if the descriptors file is there.
+	if _, err := os.Stat(serverDescriptorFile); os.IsNotExist(err) {
+		t.Skipf("skipping because of missing %s", serverDescriptorFile)
+	}
+
+	descs, err := ParseDescriptorFile(serverDescriptorFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	withKey := 0
+	for _, getDesc := range descs.RouterDescriptors {
+		desc := getDesc()
+		if desc.NTorOnionKey != "" {
+			withKey++
+		}
+		if !strings.HasPrefix(desc.OnionKey, "-----BEGIN RSA PUBLIC KEY-----\n") {
+			t.Fatalf("Descriptor %s has malformed onion key %q.", desc.Fingerprint, desc.OnionKey)
+		}
+	}
+	// Descriptors of older relays lack an ntor onion key.
+	if withKey == 0 || withKey == descs.Length() {
+		t.Errorf("Expected only some descriptors to have an ntor onion key but %d of %d have one.",
+			withKey, descs.Length())
+	}
+}
+
+// makeIdentityCert returns an "identity-ed25519" line and block whose
+// certificate was signed by the given master key.  The certificate's
+// signature is bogus.
+func makeIdentityCert(masterKey []byte) string {
+
+	cert := []byte{1, 4, 0, 0, 0, 0, 1}
+	cert = append(cert, bytes.Repeat([]byte{0xaa}, 32)...)
+	cert = append(cert, 1, 0, 32, 4, 0)
+	cert = append(cert, masterKey...)
+	cert = append(cert, bytes.Repeat([]byte{0xbb}, 64)...)
+
+	return "identity-ed25519\n" +
+		"-----BEGIN ED25519 CERT-----\n" +
+		base64.StdEncoding.EncodeToString(cert) + "\n" +
+		"-----END ED25519 CERT-----\n"
+}
+
+func TestMasterKeyEd25519(t *testing.T) {
+
+	masterKey := bytes.Repeat([]byte{0x42}, 32)
+	encoded := base64.RawStdEncoding.EncodeToString(masterKey)
+	crossCert := "onion-key-crosscert\n" +
+		"-----BEGIN CROSSCERT-----\n" +
+		"AAAA\n" +
+		"-----END CROSSCERT-----\n"
+
+	raw := "router foo 1.2.3.4 9001 0 0\n" +
+		makeIdentityCert(masterKey) +
+		"master-key-ed25519 " + encoded + "\n" +
+		crossCert
+
+	_, getDesc, err := ParseRawDescriptor(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	desc := getDesc()
+	if desc.MasterKeyEd25519 != encoded {
+		t.Errorf("Parsed master key %q, expected %q.", desc.MasterKeyEd25519, encoded)
+	}
+	// The block that follows the line must not be mistaken for part of it.
+	if desc.OnionKeyCrossCert != strings.TrimSuffix(crossCert[len("onion-key-crosscert\n"):], "\n") {
+		t.Errorf("Cross-certificate parsed incorrectly: %q", desc.OnionKeyCrossCert)
+	}
+
+	if err := desc.CheckMasterKey(); err != nil {
+		t.Errorf("Matching master key failed the check: %s", err)
+	}
+
+	// The master key has to match the key that signed the identity
+	// certificate, but only strict mode enforces that.
+	raw = "router foo 1.2.3.4 9001 0 0\n" +
+		makeIdentityCert(bytes.Repeat([]byte{0x43}, 32)) +
+		"master-key-ed25519 " + encoded + "\n" +
+		"bandwidth 1 2 3\n" +
+		"published 2017-04-15 00:00:00\n" +
+		"router-signature\n-----BEGIN SIGNATURE-----\nAAAA\n-----END SIGNATURE-----\n"
+	_, getDesc, err = ParseRawDescriptor(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if getDesc().CheckMasterKey() == nil {
+		t.Error("Mismatching master key passed the check.")
+	}
+	_, _, err = ParseRawDescriptorWithOptions(raw, WithStrictMode(true))
+	if parseErr, ok := err.(*ParseError); !ok || parseErr.Line != 6 {
+		t.Errorf("Expected error in line 6 for mismatching master key but got %v.", err)
+	}
+
+	_, getDesc, err = ParseRawDescriptor("router foo 1.2.3.4 9001 0 0\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if getDesc().MasterKeyEd25519 != "" {
+		t.Error("Descriptor without master key line has a master key.")
+	}
+
+	if _, _, err := ParseRawDescriptor("master-key-ed25519\n"); err == nil {
+		t.Error("Master key line without key did not raise an error.")
+	}
+}
+
+func TestIdentityEd25519(t *testing.T) {
+
+	masterKey := bytes.Repeat([]byte{0x42}, 32)
+	block := makeIdentityCert(masterKey)
+
+	// Tor wraps the certificate's base64 encoding after 64 characters.
+	lines := strings.Split(block, "\n")
+	wrapped := strings.Join([]string{lines[0], lines[1], lines[2][:64], lines[2][64:128], lines[2][128:], lines[3], ""}, "\n")
+
+	_, getDesc, err := ParseRawDescriptor("router foo 1.2.3.4 9001 0 0\n" + wrapped + "platform Tor 0.3.0.10 on Linux\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	desc := getDesc()
+	if len(desc.IdentityEd25519) != 140 {
+		t.Fatalf("Expected 140 bytes of certificate but got %d.", len(desc.IdentityEd25519))
+	}
+	if desc.OperatingSystem != "Linux" {
+		t.Error("Line following the certificate parsed incorrectly.")
+	}
+
+	cert, err := desc.IdentityEd25519Cert()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cert.Version != 1 || cert.CertType != 4 || cert.KeyType != 1 || !cert.Expiration.Equal(time.Unix(0, 0)) ||
+		!bytes.Equal(cert.CertifiedKey, bytes.Repeat([]byte{0xaa}, 32)) || !bytes.Equal(cert.SigningKey, masterKey) ||
+		!bytes.Equal(cert.Signature, bytes.Repeat([]byte{0xbb}, 64)) {
+		t.Errorf("Certificate parsed incorrectly: %+v", cert)
+	}
+
+	for _, raw := range [][]byte{desc.IdentityEd25519[:100], append([]byte{2}, desc.IdentityEd25519[1:]...),
+		append(desc.IdentityEd25519[:40:40], bytes.Repeat([]byte{0xbb}, 64)...)} {
+		if _, err := ParseEd25519Cert(raw); err == nil {
+			t.Errorf("Malformed certificate %x did not cause an error.", raw)
+		}
+	}
+
+	_, getDesc, err = ParseRawDescriptor("router foo 1.2.3.4 9001 0 0\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if desc := getDesc(); desc.IdentityEd25519 != nil {
+		t.Error("Descriptor without certificate has a certificate.")
+	} else if _, err := desc.IdentityEd25519Cert(); err == nil {
+		t.Error("Missing certificate did not cause an error.")
+	}
+
+	if _, _, err := ParseRawDescriptor("identity-ed25519\n-----BEGIN ED25519 CERT-----\n!!!!\n-----END ED25519 CERT-----\n"); err == nil {
+		t.Error("Malformed base64 did not cause an error.")
+	}
+}
+
+func TestVerifyEd25519Signature(t *testing.T) {
+
+	masterKey := ed25519.NewKeyFromSeed(bytes.Repeat([]byte{1}, ed25519.SeedSize))
+	signingKey := ed25519.NewKeyFromSeed(bytes.Repeat([]byte{2}, ed25519.SeedSize))
+
+	cert := []byte{1, 4, 0, 0, 0, 0, 1}
+	cert = append(cert, signingKey.Public().(ed25519.PublicKey)...)
+	cert = append(cert, 1, 0, 32, 4, 0)
+	cert = append(cert, masterKey.Public().(ed25519.PublicKey)...)
+	cert = append(cert, ed25519.Sign(masterKey, cert)...)
+
+	body := "router foo 1.2.3.4 9001 0 0\n" +
+		"identity-ed25519\n" +
+		"-----BEGIN ED25519 CERT-----\n" +
+		base64.StdEncoding.EncodeToString(cert) + "\n" +
+		"-----END ED25519 CERT-----\n" +
+		"platform Tor 0.3.0.10 on Linux\n" +
+		"router-sig-ed25519 "
+	digest := sha256.Sum256([]byte("Tor router descriptor signature v1" + body))
+	signature := base64.RawStdEncoding.EncodeToString(ed25519.Sign(signingKey, digest[:]))
+
+	_, getDesc, err := ParseRawDescriptor("@type server-descriptor 1.0\n" + body + signature + "\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	desc := getDesc()
+	if desc.RouterSigEd25519 != signature {
+		t.Errorf("Parsed signature %q, expected %q.", desc.RouterSigEd25519, signature)
+	}
+	if err := desc.VerifyEd25519Signature(); err != nil {
+		t.Errorf("Valid signature did not verify: %s", err)
+	}
+
+	// Tampering with the descriptor must invalidate the signature.
+	_, getDesc, err = ParseRawDescriptor(strings.Replace(body, "Linux", "FreeBSD", 1) + signature + "\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := getDesc().VerifyEd25519Signature(); err == nil {
+		t.Error("Signature of tampered descriptor verified.")
+	}
+
+	// So must tampering with the certificate.
+	cert[len(cert)-1] ^= 1
+	desc.IdentityEd25519 = cert
+	if err := desc.VerifyEd25519Signature(); err == nil {
+		t.Error("Tampered certificate verified.")
+	}
+
+	_, getDesc, err = ParseRawDescriptor("router foo 1.2.3.4 9001 0 0\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := getDesc().VerifyEd25519Signature(); err != ErrNoEd25519Signature {
+		t.Errorf("Expected ErrNoEd25519Signature but got %v.", err)
+	}
+}
+
+func TestPolicySummary(t *testing.T) {
+
+	tests := []struct {
+		policy   string
+		expected string
+	}{
+		{"reject *:*\n", "reject 1-65535"},
+		{"accept *:*\n", "accept 1-65535"},
+		// Rejecting private networks and single addresses doesn't matter,
+		// but rejecting a /6 does.
+		{"reject 10.0.0.0/8:*\nreject 1.2.3.4:*\naccept *:22\naccept *:80-81\nreject *:*\n", "accept 22,80-81"},
+		{"reject 4.0.0.0/6:443\naccept *:80\naccept *:443\nreject *:*\n", "accept 80"},
+		{"reject 1.2.3.0/24:*\naccept 5.6.7.8:*\nreject *:25\nreject *:119\naccept *:*\n", "reject 25,119"},
+		// IPv6 lines are ignored.
+		{"accept [2001:db8::]/32:*\nreject *:*\n", "reject 1-65535"},
+		// Port 0 is treated as port 1.
+		{"accept *:0-65535\n", "accept 1-65535"},
+		{"accept *:0\nreject *:*\n", "reject 1-65535"},
+		{"accept *:0-80\nreject *:*\n", "accept 1-80"},
+	}
+	for _, test := range tests {
+		_, getDesc, err := ParseRawDescriptor("router foo 1.2.3.4 9001 0 0\n" + test.policy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if summary := getDesc().PolicySummary(); summary != test.expected {
+			t.Errorf("Policy %q was summarised as %q, expected %q.", test.policy, summary, test.expected)
+		}
+	}
+
+	// Accepting every other port results in lists that are too long, so the
+	// accepted ports are cut off.
+	var policy []string
+	for port := 2; port <= 1000; port += 2 {
+		policy = append(policy, fmt.Sprintf("accept *:%d", port))
+	}
+	_, getDesc, err := ParseRawDescriptor("router foo 1.2.3.4 9001 0 0\n" + strings.Join(policy, "\n") + "\nreject *:*\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	summary := getDesc().PolicySummary()
+	if len(summary) > 1000 || !strings.HasPrefix(summary, "accept 2,4,6,") || strings.HasSuffix(summary, ",") {
+		t.Errorf("Long policy summarised incorrectly as %q.", summary)
+	}
+
+	// Tor's summaries in the consensus must match ours for the descriptors
+	// that the consensus refers to.
+	for _, fileName := range []string{consensusFile, serverDescriptorFile} {
+		if _, err := os.Stat(fileName); os.IsNotExist(err) {
+			t.Skipf("skipping because of missing %s", fileName)
+		}
+	}
+	consensus, err := ParseConsensusFile(consensusFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	descs, err := ParseDescriptorFile(serverDescriptorFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	compared := 0
+	for fingerprint, getDesc := range descs.RouterDescriptors {
+		desc := getDesc()
+		status, found := consensus.Get(fingerprint)
+		if !found || !strings.EqualFold(status.Digest, desc.Digest) {
+			continue
+		}
+		expected := "reject " + status.PortList
+		if status.Accept {
+			expected = "accept " + status.PortList
+		}
+		if summary := desc.PolicySummary(); summary != expected {
+			t.Errorf("Summarised %s's policy as %q, expected %q.", fingerprint, summary, expected)
+		}
+		compared++
+	}
+	if compared < 500 {
+		t.Errorf("Expected to compare at least 500 summaries but compared %d.", compared)
+	}
+}
+
+func TestPartitionExits(t *testing.T) {
+
+	descs := NewRouterDescriptors()
+	for fingerprint, policy := range map[Fingerprint]string{
+		"0000000000000000000000000000000000000000": "accept *:80\nreject *:*\n",
+		"1111111111111111111111111111111111111111": "reject *:*\n",
+		"2222222222222222222222222222222222222222": "reject *:25\naccept *:*\n",
+		"3333333333333333333333333333333333333333": "accept *:22\nreject *:*\n",
+	} {
+		_, getDesc, err := ParseRawDescriptor("router foo 1.2.3.4 9001 0 0\nfingerprint " + string(fingerprint) + "\n" + policy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		descs.Set(fingerprint, getDesc())
+	}
+
+	exits, nonExits := PartitionExits(descs, nil)
+	if exits.Length() != 2 || nonExits.Length() != 2 || descs.Length() != 4 {
+		t.Fatalf("Expected 2 exits and 2 non-exits but got %d and %d.", exits.Length(), nonExits.Length())
+	}
+	for _, fingerprint := range []Fingerprint{"0000000000000000000000000000000000000000", "2222222222222222222222222222222222222222"} {
+		if _, found := exits.GetObject(fingerprint); !found {
+			t.Errorf("Expected %s to be an exit.", fingerprint)
+		}
+	}
+
+	// The returned sets must not share state with each other or the input.
+	exits.(*RouterDescriptors).Set("4444444444444444444444444444444444444444", NewRouterDescriptor())
+	if descs.Length() != 4 || nonExits.Length() != 2 {
+		t.Error("Modifying the set of exits modified other sets.")
+	}
+
+	exits, nonExits = PartitionExits(descs, func(desc *RouterDescriptor) bool {
+		return desc.AllowsExitTo(net.ParseIP("1.2.3.4"), 22)
+	})
+	if exits.Length() != 2 || nonExits.Length() != 2 {
+		t.Errorf("Expected 2 exits and 2 non-exits but got %d and %d.", exits.Length(), nonExits.Length())
+	}
+	if _, found := nonExits.GetObject("0000000000000000000000000000000000000000"); !found {
+		t.Error("Expected custom predicate to be used.")
+	}
+}
+
+func TestStartTime(t *testing.T) {
+
+	// An uptime of one day, one hour, one minute, and one second.
+	_, getDesc, err := ParseRawDescriptor("router foo 1.2.3.4 9001 0 0\n" +
+		"published 2014-12-07 21:00:00\n" +
+		"uptime 90061\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	desc := getDesc()
+
+	start, known := desc.StartTime()
+	expected := time.Date(2014, time.December, 6, 19, 58, 59, 0, time.UTC)
+	if !known || !start.Equal(expected) {
+		t.Errorf("Got start time %s (%t), expected %s.", start, known, expected)
+	}
+
+	for _, uptime := range []uint64{0, math.MaxUint64} {
+		desc.Uptime = uptime
+		if start, known := desc.StartTime(); known || !start.Equal(desc.Published) {
+			t.Errorf("Uptime %d resulted in start time %s (%t).", uptime, start, known)
+		}
+	}
+}
+
+func TestAllowsExitTo(t *testing.T) {
+
+	_, getDesc, err := ParseRawDescriptor("router foo 1.2.3.4 9001 0 0\n" +
+		"reject 0.0.0.0/8:*\n" +
+		"reject 10.1.0.0/255.255.0.0:*\n" +
+		"reject [2001:db8::]/32:*\n" +
+		"accept 10.0.0.0/8:443\n" +
+		"reject 10.0.0.0/8:*\n" +
+		"accept *:80\n" +
+		"accept 192.0.2.1:6660-6669\n" +
+		"reject *:*\n" +
+		"ipv6-policy accept 443\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	desc := getDesc()
+
+	tests := []struct {
+		address string
+		port    uint16
+		allowed bool
+	}{
+		{"0.1.2.3", 80, false},
+		{"10.1.2.3", 443, false},
+		{"10.2.3.4", 443, true},
+		{"10.2.3.4", 80, false},
+		{"198.51.100.1", 80, true},
+		{"198.51.100.1", 443, false},
+		{"192.0.2.1", 6665, true},
+		{"192.0.2.2", 6665, false},
+		{"2001:db8::1", 443, true},
+		{"2001:db8::1", 80, false},
+	}
+	for _, test := range tests {
+		if desc.AllowsExitTo(net.ParseIP(test.address), test.port) != test.allowed {
+			t.Errorf("Expected AllowsExitTo to return %t for %s:%d.", test.allowed, test.address, test.port)
+		}
+	}
+
+	// Addresses that no line matches are allowed.
+	_, getDesc, err = ParseRawDescriptor("router foo 1.2.3.4 9001 0 0\nreject *:25\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if desc := getDesc(); desc.AllowsExitTo(net.ParseIP("1.2.3.4"), 25) || !desc.AllowsExitTo(net.ParseIP("1.2.3.4"), 80) {
+		t.Error("Exit policy without catch-all line evaluated incorrectly.")
+	}
+
+	for _, line := range []string{"accept *", "accept *:foo", "accept *:443-80", "accept foo:80",
+		"reject 1.2.3.4/33:*", "reject [foo]:*"} {
+		if _, _, err := ParseRawDescriptor(line + "\n"); err == nil {
+			t.Errorf("Invalid line %q did not raise an error.", line)
+		}
+	}
+}
+
+func TestExitPolicyV6(t *testing.T) {
+
+	ipv6 := net.ParseIP("2001:db8::1")
+
+	_, getDesc, err := ParseRawDescriptor("router foo 1.2.3.4 9001 0 0\nipv6-policy accept 80,443,6660-6669\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	desc := getDesc()
+
+	expected := &ExitPolicySummary{Accept: true, Ports: []PortRange{{80, 80}, {443, 443}, {6660, 6669}}}
+	if !desc.ExitPolicyV6.Equals(expected) {
+		t.Errorf("Parsed IPv6 exit policy %+v, expected %+v.", desc.ExitPolicyV6, expected)
+	}
+	for port, allowed := range map[uint16]bool{80: true, 443: true, 6665: true, 22: false, 6670: false} {
+		if desc.AllowsV6(ipv6, port) != allowed {
+			t.Errorf("Expected AllowsV6 to return %t for port %d.", allowed, port)
+		}
+	}
+	if desc.AllowsV6(net.ParseIP("1.2.3.4"), 80) || desc.AllowsV6(nil, 80) {
+		t.Error("IPv6 exit policy allowed a non-IPv6 address.")
+	}
+
+	_, getDesc, err = ParseRawDescriptor("router foo 1.2.3.4 9001 0 0\nipv6-policy reject 25\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if desc := getDesc(); desc.AllowsV6(ipv6, 25) || !desc.AllowsV6(ipv6, 80) {
+		t.Error("Reject policy evaluated incorrectly.")
+	}
+
+	// Without an "ipv6-policy" line, all IPv6 traffic is rejected.
+	_, getDesc, err = ParseRawDescriptor("router foo 1.2.3.4 9001 0 0\naccept *:*\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if desc := getDesc(); desc.ExitPolicyV6 != nil || desc.AllowsV6(ipv6, 80) {
+		t.Error("Descriptor without IPv6 exit policy allows IPv6 traffic.")
+	}
+
+	for _, line := range []string{"ipv6-policy", "ipv6-policy accept", "ipv6-policy allow 80",
+		"ipv6-policy accept 80,foo", "ipv6-policy accept 443-80", "ipv6-policy accept 65536"} {
+		if _, _, err := ParseRawDescriptor(line + "\n"); err == nil {
+			t.Errorf("Invalid line %q did not raise an error.", line)
+		}
+	}
+}
+
+func TestORAddresses(t *testing.T) {
+
+	raw := "router foo 1.2.3.4 9001 0 0\n" +
+		"or-address [2001:db8::1]:9001\n" +
+		"or-address 5.6.7.8:443\n"
+
+	_, getDesc, err := ParseRawDescriptor(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addresses := getDesc().ORAddresses
+	if len(addresses) != 2 {
+		t.Fatalf("Expected 2 OR addresses but got %d.", len(addresses))
+	}
+	if !addresses[0].Address.Equal(net.ParseIP("2001:db8::1")) || addresses[0].Port != 9001 {
+		t.Errorf("First OR address parsed incorrectly: %+v", addresses[0])
+	}
+	if !addresses[1].Address.Equal(net.ParseIP("5.6.7.8")) || addresses[1].Port != 443 {
+		t.Errorf("Second OR address parsed incorrectly: %+v", addresses[1])
+	}
+
+	_, getDesc, err = ParseRawDescriptor("router foo 1.2.3.4 9001 0 0\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addresses := getDesc().ORAddresses; addresses != nil {
+		t.Errorf("Descriptor without or-address line has OR addresses %v.", addresses)
+	}
+
+	for _, line := range []string{"or-address", "or-address 2001:db8::1", "or-address [foo]:9001"} {
+		if _, _, err := ParseRawDescriptor(line + "\n"); err == nil {
+			t.Errorf("Invalid line %q did not raise an error.", line)
+		}
+	}
+}
+
+func TestServesDirectory(t *testing.T) {
+
+	tests := []struct {
+		raw      string
+		expected bool
+	}{
+		{"router foo 1.2.3.4 9001 0 9030\n", true},
+		{"router foo 1.2.3.4 9001 0 0\ntunnelled-dir-server\n", true},
+		{"router foo 1.2.3.4 9001 0 0\r\ntunnelled-dir-server\r\n", true},
+		{"router foo 1.2.3.4 9001 0 0\ntunnelled-dir-server", true},
+		{"router foo 1.2.3.4 9001 0 9030\ntunnelled-dir-server\n", true},
+		{"router foo 1.2.3.4 9001 0 0\n", false},
+	}
+
+	for _, test := range tests {
+		_, getDesc, err := ParseRawDescriptor(test.raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if getDesc().ServesDirectory() != test.expected {
+			t.Errorf("%q resulted in %t, expected %t.", test.raw, !test.expected, test.expected)
+		}
+	}
+}
+
+func TestHibernatingAndCachesExtraInfo(t *testing.T) {
+
+	hibernating := `router foo 1.2.3.4 9001 0 0
+platform Tor 0.4.7.13 on Linux
+published 2023-01-01 00:00:00
+hibernating 1
+caches-extra-info
+family $AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA
+`
+	_, getDesc, err := ParseRawDescriptor(hibernating)
+	if err != nil {
+		t.Fatal(err)
+	}
+	desc := getDesc()
+	if !desc.Hibernating || !desc.CachesExtraInfo || !desc.HasFamily("AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA") {
+		t.Errorf("Hibernating descriptor parsed incorrectly: %+v", desc)
+	}
+
+	for _, raw := range []string{"router foo 1.2.3.4 9001 0 0\n", "router foo 1.2.3.4 9001 0 0\nhibernating 0\n"} {
+		_, getDesc, err := ParseRawDescriptor(raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if desc := getDesc(); desc.Hibernating || desc.CachesExtraInfo {
+			t.Errorf("%q resulted in a hibernating or extra-info caching relay.", raw)
+		}
+	}
+}
+
+func TestOverloadGeneral(t *testing.T) {
+
+	overloaded := `router foo 1.2.3.4 9001 0 0
+published 2023-01-01 00:00:00
+overload-general 1 2023-01-01 10:00:00
+`
+	_, getDesc, err := ParseRawDescriptor(overloaded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	desc := getDesc()
+	if desc.OverloadGeneral == nil || !desc.OverloadGeneral.Equal(time.Date(2023, time.January, 1, 10, 0, 0, 0, time.UTC)) {
+		t.Errorf("Unexpected general overload %v.", desc.OverloadGeneral)
+	}
+	if desc.Equals(NewRouterDescriptor()) {
+		t.Error("Overloaded descriptor compared equal to empty descriptor.")
+	}
+
+	// Descriptors predating the line lack the field.
+	_, getDesc, err = ParseRawDescriptor("router foo 1.2.3.4 9001 0 0\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if desc := getDesc(); desc.OverloadGeneral != nil {
+		t.Errorf("Descriptor without overload line parsed incorrectly: %+v", desc)
+	}
+
+	for _, line := range []string{"overload-general 1 2023-01-01", "overload-general x 2023-01-01 10:00:00",
+		"overload-general 1 yesterday noon"} {
+		if _, _, err := ParseRawDescriptor("router foo 1.2.3.4 9001 0 0\n" + line + "\n"); err == nil {
+			t.Errorf("Expected error for %q.", line)
+		}
+	}
+}
+
+func TestParseDescriptorFiles(t *testing.T) {
+
+	// Only run this test if the descriptors file is there.
+	if _, err := os.Stat(serverDescriptorFile); os.IsNotExist(err) {
+		t.Skipf("skipping because of missing %s", serverDescriptorFile)
+	}
+
+	// A second file that contains a newer descriptor of a relay that is also
+	// part of serverDescriptorFile.
+	fd, err := ioutil.TempFile("", "zoossh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(fd.Name())
+	fmt.Fprint(fd, `@type server-descriptor 1.0
+router leenuts 46.14.245.206 9001 0 0
+published 2014-12-09 14:01:26
+fingerprint F8E9 F7D3 0ED7 F541 FD24 8945 FAA2 B593 AD5E 584D
+router-signature
+-----BEGIN SIGNATURE-----
+-----END SIGNATURE-----
+`)
+	fd.Close()
+
+	descs, err := ParseDescriptorFiles([]string{serverDescriptorFile, consensusFile, fd.Name()})
+	multiErr, ok := err.(MultiError)
+	if !ok || len(multiErr) != 1 {
+		t.Fatalf("Expected one skipped file but got %v.", err)
+	}
+
+	if descs.Length() != numServerDescriptors {
+		t.Errorf("Expected %d merged descriptors but got %d.", numServerDescriptors, descs.Length())
+	}
+
+	obj, found := descs.GetObject("F8E9F7D30ED7F541FD248945FAA2B593AD5E584D")
+	if !found {
+		t.Fatal("Merged descriptor not found.")
+	}
+	if obj.(*RouterDescriptor).Published.Day() != 9 {
+		t.Error("Descriptor of earlier file was not replaced by later file.")
+	}
+
+	if _, err := ParseDescriptorFiles([]string{serverDescriptorFile}); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
+func TestParseDescriptorTar(t *testing.T) {
+
+	// Only run this test if the descriptors file is there.
+	if _, err := os.Stat(serverDescriptorFile); os.IsNotExist(err) {
+		t.Skipf("skipping because of missing %s", serverDescriptorFile)
+	}
+
+	content, err := ioutil.ReadFile(serverDescriptorFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// An archive with a directory, a descriptor file, and an index file that
+	// isn't a descriptor.
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	members := []struct {
+		header  *tar.Header
+		content []byte
+	}{
+		{&tar.Header{Name: "server-descriptors-2014-12/", Mode: 0755, Typeflag: tar.TypeDir}, nil},
+		{&tar.Header{Name: "server-descriptors-2014-12/descriptors", Mode: 0644}, content},
+		{&tar.Header{Name: "index.json", Mode: 0644}, []byte(`{"index_created":"2014-12-10 00:00"}`)},
+	}
+	for _, member := range members {
+		member.header.Size = int64(len(member.content))
+		if err := tw.WriteHeader(member.header); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(member.content); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	descriptors, err := ParseDescriptorTar(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected, err := ParseDescriptorFile(serverDescriptorFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if descriptors.Length() != expected.Length() {
+		t.Errorf("Expected %d descriptors but got %d.", expected.Length(), descriptors.Length())
+	}
+}
+
+func TestRouterDescriptorEquals(t *testing.T) {
+
+	raw := `router leenuts 46.14.245.206 9001 0 0
+published 2014-12-09 14:01:26
+fingerprint F8E9 F7D3 0ED7 F541 FD24 8945 FAA2 B593 AD5E 584D
+family $9695DFC35FFEB861329B9F1AB04C46397020CE31
+hidden-service-dir 2 3
+reject *:25
+accept *:*
+`
+	_, getDesc, err := ParseRawDescriptor(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, getOther, err := ParseRawDescriptor(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	desc, other := getDesc(), getOther()
+
+	other.Address = other.Address.To4()
+	if !desc.Equals(other) {
+		t.Error("Equal router descriptors compared unequal.")
+	}
+
+	other.Family["CCEF02AA454C0AB0FE1AC68304F6D8C4220C1912"] = true
+	if desc.Equals(other) {
+		t.Error("Router descriptors with different families compared equal.")
+	}
+
+	if desc.Equals(&RouterStatus{}) {
+		t.Error("Router descriptor compared equal to router status.")
+	}
+}
+
+func TestParseDescriptorFileNoAnnotation(t *testing.T) {
+
+	// Only run this test if the descriptors file is there.
+	if _, err := os.Stat(serverDescriptorFile); os.IsNotExist(err) {
+		t.Skipf("skipping because of missing %s", serverDescriptorFile)
+	}
+
+	content, err := ioutil.ReadFile(serverDescriptorFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fd, err := ioutil.TempFile("", "zoossh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(fd.Name())
+	if _, err := fd.Write(content[bytes.IndexByte(content, '\n')+1:]); err != nil {
+		t.Fatal(err)
+	}
+	fd.Close()
+
+	descs, err := ParseDescriptorFileNoAnnotation(fd.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if descs.Length() != numServerDescriptors {
+		t.Errorf("Expected %d descriptors but got %d.", numServerDescriptors, descs.Length())
+	}
+
+	// Files with a type annotation don't start with a "router" line.
+	if _, err := ParseDescriptorFileNoAnnotation(serverDescriptorFile); err == nil {
+		t.Error("Descriptor file with type annotation did not cause an error.")
+	}
+}
+
+func TestParseDescriptorFileMmap(t *testing.T) {
+
+	// Only run this test if the descriptors file is there.
+	if _, err := os.Stat(serverDescriptorFile); os.IsNotExist(err) {
+		t.Skipf("skipping because of missing %s", serverDescriptorFile)
+	}
+
+	descs, err := ParseDescriptorFileMmap(serverDescriptorFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected, err := ParseDescriptorFile(serverDescriptorFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if descs.Length() != expected.Length() {
+		t.Fatalf("Expected %d descriptors but got %d.", expected.Length(), descs.Length())
+	}
+	for fingerprint, getDesc := range expected.RouterDescriptors {
+		desc, found := descs.Get(fingerprint)
+		if !found || !desc.Equals(getDesc()) {
+			t.Errorf("Descriptor %s parsed differently from mapped file.", fingerprint)
+		}
+	}
+
+	// A malformed first descriptor stops parsing while the rest of the
+	// mapped file is still being read, which must not outlive the mapping.
+	content, err := ioutil.ReadFile(serverDescriptorFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	malformed, err := ioutil.TempFile("", "zoossh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(malformed.Name())
+	body := content[bytes.IndexByte(content, '\n')+1:]
+	if _, err := fmt.Fprintf(malformed, "@type server-descriptor 1.0\nrouter bad 1.2.3.4\n"+
+		"-----END SIGNATURE-----\n%s", bytes.Repeat(body, 4)); err != nil {
+		t.Fatal(err)
+	}
+	malformed.Close()
+	for i := 0; i < 10; i++ {
+		if _, err := ParseDescriptorFileMmap(malformed.Name()); err == nil {
+			t.Fatal("Malformed first descriptor did not cause an error.")
+		}
+	}
+
+	// Empty files can't be mapped, so they are read as usual.
+	fd, err := ioutil.TempFile("", "zoossh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(fd.Name())
+	fd.Close()
+	if _, err := ParseDescriptorFileMmap(fd.Name()); err == nil {
+		t.Error("Empty descriptor file did not cause an error.")
+	}
+}
+
+func TestParseDescriptorFileLenient(t *testing.T) {
+
+	// The second descriptor is malformed and lacks a signature.
+	content := `@type server-descriptor 1.0
+router foo 1.2.3.4 9001 0 0
+fingerprint AAAA AAAA AAAA AAAA AAAA AAAA AAAA AAAA AAAA AAAA
+router bad 1.2.3.4
+router baz 1.2.3.5 9001 0 0
+fingerprint BBBB BBBB BBBB BBBB BBBB BBBB BBBB BBBB BBBB BBBB
+`
+	fd, err := ioutil.TempFile("", "zoossh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(fd.Name())
+	if _, err := fd.WriteString(content); err != nil {
+		t.Fatal(err)
+	}
+	fd.Close()
+
+	if _, err := ParseDescriptorFile(fd.Name()); err == nil {
+		t.Error("Malformed descriptor did not cause an error.")
+	}
+
+	descs, errs := ParseDescriptorFileLenient(fd.Name())
+	if descs == nil || descs.Length() != 2 {
+		t.Fatalf("Expected 2 descriptors but got %v.", descs)
+	}
+	for _, fingerprint := range []Fingerprint{"AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA", "BBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBB"} {
+		if _, found := descs.GetObject(fingerprint); !found {
+			t.Errorf("Descriptor %s not found.", fingerprint)
+		}
+	}
+	if len(errs) != 1 {
+		t.Fatalf("Expected 1 error but got %v.", errs)
+	}
+	if parseErr, ok := errs[0].(*ParseError); !ok || parseErr.Line != 4 || parseErr.Field != "router" {
+		t.Errorf("Unexpected error %v.", errs[0])
+	}
+
+	if descs, errs := ParseDescriptorFileLenient(consensusFile); descs != nil || len(errs) != 1 {
+		t.Error("Consensus file did not cause an error.")
+	}
+}
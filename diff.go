@@ -0,0 +1,179 @@
+// Provides functions to compare two consensuses.
+
+package zoossh
+
+// StatusChange describes how a relay's router status changed between two
+// consensuses.  Fields that did not change hold the same old and new value.
+type StatusChange struct {
+	Fingerprint Fingerprint
+
+	// The names of the flags that the relay gained and lost, in the order in
+	// which they appear in the RouterFlags struct.
+	FlagsAdded   []string
+	FlagsRemoved []string
+
+	OldBandwidth uint64
+	NewBandwidth uint64
+
+	OldAddress RouterAddress
+	NewAddress RouterAddress
+}
+
+// FlagsChanged returns true if the relay gained or lost at least one flag.
+func (change *StatusChange) FlagsChanged() bool {
+
+	return len(change.FlagsAdded) > 0 || len(change.FlagsRemoved) > 0
+}
+
+// BandwidthChanged returns true if the relay's bandwidth changed.
+func (change *StatusChange) BandwidthChanged() bool {
+
+	return change.OldBandwidth != change.NewBandwidth
+}
+
+// AddressChanged returns true if any of the relay's addresses or ports
+// changed.
+func (change *StatusChange) AddressChanged() bool {
+
+	return !change.OldAddress.Equals(change.NewAddress)
+}
+
+// ConsensusDiff holds the differences between two consensuses.  All slices
+// are ordered by fingerprint.
+type ConsensusDiff struct {
+	// Relays that are only in the new consensus.
+	Added []Fingerprint
+
+	// Relays that are only in the old consensus.
+	Removed []Fingerprint
+
+	// Relays that are in both consensuses but whose flags, bandwidth, or
+	// address changed.
+	Changed []StatusChange
+}
+
+// diffFlags returns the names of the flags that are set in b but not in a.
+func diffFlags(a, b RouterFlags) []string {
+
+	set := make(map[string]bool)
+	for _, name := range a.names() {
+		set[name] = true
+	}
+
+	var diff []string
+	for _, name := range b.names() {
+		if !set[name] {
+			diff = append(diff, name)
+		}
+	}
+
+	return diff
+}
+
+// DiffConsensus determines which relays were added to, removed from, and
+// changed between the old and the new consensus.  Relays are matched by their
+// fingerprint, so the order of router statuses does not matter.
+func DiffConsensus(old, new *Consensus) ConsensusDiff {
+
+	var diff ConsensusDiff
+
+	for _, fingerprint := range old.sortedFingerprints() {
+		if _, exists := new.RouterStatuses[fingerprint]; !exists {
+			diff.Removed = append(diff.Removed, fingerprint)
+		}
+	}
+
+	for _, fingerprint := range new.sortedFingerprints() {
+		getOldStatus, exists := old.RouterStatuses[fingerprint]
+		if !exists {
+			diff.Added = append(diff.Added, fingerprint)
+			continue
+		}
+
+		oldStatus, newStatus := getOldStatus(), new.RouterStatuses[fingerprint]()
+		if oldStatus == nil || newStatus == nil {
+			continue
+		}
+
+		change := StatusChange{
+			Fingerprint:  fingerprint,
+			FlagsAdded:   diffFlags(oldStatus.Flags, newStatus.Flags),
+			FlagsRemoved: diffFlags(newStatus.Flags, oldStatus.Flags),
+			OldBandwidth: oldStatus.Bandwidth,
+			NewBandwidth: newStatus.Bandwidth,
+			OldAddress:   oldStatus.Address,
+			NewAddress:   newStatus.Address,
+		}
+		if change.FlagsChanged() || change.BandwidthChanged() || change.AddressChanged() {
+			diff.Changed = append(diff.Changed, change)
+		}
+	}
+
+	return diff
+}
+
+// Churn summarises how many relays joined, left, and remained between two
+// consensuses.
+type Churn struct {
+	// Relays that are only in the new consensus.
+	JoinedCount int
+
+	// Relays that are only in the old consensus.
+	LeftCount int
+
+	// Relays that are in both consensuses.
+	StableCount int
+
+	// The fraction of bandwidth that changed hands, i.e., the bandwidth of
+	// the relays that joined plus the bandwidth of the relays that left,
+	// divided by the total bandwidth of both consensuses.  The value lies
+	// between 0 and 1, and is 0 if neither consensus has any bandwidth.
+	BandwidthChurn float64
+}
+
+// statusBandwidth returns the bandwidth of the given router status getter, or
+// 0 if the getter fails to return a status.
+func statusBandwidth(getStatus GetStatus) uint64 {
+
+	if status := getStatus(); status != nil {
+		return status.Bandwidth
+	}
+
+	return 0
+}
+
+// ChurnStats determines how many relays joined, left, and remained between the
+// old and the new consensus, along with the bandwidth-weighted churn.  Like
+// DiffConsensus, it matches relays by their fingerprint.  If the old
+// consensus is empty, all relays of the new consensus count as joined.
+func ChurnStats(old, new *Consensus) Churn {
+
+	var churn Churn
+	var changedBandwidth, totalBandwidth uint64
+
+	for fingerprint, getStatus := range old.RouterStatuses {
+		bandwidth := statusBandwidth(getStatus)
+		totalBandwidth += bandwidth
+		if _, exists := new.RouterStatuses[fingerprint]; !exists {
+			churn.LeftCount++
+			changedBandwidth += bandwidth
+		}
+	}
+
+	for fingerprint, getStatus := range new.RouterStatuses {
+		bandwidth := statusBandwidth(getStatus)
+		totalBandwidth += bandwidth
+		if _, exists := old.RouterStatuses[fingerprint]; exists {
+			churn.StableCount++
+		} else {
+			churn.JoinedCount++
+			changedBandwidth += bandwidth
+		}
+	}
+
+	if totalBandwidth > 0 {
+		churn.BandwidthChurn = float64(changedBandwidth) / float64(totalBandwidth)
+	}
+
+	return churn
+}
@@ -0,0 +1,114 @@
+// Tests functions from "diff.go".
+
+package zoossh
+
+import (
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestDiffConsensus(t *testing.T) {
+
+	address := RouterAddress{IPv4Address: net.ParseIP("1.2.3.4"), IPv4ORPort: 9001}
+	flags := RouterFlags{Running: true, Valid: true, Fast: true}
+
+	old := NewConsensus()
+	new := NewConsensus()
+
+	// A relay that disappears.
+	old.Set("AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA", &RouterStatus{Bandwidth: 10, Flags: flags, Address: address})
+	// A relay that doesn't change at all.  Its address uses a different
+	// representation in the new consensus.
+	old.Set("BBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBB", &RouterStatus{Bandwidth: 20, Flags: flags, Address: address})
+	new.Set("BBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBB", &RouterStatus{Bandwidth: 20, Flags: flags,
+		Address: RouterAddress{IPv4Address: net.ParseIP("1.2.3.4").To4(), IPv4ORPort: 9001}})
+	// A relay that gains the Guard flag, loses the Fast flag, and changes
+	// its bandwidth.
+	old.Set("CCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCC", &RouterStatus{Bandwidth: 30, Flags: flags, Address: address})
+	new.Set("CCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCC", &RouterStatus{Bandwidth: 40,
+		Flags: RouterFlags{Running: true, Valid: true, Guard: true}, Address: address})
+	// A relay that changes its port.
+	old.Set("DDDDDDDDDDDDDDDDDDDDDDDDDDDDDDDDDDDDDDDD", &RouterStatus{Bandwidth: 50, Flags: flags, Address: address})
+	new.Set("DDDDDDDDDDDDDDDDDDDDDDDDDDDDDDDDDDDDDDDD", &RouterStatus{Bandwidth: 50, Flags: flags,
+		Address: RouterAddress{IPv4Address: net.ParseIP("1.2.3.4"), IPv4ORPort: 443}})
+	// A relay that appears.
+	new.Set("EEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEE", &RouterStatus{Bandwidth: 60, Flags: flags, Address: address})
+
+	diff := DiffConsensus(old, new)
+
+	if !reflect.DeepEqual(diff.Added, []Fingerprint{"EEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEE"}) {
+		t.Errorf("Unexpected added relays %v.", diff.Added)
+	}
+	if !reflect.DeepEqual(diff.Removed, []Fingerprint{"AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA"}) {
+		t.Errorf("Unexpected removed relays %v.", diff.Removed)
+	}
+	if len(diff.Changed) != 2 {
+		t.Fatalf("Expected 2 changed relays but got %d.", len(diff.Changed))
+	}
+
+	change := diff.Changed[0]
+	if change.Fingerprint != "CCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCC" {
+		t.Errorf("Unexpected changed relay %s.", change.Fingerprint)
+	}
+	if !reflect.DeepEqual(change.FlagsAdded, []string{"Guard"}) ||
+		!reflect.DeepEqual(change.FlagsRemoved, []string{"Fast"}) {
+		t.Errorf("Unexpected flag changes +%v -%v.", change.FlagsAdded, change.FlagsRemoved)
+	}
+	if !change.BandwidthChanged() || change.OldBandwidth != 30 || change.NewBandwidth != 40 {
+		t.Error("Bandwidth change not detected.")
+	}
+	if change.AddressChanged() {
+		t.Error("Detected address change where there was none.")
+	}
+
+	change = diff.Changed[1]
+	if change.Fingerprint != "DDDDDDDDDDDDDDDDDDDDDDDDDDDDDDDDDDDDDDDD" {
+		t.Errorf("Unexpected changed relay %s.", change.Fingerprint)
+	}
+	if !change.AddressChanged() || change.NewAddress.IPv4ORPort != 443 {
+		t.Error("Address change not detected.")
+	}
+	if change.FlagsChanged() || change.BandwidthChanged() {
+		t.Error("Detected flag or bandwidth change where there was none.")
+	}
+
+	// A consensus compared with itself must not differ.
+	diff = DiffConsensus(old, old)
+	if len(diff.Added) != 0 || len(diff.Removed) != 0 || len(diff.Changed) != 0 {
+		t.Error("Consensus differs from itself.")
+	}
+}
+
+func TestChurnStats(t *testing.T) {
+
+	old := NewConsensus()
+	new := NewConsensus()
+
+	old.Set("AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA", &RouterStatus{Bandwidth: 10})
+	old.Set("BBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBB", &RouterStatus{Bandwidth: 20})
+	new.Set("BBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBB", &RouterStatus{Bandwidth: 30})
+	new.Set("CCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCC", &RouterStatus{Bandwidth: 40})
+
+	// 10 left and 40 joined out of a total of 100.
+	churn := ChurnStats(old, new)
+	if churn != (Churn{JoinedCount: 1, LeftCount: 1, StableCount: 1, BandwidthChurn: 0.5}) {
+		t.Errorf("Unexpected churn %+v.", churn)
+	}
+
+	// All relays join an empty consensus.
+	churn = ChurnStats(NewConsensus(), new)
+	if churn != (Churn{JoinedCount: 2, BandwidthChurn: 1}) {
+		t.Errorf("Unexpected churn %+v for empty old consensus.", churn)
+	}
+
+	// A consensus compared with itself has no churn.
+	churn = ChurnStats(old, old)
+	if churn != (Churn{StableCount: 2}) {
+		t.Errorf("Unexpected churn %+v for identical consensuses.", churn)
+	}
+
+	if churn = ChurnStats(NewConsensus(), NewConsensus()); churn != (Churn{}) {
+		t.Errorf("Unexpected churn %+v for empty consensuses.", churn)
+	}
+}
@@ -0,0 +1,547 @@
+// Parses files containing extra-info descriptors.
+
+package zoossh
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// We (try to) support the extra-info descriptors of relays as well as those
+// of bridges, sanitised or not.
+var extraInfoMatcher AnnotationMatcher = func(observed *Annotation) bool {
+
+	return MatchAnnotationMajor("extra-info", "1")(observed) ||
+		MatchAnnotationMajor("bridge-extra-info", "1")(observed)
+}
+
+// extractExtraInfo is a bufio.SplitFunc that extracts individual extra-info
+// descriptors.
+var extractExtraInfo = extractByKeyword("extra-info")
+
+// Transport represents a pluggable transport as advertised in a "transport"
+// line.
+type Transport struct {
+	// The transport's name, e.g., "obfs4".
+	Name string
+
+	// The address and port that the transport listens on.  Sanitised bridge
+	// extra-info descriptors lack them.
+	Address net.IP
+	Port    uint16
+
+	// The transport's arguments, e.g., "cert" and "iat-mode" for obfs4.
+	Args map[string]string
+}
+
+// An (incomplete) extra-info descriptor as defined in dirspec.txt, Section
+// 2.1.2.
+type ExtraInfo struct {
+
+	// The single fields of an "extra-info" line.
+	Nickname    string
+	Fingerprint Fingerprint
+
+	// The single fields of a "published" line.
+	Published time.Time
+
+	// The "transport" lines, in the order in which they appear.
+	Transports []Transport
+
+	// The number of unique client IP addresses per country code, as reported
+	// in the "bridge-ips" line.  Bridges round these numbers up to multiples
+	// of 8.  The map is nil if the line is missing.
+	BridgeIPs map[string]uint64
+
+	// The number of unique client IP addresses per pluggable transport, as
+	// reported in the "bridge-ip-transports" line.  Clients that connect
+	// without a transport are counted as "<OR>".  The map is nil if the line
+	// is missing.
+	BridgeIPTransports map[string]uint64
+
+	// The end and the length of the interval that the bridge statistics,
+	// e.g., BridgeIPs, cover, as reported in the "bridge-stats-end" line.
+	// Both are zero if the line is missing.
+	BridgeStatsEnd      time.Time
+	BridgeStatsInterval time.Duration
+
+	// The number of directory requests per country code, as reported in the
+	// "dirreq-v3-reqs" line.  Relays and bridges round these numbers up to
+	// multiples of 8.  The map is nil if the line is missing.
+	DirReqV3Reqs map[string]uint64
+
+	// The "overload-ratelimits" line, which tells us when the relay last hit
+	// its bandwidth rate limits.  It is nil if the line is missing.
+	OverloadRateLimits *OverloadRateLimits
+
+	// The timestamp of an "overload-fd-exhausted" line, i.e., when the relay
+	// last ran out of file descriptors.  It is nil if the line is missing.
+	OverloadFDExhausted *time.Time
+}
+
+type ExtraInfos struct {
+
+	// A map from relay fingerprint to the extra-info descriptor.
+	ExtraInfos map[Fingerprint]*ExtraInfo
+}
+
+// NewExtraInfos serves as a constructor and returns a pointer to a freshly
+// allocated and empty ExtraInfos struct.
+func NewExtraInfos() *ExtraInfos {
+
+	return &ExtraInfos{ExtraInfos: make(map[Fingerprint]*ExtraInfo)}
+}
+
+// String implements the String as well as the Object interface.  It returns
+// the extra-info descriptor's string representation.
+func (e *ExtraInfo) String() string {
+
+	transports := make([]string, len(e.Transports))
+	for i, transport := range e.Transports {
+		transports[i] = transport.Name
+	}
+
+	return fmt.Sprintf("%s,%s,%s,%s",
+		e.Fingerprint,
+		e.Nickname,
+		e.Published.Format(time.RFC3339),
+		strings.Join(transports, "|"))
+}
+
+// GetFingerprint implements the Object interface.  It returns the extra-info
+// descriptor's fingerprint.
+func (e *ExtraInfo) GetFingerprint() Fingerprint {
+
+	return e.Fingerprint
+}
+
+// Equals implements the Object interface.  It returns true if the given object
+// is an extra-info descriptor whose fields are equal to the fields of this
+// extra-info descriptor.
+func (e *ExtraInfo) Equals(other Object) bool {
+
+	o, ok := other.(*ExtraInfo)
+	if !ok || e == nil || o == nil {
+		return ok && e == o
+	}
+
+	if e.Nickname != o.Nickname || e.Fingerprint != o.Fingerprint ||
+		!e.Published.Equal(o.Published) || len(e.Transports) != len(o.Transports) ||
+		!countsEqual(e.BridgeIPs, o.BridgeIPs) ||
+		!countsEqual(e.BridgeIPTransports, o.BridgeIPTransports) ||
+		!e.BridgeStatsEnd.Equal(o.BridgeStatsEnd) || e.BridgeStatsInterval != o.BridgeStatsInterval ||
+		!countsEqual(e.DirReqV3Reqs, o.DirReqV3Reqs) ||
+		!e.OverloadRateLimits.Equals(o.OverloadRateLimits) ||
+		!timePtrsEqual(e.OverloadFDExhausted, o.OverloadFDExhausted) {
+		return false
+	}
+
+	for i := range e.Transports {
+		if !e.Transports[i].Equals(o.Transports[i]) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// countsEqual checks whether the two given maps hold the same counts for the
+// same keys.
+func countsEqual(a, b map[string]uint64) bool {
+
+	if len(a) != len(b) {
+		return false
+	}
+	for key, count := range a {
+		if otherCount, exists := b[key]; !exists || count != otherCount {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Equals checks whether the two given transports are equal.
+func (t Transport) Equals(other Transport) bool {
+
+	if t.Name != other.Name || !t.Address.Equal(other.Address) ||
+		t.Port != other.Port || len(t.Args) != len(other.Args) {
+		return false
+	}
+
+	for key, value := range t.Args {
+		if otherValue, exists := other.Args[key]; !exists || value != otherValue {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Length implements the ObjectSet interface.  It returns the length of the
+// extra-info descriptors.
+func (es *ExtraInfos) Length() int {
+
+	return len(es.ExtraInfos)
+}
+
+// Iterate implements the ObjectSet interface.  Using a channel, it iterates
+// over and returns all extra-info descriptors.  The given object filter can be
+// used to filter extra-info descriptors by fingerprint and nickname.
+func (es *ExtraInfos) Iterate(filter *ObjectFilter) <-chan Object {
+
+	ch := make(chan Object)
+
+	go func() {
+		for _, extraInfo := range es.ExtraInfos {
+			if filter == nil || filter.IsEmpty() ||
+				filter.HasFingerprint(extraInfo.Fingerprint) || filter.HasNickname(extraInfo.Nickname) {
+				ch <- extraInfo
+			}
+		}
+		close(ch)
+	}()
+
+	return ch
+}
+
+// GetObject implements the ObjectSet interface.  It returns the object
+// identified by the given fingerprint.  If the object is not present in the
+// set, false is returned, otherwise true.
+func (es *ExtraInfos) GetObject(fingerprint Fingerprint) (Object, bool) {
+
+	return es.Get(fingerprint)
+}
+
+// Merge merges the given object set with itself.  Extra-info descriptors of
+// the given set replace existing ones with the same fingerprint.
+func (es *ExtraInfos) Merge(objs ObjectSet) {
+
+	for obj := range objs.Iterate(nil) {
+		if extraInfo, ok := obj.(*ExtraInfo); ok {
+			es.ExtraInfos[SanitiseFingerprint(extraInfo.Fingerprint)] = extraInfo
+		}
+	}
+}
+
+// Get returns the extra-info descriptor for the given fingerprint and a
+// boolean value indicating if the descriptor could be found.
+func (es *ExtraInfos) Get(fingerprint Fingerprint) (*ExtraInfo, bool) {
+
+	extraInfo, exists := es.ExtraInfos[SanitiseFingerprint(fingerprint)]
+	return extraInfo, exists
+}
+
+// ToSlice converts the given extra-info descriptors to a slice, ordered by
+// fingerprint.
+func (es *ExtraInfos) ToSlice() []*ExtraInfo {
+
+	fingerprints := make([]string, 0, len(es.ExtraInfos))
+	for fingerprint := range es.ExtraInfos {
+		fingerprints = append(fingerprints, string(fingerprint))
+	}
+	sort.Strings(fingerprints)
+
+	extraInfos := make([]*ExtraInfo, len(fingerprints))
+	for i, fingerprint := range fingerprints {
+		extraInfos[i] = es.ExtraInfos[Fingerprint(fingerprint)]
+	}
+
+	return extraInfos
+}
+
+// parseTransport parses the arguments of a "transport" line, i.e., the
+// transport's name, optionally followed by its address and port and a
+// comma-separated list of key=value arguments.
+func parseTransport(words []string) (Transport, error) {
+
+	var transport Transport
+
+	if len(words) < 1 {
+		return transport, fmt.Errorf("missing transport name")
+	}
+	transport.Name = words[0]
+
+	if len(words) > 1 {
+		host, port, err := net.SplitHostPort(words[1])
+		if err != nil {
+			return transport, err
+		}
+		transport.Address = net.ParseIP(host)
+		if transport.Address == nil {
+			return transport, fmt.Errorf("invalid transport address %q", host)
+		}
+		transport.Port = StringToPort(port)
+	}
+
+	if len(words) > 2 {
+		transport.Args = make(map[string]string)
+		for _, arg := range strings.Split(strings.Join(words[2:], " "), ",") {
+			keyValue := strings.SplitN(arg, "=", 2)
+			if len(keyValue) != 2 {
+				return transport, fmt.Errorf("expected key=value pair but got %q", arg)
+			}
+			transport.Args[keyValue[0]] = keyValue[1]
+		}
+	}
+
+	return transport, nil
+}
+
+// parseCounts parses the comma-separated key=count pairs of lines such as
+// "bridge-ips" and "dirreq-v3-reqs", e.g., "cn=16,us=8".
+func parseCounts(words []string) (map[string]uint64, error) {
+
+	counts := make(map[string]uint64)
+
+	for _, word := range words {
+		for _, pair := range strings.Split(word, ",") {
+			if pair == "" {
+				continue
+			}
+			keyValue := strings.SplitN(pair, "=", 2)
+			if len(keyValue) != 2 || keyValue[0] == "" {
+				return nil, fmt.Errorf("expected key=count pair but got %q", pair)
+			}
+			count, err := strconv.ParseUint(keyValue[1], 10, 64)
+			if err != nil {
+				return nil, err
+			}
+			counts[keyValue[0]] = count
+		}
+	}
+
+	return counts, nil
+}
+
+// parseStatsEnd parses the fields of lines such as "bridge-stats-end", i.e., the
+// end of a statistics interval followed by the interval's length in seconds,
+// e.g., "2017-04-14 13:17:47 (86400 s)".
+func parseStatsEnd(words []string) (time.Time, time.Duration, error) {
+
+	if len(words) != 4 || !strings.HasPrefix(words[2], "(") || words[3] != "s)" {
+		return time.Time{}, 0, fmt.Errorf("expected \"YYYY-MM-DD HH:MM:SS (NSEC s)\" but got %q",
+			strings.Join(words, " "))
+	}
+
+	end, err := time.Parse(publishedTimeLayout, words[0]+" "+words[1])
+	if err != nil {
+		return time.Time{}, 0, err
+	}
+	seconds, err := strconv.ParseUint(words[2][1:], 10, 32)
+	if err != nil {
+		return time.Time{}, 0, err
+	}
+
+	return end, time.Duration(seconds) * time.Second, nil
+}
+
+// OverloadRateLimits represents an "overload-ratelimits" line, i.e., the
+// relay's bandwidth limits and how often it hit them.
+type OverloadRateLimits struct {
+	// When the relay last hit its rate limits.
+	Time time.Time
+
+	// The relay's configured rate and burst limit in bytes per second.
+	RateLimit  uint64
+	BurstLimit uint64
+
+	// How often the relay's read and write limits were hit.
+	ReadOverloadCount  uint64
+	WriteOverloadCount uint64
+}
+
+// Equals returns true if the given rate limits are either both nil or equal.
+func (limits *OverloadRateLimits) Equals(other *OverloadRateLimits) bool {
+
+	if limits == nil || other == nil {
+		return limits == other
+	}
+
+	return limits.Time.Equal(other.Time) &&
+		limits.RateLimit == other.RateLimit &&
+		limits.BurstLimit == other.BurstLimit &&
+		limits.ReadOverloadCount == other.ReadOverloadCount &&
+		limits.WriteOverloadCount == other.WriteOverloadCount
+}
+
+// parseOverloadRateLimits parses the words of an "overload-ratelimits" line,
+// i.e., the keyword, a version, a timestamp, the rate and burst limit, and
+// the read and write overload counts.
+func parseOverloadRateLimits(words []string) (*OverloadRateLimits, error) {
+
+	if len(words) < 8 {
+		return nil, fmt.Errorf("expected 8 fields but got %d", len(words))
+	}
+	overloaded, err := parseOverloadTime(words[:4])
+	if err != nil {
+		return nil, err
+	}
+
+	limits := &OverloadRateLimits{Time: *overloaded}
+	values := []*uint64{&limits.RateLimit, &limits.BurstLimit, &limits.ReadOverloadCount, &limits.WriteOverloadCount}
+	for i, word := range words[4:8] {
+		if *values[i], err = strconv.ParseUint(word, 10, 64); err != nil {
+			return nil, fmt.Errorf("malformed value %q", word)
+		}
+	}
+
+	return limits, nil
+}
+
+// ParseRawExtraInfo parses a raw extra-info descriptor (in string format) and
+// returns the extra-info descriptor if parsing was successful.
+func ParseRawExtraInfo(rawExtraInfo string) (*ExtraInfo, error) {
+
+	var extraInfo = new(ExtraInfo)
+
+	for i, line := range strings.Split(rawExtraInfo, "\n") {
+
+		words := strings.Fields(line)
+		if len(words) == 0 {
+			continue
+		}
+
+		// Wraps the given error in a ParseError for the current line.
+		fail := func(err error) (*ExtraInfo, error) {
+			return nil, newParseError(i+1, line, words[0], err)
+		}
+
+		switch words[0] {
+
+		case "extra-info":
+			if len(words) < 3 {
+				return fail(fmt.Errorf("expected 3 fields but got %d", len(words)))
+			}
+			extraInfo.Nickname = words[1]
+			extraInfo.Fingerprint = SanitiseFingerprint(Fingerprint(words[2]))
+
+		case "published":
+			published, err := time.Parse(publishedTimeLayout, strings.Join(words[1:], " "))
+			if err != nil {
+				return fail(err)
+			}
+			extraInfo.Published = published
+
+		case "transport":
+			transport, err := parseTransport(words[1:])
+			if err != nil {
+				return fail(err)
+			}
+			extraInfo.Transports = append(extraInfo.Transports, transport)
+
+		case "bridge-ips":
+			counts, err := parseCounts(words[1:])
+			if err != nil {
+				return fail(err)
+			}
+			extraInfo.BridgeIPs = counts
+
+		case "bridge-ip-transports":
+			counts, err := parseCounts(words[1:])
+			if err != nil {
+				return fail(err)
+			}
+			extraInfo.BridgeIPTransports = counts
+
+		case "bridge-stats-end":
+			end, interval, err := parseStatsEnd(words[1:])
+			if err != nil {
+				return fail(err)
+			}
+			extraInfo.BridgeStatsEnd, extraInfo.BridgeStatsInterval = end, interval
+
+		case "dirreq-v3-reqs":
+			counts, err := parseCounts(words[1:])
+			if err != nil {
+				return fail(err)
+			}
+			extraInfo.DirReqV3Reqs = counts
+
+		case "overload-ratelimits":
+			limits, err := parseOverloadRateLimits(words)
+			if err != nil {
+				return fail(err)
+			}
+			extraInfo.OverloadRateLimits = limits
+
+		case "overload-fd-exhausted":
+			overloaded, err := parseOverloadTime(words)
+			if err != nil {
+				return fail(err)
+			}
+			extraInfo.OverloadFDExhausted = overloaded
+		}
+	}
+
+	return extraInfo, nil
+}
+
+// parseExtraInfoUnchecked parses a document containing extra-info
+// descriptors.  The input should be without a type annotation; i.e., the type
+// annotation should already have been read and checked to be the correct
+// type.  The given settings apply to parsing.
+func parseExtraInfoUnchecked(r io.Reader, options *parseOptions) (*ExtraInfos, error) {
+
+	var extraInfos = NewExtraInfos()
+
+	// We will read raw extra-info descriptors from this channel.
+	queue := make(chan QueueUnit)
+	// The type annotation took up the first line.
+	go dissectFile(r, extractExtraInfo, queue, 2)
+	duplicates := newDuplicateTracker(options)
+
+	for unit := range queue {
+		if unit.Err != nil {
+			return nil, unit.Err
+		}
+
+		extraInfo, err := ParseRawExtraInfo(unit.Blurb)
+		if err != nil {
+			return nil, offsetParseError(err, unit.Line-1)
+		}
+
+		if keep, err := duplicates.keep(extraInfo.Fingerprint, unit.Line); err != nil {
+			return nil, err
+		} else if !keep {
+			continue
+		}
+
+		extraInfos.ExtraInfos[extraInfo.Fingerprint] = extraInfo
+	}
+
+	return extraInfos, nil
+}
+
+// ParseExtraInfoFile parses the given file containing the extra-info
+// descriptors of relays or bridges and returns a pointer to ExtraInfos if
+// parsing was successful.  If there were any errors, an error string is
+// returned.
+func ParseExtraInfoFile(fileName string) (*ExtraInfos, error) {
+
+	return ParseExtraInfoFileWithOptions(fileName)
+}
+
+// ParseExtraInfoFileWithOptions works like ParseExtraInfoFile but applies the
+// given options.
+func ParseExtraInfoFileWithOptions(fileName string, opts ...ParseOption) (*ExtraInfos, error) {
+
+	fd, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+
+	r, err := readAndMatchAnnotation(fd, extraInfoMatcher)
+	if err != nil {
+		return nil, err
+	}
+
+	return parseExtraInfoUnchecked(r, newParseOptions(opts))
+}
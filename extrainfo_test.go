@@ -0,0 +1,127 @@
+// Tests functions from "extrainfo.go".
+
+package zoossh
+
+import (
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseExtraInfoFile(t *testing.T) {
+
+	// Only run this test if the extra-info file is there.
+	if _, err := os.Stat(bridgeExtraInfoFile); os.IsNotExist(err) {
+		t.Skipf("skipping because of missing %s", bridgeExtraInfoFile)
+	}
+
+	extraInfos, err := ParseExtraInfoFile(bridgeExtraInfoFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if extraInfos.Length() != 2 {
+		t.Errorf("Expected 2 extra-info descriptors but got %d.", extraInfos.Length())
+	}
+
+	extraInfo, found := extraInfos.Get("00408EC8DA1E2AB279DF2F332C79AF389AB85D02")
+	if !found {
+		t.Fatal("Extra-info descriptor not found.")
+	}
+	if len(extraInfo.Transports) != 2 {
+		t.Fatalf("Expected 2 transports but got %d.", len(extraInfo.Transports))
+	}
+
+	obfs4 := extraInfo.Transports[0]
+	if obfs4.Name != "obfs4" || obfs4.Address.String() != "10.94.227.130" || obfs4.Port != 44325 {
+		t.Errorf("obfs4 transport parsed incorrectly: %+v", obfs4)
+	}
+	if obfs4.Args["iat-mode"] != "0" || len(obfs4.Args["cert"]) != 70 {
+		t.Errorf("obfs4 transport arguments parsed incorrectly: %v", obfs4.Args)
+	}
+	if obfs3 := extraInfo.Transports[1]; obfs3.Name != "obfs3" || obfs3.Args != nil {
+		t.Errorf("obfs3 transport parsed incorrectly: %+v", obfs3)
+	}
+
+	expected := map[string]uint64{"cn": 8, "ir": 8, "us": 8}
+	if !reflect.DeepEqual(extraInfo.BridgeIPs, expected) {
+		t.Errorf("Parsed bridge-ips %v, expected %v.", extraInfo.BridgeIPs, expected)
+	}
+	expected = map[string]uint64{"<OR>": 8, "obfs4": 16}
+	if !reflect.DeepEqual(extraInfo.BridgeIPTransports, expected) {
+		t.Errorf("Parsed bridge-ip-transports %v, expected %v.", extraInfo.BridgeIPTransports, expected)
+	}
+	if !extraInfo.BridgeStatsEnd.Equal(time.Date(2017, 4, 14, 13, 17, 47, 0, time.UTC)) ||
+		extraInfo.BridgeStatsInterval != 24*time.Hour {
+		t.Errorf("Parsed bridge-stats-end %s (%s) incorrectly.", extraInfo.BridgeStatsEnd, extraInfo.BridgeStatsInterval)
+	}
+
+	// Sanitised transport lines lack an address.
+	extraInfo, found = extraInfos.Get("12B49D5C01CA5C41E6E00B049D336EDF3A0B41DC")
+	if !found {
+		t.Fatal("Extra-info descriptor not found.")
+	}
+	if transport := extraInfo.Transports[0]; transport.Name != "obfs4" || transport.Address != nil || transport.Port != 0 {
+		t.Errorf("Sanitised transport parsed incorrectly: %+v", transport)
+	}
+	if transport := extraInfo.Transports[1]; transport.Address.String() != "2001:db8::7" || transport.Port != 443 {
+		t.Errorf("IPv6 transport parsed incorrectly: %+v", transport)
+	}
+	if extraInfo.BridgeIPs != nil || extraInfo.BridgeIPTransports != nil || extraInfo.DirReqV3Reqs != nil ||
+		!extraInfo.BridgeStatsEnd.IsZero() {
+		t.Error("Extra-info descriptor without client statistics has statistics.")
+	}
+	if extraInfo.OverloadRateLimits != nil || extraInfo.OverloadFDExhausted != nil {
+		t.Error("Extra-info descriptor without overload lines is overloaded.")
+	}
+
+	if _, err := ParseRawExtraInfo("transport obfs4 10.94.227.130\n"); err == nil {
+		t.Error("Transport without port did not raise an error.")
+	}
+	if _, err := ParseRawExtraInfo("bridge-ips cn=8,us\n"); err == nil {
+		t.Error("Malformed bridge-ips line did not raise an error.")
+	}
+	if _, err := ParseRawExtraInfo("bridge-ip-transports obfs4=many\n"); err == nil {
+		t.Error("Malformed bridge-ip-transports line did not raise an error.")
+	}
+
+	extraInfo, err = ParseRawExtraInfo("extra-info foo 0000000000000000000000000000000000000000\n" +
+		"dirreq-v3-reqs de=16,ru=8,??=8\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = map[string]uint64{"de": 16, "ru": 8, "??": 8}
+	if !reflect.DeepEqual(extraInfo.DirReqV3Reqs, expected) {
+		t.Errorf("Parsed dirreq-v3-reqs %v, expected %v.", extraInfo.DirReqV3Reqs, expected)
+	}
+	// Relays that haven't seen requests yet publish an empty line.
+	if extraInfo, err := ParseRawExtraInfo("dirreq-v3-reqs\n"); err != nil || extraInfo.DirReqV3Reqs == nil ||
+		len(extraInfo.DirReqV3Reqs) != 0 {
+		t.Errorf("Empty dirreq-v3-reqs line resulted in (%v, %v).", extraInfo, err)
+	}
+	extraInfo, err = ParseRawExtraInfo("extra-info foo 0000000000000000000000000000000000000000\n" +
+		"overload-ratelimits 1 2023-01-01 11:00:00 1048576 2097152 3 4\n" +
+		"overload-fd-exhausted 1 2023-01-01 12:00:00\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	limits := &OverloadRateLimits{time.Date(2023, time.January, 1, 11, 0, 0, 0, time.UTC), 1048576, 2097152, 3, 4}
+	if !extraInfo.OverloadRateLimits.Equals(limits) {
+		t.Errorf("Unexpected rate limit overload %+v.", extraInfo.OverloadRateLimits)
+	}
+	if extraInfo.OverloadFDExhausted == nil ||
+		!extraInfo.OverloadFDExhausted.Equal(time.Date(2023, time.January, 1, 12, 0, 0, 0, time.UTC)) {
+		t.Errorf("Unexpected file descriptor overload %v.", extraInfo.OverloadFDExhausted)
+	}
+
+	for _, line := range []string{"dirreq-v3-reqs de=x\n", "bridge-stats-end 2017-04-14 13:17:47\n",
+		"bridge-stats-end 2017-04-14 13:17:47 (x s)\n", "bridge-stats-end 2017-04-14 (86400 s)\n",
+		"overload-fd-exhausted 1 yesterday noon\n",
+		"overload-ratelimits 1 2023-01-01 11:00:00 1048576 2097152 3\n",
+		"overload-ratelimits 1 2023-01-01 11:00:00 1048576 2097152 3 -4\n"} {
+		if _, err := ParseRawExtraInfo(line); err == nil {
+			t.Errorf("Malformed line %q did not raise an error.", line)
+		}
+	}
+}
@@ -0,0 +1,144 @@
+// Provides functions to analyse the family declarations of relays.
+
+package zoossh
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// resolveFamilyMember turns the given entry of a "family" line into a
+// fingerprint.  Entries are either fingerprints, optionally followed by "=" or
+// "~" and a nickname, or nicknames.  Nicknames are resolved using the given
+// map from nicknames to fingerprints.  The function returns false if the
+// entry cannot be resolved.
+func resolveFamilyMember(entry string, nicknames map[string][]Fingerprint) (Fingerprint, bool) {
+
+	entry = strings.TrimPrefix(entry, "$")
+	if i := strings.IndexAny(entry, "=~"); i >= 0 {
+		entry = entry[:i]
+	}
+
+	if hexFingerprintRegexp.MatchString(entry) {
+		return SanitiseFingerprint(Fingerprint(entry)), true
+	}
+
+	// Nicknames are case-insensitive and not unique, so we only resolve
+	// those that belong to a single relay.
+	if fingerprints := nicknames[strings.ToLower(entry)]; len(fingerprints) == 1 {
+		return fingerprints[0], true
+	}
+
+	return "", false
+}
+
+// familyClaims maps every router descriptor in the given set to the set of
+// relays that it claims as family members.  Family entries that cannot be
+// resolved to a fingerprint are left out.  The function also returns the
+// router descriptors it found in the set.
+func familyClaims(descriptors ObjectSet) (map[Fingerprint]map[Fingerprint]bool, []*RouterDescriptor) {
+
+	var descs []*RouterDescriptor
+	nicknames := make(map[string][]Fingerprint)
+
+	for obj := range descriptors.Iterate(nil) {
+		desc, ok := obj.(*RouterDescriptor)
+		if !ok || desc == nil {
+			continue
+		}
+		descs = append(descs, desc)
+		nickname := strings.ToLower(desc.Nickname)
+		nicknames[nickname] = append(nicknames[nickname], SanitiseFingerprint(desc.Fingerprint))
+	}
+
+	claims := make(map[Fingerprint]map[Fingerprint]bool)
+	for _, desc := range descs {
+		fingerprint := SanitiseFingerprint(desc.Fingerprint)
+		members := make(map[Fingerprint]bool)
+		for entry := range desc.Family {
+			member, ok := resolveFamilyMember(string(entry), nicknames)
+			if ok && member != fingerprint {
+				members[member] = true
+			}
+		}
+		claims[fingerprint] = members
+	}
+
+	return claims, descs
+}
+
+// ResolveFamilies determines the mutual family relationships of the router
+// descriptors in the given set.  Two relays are in the same family if both of
+// them list each other in their "family" line, just like Tor requires.  Family
+// entries that consist of nicknames are resolved to fingerprints using the
+// given set if the nickname is unique.  The returned map contains, for each
+// relay that is part of a family, the sorted fingerprints of its family
+// members.  Relays whose family declarations are not reciprocated are not part
+// of the map.
+func ResolveFamilies(descriptors ObjectSet) map[Fingerprint][]Fingerprint {
+
+	claims, _ := familyClaims(descriptors)
+
+	families := make(map[Fingerprint][]Fingerprint)
+	for fingerprint, members := range claims {
+		var mutual []string
+		for member := range members {
+			if claims[member][fingerprint] {
+				mutual = append(mutual, string(member))
+			}
+		}
+		if len(mutual) == 0 {
+			continue
+		}
+
+		sort.Strings(mutual)
+		families[fingerprint] = make([]Fingerprint, len(mutual))
+		for i, member := range mutual {
+			families[fingerprint][i] = Fingerprint(member)
+		}
+	}
+
+	return families
+}
+
+// FamilyDOT writes the family declarations of the router descriptors as a
+// GraphViz DOT graph to the given writer.  Every relay is a node that is
+// identified by its fingerprint and labelled with its nickname, and every
+// family entry that can be resolved to a fingerprint is an edge from the
+// declaring relay to the declared one.  Mutual family relationships thus
+// appear as a pair of edges.  Nodes and edges are ordered by fingerprint.
+func (rds *RouterDescriptors) FamilyDOT(w io.Writer) error {
+
+	claims, descs := familyClaims(rds)
+
+	sort.Slice(descs, func(i, j int) bool {
+		return SanitiseFingerprint(descs[i].Fingerprint) < SanitiseFingerprint(descs[j].Fingerprint)
+	})
+
+	var buf bytes.Buffer
+	buf.WriteString("digraph family {\n")
+
+	for _, desc := range descs {
+		fmt.Fprintf(&buf, "\t%q [label=%q];\n", SanitiseFingerprint(desc.Fingerprint), desc.Nickname)
+	}
+
+	for _, desc := range descs {
+		fingerprint := SanitiseFingerprint(desc.Fingerprint)
+		var members []string
+		for member := range claims[fingerprint] {
+			members = append(members, string(member))
+		}
+		sort.Strings(members)
+		for _, member := range members {
+			fmt.Fprintf(&buf, "\t%q -> %q;\n", fingerprint, member)
+		}
+	}
+
+	buf.WriteString("}\n")
+
+	_, err := w.Write(buf.Bytes())
+	return err
+}
@@ -0,0 +1,99 @@
+// Tests functions from "family.go".
+
+package zoossh
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestResolveFamilies(t *testing.T) {
+
+	const (
+		fprA = "AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA"
+		fprB = "BBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBB"
+		fprC = "CCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCC"
+		fprD = "DDDDDDDDDDDDDDDDDDDDDDDDDDDDDDDDDDDDDDDD"
+	)
+
+	newDesc := func(nickname string, fingerprint Fingerprint, family ...Fingerprint) *RouterDescriptor {
+		desc := NewRouterDescriptor()
+		desc.Nickname = nickname
+		desc.Fingerprint = fingerprint
+		for _, member := range family {
+			desc.Family[member] = true
+		}
+		return desc
+	}
+
+	descriptors := NewRouterDescriptors()
+	// A and B list each other, B by nickname.
+	descriptors.Set(fprA, newDesc("alpha", fprA, "beta", "$"+fprC))
+	descriptors.Set(fprB, newDesc("beta", fprB, "$aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa=alpha"))
+	// C's claim of A isn't reciprocated.
+	descriptors.Set(fprC, newDesc("gamma", fprC, "$"+fprD))
+	// D lists C but also an ambiguous nickname.
+	descriptors.Set(fprD, newDesc("delta", fprD, "$"+fprC+"~gamma", "Unnamed"))
+
+	expected := map[Fingerprint][]Fingerprint{
+		fprA: {fprB},
+		fprB: {fprA},
+		fprC: {fprD},
+		fprD: {fprC},
+	}
+
+	families := ResolveFamilies(descriptors)
+	if !reflect.DeepEqual(families, expected) {
+		t.Errorf("Expected families %v but got %v.", expected, families)
+	}
+
+	if families := ResolveFamilies(NewRouterDescriptors()); len(families) != 0 {
+		t.Errorf("Expected no families but got %v.", families)
+	}
+}
+
+func TestFamilyDOT(t *testing.T) {
+
+	const (
+		fprA = "AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA"
+		fprB = "BBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBB"
+		fprC = "CCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCC"
+	)
+
+	descriptors := NewRouterDescriptors()
+	for _, desc := range []*RouterDescriptor{
+		{Nickname: "alpha", Fingerprint: fprA, Family: map[Fingerprint]bool{"$" + fprB: true, "gamma": true}},
+		{Nickname: "beta", Fingerprint: fprB, Family: map[Fingerprint]bool{"alpha": true}},
+		{Nickname: "gamma", Fingerprint: fprC, Family: map[Fingerprint]bool{"unknown": true}},
+	} {
+		descriptors.Set(desc.Fingerprint, desc)
+	}
+
+	var buf bytes.Buffer
+	if err := descriptors.FamilyDOT(&buf); err != nil {
+		t.Fatal(err)
+	}
+	dot := buf.String()
+
+	if !strings.HasPrefix(dot, "digraph family {\n") || !strings.HasSuffix(dot, "}\n") {
+		t.Errorf("Output is not a DOT digraph: %s", dot)
+	}
+
+	for _, expected := range []string{
+		`"` + fprA + `" [label="alpha"];`,
+		`"` + fprC + `" [label="gamma"];`,
+		`"` + fprA + `" -> "` + fprB + `";`,
+		`"` + fprA + `" -> "` + fprC + `";`,
+		`"` + fprB + `" -> "` + fprA + `";`,
+	} {
+		if !strings.Contains(dot, expected) {
+			t.Errorf("Output lacks %s: %s", expected, dot)
+		}
+	}
+
+	if n := strings.Count(dot, "->"); n != 3 {
+		t.Errorf("Expected 3 edges but got %d: %s", n, dot)
+	}
+}
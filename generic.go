@@ -3,7 +3,8 @@
 package zoossh
 
 import (
-	"fmt"
+	"bytes"
+	"context"
 	"io"
 	"net"
 	"os"
@@ -17,9 +18,14 @@ type Fingerprint string
 type Object interface {
 	String() string
 	GetFingerprint() Fingerprint
+	Equals(Object) bool
 }
 
 // ObjectSet defines functions that should be supported by a set of objects.
+// The methods of this interface, except for Merge, may be called by several
+// goroutines at once on the object sets of this package, but not while one of
+// them modifies the set.  Use SyncObjectSet for that.  Other methods of the
+// sets make no such promise unless they document it.
 type ObjectSet interface {
 	Length() int
 	Iterate(*ObjectFilter) <-chan Object
@@ -89,34 +95,136 @@ func NewObjectFilter() *ObjectFilter {
 	}
 }
 
+// Filter lazily filters the objects of the given set.  The returned channel
+// yields the objects for which the given predicate returns true, one at a
+// time as the consumer reads them, and is closed after the last object.
+// Consumers that stop reading early must cancel the given context, so that the
+// goroutines behind the channel terminate.  Filters can be chained using
+// FilterObjects.
+func Filter(ctx context.Context, set ObjectSet, pred func(Object) bool) <-chan Object {
+
+	return FilterObjects(ctx, set.Iterate(nil), pred)
+}
+
+// FilterObjects is like Filter but reads the objects from the given channel,
+// e.g., the channel returned by Filter or Iterate.  Once the context is
+// cancelled, the given channel is drained in the background, because the
+// goroutines behind Iterate cannot be stopped otherwise.
+func FilterObjects(ctx context.Context, objs <-chan Object, pred func(Object) bool) <-chan Object {
+
+	ch := make(chan Object)
+
+	go func() {
+		defer close(ch)
+		for obj := range objs {
+			if !pred(obj) {
+				continue
+			}
+			select {
+			case ch <- obj:
+			case <-ctx.Done():
+				for range objs {
+				}
+				return
+			}
+		}
+	}()
+
+	return ch
+}
+
 // parseWithAnnotation parses the input using a parser appropriate for the given
 // annotation.  The input should not have an annotation of its own (it should
 // already have been read).  Returns an error if the annotation is of an unknown
-// type.  Otherwise, returns the output of the chosen parser.
-func parseWithAnnotation(r io.Reader, annotation *Annotation) (ObjectSet, error) {
+// type.  Otherwise, returns the output of the chosen parser, which uses the
+// given settings.
+func parseWithAnnotation(r io.Reader, annotation *Annotation, options *parseOptions) (ObjectSet, error) {
 
 	// Use the annotation to find the right parser.
 	if _, ok := descriptorAnnotations[*annotation]; ok {
-		return parseDescriptorUnchecked(r, false)
+		return parseDescriptorUnchecked(r, false, options)
 	}
 
 	if _, ok := consensusAnnotations[*annotation]; ok {
-		return parseConsensusUnchecked(r, false)
+		return parseConsensusUnchecked(r, false, options)
+	}
+
+	if _, ok := voteAnnotations[*annotation]; ok {
+		return parseVoteUnchecked(r, options)
+	}
+
+	if _, ok := bridgeStatusAnnotations[*annotation]; ok {
+		return parseBridgeStatusUnchecked(r, options)
 	}
 
-	return nil, fmt.Errorf("could not find suitable parser")
+	if bridgeDescriptorMatcher(annotation) {
+		return parseBridgeDescriptorUnchecked(r, options)
+	}
+
+	if extraInfoMatcher(annotation) {
+		return parseExtraInfoUnchecked(r, options)
+	}
+
+	logParse(LogWarn, "unknown file annotation: %s", annotation)
+	return nil, &UnknownAnnotationError{annotation}
 }
 
 // ParseUnknown first reads a type annotation and passes it along with the rest
 // of the input to parseWithAnnotation.
 func ParseUnknown(r io.Reader) (ObjectSet, error) {
 
+	return ParseUnknownWithOptions(r)
+}
+
+// ParseUnknownWithOptions works like ParseUnknown but applies the given
+// options.
+func ParseUnknownWithOptions(r io.Reader, opts ...ParseOption) (ObjectSet, error) {
+
+	_, objs, err := ParseUnknownReaderWithOptions(r, opts...)
+	return objs, err
+}
+
+// ParseUnknownReader works like ParseUnknown but also returns the type
+// annotation that determined the parser.  The reader is consumed
+// progressively and never seeked, so it can be a stream such as the body of an
+// http.Response: only the annotation line is buffered before the rest of the
+// input is handed to the parser.  The annotation is returned along with parse
+// errors if it could be read.
+func ParseUnknownReader(r io.Reader) (*Annotation, ObjectSet, error) {
+
+	return ParseUnknownReaderWithOptions(r)
+}
+
+// ParseUnknownReaderWithOptions works like ParseUnknownReader but applies the
+// given options.
+func ParseUnknownReaderWithOptions(r io.Reader, opts ...ParseOption) (*Annotation, ObjectSet, error) {
+
 	annotation, r, err := readAnnotation(r)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	return parseWithAnnotation(r, annotation)
+	objs, err := parseWithAnnotation(r, annotation, newParseOptions(opts))
+	if err != nil {
+		return annotation, nil, err
+	}
+
+	return annotation, objs, nil
+}
+
+// ParseUnknownBytes attempts to parse the given byte slice whose content we
+// don't know.  Just like ParseUnknownFile, it uses the type annotation to pick
+// the right parser.
+func ParseUnknownBytes(b []byte) (ObjectSet, error) {
+
+	return ParseUnknownBytesWithOptions(b)
+}
+
+// ParseUnknownBytesWithOptions works like ParseUnknownBytes but applies the
+// given options.
+func ParseUnknownBytesWithOptions(b []byte, opts ...ParseOption) (ObjectSet, error) {
+
+	return ParseUnknownWithOptions(bytes.NewReader(b), opts...)
 }
 
 // ParseUnknownFile attempts to parse a file whose content we don't know.  We
@@ -124,11 +232,18 @@ func ParseUnknown(r io.Reader) (ObjectSet, error) {
 // ObjectSet is returned if parsing was successful.
 func ParseUnknownFile(fileName string) (ObjectSet, error) {
 
+	return ParseUnknownFileWithOptions(fileName)
+}
+
+// ParseUnknownFileWithOptions works like ParseUnknownFile but applies the given
+// options.
+func ParseUnknownFileWithOptions(fileName string, opts ...ParseOption) (ObjectSet, error) {
+
 	fd, err := os.Open(fileName)
 	if err != nil {
 		return nil, err
 	}
 	defer fd.Close()
 
-	return ParseUnknown(fd)
+	return ParseUnknownWithOptions(fd, opts...)
 }
@@ -3,8 +3,13 @@
 package zoossh
 
 import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
 	"net"
 	"os"
+	"strings"
 	"testing"
 )
 
@@ -31,6 +36,145 @@ func TestParseUnknownFile(t *testing.T) {
 	}
 }
 
+func TestParseUnknownAnnotationErrors(t *testing.T) {
+
+	_, err := ParseUnknownBytes([]byte("@type torperf 1.0\nfoo\n"))
+	if !errors.Is(err, ErrUnknownAnnotation) {
+		t.Fatalf("Expected ErrUnknownAnnotation but got %v.", err)
+	}
+	var unknown *UnknownAnnotationError
+	if !errors.As(err, &unknown) || unknown.Annotation.Type != "torperf" {
+		t.Errorf("Error %v does not tell the unknown type.", err)
+	}
+
+	for _, input := range []string{"", "router foo 1.2.3.4 9001 0 0\n", "no line break"} {
+		if _, err := ParseUnknownBytes([]byte(input)); !errors.Is(err, ErrNoAnnotation) {
+			t.Errorf("Expected ErrNoAnnotation for %q but got %v.", input, err)
+		}
+		if _, err := GetAnnotationType(strings.NewReader(input)); !errors.Is(err, ErrNoAnnotation) {
+			t.Errorf("Expected ErrNoAnnotation for %q but got %v.", input, err)
+		}
+	}
+
+	// Malformed annotations are neither missing nor unknown.
+	_, err = ParseUnknownBytes([]byte("@type server-descriptor\n"))
+	if err == nil || errors.Is(err, ErrNoAnnotation) || errors.Is(err, ErrUnknownAnnotation) {
+		t.Errorf("Unexpected error %v for malformed annotation.", err)
+	}
+
+	// Neither are malformed documents of a known type.
+	_, err = ParseUnknownBytes([]byte("@type server-descriptor 1.0\nrouter foo\n"))
+	if err == nil || errors.Is(err, ErrNoAnnotation) || errors.Is(err, ErrUnknownAnnotation) {
+		t.Errorf("Unexpected error %v for malformed descriptor.", err)
+	}
+}
+
+func TestParseUnknownReader(t *testing.T) {
+
+	// Only run this test if the descriptors file is there.
+	if _, err := os.Stat(serverDescriptorFile); os.IsNotExist(err) {
+		t.Skipf("skipping because of missing %s", serverDescriptorFile)
+	}
+
+	raw, err := ioutil.ReadFile(serverDescriptorFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected, err := ParseDescriptorBytes(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A pipe can't seek, just like the body of an HTTP response.
+	pr, pw := io.Pipe()
+	go func() {
+		for len(raw) > 0 {
+			n := 4096
+			if n > len(raw) {
+				n = len(raw)
+			}
+			if _, err := pw.Write(raw[:n]); err != nil {
+				return
+			}
+			raw = raw[n:]
+		}
+		pw.Close()
+	}()
+
+	annotation, objs, err := ParseUnknownReader(pr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if annotation.Type != "server-descriptor" {
+		t.Errorf("Expected server descriptor annotation but got %s.", annotation)
+	}
+	if objs.Length() != expected.Length() {
+		t.Errorf("Expected %d descriptors but got %d.", expected.Length(), objs.Length())
+	}
+
+	// The annotation is returned even if the document is malformed.
+	annotation, objs, err = ParseUnknownReader(strings.NewReader("@type server-descriptor 1.0\nrouter foo\n"))
+	if err == nil || objs != nil || annotation == nil || annotation.Type != "server-descriptor" {
+		t.Errorf("Malformed descriptor resulted in (%v, %v, %v).", annotation, objs, err)
+	}
+	if annotation, _, err := ParseUnknownReader(strings.NewReader("no annotation\n")); err == nil || annotation != nil {
+		t.Errorf("Missing annotation resulted in (%v, %v).", annotation, err)
+	}
+}
+
+// Test the functions that parse byte slices rather than files.
+func TestParseBytes(t *testing.T) {
+
+	// Only run this test if the consensus and descriptors files are there.
+	if _, err := os.Stat(consensusFile); os.IsNotExist(err) {
+		t.Skipf("skipping because of missing %s", consensusFile)
+	}
+	if _, err := os.Stat(serverDescriptorFile); os.IsNotExist(err) {
+		t.Skipf("skipping because of missing %s", serverDescriptorFile)
+	}
+
+	consensusBytes, err := ioutil.ReadFile(consensusFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	descriptorBytes, err := ioutil.ReadFile(serverDescriptorFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	consensus, err := ParseConsensusBytes(consensusBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	consensusFromFile, err := ParseConsensusFile(consensusFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if consensus.Length() != consensusFromFile.Length() {
+		t.Errorf("Expected %d router statuses but got %d.", consensusFromFile.Length(), consensus.Length())
+	}
+
+	descriptors, err := ParseDescriptorBytes(descriptorBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	descriptorsFromFile, err := ParseDescriptorFile(serverDescriptorFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if descriptors.Length() != descriptorsFromFile.Length() {
+		t.Errorf("Expected %d router descriptors but got %d.", descriptorsFromFile.Length(), descriptors.Length())
+	}
+
+	objs, err := ParseUnknownBytes(descriptorBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := objs.(*RouterDescriptors); !ok {
+		t.Errorf("Expected *RouterDescriptors but got %T.", objs)
+	}
+}
+
 func TestInterfaces(t *testing.T) {
 
 	testFingerprint := Fingerprint("9695DFC35FFEB861329B9F1AB04C46397020CE31")
@@ -244,3 +388,45 @@ func TestDescriptorFiltering(t *testing.T) {
 		t.Error("Processed unexpected number of router descriptors.", count)
 	}
 }
+
+func TestFilter(t *testing.T) {
+
+	set := NewSortedObjectSet()
+	for _, fingerprint := range []Fingerprint{
+		"0000000000000000000000000000000000000000",
+		"1111111111111111111111111111111111111111",
+		"2222222222222222222222222222222222222222",
+		"3333333333333333333333333333333333333333",
+	} {
+		status := &RouterStatus{Fingerprint: fingerprint, Nickname: "foo"}
+		if fingerprint[0] >= '2' {
+			status.Nickname = "bar"
+		}
+		set.Add(status)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Chain two filters.
+	bars := Filter(ctx, set, func(obj Object) bool {
+		return obj.(*RouterStatus).Nickname == "bar"
+	})
+	threes := FilterObjects(ctx, bars, func(obj Object) bool {
+		return obj.GetFingerprint()[0] == '3'
+	})
+	var got []Fingerprint
+	for obj := range threes {
+		got = append(got, obj.GetFingerprint())
+	}
+	if len(got) != 1 || got[0] != "3333333333333333333333333333333333333333" {
+		t.Errorf("Chained filters returned unexpected objects %v.", got)
+	}
+
+	// Stopping early and cancelling must close the channel.
+	all := Filter(ctx, set, func(Object) bool { return true })
+	<-all
+	cancel()
+	for range all {
+	}
+}
@@ -0,0 +1,193 @@
+// Provides functions to track relays across a sequence of consensuses.
+
+package zoossh
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// FlagInterval represents a period of time during which a relay continuously
+// held the given set of flags.
+type FlagInterval struct {
+	Start time.Time
+	End   time.Time
+	Flags RouterFlags
+}
+
+// FlagSnapshot represents the flags that a relay held in the consensus that
+// became valid at the given time.
+type FlagSnapshot struct {
+	ValidAfter time.Time
+	Flags      RouterFlags
+}
+
+// BuildFlagHistory determines the flags that every relay held in each of the
+// given consensuses.  The consensuses are processed in the order of their
+// valid-after times, regardless of the order in which they are given, so every
+// relay's snapshots are in chronological order.  A relay that is missing from
+// a consensus has no snapshot for its valid-after time.  The given slice is
+// left untouched, and nil consensuses are skipped.
+func BuildFlagHistory(consensuses []*Consensus) map[Fingerprint][]FlagSnapshot {
+
+	sorted := make([]*Consensus, 0, len(consensuses))
+	for _, c := range consensuses {
+		if c != nil {
+			sorted = append(sorted, c)
+		}
+	}
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].ValidAfter.Before(sorted[j].ValidAfter)
+	})
+
+	history := make(map[Fingerprint][]FlagSnapshot)
+	for _, c := range sorted {
+		for fingerprint, getStatus := range c.RouterStatuses {
+			status := getStatus()
+			if status == nil {
+				continue
+			}
+			history[fingerprint] = append(history[fingerprint], FlagSnapshot{c.ValidAfter, status.Flags})
+		}
+	}
+
+	return history
+}
+
+// CompressFlagTimeline encodes the given flag timeline in a compact binary
+// format.  Integers are encoded as varints, timestamps at a granularity of
+// seconds, and every interval's start is stored relative to the end of the
+// previous interval.  Relays are encoded in the order of their fingerprints, so
+// the output is deterministic.  Use DecompressFlagTimeline to decode the
+// result.
+func CompressFlagTimeline(t map[Fingerprint][]FlagInterval) []byte {
+
+	var buf []byte
+	var scratch [binary.MaxVarintLen64]byte
+
+	putUvarint := func(x uint64) {
+		n := binary.PutUvarint(scratch[:], x)
+		buf = append(buf, scratch[:n]...)
+	}
+	putVarint := func(x int64) {
+		n := binary.PutVarint(scratch[:], x)
+		buf = append(buf, scratch[:n]...)
+	}
+
+	fingerprints := make([]string, 0, len(t))
+	for fpr := range t {
+		fingerprints = append(fingerprints, string(fpr))
+	}
+	sort.Strings(fingerprints)
+
+	putUvarint(uint64(len(fingerprints)))
+	for _, fpr := range fingerprints {
+		intervals := t[Fingerprint(fpr)]
+
+		putUvarint(uint64(len(fpr)))
+		buf = append(buf, fpr...)
+
+		putUvarint(uint64(len(intervals)))
+		var prev int64
+		for _, interval := range intervals {
+			start := interval.Start.Unix()
+			end := interval.End.Unix()
+			putVarint(start - prev)
+			putVarint(end - start)
+			putUvarint(uint64(interval.Flags.bits()))
+			prev = end
+		}
+	}
+
+	return buf
+}
+
+// DecompressFlagTimeline decodes a flag timeline that was encoded by
+// CompressFlagTimeline.  All timestamps are returned in UTC.  An error is
+// returned if the given data is truncated or malformed.
+func DecompressFlagTimeline(b []byte) (map[Fingerprint][]FlagInterval, error) {
+
+	errTruncated := errors.New("truncated flag timeline")
+
+	uvarint := func() (uint64, error) {
+		x, n := binary.Uvarint(b)
+		if n <= 0 {
+			return 0, errTruncated
+		}
+		b = b[n:]
+		return x, nil
+	}
+	varint := func() (int64, error) {
+		x, n := binary.Varint(b)
+		if n <= 0 {
+			return 0, errTruncated
+		}
+		b = b[n:]
+		return x, nil
+	}
+
+	numRelays, err := uvarint()
+	if err != nil {
+		return nil, err
+	}
+
+	timeline := make(map[Fingerprint][]FlagInterval)
+	for i := uint64(0); i < numRelays; i++ {
+		fprLen, err := uvarint()
+		if err != nil {
+			return nil, err
+		}
+		if fprLen > uint64(len(b)) {
+			return nil, errTruncated
+		}
+		fpr := Fingerprint(b[:fprLen])
+		b = b[fprLen:]
+
+		numIntervals, err := uvarint()
+		if err != nil {
+			return nil, err
+		}
+		// Every interval takes up at least three bytes.
+		if numIntervals > uint64(len(b)/3) {
+			return nil, errTruncated
+		}
+
+		intervals := make([]FlagInterval, numIntervals)
+		var prev int64
+		for j := range intervals {
+			startDelta, err := varint()
+			if err != nil {
+				return nil, err
+			}
+			duration, err := varint()
+			if err != nil {
+				return nil, err
+			}
+			bits, err := uvarint()
+			if err != nil {
+				return nil, err
+			}
+			if bits > 0xffff {
+				return nil, fmt.Errorf("invalid flag bits %#x for %s", bits, fpr)
+			}
+
+			start := prev + startDelta
+			intervals[j] = FlagInterval{
+				Start: time.Unix(start, 0).UTC(),
+				End:   time.Unix(start+duration, 0).UTC(),
+				Flags: routerFlagsFromBits(uint16(bits)),
+			}
+			prev = start + duration
+		}
+		timeline[fpr] = intervals
+	}
+
+	if len(b) != 0 {
+		return nil, fmt.Errorf("%d trailing bytes after flag timeline", len(b))
+	}
+
+	return timeline, nil
+}
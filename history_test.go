@@ -0,0 +1,94 @@
+// Tests functions from "history.go".
+
+package zoossh
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestFlagTimelineCompression(t *testing.T) {
+
+	hour := func(h int) time.Time {
+		return time.Date(2014, time.December, 8, h, 0, 0, 0, time.UTC)
+	}
+
+	timeline := map[Fingerprint][]FlagInterval{
+		"9695DFC35FFEB861329B9F1AB04C46397020CE31": {
+			{hour(0), hour(3), RouterFlags{Fast: true, Running: true, Valid: true}},
+			{hour(5), hour(9), RouterFlags{Fast: true, Guard: true, Running: true, Valid: true}},
+		},
+		"CCEF02AA454C0AB0FE1AC68304F6D8C4220C1912": {
+			{hour(1), hour(2), RouterFlags{Authority: true, V2Dir: true}},
+		},
+		"F8E9F7D30ED7F541FD248945FAA2B593AD5E584D": {},
+	}
+
+	compressed := CompressFlagTimeline(timeline)
+
+	decompressed, err := DecompressFlagTimeline(compressed)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(timeline["9695DFC35FFEB861329B9F1AB04C46397020CE31"],
+		decompressed["9695DFC35FFEB861329B9F1AB04C46397020CE31"]) {
+		t.Error("Flag timeline did not survive round trip.")
+	}
+
+	if !reflect.DeepEqual(timeline["CCEF02AA454C0AB0FE1AC68304F6D8C4220C1912"],
+		decompressed["CCEF02AA454C0AB0FE1AC68304F6D8C4220C1912"]) {
+		t.Error("Flag timeline did not survive round trip.")
+	}
+
+	if len(decompressed) != len(timeline) {
+		t.Errorf("Expected %d relays but got %d.", len(timeline), len(decompressed))
+	}
+
+	// Truncated input must result in an error rather than a partial timeline.
+	if _, err := DecompressFlagTimeline(compressed[:len(compressed)-1]); err == nil {
+		t.Error("Truncated flag timeline did not raise an error.")
+	}
+}
+
+func TestBuildFlagHistory(t *testing.T) {
+
+	start := time.Date(2017, 4, 15, 0, 0, 0, 0, time.UTC)
+	var consensuses []*Consensus
+	for i := 0; i < 3; i++ {
+		c := NewConsensus()
+		c.ValidAfter = start.Add(time.Duration(i) * time.Hour)
+		c.Set("AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA", &RouterStatus{Flags: RouterFlags{Running: true, Guard: i > 0}})
+		if i != 1 {
+			c.Set("BBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBB", &RouterStatus{Flags: RouterFlags{Exit: true}})
+		}
+		consensuses = append(consensuses, c)
+	}
+
+	// The input order must not matter.
+	shuffled := []*Consensus{consensuses[2], nil, consensuses[0], consensuses[1]}
+	history := BuildFlagHistory(shuffled)
+	if shuffled[0] != consensuses[2] {
+		t.Error("Input slice was modified.")
+	}
+
+	expected := map[Fingerprint][]FlagSnapshot{
+		"AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA": {
+			{start, RouterFlags{Running: true}},
+			{start.Add(time.Hour), RouterFlags{Running: true, Guard: true}},
+			{start.Add(2 * time.Hour), RouterFlags{Running: true, Guard: true}},
+		},
+		"BBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBB": {
+			{start, RouterFlags{Exit: true}},
+			{start.Add(2 * time.Hour), RouterFlags{Exit: true}},
+		},
+	}
+	if !reflect.DeepEqual(history, expected) {
+		t.Errorf("Expected flag history\n%v\nbut got\n%v", expected, history)
+	}
+
+	if history := BuildFlagHistory(nil); len(history) != 0 {
+		t.Errorf("Expected empty flag history but got %v.", history)
+	}
+}
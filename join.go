@@ -0,0 +1,44 @@
+// Provides functions to combine consensuses with router descriptors.
+
+package zoossh
+
+// RelayInfo combines a relay's router status with the router descriptor that
+// the status references.  The descriptor is nil if it is unavailable.
+type RelayInfo struct {
+	*RouterStatus
+	*RouterDescriptor
+}
+
+// JoinConsensus pairs every router status in the given consensus with the
+// router descriptor that it references.  Descriptors are matched by their
+// digest rather than their fingerprint, so a stale descriptor of the same
+// relay is not mistaken for the referenced one.  The function also returns
+// the number of router statuses without a matching descriptor, which tells
+// how complete the given descriptors are.
+func JoinConsensus(c *Consensus, descriptors ObjectSet) (map[Fingerprint]*RelayInfo, int) {
+
+	byDigest := make(map[string]*RouterDescriptor)
+	for object := range descriptors.Iterate(nil) {
+		if desc, ok := object.(*RouterDescriptor); ok && desc != nil && desc.Digest != "" {
+			byDigest[desc.Digest] = desc
+		}
+	}
+
+	joined := make(map[Fingerprint]*RelayInfo)
+	unmatched := 0
+
+	for fingerprint, getStatus := range c.RouterStatuses {
+		status := getStatus()
+		if status == nil {
+			continue
+		}
+
+		desc := byDigest[status.Digest]
+		if desc == nil {
+			unmatched++
+		}
+		joined[fingerprint] = &RelayInfo{status, desc}
+	}
+
+	return joined, unmatched
+}
@@ -0,0 +1,63 @@
+// Tests functions from "join.go".
+
+package zoossh
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestJoinConsensus(t *testing.T) {
+
+	// Only run this test if the descriptor directory is there.
+	if _, err := os.Stat(serverDescriptorDir); os.IsNotExist(err) {
+		t.Skipf("skipping because of missing %s", serverDescriptorDir)
+	}
+
+	// Both descriptors belong to the same relay.
+	const (
+		oldDigest = "88827c73d5fd35e9638f820c44187ccdf8403b0f"
+		newDigest = "7aef3ff4d6a3b20c03ebefef94e6dfca4d9b663a"
+		fpr       = Fingerprint("7BD84CB63845E0D61C1CFA83914A1B8C968482B1")
+	)
+
+	date := time.Date(2014, 12, 8, 0, 0, 0, 0, time.UTC)
+	oldDesc, err := LoadDescriptorFromDigest(serverDescriptorDir, oldDigest, date)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newDesc, err := LoadDescriptorFromDigest(serverDescriptorDir, newDigest, date)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if oldDesc.Digest != oldDigest || newDesc.Digest != newDigest {
+		t.Fatalf("Computed digests %s and %s, expected %s and %s.",
+			oldDesc.Digest, newDesc.Digest, oldDigest, newDigest)
+	}
+
+	consensus := NewConsensus()
+	consensus.Set(fpr, &RouterStatus{Fingerprint: fpr, Digest: newDigest})
+	consensus.Set("AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA", &RouterStatus{Digest: "foo"})
+
+	// The stale descriptor must not be paired with the router status.
+	stale := NewRouterDescriptors()
+	stale.Set(fpr, oldDesc)
+	joined, unmatched := JoinConsensus(consensus, stale)
+	if len(joined) != 2 || unmatched != 2 {
+		t.Errorf("Expected 2 joined and 2 unmatched relays but got %d and %d.", len(joined), unmatched)
+	}
+	if info := joined[fpr]; info == nil || info.RouterStatus == nil || info.RouterDescriptor != nil {
+		t.Error("Router status was paired with a stale descriptor.")
+	}
+
+	current := NewRouterDescriptors()
+	current.Set(fpr, newDesc)
+	joined, unmatched = JoinConsensus(consensus, current)
+	if unmatched != 1 {
+		t.Errorf("Expected 1 unmatched relay but got %d.", unmatched)
+	}
+	if info := joined[fpr]; info == nil || info.RouterDescriptor != newDesc {
+		t.Error("Router status was not paired with its descriptor.")
+	}
+}
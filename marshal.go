@@ -0,0 +1,485 @@
+// Provides a binary encoding of consensuses, which is faster to decode than a
+// consensus' text format.
+
+package zoossh
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"sort"
+	"time"
+)
+
+// The magic bytes and the format version that the binary encoding of a
+// consensus starts with.  The version must be increased whenever the layout
+// changes.
+const (
+	consensusBinaryMagic   = "zoossh-consensus"
+	consensusBinaryVersion = 4
+)
+
+var errTruncatedConsensus = errors.New("truncated binary consensus")
+
+// binaryEncoder appends varints and length-prefixed values to a buffer.
+// Slices and maps are prefixed with their length plus one, so that a length of
+// zero denotes nil.
+type binaryEncoder struct {
+	buf     []byte
+	scratch [binary.MaxVarintLen64]byte
+}
+
+func (e *binaryEncoder) uvarint(x uint64) {
+
+	n := binary.PutUvarint(e.scratch[:], x)
+	e.buf = append(e.buf, e.scratch[:n]...)
+}
+
+func (e *binaryEncoder) varint(x int64) {
+
+	n := binary.PutVarint(e.scratch[:], x)
+	e.buf = append(e.buf, e.scratch[:n]...)
+}
+
+func (e *binaryEncoder) bool(b bool) {
+
+	if b {
+		e.buf = append(e.buf, 1)
+	} else {
+		e.buf = append(e.buf, 0)
+	}
+}
+
+func (e *binaryEncoder) string(s string) {
+
+	e.uvarint(uint64(len(s)))
+	e.buf = append(e.buf, s...)
+}
+
+func (e *binaryEncoder) bytes(b []byte) {
+
+	if b == nil {
+		e.uvarint(0)
+		return
+	}
+	e.uvarint(uint64(len(b)) + 1)
+	e.buf = append(e.buf, b...)
+}
+
+func (e *binaryEncoder) time(t time.Time) {
+
+	e.varint(t.Unix())
+	e.uvarint(uint64(t.Nanosecond()))
+}
+
+// binaryDecoder reads the values that binaryEncoder wrote.  The first error
+// sticks, and all subsequent reads return zero values.
+type binaryDecoder struct {
+	buf []byte
+	err error
+}
+
+func (d *binaryDecoder) uvarint() uint64 {
+
+	if d.err != nil {
+		return 0
+	}
+	x, n := binary.Uvarint(d.buf)
+	if n <= 0 {
+		d.err = errTruncatedConsensus
+		return 0
+	}
+	d.buf = d.buf[n:]
+
+	return x
+}
+
+func (d *binaryDecoder) varint() int64 {
+
+	if d.err != nil {
+		return 0
+	}
+	x, n := binary.Varint(d.buf)
+	if n <= 0 {
+		d.err = errTruncatedConsensus
+		return 0
+	}
+	d.buf = d.buf[n:]
+
+	return x
+}
+
+func (d *binaryDecoder) uint16() uint16 {
+
+	x := d.uvarint()
+	if x > math.MaxUint16 {
+		d.fail(fmt.Errorf("value %d out of range", x))
+		return 0
+	}
+
+	return uint16(x)
+}
+
+func (d *binaryDecoder) bool() bool {
+
+	return d.uvarint() != 0
+}
+
+// next consumes and returns the given number of bytes.
+func (d *binaryDecoder) next(n uint64) []byte {
+
+	if d.err != nil {
+		return nil
+	}
+	if n > uint64(len(d.buf)) {
+		d.err = errTruncatedConsensus
+		return nil
+	}
+	b := d.buf[:n]
+	d.buf = d.buf[n:]
+
+	return b
+}
+
+func (d *binaryDecoder) string() string {
+
+	return string(d.next(d.uvarint()))
+}
+
+func (d *binaryDecoder) bytes() []byte {
+
+	n := d.uvarint()
+	if n == 0 {
+		return nil
+	}
+
+	return append([]byte{}, d.next(n-1)...)
+}
+
+func (d *binaryDecoder) time() time.Time {
+
+	sec := d.varint()
+	nsec := d.uvarint()
+	if nsec >= uint64(time.Second) {
+		d.fail(fmt.Errorf("nanoseconds %d out of range", nsec))
+		return time.Time{}
+	}
+
+	return time.Unix(sec, int64(nsec)).UTC()
+}
+
+// length reads the length of a slice or map, which was increased by one.  It
+// returns -1 for nil.  Every element takes up at least one byte, which lets us
+// reject bogus lengths before allocating memory.
+func (d *binaryDecoder) length() int {
+
+	n := d.uvarint()
+	if n == 0 || d.err != nil {
+		return -1
+	}
+	if n-1 > uint64(len(d.buf)) {
+		d.err = errTruncatedConsensus
+		return -1
+	}
+
+	return int(n - 1)
+}
+
+func (d *binaryDecoder) fail(err error) {
+
+	if d.err == nil {
+		d.err = err
+	}
+}
+
+// MarshalBinary implements the encoding.BinaryMarshaler interface.  It encodes
+// the consensus' meta information, parameters, authorities, bandwidth weights,
+// router statuses, and the valid-after times that MergeConsensus tracks for
+// router statuses in a compact binary format that UnmarshalBinary decodes
+// much faster than ParseConsensusFile parses the consensus' text format.  All
+// router statuses are parsed in the process.  Statuses that turn out to be
+// malformed when parsed lazily are dropped, and neither the results of
+// CheckEntryStructure nor the digest of ComputeSHA256Digest are retained.
+// Note that a Vote's own fields are not encoded.
+func (c *Consensus) MarshalBinary() ([]byte, error) {
+
+	e := &binaryEncoder{}
+	e.buf = append(e.buf, consensusBinaryMagic...)
+	e.uvarint(consensusBinaryVersion)
+
+	// Meta information, in the order of its keys to keep the output
+	// deterministic.
+	if c.MetaInfo == nil {
+		e.uvarint(0)
+	} else {
+		keys := make([]string, 0, len(c.MetaInfo))
+		for key := range c.MetaInfo {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		e.uvarint(uint64(len(keys)) + 1)
+		for _, key := range keys {
+			e.string(key)
+			e.bytes(c.MetaInfo[key])
+		}
+	}
+
+	e.time(c.ValidAfter)
+	e.time(c.FreshUntil)
+	e.time(c.ValidUntil)
+	e.uvarint(uint64(c.ConsensusMethod))
+	e.bytes(c.SharedRandPrevious)
+	e.bytes(c.SharedRandCurrent)
+
+	if c.Params == nil {
+		e.uvarint(0)
+	} else {
+		keys := make([]string, 0, len(c.Params))
+		for key := range c.Params {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		e.uvarint(uint64(len(keys)) + 1)
+		for _, key := range keys {
+			e.string(key)
+			e.varint(int64(c.Params[key]))
+		}
+	}
+
+	if c.DirSources == nil {
+		e.uvarint(0)
+	} else {
+		e.uvarint(uint64(len(c.DirSources)) + 1)
+		for _, source := range c.DirSources {
+			e.string(source.Nickname)
+			e.string(string(source.Fingerprint))
+			e.string(source.Hostname)
+			e.bytes(source.Address)
+			e.uvarint(uint64(source.DirPort))
+			e.uvarint(uint64(source.ORPort))
+			e.string(source.Contact)
+			e.string(source.VoteDigest)
+		}
+	}
+
+	if c.BandwidthWeights == nil {
+		e.uvarint(0)
+	} else {
+		keys := make([]string, 0, len(c.BandwidthWeights))
+		for key := range c.BandwidthWeights {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		e.uvarint(uint64(len(keys)) + 1)
+		for _, key := range keys {
+			e.string(key)
+			e.varint(c.BandwidthWeights[key])
+		}
+	}
+
+	var statuses []*RouterStatus
+	for _, fingerprint := range c.sortedFingerprints() {
+		if status := c.RouterStatuses[fingerprint](); status != nil {
+			statuses = append(statuses, status)
+		}
+	}
+	e.uvarint(uint64(len(statuses)) + 1)
+	for _, status := range statuses {
+		encodeRouterStatus(e, status)
+	}
+
+	// The valid-after times of merged router statuses, in the order of their
+	// fingerprints.
+	if c.statusValidAfter == nil {
+		e.uvarint(0)
+	} else {
+		fingerprints := make([]Fingerprint, 0, len(c.statusValidAfter))
+		for fingerprint := range c.statusValidAfter {
+			fingerprints = append(fingerprints, fingerprint)
+		}
+		sort.Slice(fingerprints, func(i, j int) bool {
+			return fingerprints[i] < fingerprints[j]
+		})
+		e.uvarint(uint64(len(fingerprints)) + 1)
+		for _, fingerprint := range fingerprints {
+			e.string(string(fingerprint))
+			e.time(c.statusValidAfter[fingerprint])
+		}
+	}
+
+	return e.buf, nil
+}
+
+// encodeRouterStatus appends the given router status to the encoder's buffer.
+func encodeRouterStatus(e *binaryEncoder, s *RouterStatus) {
+
+	e.string(s.Nickname)
+	e.string(string(s.Fingerprint))
+	e.string(s.Digest)
+	e.time(s.Publication)
+
+	e.bytes(s.Address.IPv4Address)
+	e.uvarint(uint64(s.Address.IPv4ORPort))
+	e.uvarint(uint64(s.Address.IPv4DirPort))
+	e.bytes(s.Address.IPv6Address)
+	e.uvarint(uint64(s.Address.IPv6ORPort))
+
+	e.uvarint(uint64(s.Flags.bits()))
+	e.string(s.TorVersion)
+	e.string(s.RawVersion)
+	e.uvarint(s.Bandwidth)
+	e.uvarint(s.Measured)
+	e.bool(s.Unmeasured)
+	e.bool(s.Accept)
+	e.string(s.PortList)
+	e.string(s.Ed25519Identity)
+
+	if s.Unrecognized == nil {
+		e.uvarint(0)
+	} else {
+		e.uvarint(uint64(len(s.Unrecognized)) + 1)
+		for _, line := range s.Unrecognized {
+			e.string(line)
+		}
+	}
+
+	e.string(s.CountryCode)
+}
+
+// UnmarshalBinary implements the encoding.BinaryUnmarshaler interface.  It
+// decodes a consensus that was encoded by MarshalBinary, replacing the
+// consensus' contents.  An error is returned if the data is truncated,
+// malformed, or was encoded using a different version of the format.
+func (c *Consensus) UnmarshalBinary(data []byte) error {
+
+	if len(data) < len(consensusBinaryMagic) || string(data[:len(consensusBinaryMagic)]) != consensusBinaryMagic {
+		return errors.New("not a binary consensus")
+	}
+	d := &binaryDecoder{buf: data[len(consensusBinaryMagic):]}
+	if version := d.uvarint(); d.err == nil && version != consensusBinaryVersion {
+		return fmt.Errorf("unsupported binary consensus version %d", version)
+	}
+
+	decoded := NewConsensus()
+
+	decoded.MetaInfo = nil
+	if n := d.length(); n >= 0 {
+		decoded.MetaInfo = make(map[string][]byte, n)
+		for i := 0; i < n && d.err == nil; i++ {
+			key := d.string()
+			decoded.MetaInfo[key] = d.bytes()
+		}
+	}
+
+	decoded.ValidAfter = d.time()
+	decoded.FreshUntil = d.time()
+	decoded.ValidUntil = d.time()
+	decoded.ConsensusMethod = int(d.uvarint())
+	decoded.SharedRandPrevious = d.bytes()
+	decoded.SharedRandCurrent = d.bytes()
+
+	if n := d.length(); n >= 0 {
+		decoded.Params = make(map[string]int, n)
+		for i := 0; i < n && d.err == nil; i++ {
+			key := d.string()
+			decoded.Params[key] = int(d.varint())
+		}
+	}
+
+	if n := d.length(); n >= 0 {
+		decoded.DirSources = make([]DirSource, n)
+		for i := 0; i < n && d.err == nil; i++ {
+			decoded.DirSources[i] = DirSource{
+				Nickname:    d.string(),
+				Fingerprint: Fingerprint(d.string()),
+				Hostname:    d.string(),
+				Address:     net.IP(d.bytes()),
+				DirPort:     d.uint16(),
+				ORPort:      d.uint16(),
+				Contact:     d.string(),
+				VoteDigest:  d.string(),
+			}
+		}
+	}
+
+	if n := d.length(); n >= 0 {
+		decoded.BandwidthWeights = make(map[string]int64, n)
+		for i := 0; i < n && d.err == nil; i++ {
+			key := d.string()
+			decoded.BandwidthWeights[key] = d.varint()
+		}
+	}
+
+	for n, i := d.length(), 0; i < n && d.err == nil; i++ {
+		status := decodeRouterStatus(d)
+		decoded.RouterStatuses[SanitiseFingerprint(status.Fingerprint)] = func() *RouterStatus {
+			return status
+		}
+	}
+
+	if n := d.length(); n >= 0 {
+		decoded.statusValidAfter = make(map[Fingerprint]time.Time, n)
+		for i := 0; i < n && d.err == nil; i++ {
+			fingerprint := Fingerprint(d.string())
+			decoded.statusValidAfter[fingerprint] = d.time()
+		}
+	}
+
+	if d.err != nil {
+		return d.err
+	}
+	if len(d.buf) != 0 {
+		return fmt.Errorf("%d trailing bytes after binary consensus", len(d.buf))
+	}
+
+	// The consensus holds a mutex, so we replace its contents field by field
+	// rather than copying the decoded consensus as a whole.
+	c.copyHeader(decoded)
+	c.RouterStatuses = decoded.RouterStatuses
+	c.statusValidAfter = decoded.statusValidAfter
+	c.sharedRandCommits, c.entryErrors = nil, nil
+	c.firstEntryLine, c.sha256Digest = 0, nil
+	c.invalidateCaches()
+
+	return nil
+}
+
+// decodeRouterStatus reads a router status that was written by
+// encodeRouterStatus.
+func decodeRouterStatus(d *binaryDecoder) *RouterStatus {
+
+	s := &RouterStatus{}
+	s.Nickname = d.string()
+	s.Fingerprint = Fingerprint(d.string())
+	s.Digest = d.string()
+	s.Publication = d.time()
+
+	s.Address.IPv4Address = net.IP(d.bytes())
+	s.Address.IPv4ORPort = d.uint16()
+	s.Address.IPv4DirPort = d.uint16()
+	s.Address.IPv6Address = net.IP(d.bytes())
+	s.Address.IPv6ORPort = d.uint16()
+
+	s.Flags = routerFlagsFromBits(d.uint16())
+	s.TorVersion = d.string()
+	s.RawVersion = d.string()
+	s.Bandwidth = d.uvarint()
+	s.Measured = d.uvarint()
+	s.Unmeasured = d.bool()
+	s.Accept = d.bool()
+	s.PortList = d.string()
+	s.Ed25519Identity = d.string()
+
+	if n := d.length(); n >= 0 {
+		s.Unrecognized = make([]string, n)
+		for i := 0; i < n && d.err == nil; i++ {
+			s.Unrecognized[i] = d.string()
+		}
+	}
+
+	s.CountryCode = d.string()
+
+	return s
+}
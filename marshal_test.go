@@ -0,0 +1,104 @@
+// Tests functions from "marshal.go".
+
+package zoossh
+
+import (
+	"net"
+	"os"
+	"reflect"
+	"testing"
+)
+
+// Benchmark the time it takes to decode a binary consensus.  Compare with
+// BenchmarkConsensusParsing.
+func BenchmarkConsensusUnmarshal(b *testing.B) {
+
+	// Only run this benchmark if the consensus file is there.
+	if _, err := os.Stat(consensusFile); os.IsNotExist(err) {
+		b.Skipf("skipping because of missing %s", consensusFile)
+	}
+
+	consensus, err := ParseConsensusFile(consensusFile)
+	if err != nil {
+		b.Fatal(err)
+	}
+	data, err := consensus.MarshalBinary()
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if err := new(Consensus).UnmarshalBinary(data); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestConsensusBinaryRoundTrip(t *testing.T) {
+
+	// Only run this test if the consensus file is there.
+	if _, err := os.Stat(consensusFile); os.IsNotExist(err) {
+		t.Skipf("skipping because of missing %s", consensusFile)
+	}
+
+	consensus, err := LazilyParseConsensusFile(consensusFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	consensus.EnrichCountry(func(ip net.IP) string { return "de" })
+
+	data, err := consensus.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded := &Consensus{}
+	if err := decoded.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(consensus.MetaInfo, decoded.MetaInfo) ||
+		!reflect.DeepEqual(consensus.DirSources, decoded.DirSources) ||
+		!reflect.DeepEqual(consensus.BandwidthWeights, decoded.BandwidthWeights) ||
+		!reflect.DeepEqual(consensus.Params, decoded.Params) ||
+		!reflect.DeepEqual(consensus.SharedRandPrevious, decoded.SharedRandPrevious) ||
+		!reflect.DeepEqual(consensus.SharedRandCurrent, decoded.SharedRandCurrent) {
+		t.Error("Meta information changed during round trip.")
+	}
+	if consensus.ValidAfter != decoded.ValidAfter || consensus.FreshUntil != decoded.FreshUntil ||
+		consensus.ValidUntil != decoded.ValidUntil {
+		t.Error("Validity period changed during round trip.")
+	}
+
+	if consensus.Length() != decoded.Length() {
+		t.Fatalf("Expected %d router statuses but got %d.", consensus.Length(), decoded.Length())
+	}
+	for fingerprint, getStatus := range consensus.RouterStatuses {
+		status, found := decoded.Get(fingerprint)
+		if !found || !reflect.DeepEqual(getStatus(), status) {
+			t.Errorf("Router status %s changed during round trip.", fingerprint)
+		}
+	}
+
+	// The encoding must be deterministic.
+	again, err := decoded.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(data, again) {
+		t.Error("Encoding the decoded consensus resulted in different data.")
+	}
+
+	// Truncated data must not decode.
+	for _, n := range []int{0, len(consensusBinaryMagic) + 1, len(data) / 2, len(data) - 1} {
+		if err := new(Consensus).UnmarshalBinary(data[:n]); err == nil {
+			t.Errorf("Data truncated to %d bytes did not cause an error.", n)
+		}
+	}
+
+	// Neither must data of a different format version.
+	other := append([]byte(consensusBinaryMagic), consensusBinaryVersion+1)
+	if err := new(Consensus).UnmarshalBinary(append(other, data[len(other):]...)); err == nil {
+		t.Error("Unsupported format version did not cause an error.")
+	}
+}
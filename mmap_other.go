@@ -0,0 +1,16 @@
+//go:build !unix
+
+// Stands in for memory-mapping on platforms that don't support it.
+
+package zoossh
+
+import (
+	"errors"
+)
+
+// mmapFile always fails because memory-mapping is not supported on this
+// platform.  Callers fall back to reading the file.
+func mmapFile(fileName string) ([]byte, func() error, error) {
+
+	return nil, nil, errors.New("memory-mapping not supported on this platform")
+}
@@ -0,0 +1,40 @@
+//go:build unix
+
+// Memory-maps files on platforms that support it.
+
+package zoossh
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// mmapFile maps the named file read-only into memory and returns the mapped
+// bytes along with a function that unmaps them.  The bytes must not be used
+// after the mapping was unmapped.
+func mmapFile(fileName string) ([]byte, func() error, error) {
+
+	fd, err := os.Open(fileName)
+	if err != nil {
+		return nil, nil, err
+	}
+	// The mapping remains valid after the file is closed.
+	defer fd.Close()
+
+	info, err := fd.Stat()
+	if err != nil {
+		return nil, nil, err
+	}
+	size := info.Size()
+	if size <= 0 || int64(int(size)) != size {
+		return nil, nil, errors.New("file size not suitable for memory-mapping")
+	}
+
+	data, err := syscall.Mmap(int(fd.Fd()), 0, int(size), syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return data, func() error { return syscall.Munmap(data) }, nil
+}
@@ -0,0 +1,206 @@
+// Provides functions that model how Tor clients select relays.
+
+package zoossh
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+)
+
+// Weight values in the "bandwidth-weights" line are scaled by this value.
+const bandwidthWeightScale = 10000
+
+// Position represents the position of a relay in a circuit.
+type Position int
+
+const (
+	PositionGuard Position = iota
+	PositionMiddle
+	PositionExit
+)
+
+// String implements the Stringer interface.  It returns the position's name as
+// understood by SelectionEntropy, i.e., "guard", "middle", or "exit".
+func (p Position) String() string {
+
+	switch p {
+	case PositionGuard:
+		return "guard"
+	case PositionMiddle:
+		return "middle"
+	case PositionExit:
+		return "exit"
+	}
+
+	return fmt.Sprintf("Position(%d)", int(p))
+}
+
+// isEligible returns true if the given router status can be selected for the
+// given position, which is either "guard", "middle", or "exit".
+func isEligible(status *RouterStatus, position string) bool {
+
+	if !status.Flags.Running || !status.Flags.Valid {
+		return false
+	}
+
+	switch position {
+	case "guard":
+		return status.Flags.Guard
+	case "middle":
+		return true
+	case "exit":
+		return status.Flags.Exit && !status.Flags.BadExit
+	}
+
+	return false
+}
+
+// positionWeight returns the bandwidth weight that Tor clients apply to the
+// given router status when selecting a relay for the given position.  See
+// dir-spec.txt, Section 3.8.3 for details.
+func (c *Consensus) positionWeight(status *RouterStatus, position string) int64 {
+
+	// Consensuses that predate bandwidth weights don't weigh relays.
+	if c.BandwidthWeights == nil {
+		return bandwidthWeightScale
+	}
+
+	// The names of the weights for guard, exit, guard+exit, and other relays.
+	var names [4]string
+	switch position {
+	case "guard":
+		names = [4]string{"Wgg", "Weg", "Wgd", "Wgm"}
+	case "middle":
+		names = [4]string{"Wmg", "Wme", "Wmd", "Wmm"}
+	case "exit":
+		names = [4]string{"Weg", "Wee", "Wed", "Wem"}
+	default:
+		return 0
+	}
+
+	var name string
+	switch {
+	case status.Flags.Guard && status.Flags.Exit:
+		name = names[2]
+	case status.Flags.Guard:
+		name = names[0]
+	case status.Flags.Exit:
+		name = names[1]
+	default:
+		name = names[3]
+	}
+
+	return c.BandwidthWeights[name]
+}
+
+// selectionWeights returns the weighted bandwidth of every relay that is
+// eligible for the given position, which is either "guard", "middle", or
+// "exit".
+func (c *Consensus) selectionWeights(position string) map[Fingerprint]float64 {
+
+	weights := make(map[Fingerprint]float64)
+
+	for fingerprint, getStatus := range c.RouterStatuses {
+		status := getStatus()
+		if status == nil || !isEligible(status, position) {
+			continue
+		}
+		weights[fingerprint] = float64(status.Bandwidth) *
+			float64(c.positionWeight(status, position)) / bandwidthWeightScale
+	}
+
+	return weights
+}
+
+// SelectionEntropy returns the Shannon entropy (in bits) of the probability
+// distribution with which Tor clients select relays for the given position,
+// which is either "guard", "middle", or "exit".  Relays are weighted by their
+// bandwidth and the consensus footer's bandwidth weights.  The entropy is 0
+// if the position is unknown or if no relay can be selected.
+func (c *Consensus) SelectionEntropy(position string) float64 {
+
+	weights := c.selectionWeights(position)
+
+	var total float64
+	for _, weight := range weights {
+		total += weight
+	}
+	if total == 0 {
+		return 0
+	}
+
+	var entropy float64
+	for _, weight := range weights {
+		if weight == 0 {
+			continue
+		}
+		p := weight / total
+		entropy -= p * math.Log2(p)
+	}
+
+	return entropy
+}
+
+// SampleRelay draws a relay for the given position the way Tor clients do,
+// i.e., with a probability proportional to the relay's bandwidth, weighted by
+// the consensus footer's bandwidth weights.  Randomness is taken from the
+// given source, or from the math/rand package's default source if rng is nil.
+// An error is returned if no relay is eligible for the given position.
+func (c *Consensus) SampleRelay(position Position, rng *rand.Rand) (*RouterStatus, error) {
+
+	weights := c.selectionWeights(position.String())
+
+	// Iterate in a fixed order, so a seeded source yields reproducible
+	// results.
+	var fingerprints []Fingerprint
+	var total float64
+	for _, fingerprint := range c.sortedFingerprints() {
+		if weight := weights[fingerprint]; weight > 0 {
+			fingerprints = append(fingerprints, fingerprint)
+			total += weight
+		}
+	}
+	if total == 0 {
+		return nil, fmt.Errorf("no relay is eligible for position %s", position)
+	}
+
+	var r float64
+	if rng == nil {
+		r = rand.Float64() * total
+	} else {
+		r = rng.Float64() * total
+	}
+
+	// Fall back to the last relay in case rounding errors prevent us from
+	// reaching r.
+	chosen := fingerprints[len(fingerprints)-1]
+	for _, fingerprint := range fingerprints {
+		r -= weights[fingerprint]
+		if r < 0 {
+			chosen = fingerprint
+			break
+		}
+	}
+
+	status, _ := c.Get(chosen)
+	return status, nil
+}
+
+// GuardExitOverlap returns the router statuses that have both the Guard and
+// the Exit flag, ordered by fingerprint.  Tor never uses the same relay in
+// more than one position of a circuit, so these relays compete for the guard
+// and the exit position.
+func (c *Consensus) GuardExitOverlap() []*RouterStatus {
+
+	var overlap []*RouterStatus
+
+	for _, fingerprint := range c.sortedFingerprints() {
+		status := c.RouterStatuses[fingerprint]()
+		if status != nil && status.Flags.Guard && status.Flags.Exit {
+			overlap = append(overlap, status)
+		}
+	}
+
+	return overlap
+}
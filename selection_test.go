@@ -0,0 +1,146 @@
+// Tests functions from "selection.go".
+
+package zoossh
+
+import (
+	"math"
+	"math/rand"
+	"os"
+	"testing"
+)
+
+// newSelectionConsensus returns a small consensus whose selection
+// probabilities are easy to compute by hand.
+func newSelectionConsensus() *Consensus {
+
+	consensus := NewConsensus()
+	consensus.BandwidthWeights = map[string]int64{
+		"Wgg": 10000, "Wgd": 0, "Wgm": 10000,
+		"Wmg": 5000, "Wme": 0, "Wmd": 0, "Wmm": 10000,
+		"Weg": 0, "Wee": 10000, "Wed": 10000, "Wem": 10000,
+	}
+
+	running := RouterFlags{Running: true, Valid: true, Fast: true}
+	guard := RouterFlags{Running: true, Valid: true, Guard: true}
+	exit := RouterFlags{Running: true, Valid: true, Exit: true}
+	guardExit := RouterFlags{Running: true, Valid: true, Guard: true, Exit: true}
+
+	statuses := []*RouterStatus{
+		{Fingerprint: "AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA", Bandwidth: 100, Flags: guard},
+		{Fingerprint: "BBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBB", Bandwidth: 300, Flags: guard},
+		{Fingerprint: "CCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCC", Bandwidth: 200, Flags: exit},
+		{Fingerprint: "DDDDDDDDDDDDDDDDDDDDDDDDDDDDDDDDDDDDDDDD", Bandwidth: 200, Flags: guardExit},
+		{Fingerprint: "EEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEE", Bandwidth: 200, Flags: running},
+		{Fingerprint: "FFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFF", Bandwidth: 200, Flags: RouterFlags{}},
+	}
+	for _, status := range statuses {
+		consensus.Set(status.Fingerprint, status)
+	}
+
+	return consensus
+}
+
+func TestSelectionEntropy(t *testing.T) {
+
+	consensus := newSelectionConsensus()
+
+	// Guard position: 100 and 300 (the guard+exit relay has weight 0), i.e.,
+	// probabilities of 1/4 and 3/4.
+	expected := -(0.25*math.Log2(0.25) + 0.75*math.Log2(0.75))
+	if entropy := consensus.SelectionEntropy("guard"); math.Abs(entropy-expected) > 1e-9 {
+		t.Errorf("Expected guard entropy %f but got %f.", expected, entropy)
+	}
+
+	// Middle position: 50, 150, and 200 (exit and guard+exit relays have weight
+	// 0), i.e., probabilities of 1/8, 3/8, and 1/2.
+	expected = -(0.125*math.Log2(0.125) + 0.375*math.Log2(0.375) + 0.5*math.Log2(0.5))
+	if entropy := consensus.SelectionEntropy("middle"); math.Abs(entropy-expected) > 1e-9 {
+		t.Errorf("Expected middle entropy %f but got %f.", expected, entropy)
+	}
+
+	// Exit position: two relays with 200 each, i.e., one bit.
+	if entropy := consensus.SelectionEntropy("exit"); math.Abs(entropy-1) > 1e-9 {
+		t.Errorf("Expected exit entropy 1 but got %f.", entropy)
+	}
+
+	if entropy := consensus.SelectionEntropy("foo"); entropy != 0 {
+		t.Errorf("Expected entropy 0 for unknown position but got %f.", entropy)
+	}
+}
+
+func TestGuardExitOverlap(t *testing.T) {
+
+	// Only run this test if the consensus file is there.
+	if _, err := os.Stat(consensusFile); os.IsNotExist(err) {
+		t.Skipf("skipping because of missing %s", consensusFile)
+	}
+
+	consensus, err := ParseConsensusFile(consensusFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	overlap := consensus.GuardExitOverlap()
+	if len(overlap) != 456 {
+		t.Errorf("Expected 456 relays with Guard and Exit flag but got %d.", len(overlap))
+	}
+
+	for _, status := range overlap {
+		if !status.Flags.Guard || !status.Flags.Exit {
+			t.Errorf("Relay %s lacks the Guard or Exit flag.", status.Fingerprint)
+		}
+	}
+
+	if overlap := newSelectionConsensus().GuardExitOverlap(); len(overlap) != 1 ||
+		overlap[0].Fingerprint != "DDDDDDDDDDDDDDDDDDDDDDDDDDDDDDDDDDDDDDDD" {
+		t.Error("Guard and exit overlap computed incorrectly.")
+	}
+}
+
+func TestSampleRelay(t *testing.T) {
+
+	consensus := newSelectionConsensus()
+	rng := rand.New(rand.NewSource(1))
+
+	// Guard position: A and B are drawn with probabilities of 1/4 and 3/4.
+	counts := make(map[Fingerprint]int)
+	const draws = 20000
+	for i := 0; i < draws; i++ {
+		status, err := consensus.SampleRelay(PositionGuard, rng)
+		if err != nil {
+			t.Fatal(err)
+		}
+		counts[status.Fingerprint]++
+	}
+
+	if len(counts) != 2 {
+		t.Errorf("Expected 2 distinct guards but got %d.", len(counts))
+	}
+	if ratio := float64(counts["BBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBB"]) / draws; math.Abs(ratio-0.75) > 0.02 {
+		t.Errorf("Expected guard B in 75%% of draws but got %.1f%%.", ratio*100)
+	}
+
+	// Exit relays must have the Exit flag.
+	for i := 0; i < 100; i++ {
+		status, err := consensus.SampleRelay(PositionExit, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !status.Flags.Exit {
+			t.Fatalf("Sampled exit relay %s lacks the Exit flag.", status.Fingerprint)
+		}
+	}
+
+	// Without exit relays, sampling an exit must fail.
+	noExits := NewConsensus()
+	noExits.Set("AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA", &RouterStatus{
+		Bandwidth: 100,
+		Flags:     RouterFlags{Running: true, Valid: true, Guard: true},
+	})
+	if _, err := noExits.SampleRelay(PositionExit, rng); err == nil {
+		t.Error("Sampling an exit without exit relays did not raise an error.")
+	}
+	if _, err := noExits.SampleRelay(PositionGuard, rng); err != nil {
+		t.Error(err)
+	}
+}
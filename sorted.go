@@ -0,0 +1,147 @@
+// Provides an object set that is backed by a sorted slice.
+
+package zoossh
+
+import (
+	"sort"
+)
+
+// SortedObjectSet is an ObjectSet that keeps its objects in a slice that is
+// sorted by fingerprint.  It uses considerably less memory than the map-based
+// object sets, which makes it a good fit for read-only analyses of many
+// objects.  Lookups take O(log n) time, but adding a single object takes O(n)
+// time, so large sets should be built using Merge.
+type SortedObjectSet struct {
+	objects []Object
+}
+
+// NewSortedObjectSet serves as a constructor and returns a pointer to a
+// freshly allocated and empty SortedObjectSet.
+func NewSortedObjectSet() *SortedObjectSet {
+
+	return &SortedObjectSet{}
+}
+
+// search returns the index of the object with the given fingerprint, or the
+// index at which it would have to be inserted.
+func (s *SortedObjectSet) search(fingerprint Fingerprint) int {
+
+	return sort.Search(len(s.objects), func(i int) bool {
+		return s.objects[i].GetFingerprint() >= fingerprint
+	})
+}
+
+// Length implements the ObjectSet interface.  It returns the number of
+// objects in the set.
+func (s *SortedObjectSet) Length() int {
+
+	return len(s.objects)
+}
+
+// Iterate implements the ObjectSet interface.  Using a channel, it iterates
+// over and returns all objects in the order of their fingerprints.  Router
+// statuses and router descriptors can be filtered by fingerprint, IP address,
+// and nickname, and all other objects by fingerprint.
+func (s *SortedObjectSet) Iterate(filter *ObjectFilter) <-chan Object {
+
+	ch := make(chan Object)
+	objects := s.objects
+
+	go func() {
+		for _, obj := range objects {
+			if filter == nil || filter.IsEmpty() || filter.matchesObject(obj) {
+				ch <- obj
+			}
+		}
+		close(ch)
+	}()
+
+	return ch
+}
+
+// GetObject implements the ObjectSet interface.  It returns the object
+// identified by the given fingerprint.  If the object is not present in the
+// set, false is returned, otherwise true.
+func (s *SortedObjectSet) GetObject(fingerprint Fingerprint) (Object, bool) {
+
+	fingerprint = SanitiseFingerprint(fingerprint)
+	i := s.search(fingerprint)
+	if i < len(s.objects) && s.objects[i].GetFingerprint() == fingerprint {
+		return s.objects[i], true
+	}
+
+	return nil, false
+}
+
+// Add adds the given object to the set, replacing an existing object with the
+// same fingerprint.
+func (s *SortedObjectSet) Add(obj Object) {
+
+	i := s.search(obj.GetFingerprint())
+	if i < len(s.objects) && s.objects[i].GetFingerprint() == obj.GetFingerprint() {
+		s.objects[i] = obj
+		return
+	}
+
+	s.objects = append(s.objects, nil)
+	copy(s.objects[i+1:], s.objects[i:])
+	s.objects[i] = obj
+}
+
+// Merge merges the given object set with itself.  Like for the other object
+// sets, existing objects take precedence over objects of the given set that
+// have the same fingerprint.  If the given set is a SortedObjectSet, the two
+// slices are merged in linear time; other sets are sorted first.
+func (s *SortedObjectSet) Merge(objs ObjectSet) {
+
+	var other []Object
+	if sorted, ok := objs.(*SortedObjectSet); ok {
+		other = sorted.objects
+	} else {
+		other = make([]Object, 0, objs.Length())
+		for obj := range objs.Iterate(nil) {
+			other = append(other, obj)
+		}
+		sort.SliceStable(other, func(i, j int) bool {
+			return other[i].GetFingerprint() < other[j].GetFingerprint()
+		})
+	}
+
+	merged := make([]Object, 0, len(s.objects)+len(other))
+	add := func(obj Object) {
+		if n := len(merged); n > 0 && merged[n-1].GetFingerprint() == obj.GetFingerprint() {
+			return
+		}
+		merged = append(merged, obj)
+	}
+
+	// On ties, our own object comes first, so add() drops the other one.
+	i, j := 0, 0
+	for i < len(s.objects) || j < len(other) {
+		if j == len(other) ||
+			(i < len(s.objects) && s.objects[i].GetFingerprint() <= other[j].GetFingerprint()) {
+			add(s.objects[i])
+			i++
+		} else {
+			add(other[j])
+			j++
+		}
+	}
+
+	s.objects = merged
+}
+
+// matchesObject returns true if the given object passes the object filter.
+// Only router statuses and router descriptors expose their IP addresses and
+// nicknames, so all other objects are matched by fingerprint.
+func (filter *ObjectFilter) matchesObject(obj Object) bool {
+
+	switch o := obj.(type) {
+	case *RouterStatus:
+		return filter.MatchesRouterStatus(o)
+	case *RouterDescriptor:
+		return filter.MatchesRouterDescriptor(o)
+	}
+
+	return filter.HasFingerprint(obj.GetFingerprint())
+}
@@ -0,0 +1,162 @@
+// Tests functions from "sorted.go".
+
+package zoossh
+
+import (
+	"fmt"
+	"net"
+	"testing"
+)
+
+// makeRouterStatuses returns the given number of router statuses with
+// distinct fingerprints, in descending order of fingerprint.
+func makeRouterStatuses(n int) []*RouterStatus {
+
+	statuses := make([]*RouterStatus, n)
+	for i := range statuses {
+		statuses[i] = &RouterStatus{
+			Fingerprint: Fingerprint(fmt.Sprintf("%040X", n-i)),
+			Nickname:    fmt.Sprintf("relay%d", n-i),
+			Bandwidth:   uint64(i),
+		}
+	}
+
+	return statuses
+}
+
+// Benchmark the memory it takes to hold router statuses in a consensus, which
+// is backed by a map.  Compare with BenchmarkSortedObjectSetMemory.
+func BenchmarkConsensusMemory(b *testing.B) {
+
+	statuses := makeRouterStatuses(10000)
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		consensus := NewConsensus()
+		for _, status := range statuses {
+			consensus.Set(status.Fingerprint, status)
+		}
+	}
+}
+
+// Benchmark the memory it takes to hold router statuses in a sorted object
+// set.
+func BenchmarkSortedObjectSetMemory(b *testing.B) {
+
+	consensus := NewConsensus()
+	for _, status := range makeRouterStatuses(10000) {
+		consensus.Set(status.Fingerprint, status)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		set := NewSortedObjectSet()
+		set.Merge(consensus)
+	}
+}
+
+func TestSortedObjectSet(t *testing.T) {
+
+	set := NewSortedObjectSet()
+	statuses := makeRouterStatuses(5)
+	for _, status := range statuses {
+		set.Add(status)
+	}
+
+	if set.Length() != 5 {
+		t.Errorf("Expected 5 objects but got %d.", set.Length())
+	}
+
+	var prev Fingerprint
+	for obj := range set.Iterate(nil) {
+		if obj.GetFingerprint() <= prev {
+			t.Errorf("Iterated over %s after %s.", obj.GetFingerprint(), prev)
+		}
+		prev = obj.GetFingerprint()
+	}
+
+	for _, status := range statuses {
+		if obj, found := set.GetObject(status.Fingerprint); !found || obj != status {
+			t.Errorf("Object %s not found.", status.Fingerprint)
+		}
+	}
+	if _, found := set.GetObject(Fingerprint(fmt.Sprintf("%040X", 6))); found {
+		t.Error("Found object that is not in the set.")
+	}
+
+	// Adding an object with an existing fingerprint replaces the object.
+	replacement := &RouterStatus{Fingerprint: statuses[0].Fingerprint}
+	set.Add(replacement)
+	if obj, _ := set.GetObject(statuses[0].Fingerprint); set.Length() != 5 || obj != replacement {
+		t.Error("Object was not replaced.")
+	}
+
+	filter := NewObjectFilter()
+	filter.AddNickname("relay2")
+	filter.AddFingerprint(statuses[4].Fingerprint)
+	filtered := 0
+	for range set.Iterate(filter) {
+		filtered++
+	}
+	if filtered != 2 {
+		t.Errorf("Expected 2 filtered objects but got %d.", filtered)
+	}
+}
+
+func TestSortedObjectSetMerge(t *testing.T) {
+
+	statuses := makeRouterStatuses(6)
+
+	evens := NewSortedObjectSet()
+	odds := NewSortedObjectSet()
+	for i, status := range statuses {
+		if i%2 == 0 {
+			evens.Add(status)
+		} else {
+			odds.Add(status)
+		}
+	}
+
+	// The duplicate must not replace the existing object.
+	duplicate := &RouterStatus{Fingerprint: statuses[0].Fingerprint}
+	odds.Add(duplicate)
+
+	evens.Merge(odds)
+	if evens.Length() != 6 {
+		t.Fatalf("Expected 6 objects but got %d.", evens.Length())
+	}
+	if obj, _ := evens.GetObject(statuses[0].Fingerprint); obj != statuses[0] {
+		t.Error("Existing object was replaced during merge.")
+	}
+
+	var prev Fingerprint
+	for obj := range evens.Iterate(nil) {
+		if obj.GetFingerprint() <= prev {
+			t.Errorf("Iterated over %s after %s.", obj.GetFingerprint(), prev)
+		}
+		prev = obj.GetFingerprint()
+	}
+
+	// Merge a map-based object set.
+	consensus := NewConsensus()
+	extra := &RouterStatus{
+		Fingerprint: Fingerprint(fmt.Sprintf("%040X", 0)),
+		Address:     RouterAddress{IPv4Address: net.ParseIP("1.2.3.4")},
+	}
+	consensus.Set(extra.Fingerprint, extra)
+	consensus.Set(statuses[1].Fingerprint, statuses[1])
+	evens.Merge(consensus)
+	if evens.Length() != 7 {
+		t.Fatalf("Expected 7 objects but got %d.", evens.Length())
+	}
+
+	filter := NewObjectFilter()
+	filter.AddIPAddr(net.ParseIP("1.2.3.4"))
+	for obj := range evens.Iterate(filter) {
+		if obj != extra {
+			t.Errorf("Unexpected object %s passed the filter.", obj.GetFingerprint())
+		}
+	}
+}
@@ -0,0 +1,354 @@
+// Provides functions to compute aggregate statistics over parsed documents.
+
+package zoossh
+
+import (
+	"net"
+	"sort"
+	"time"
+)
+
+// ConsensusSummary holds aggregate statistics of a consensus.
+type ConsensusSummary struct {
+	// The number of all router statuses, including relays that are not
+	// running.
+	TotalRelays int
+
+	// The number of relays that have the respective flag.
+	Guard   int
+	Exit    int
+	Fast    int
+	Stable  int
+	Running int
+
+	// The number of relays that lack the Running flag.
+	NotRunning int
+
+	// The sum of all "w" lines' Bandwidth values.  In a vote, that is the
+	// relays' self-advertised bandwidth.
+	AdvertisedBandwidth uint64
+
+	// The sum of the bandwidth of all relays whose bandwidth was measured.
+	MeasuredBandwidth uint64
+}
+
+// measuredBandwidth returns the measured bandwidth of the given router status,
+// or 0 if its bandwidth was not measured.
+func measuredBandwidth(s *RouterStatus) uint64 {
+
+	switch {
+	case s.Unmeasured:
+		return 0
+	case s.Measured != 0:
+		// Votes carry measurements in a separate field.
+		return s.Measured
+	default:
+		return s.Bandwidth
+	}
+}
+
+// Summary computes aggregate statistics of the consensus in a single pass over
+// its router statuses.
+func (c *Consensus) Summary() ConsensusSummary {
+
+	var summary ConsensusSummary
+
+	for _, getStatus := range c.RouterStatuses {
+		status := getStatus()
+		if status == nil {
+			continue
+		}
+
+		summary.TotalRelays++
+		if status.Flags.Guard {
+			summary.Guard++
+		}
+		if status.Flags.Exit {
+			summary.Exit++
+		}
+		if status.Flags.Fast {
+			summary.Fast++
+		}
+		if status.Flags.Stable {
+			summary.Stable++
+		}
+		if status.Flags.Running {
+			summary.Running++
+		} else {
+			summary.NotRunning++
+		}
+
+		summary.AdvertisedBandwidth += status.Bandwidth
+		summary.MeasuredBandwidth += measuredBandwidth(status)
+	}
+
+	return summary
+}
+
+// ORPortDistribution counts the relays in the consensus per IPv4 OR port.
+func (c *Consensus) ORPortDistribution() map[uint16]int {
+
+	distribution := make(map[uint16]int)
+
+	for _, getStatus := range c.RouterStatuses {
+		status := getStatus()
+		if status == nil {
+			continue
+		}
+		distribution[status.Address.IPv4ORPort]++
+	}
+
+	return distribution
+}
+
+// BandwidthRank pairs a relay's fingerprint with its bandwidth.  It is an
+// alias of an unnamed struct, so callers may use either type.
+type BandwidthRank = struct {
+	Fpr Fingerprint
+	BW  int64
+}
+
+// BandwidthRanking returns the fingerprints and bandwidth values of all relays
+// in the consensus, sorted by bandwidth in descending order.  Relays with
+// equal bandwidth are ordered by fingerprint.
+func (c *Consensus) BandwidthRanking() []BandwidthRank {
+
+	ranking := make([]BandwidthRank, 0, c.Length())
+	for fingerprint, getStatus := range c.RouterStatuses {
+		status := getStatus()
+		if status == nil {
+			continue
+		}
+		ranking = append(ranking, BandwidthRank{fingerprint, int64(status.Bandwidth)})
+	}
+
+	sort.Slice(ranking, func(i, j int) bool {
+		if ranking[i].BW != ranking[j].BW {
+			return ranking[i].BW > ranking[j].BW
+		}
+		return ranking[i].Fpr < ranking[j].Fpr
+	})
+
+	return ranking
+}
+
+// Statuses returns the router statuses of the consensus, ordered by
+// fingerprint.  Unlike ToSlice, which returns functions that parse router
+// statuses on demand, this method parses all router statuses.  Router statuses
+// that fail to parse are left out.
+func (c *Consensus) Statuses() []*RouterStatus {
+
+	statuses := make([]*RouterStatus, 0, c.Length())
+	for _, fingerprint := range c.sortedFingerprints() {
+		if status := c.RouterStatuses[fingerprint](); status != nil {
+			statuses = append(statuses, status)
+		}
+	}
+
+	return statuses
+}
+
+// SortedByBandwidth returns the router statuses of the consensus, sorted by
+// bandwidth in descending order.  Relays with equal bandwidth are ordered by
+// fingerprint, so the result is deterministic.  Like Statuses, this method
+// parses all router statuses.
+func (c *Consensus) SortedByBandwidth() []*RouterStatus {
+
+	statuses := c.Statuses()
+
+	// The statuses are ordered by fingerprint, which a stable sort retains
+	// for equal bandwidth values.
+	sort.SliceStable(statuses, func(i, j int) bool {
+		return statuses[i].Bandwidth > statuses[j].Bandwidth
+	})
+
+	return statuses
+}
+
+// TopN returns the n router statuses with the highest bandwidth, ordered as by
+// SortedByBandwidth.  If the consensus has fewer than n relays, all of them
+// are returned.
+func (c *Consensus) TopN(n int) []*RouterStatus {
+
+	statuses := c.SortedByBandwidth()
+	if n < 0 {
+		n = 0
+	}
+	if n < len(statuses) {
+		statuses = statuses[:n]
+	}
+
+	return statuses
+}
+
+// RelaysControllingFraction returns the minimum number of relays whose
+// combined consensus weight makes up at least the given fraction (between 0
+// and 1) of the consensus' total weight.  For example, a fraction of 0.5
+// answers how few relays control half of the network.  The function returns 0
+// if the fraction is not positive or if the consensus has no weight at all.
+func (c *Consensus) RelaysControllingFraction(frac float64) int {
+
+	ranking := c.BandwidthRanking()
+
+	var total int64
+	for _, rank := range ranking {
+		total += rank.BW
+	}
+	if frac <= 0 || total == 0 {
+		return 0
+	}
+
+	var sum int64
+	for i, rank := range ranking {
+		sum += rank.BW
+		if float64(sum) >= frac*float64(total) {
+			return i + 1
+		}
+	}
+
+	return len(ranking)
+}
+
+// BandwidthGini returns the Gini coefficient of the consensus bandwidth of all
+// running relays, i.e., 0 if all relays have the same bandwidth and values
+// close to 1 if a few relays have almost all bandwidth.  The function returns
+// 0 if there are fewer than two running relays or no bandwidth at all.
+func (c *Consensus) BandwidthGini() float64 {
+
+	var bandwidths []uint64
+	var total float64
+	for _, getStatus := range c.RouterStatuses {
+		if status := getStatus(); status != nil && status.Flags.Running {
+			bandwidths = append(bandwidths, status.Bandwidth)
+			total += float64(status.Bandwidth)
+		}
+	}
+
+	n := float64(len(bandwidths))
+	if len(bandwidths) < 2 || total == 0 {
+		return 0
+	}
+	sort.Slice(bandwidths, func(i, j int) bool { return bandwidths[i] < bandwidths[j] })
+
+	// With bandwidths x_1 <= ... <= x_n, the coefficient is
+	// 2 * sum(i * x_i) / (n * sum(x_i)) - (n + 1) / n.
+	var weighted float64
+	for i, bandwidth := range bandwidths {
+		weighted += float64(i+1) * float64(bandwidth)
+	}
+
+	return 2*weighted/(n*total) - (n+1)/n
+}
+
+// PublicationLag returns, for every relay in the given consensus, how much
+// time passed between the publication of the relay's descriptor (as given in
+// the "r" line) and the consensus' ValidAfter time.  Large lags indicate stale
+// descriptors.
+func PublicationLag(c *Consensus) map[Fingerprint]time.Duration {
+
+	lags := make(map[Fingerprint]time.Duration)
+
+	for fingerprint, getStatus := range c.RouterStatuses {
+		if status := getStatus(); status != nil {
+			lags[fingerprint] = c.ValidAfter.Sub(status.Publication)
+		}
+	}
+
+	return lags
+}
+
+// MedianLag returns the median of the given publication lags, as returned by
+// PublicationLag.  For an even number of lags, the mean of the two middle lags
+// is returned.  The median of no lags is 0.
+func MedianLag(lags map[Fingerprint]time.Duration) time.Duration {
+
+	if len(lags) == 0 {
+		return 0
+	}
+
+	sorted := make([]time.Duration, 0, len(lags))
+	for _, lag := range lags {
+		sorted = append(sorted, lag)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	middle := len(sorted) / 2
+	if len(sorted)%2 == 1 {
+		return sorted[middle]
+	}
+
+	return (sorted[middle-1] + sorted[middle]) / 2
+}
+
+// totalRunningBandwidth returns the summed up bandwidth of all relays in the
+// consensus that have the Running flag.  The sum is cached until the consensus
+// is modified using Set, but not if RouterStatuses is modified directly.
+func (c *Consensus) totalRunningBandwidth() uint64 {
+
+	c.cacheMutex.Lock()
+	defer c.cacheMutex.Unlock()
+
+	if c.runningBandwidthValid {
+		return c.runningBandwidth
+	}
+
+	var total uint64
+	for _, getStatus := range c.RouterStatuses {
+		if status := getStatus(); status != nil && status.Flags.Running {
+			total += status.Bandwidth
+		}
+	}
+	c.runningBandwidth, c.runningBandwidthValid = total, true
+
+	return total
+}
+
+// WeightFraction returns the relay's consensus weight fraction, i.e., its
+// bandwidth divided by the bandwidth of all running relays in the given
+// consensus, which the relay is expected to be part of.  Relays without the
+// Running flag have a fraction of 0.  The total is computed once and cached in
+// the consensus, so calling this method for every relay is cheap.  The cache
+// is invalidated by Set, but not if RouterStatuses is modified directly.
+func (s *RouterStatus) WeightFraction(c *Consensus) float64 {
+
+	if !s.Flags.Running {
+		return 0
+	}
+
+	total := c.totalRunningBandwidth()
+	if total == 0 {
+		return 0
+	}
+
+	return float64(s.Bandwidth) / float64(total)
+}
+
+// UnknownAS is the autonomous system number under which GroupByAS groups
+// relays whose AS is unknown.  AS 0 is reserved, so it cannot clash with a
+// real AS.
+const UnknownAS uint32 = 0
+
+// GroupByAS groups the consensus' router statuses by the autonomous system
+// that the given lookup function returns for the relay's IPv4 address.  Just
+// like EnrichCountry, this keeps zoossh free of a routing dataset.  Relays
+// without an IPv4 address and relays for which the lookup function returns 0
+// are grouped under UnknownAS.  The router statuses of every group are sorted
+// by fingerprint.  A consensus without relays results in an empty map.
+func (c *Consensus) GroupByAS(lookup func(net.IP) uint32) map[uint32][]*RouterStatus {
+
+	groups := make(map[uint32][]*RouterStatus)
+	for _, fingerprint := range c.sortedFingerprints() {
+		status := c.RouterStatuses[fingerprint]()
+		if status == nil {
+			continue
+		}
+
+		as := UnknownAS
+		if status.Address.IPv4Address != nil {
+			as = lookup(status.Address.IPv4Address)
+		}
+		groups[as] = append(groups[as], status)
+	}
+
+	return groups
+}
@@ -0,0 +1,379 @@
+// Tests functions from "stats.go".
+
+package zoossh
+
+import (
+	"math"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestConsensusSummary(t *testing.T) {
+
+	consensus := NewConsensus()
+	consensus.Set("A", &RouterStatus{
+		Flags:     RouterFlags{Guard: true, Fast: true, Stable: true, Running: true},
+		Bandwidth: 100,
+	})
+	consensus.Set("B", &RouterStatus{
+		Flags:      RouterFlags{Exit: true, Running: true},
+		Bandwidth:  20,
+		Unmeasured: true,
+	})
+	consensus.Set("C", &RouterStatus{
+		Flags:     RouterFlags{Guard: true, Exit: true},
+		Bandwidth: 5,
+	})
+
+	expected := ConsensusSummary{
+		TotalRelays:         3,
+		Guard:               2,
+		Exit:                2,
+		Fast:                1,
+		Stable:              1,
+		Running:             2,
+		NotRunning:          1,
+		AdvertisedBandwidth: 125,
+		MeasuredBandwidth:   105,
+	}
+
+	if summary := consensus.Summary(); summary != expected {
+		t.Errorf("Expected summary %+v but got %+v.", expected, summary)
+	}
+
+	if summary := NewConsensus().Summary(); summary != (ConsensusSummary{}) {
+		t.Errorf("Expected empty summary but got %+v.", summary)
+	}
+}
+
+func TestORPortDistribution(t *testing.T) {
+
+	// Only run this test if the consensus file is there.
+	if _, err := os.Stat(consensusFile); os.IsNotExist(err) {
+		t.Skipf("skipping because of missing %s", consensusFile)
+	}
+
+	consensus, err := ParseConsensusFile(consensusFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	distribution := consensus.ORPortDistribution()
+	if distribution[9001] != 3529 {
+		t.Errorf("Expected 3529 relays on port 9001 but got %d.", distribution[9001])
+	}
+	if distribution[443] != 1850 {
+		t.Errorf("Expected 1850 relays on port 443 but got %d.", distribution[443])
+	}
+
+	total := 0
+	for _, count := range distribution {
+		total += count
+	}
+	if total != consensus.Length() {
+		t.Errorf("Expected %d relays in total but got %d.", consensus.Length(), total)
+	}
+}
+
+func TestBandwidthRanking(t *testing.T) {
+
+	// Only run this test if the consensus file is there.
+	if _, err := os.Stat(consensusFile); os.IsNotExist(err) {
+		t.Skipf("skipping because of missing %s", consensusFile)
+	}
+
+	consensus, err := ParseConsensusFile(consensusFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var highest uint64
+	for _, getStatus := range consensus.RouterStatuses {
+		if status := getStatus(); status.Bandwidth > highest {
+			highest = status.Bandwidth
+		}
+	}
+
+	ranking := consensus.BandwidthRanking()
+	if len(ranking) != consensus.Length() {
+		t.Errorf("Expected %d ranked relays but got %d.", consensus.Length(), len(ranking))
+	}
+	if ranking[0].BW != int64(highest) {
+		t.Errorf("Expected highest bandwidth %d but got %d.", highest, ranking[0].BW)
+	}
+	if status, _ := consensus.Get(ranking[0].Fpr); status.Bandwidth != highest {
+		t.Error("First ranked relay is not the highest-bandwidth relay.")
+	}
+
+	for i := 1; i < len(ranking); i++ {
+		if ranking[i-1].BW < ranking[i].BW {
+			t.Fatal("Bandwidth ranking is not sorted in descending order.")
+		}
+	}
+}
+
+func TestSortedByBandwidth(t *testing.T) {
+
+	consensus := NewConsensus()
+	for fingerprint, bandwidth := range map[Fingerprint]uint64{
+		"DDDDDDDDDDDDDDDDDDDDDDDDDDDDDDDDDDDDDDDD": 100,
+		"BBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBB": 300,
+		"CCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCC": 100,
+		"AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA": 100,
+	} {
+		consensus.Set(fingerprint, &RouterStatus{Fingerprint: fingerprint, Bandwidth: bandwidth})
+	}
+
+	expected := []Fingerprint{
+		"BBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBB",
+		"AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA",
+		"CCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCC",
+		"DDDDDDDDDDDDDDDDDDDDDDDDDDDDDDDDDDDDDDDD",
+	}
+
+	// Repeat to make sure that map iteration order doesn't matter.
+	for i := 0; i < 10; i++ {
+		sorted := consensus.SortedByBandwidth()
+		if len(sorted) != len(expected) {
+			t.Fatalf("Expected %d router statuses but got %d.", len(expected), len(sorted))
+		}
+		for j, status := range sorted {
+			if status.Fingerprint != expected[j] {
+				t.Fatalf("Expected %s at position %d but got %s.", expected[j], j, status.Fingerprint)
+			}
+		}
+	}
+
+	statuses := consensus.Statuses()
+	if len(statuses) != len(expected) {
+		t.Fatalf("Expected %d router statuses but got %d.", len(expected), len(statuses))
+	}
+	for i, status := range statuses {
+		if i > 0 && statuses[i-1].Fingerprint >= status.Fingerprint {
+			t.Errorf("Statuses are not ordered by fingerprint: %s before %s.", statuses[i-1].Fingerprint, status.Fingerprint)
+		}
+	}
+
+	if top := consensus.TopN(2); len(top) != 2 || top[0].Fingerprint != expected[0] || top[1].Fingerprint != expected[1] {
+		t.Errorf("TopN(2) returned unexpected router statuses %v.", top)
+	}
+	if top := consensus.TopN(10); len(top) != len(expected) {
+		t.Errorf("Expected TopN(10) to return %d router statuses but got %d.", len(expected), len(top))
+	}
+	if top := consensus.TopN(-1); len(top) != 0 {
+		t.Errorf("Expected TopN(-1) to return no router statuses but got %d.", len(top))
+	}
+}
+
+func TestRelaysControllingFraction(t *testing.T) {
+
+	consensus := NewConsensus()
+	for i, bandwidth := range []uint64{500, 200, 100, 100, 50, 50} {
+		fingerprint := Fingerprint(strings.Repeat(string(rune('A'+i)), 40))
+		consensus.Set(fingerprint, &RouterStatus{Fingerprint: fingerprint, Bandwidth: bandwidth})
+	}
+
+	tests := []struct {
+		frac     float64
+		expected int
+	}{
+		{0, 0},
+		{0.1, 1},
+		{0.5, 1},
+		{0.51, 2},
+		{0.7, 2},
+		{0.8, 3},
+		{0.95, 5},
+		{1, 6},
+		{2, 6},
+	}
+
+	for _, test := range tests {
+		if n := consensus.RelaysControllingFraction(test.frac); n != test.expected {
+			t.Errorf("Fraction %.2f resulted in %d relays, expected %d.", test.frac, n, test.expected)
+		}
+	}
+
+	if n := NewConsensus().RelaysControllingFraction(0.5); n != 0 {
+		t.Errorf("Expected 0 relays for empty consensus but got %d.", n)
+	}
+}
+
+func TestBandwidthGini(t *testing.T) {
+
+	newConsensus := func(bandwidths ...uint64) *Consensus {
+		consensus := NewConsensus()
+		for i, bandwidth := range bandwidths {
+			fingerprint := Fingerprint(strings.Repeat(string(rune('A'+i)), 40))
+			consensus.Set(fingerprint, &RouterStatus{Fingerprint: fingerprint, Bandwidth: bandwidth,
+				Flags: RouterFlags{Running: true}})
+		}
+		return consensus
+	}
+
+	tests := []struct {
+		bandwidths []uint64
+		expected   float64
+	}{
+		{nil, 0},
+		{[]uint64{100}, 0},
+		{[]uint64{0, 0}, 0},
+		{[]uint64{50, 50, 50, 50}, 0},
+		{[]uint64{0, 0, 0, 100}, 0.75},
+		{[]uint64{30, 10, 20}, 2.0 / 9},
+	}
+
+	for _, test := range tests {
+		if gini := newConsensus(test.bandwidths...).BandwidthGini(); math.Abs(gini-test.expected) > 1e-9 {
+			t.Errorf("Bandwidths %v resulted in %f, expected %f.", test.bandwidths, gini, test.expected)
+		}
+	}
+
+	// Relays that aren't running are ignored.
+	consensus := newConsensus(50, 50)
+	consensus.Set("CCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCC", &RouterStatus{Bandwidth: 1000})
+	if gini := consensus.BandwidthGini(); gini != 0 {
+		t.Errorf("Expected 0 for equal running relays but got %f.", gini)
+	}
+}
+
+func TestPublicationLag(t *testing.T) {
+
+	// Only run this test if the consensus file is there.
+	if _, err := os.Stat(consensusFile); os.IsNotExist(err) {
+		t.Skipf("skipping because of missing %s", consensusFile)
+	}
+
+	consensus, err := ParseConsensusFile(consensusFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lags := PublicationLag(consensus)
+	if len(lags) != consensus.Length() {
+		t.Errorf("Expected %d lags but got %d.", consensus.Length(), len(lags))
+	}
+
+	if median := MedianLag(lags); median < 0 {
+		t.Errorf("Expected non-negative median lag but got %s.", median)
+	}
+
+	crafted := map[Fingerprint]time.Duration{"A": time.Hour, "B": 3 * time.Hour, "C": 2 * time.Hour}
+	if median := MedianLag(crafted); median != 2*time.Hour {
+		t.Errorf("Expected median lag of 2h but got %s.", median)
+	}
+	crafted["D"] = 4 * time.Hour
+	if median := MedianLag(crafted); median != 150*time.Minute {
+		t.Errorf("Expected median lag of 2h30m but got %s.", median)
+	}
+	if median := MedianLag(nil); median != 0 {
+		t.Errorf("Expected median lag of 0 but got %s.", median)
+	}
+}
+
+func TestWeightFraction(t *testing.T) {
+
+	running := RouterFlags{Running: true, Valid: true}
+	statuses := []*RouterStatus{
+		{Fingerprint: "AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA", Bandwidth: 100, Flags: running},
+		{Fingerprint: "BBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBB", Bandwidth: 300, Flags: running},
+		{Fingerprint: "CCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCC", Bandwidth: 600, Flags: RouterFlags{Valid: true}},
+	}
+
+	consensus := NewConsensus()
+	for _, status := range statuses {
+		consensus.Set(status.Fingerprint, status)
+	}
+
+	// The non-running relay must not count towards the total.
+	if fraction := statuses[0].WeightFraction(consensus); fraction != 0.25 {
+		t.Errorf("Expected weight fraction 0.25 but got %f.", fraction)
+	}
+	if fraction := statuses[1].WeightFraction(consensus); fraction != 0.75 {
+		t.Errorf("Expected weight fraction 0.75 but got %f.", fraction)
+	}
+	if fraction := statuses[2].WeightFraction(consensus); fraction != 0 {
+		t.Errorf("Expected weight fraction 0 for non-running relay but got %f.", fraction)
+	}
+
+	// Adding a relay must invalidate the cached total.
+	added := &RouterStatus{Fingerprint: "DDDDDDDDDDDDDDDDDDDDDDDDDDDDDDDDDDDDDDDD", Bandwidth: 400, Flags: running}
+	consensus.Set(added.Fingerprint, added)
+	if fraction := added.WeightFraction(consensus); fraction != 0.5 {
+		t.Errorf("Expected weight fraction 0.5 but got %f.", fraction)
+	}
+
+	// The total is cached on demand, which must be safe for concurrent
+	// calls.  Run with -race to check.
+	consensus.Set(added.Fingerprint, added)
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if fraction := added.WeightFraction(consensus); fraction != 0.5 {
+				t.Errorf("Expected weight fraction 0.5 but got %f.", fraction)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if fraction := statuses[0].WeightFraction(NewConsensus()); fraction != 0 {
+		t.Errorf("Expected weight fraction 0 for empty consensus but got %f.", fraction)
+	}
+}
+
+func TestGroupByAS(t *testing.T) {
+
+	lookup := func(ip net.IP) uint32 {
+		switch ip.String() {
+		case "1.1.1.1", "1.1.1.2":
+			return 13335
+		case "8.8.8.8":
+			return 15169
+		}
+		return 0
+	}
+
+	if groups := NewConsensus().GroupByAS(lookup); len(groups) != 0 {
+		t.Errorf("Expected no groups for empty consensus but got %d.", len(groups))
+	}
+
+	consensus := NewConsensus()
+	for fingerprint, addr := range map[Fingerprint]string{
+		"AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA": "1.1.1.2",
+		"BBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBB": "1.1.1.1",
+		"CCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCC": "8.8.8.8",
+		"DDDDDDDDDDDDDDDDDDDDDDDDDDDDDDDDDDDDDDDD": "10.0.0.1",
+		"EEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEE": "",
+	} {
+		status := &RouterStatus{Fingerprint: fingerprint}
+		status.Address.IPv4Address = net.ParseIP(addr)
+		consensus.Set(fingerprint, status)
+	}
+
+	groups := consensus.GroupByAS(lookup)
+	expected := map[uint32][]Fingerprint{
+		13335:     {"AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA", "BBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBB"},
+		15169:     {"CCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCC"},
+		UnknownAS: {"DDDDDDDDDDDDDDDDDDDDDDDDDDDDDDDDDDDDDDDD", "EEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEE"},
+	}
+	if len(groups) != len(expected) {
+		t.Fatalf("Expected %d groups but got %d.", len(expected), len(groups))
+	}
+	for as, fingerprints := range expected {
+		if len(groups[as]) != len(fingerprints) {
+			t.Errorf("Expected %d relays in AS %d but got %d.", len(fingerprints), as, len(groups[as]))
+			continue
+		}
+		for i, status := range groups[as] {
+			if status.Fingerprint != fingerprints[i] {
+				t.Errorf("Expected %s at position %d of AS %d but got %s.", fingerprints[i], i, as, status.Fingerprint)
+			}
+		}
+	}
+}
@@ -0,0 +1,88 @@
+// Provides an object set that is safe for concurrent use.
+
+package zoossh
+
+import (
+	"sync"
+)
+
+// SyncObjectSet wraps an ObjectSet and makes it safe for concurrent use.  The
+// object sets of this package allow concurrent calls of Length, Iterate, and
+// GetObject, as long as no goroutine modifies them at the same time, e.g.,
+// using Merge or Set.  SyncObjectSet guards these three methods and Merge with
+// a read-write mutex, so several goroutines can query the set while others
+// merge new objects into it.  Methods that are not part of ObjectSet, e.g.,
+// those of a wrapped Consensus, are not guarded.  The wrapped set must not be
+// accessed directly anymore.
+type SyncObjectSet struct {
+	mutex sync.RWMutex
+	set   ObjectSet
+}
+
+// NewSyncObjectSet serves as a constructor and returns a pointer to a
+// SyncObjectSet that wraps the given object set.
+func NewSyncObjectSet(set ObjectSet) *SyncObjectSet {
+
+	return &SyncObjectSet{set: set}
+}
+
+// Length implements the ObjectSet interface.  It returns the number of
+// objects in the wrapped set.
+func (s *SyncObjectSet) Length() int {
+
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	return s.set.Length()
+}
+
+// Iterate implements the ObjectSet interface.  It takes a snapshot of the
+// objects in the wrapped set that pass the given filter and returns them using
+// a channel.  Taking a snapshot means that the set is not locked while the
+// caller consumes the channel, so callers may stop reading early.
+func (s *SyncObjectSet) Iterate(filter *ObjectFilter) <-chan Object {
+
+	var objects []Object
+
+	s.mutex.RLock()
+	for obj := range s.set.Iterate(filter) {
+		objects = append(objects, obj)
+	}
+	s.mutex.RUnlock()
+
+	ch := make(chan Object)
+	go func() {
+		for _, obj := range objects {
+			ch <- obj
+		}
+		close(ch)
+	}()
+
+	return ch
+}
+
+// GetObject implements the ObjectSet interface.  It returns the object
+// identified by the given fingerprint and a boolean value indicating if the
+// object could be found.
+func (s *SyncObjectSet) GetObject(fingerprint Fingerprint) (Object, bool) {
+
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	return s.set.GetObject(fingerprint)
+}
+
+// Merge implements the ObjectSet interface.  It merges the given object set
+// into the wrapped set.  The given set is copied before the wrapped set is
+// locked, so two SyncObjectSets can be merged into each other concurrently
+// without deadlocking.
+func (s *SyncObjectSet) Merge(objs ObjectSet) {
+
+	snapshot := NewSortedObjectSet()
+	snapshot.Merge(objs)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.set.Merge(snapshot)
+}
@@ -0,0 +1,66 @@
+// Tests functions from "sync.go".
+
+package zoossh
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestSyncObjectSet(t *testing.T) {
+
+	consensus := NewConsensus()
+	for _, status := range makeRouterStatuses(100) {
+		consensus.Set(status.Fingerprint, status)
+	}
+	set := NewSyncObjectSet(consensus)
+
+	// Readers and writers run concurrently, which the race detector checks.
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for obj := range set.Iterate(nil) {
+				if _, found := set.GetObject(obj.GetFingerprint()); !found {
+					t.Errorf("Object %s not found.", obj.GetFingerprint())
+				}
+			}
+		}()
+		go func(i int) {
+			defer wg.Done()
+			extra := NewConsensus()
+			status := &RouterStatus{Fingerprint: Fingerprint(fmt.Sprintf("%040X", 1000+i))}
+			extra.Set(status.Fingerprint, status)
+			set.Merge(extra)
+		}(i)
+	}
+
+	// Merging sets into each other must not deadlock.
+	other := NewSyncObjectSet(NewConsensus())
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		set.Merge(other)
+	}()
+	go func() {
+		defer wg.Done()
+		other.Merge(set)
+	}()
+	wg.Wait()
+
+	if set.Length() != 104 {
+		t.Errorf("Expected 104 objects but got %d.", set.Length())
+	}
+	set.Merge(set)
+	if set.Length() != 104 {
+		t.Errorf("Merging the set with itself changed its length to %d.", set.Length())
+	}
+
+	// Callers may stop iterating early.
+	for range set.Iterate(nil) {
+		break
+	}
+	set.Merge(NewConsensus())
+}
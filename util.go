@@ -4,8 +4,10 @@ package zoossh
 
 import (
 	"bufio"
+	"bytes"
 	"encoding/base64"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"os"
@@ -13,12 +15,16 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
 type QueueUnit struct {
 	Blurb string
 	Err   error
+
+	// The line number at which Blurb starts in the dissected file.
+	Line int
 }
 
 type Annotation struct {
@@ -27,6 +33,384 @@ type Annotation struct {
 	Minor string
 }
 
+var (
+	// ErrNoAnnotation is returned if a document does not start with a type
+	// annotation.
+	ErrNoAnnotation = errors.New("missing file annotation")
+
+	// ErrUnknownAnnotation is returned, wrapped in an UnknownAnnotationError,
+	// if a document's type annotation is well-formed but of a type that
+	// zoossh cannot parse.
+	ErrUnknownAnnotation = errors.New("unknown file annotation")
+)
+
+// UnknownAnnotationError tells which unknown type annotation a document has.
+// It matches ErrUnknownAnnotation when passed to errors.Is, so callers can
+// tell unknown documents apart from malformed ones.
+type UnknownAnnotationError struct {
+	Annotation *Annotation
+}
+
+// Error implements the error interface.
+func (e *UnknownAnnotationError) Error() string {
+
+	return fmt.Sprintf("%s: %s", ErrUnknownAnnotation, e.Annotation)
+}
+
+// Unwrap returns ErrUnknownAnnotation.
+func (e *UnknownAnnotationError) Unwrap() error {
+
+	return ErrUnknownAnnotation
+}
+
+// annotationLineError returns the error for the given first line of a
+// document, which could not be parsed as type annotation.  Lines that don't
+// even start like a type annotation mean that the annotation is missing
+// altogether, so we return ErrNoAnnotation rather than the given error.
+func annotationLineError(line string, err error) error {
+
+	if !strings.HasPrefix(line, "@type") {
+		return fmt.Errorf("%w: first line is %q", ErrNoAnnotation, line)
+	}
+
+	return err
+}
+
+// The maximum number of bytes of an offending line that we keep in a
+// ParseError.
+const maxParseErrorText = 80
+
+// ParseError is returned by the parsers if they encounter a malformed line.
+// It tells the caller where the problem is, so malformed documents can be
+// debugged without bisecting the input.
+type ParseError struct {
+	// The line number of the offending line, starting at 1.
+	Line int
+
+	// The offending line, truncated to maxParseErrorText bytes.
+	Text string
+
+	// The keyword of the field that was being parsed.
+	Field string
+
+	// The underlying error.
+	Err error
+}
+
+// newParseError returns a ParseError for the given line, which is found at the
+// given line number and belongs to the given field.
+func newParseError(lineNum int, line, field string, err error) *ParseError {
+
+	if len(line) > maxParseErrorText {
+		line = line[:maxParseErrorText] + "..."
+	}
+
+	return &ParseError{Line: lineNum, Text: line, Field: field, Err: err}
+}
+
+// Error implements the error interface.
+func (e *ParseError) Error() string {
+
+	return fmt.Sprintf("line %d: could not parse %q field in %q: %s", e.Line, e.Field, e.Text, e.Err)
+}
+
+// offsetParseError shifts the line number of the given error by offset lines
+// if it is a ParseError or a DuplicateFingerprintError.  The parsers use it to
+// turn line numbers relative to a string chunk into line numbers relative to
+// the entire document.
+func offsetParseError(err error, offset int) error {
+
+	switch e := err.(type) {
+	case *ParseError:
+		e.Line += offset
+	case *DuplicateFingerprintError:
+		e.Line += offset
+	}
+
+	return err
+}
+
+// The levels that the parsers pass to the parse logger.  LogWarn is used for
+// dropped records and unknown annotations, and LogDebug for malformed values
+// that the parsers tolerate.
+const (
+	LogWarn  = "warn"
+	LogDebug = "debug"
+)
+
+var (
+	parseLoggerMutex sync.RWMutex
+	parseLogger      func(level, msg string)
+)
+
+// SetParseLogger sets a function that the parsers call when they skip a
+// record, encounter an unknown type annotation, or tolerate a malformed field.
+// The level is either LogWarn or LogDebug.  The function may be called
+// concurrently.  By default, no function is set and nothing is logged.  A nil
+// function turns logging off again.
+func SetParseLogger(fn func(level, msg string)) {
+
+	parseLoggerMutex.Lock()
+	defer parseLoggerMutex.Unlock()
+
+	parseLogger = fn
+}
+
+// logParse formats the given message and passes it to the parse logger, if
+// there is one.
+func logParse(level, format string, args ...interface{}) {
+
+	parseLoggerMutex.RLock()
+	logger := parseLogger
+	parseLoggerMutex.RUnlock()
+
+	if logger != nil {
+		logger(level, fmt.Sprintf(format, args...))
+	}
+}
+
+// DuplicateMode determines what the parsers do if a single file contains
+// several records with the same fingerprint.
+type DuplicateMode int
+
+const (
+	// DuplicateKeepLast keeps the record that comes last in the file.  That
+	// is the default.
+	DuplicateKeepLast DuplicateMode = iota
+	// DuplicateKeepFirst keeps the record that comes first in the file.
+	DuplicateKeepFirst
+	// DuplicateError makes the parsers return a *DuplicateFingerprintError.
+	DuplicateError
+)
+
+// ParseOption configures a single call of a parsing function, e.g.,
+// ParseDescriptorFileWithOptions(fileName, WithOnDuplicate(DuplicateError)).
+// Options only affect the call that they are passed to.  Every exported
+// parsing function that takes options is a "WithOptions" variant of a function
+// with the same name and the default settings.
+type ParseOption func(*parseOptions)
+
+// parseOptions holds the settings of a single parsing call.
+type parseOptions struct {
+	onDuplicate  DuplicateMode
+	strict       bool
+	checkEntries bool
+	sha256Digest bool
+}
+
+// newParseOptions returns the settings that result from applying the given
+// options to the defaults.
+func newParseOptions(opts []ParseOption) *parseOptions {
+
+	options := &parseOptions{onDuplicate: DuplicateKeepLast}
+	for _, opt := range opts {
+		opt(options)
+	}
+
+	return options
+}
+
+// WithOnDuplicate sets what the parsers do if a file contains several router
+// statuses, router descriptors, or extra-info descriptors with the same
+// fingerprint.  The default is DuplicateKeepLast.  Unless the mode is
+// DuplicateError, dropped records are passed to the parse logger at level
+// LogWarn.  Records with the same fingerprint in different files, e.g., when
+// using ParseDescriptorFiles, are not affected.
+func WithOnDuplicate(mode DuplicateMode) ParseOption {
+
+	return func(options *parseOptions) {
+		options.onDuplicate = mode
+	}
+}
+
+// WithEntryStructureCheck turns the structural check of router status entries
+// on or off.  It is off by default because it costs time for every entry, even
+// in lazily parsed consensuses.  If it is on, Consensus.CheckEntryStructure
+// returns the problems that were found.  Strict mode always runs the check but
+// fails on the first problem.
+func WithEntryStructureCheck(check bool) ParseOption {
+
+	return func(options *parseOptions) {
+		options.checkEntries = check
+	}
+}
+
+// WithSHA256Digest turns the computation of the digest that
+// Consensus.ComputeSHA256Digest returns on or off.  It is off by default
+// because hashing the document costs time for every parse.
+func WithSHA256Digest(compute bool) ParseOption {
+
+	return func(options *parseOptions) {
+		options.sha256Digest = compute
+	}
+}
+
+// WithStrictMode turns strict parsing on or off.  By default, the parsers are
+// lenient and skip lines that they don't understand.  In strict mode, router
+// status entries and router descriptors with unrecognised keyword lines,
+// missing or repeated mandatory lines, or lines in an order that the
+// specification forbids make the parsers fail with a *ParseError that names
+// the offending keyword and line.  Lazily parsed descriptors are checked when
+// they are parsed, but still in the mode that was given when the file was
+// parsed.
+func WithStrictMode(strict bool) ParseOption {
+
+	return func(options *parseOptions) {
+		options.strict = strict
+	}
+}
+
+// DuplicateFingerprintError is returned by the parsers if a file contains
+// several records with the same fingerprint and WithOnDuplicate was passed
+// DuplicateError.
+type DuplicateFingerprintError struct {
+	// The line at which the duplicate record starts.
+	Line        int
+	Fingerprint Fingerprint
+}
+
+// Error implements the error interface.
+func (e *DuplicateFingerprintError) Error() string {
+
+	return fmt.Sprintf("line %d: duplicate fingerprint %s", e.Line, e.Fingerprint)
+}
+
+// duplicateTracker remembers the fingerprints of the records that were parsed
+// from a single file, to apply the duplicate mode to them.
+type duplicateTracker struct {
+	mode DuplicateMode
+	seen map[Fingerprint]bool
+}
+
+// newDuplicateTracker returns a duplicateTracker that uses the duplicate mode
+// of the given settings.
+func newDuplicateTracker(options *parseOptions) *duplicateTracker {
+
+	return &duplicateTracker{mode: options.onDuplicate, seen: make(map[Fingerprint]bool)}
+}
+
+// keep determines if the record with the given fingerprint, which starts at
+// the given line, should be added to the object set, possibly replacing an
+// earlier one.  An error is returned if the record is a duplicate and the mode
+// is DuplicateError.
+func (dt *duplicateTracker) keep(fingerprint Fingerprint, line int) (bool, error) {
+
+	fingerprint = SanitiseFingerprint(fingerprint)
+	if !dt.seen[fingerprint] {
+		dt.seen[fingerprint] = true
+		return true, nil
+	}
+
+	switch dt.mode {
+	case DuplicateKeepFirst:
+		logParse(LogWarn, "line %d: dropping duplicate record for %s", line, fingerprint)
+		return false, nil
+	case DuplicateError:
+		return false, &DuplicateFingerprintError{Line: line, Fingerprint: fingerprint}
+	default:
+		logParse(LogWarn, "line %d: replacing earlier record for %s", line, fingerprint)
+		return true, nil
+	}
+}
+
+// TorVersion represents a Tor version number as specified in version-spec.txt,
+// e.g., "0.4.7.13" or "0.4.8.1-alpha".
+type TorVersion struct {
+	Major, Minor, Micro, Patch int
+
+	// The status tag, e.g., "alpha" or "rc", which is empty for stable
+	// releases.
+	Status string
+}
+
+// ParseTorVersion parses the given Tor version number.  Extra information in
+// parentheses after the version number, such as a git commit, is ignored.
+func ParseTorVersion(s string) (*TorVersion, error) {
+
+	fields := strings.Fields(s)
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("empty Tor version")
+	}
+
+	number := fields[0]
+	version := &TorVersion{}
+	if i := strings.IndexByte(number, '-'); i >= 0 {
+		version.Status = number[i+1:]
+		number = number[:i]
+	}
+
+	parts := strings.Split(number, ".")
+	if len(parts) < 3 || len(parts) > 4 {
+		return nil, fmt.Errorf("malformed Tor version %q", s)
+	}
+	nums := []*int{&version.Major, &version.Minor, &version.Micro, &version.Patch}
+	for i, part := range parts {
+		num, err := strconv.Atoi(part)
+		if err != nil || num < 0 {
+			return nil, fmt.Errorf("malformed Tor version %q", s)
+		}
+		*nums[i] = num
+	}
+
+	return version, nil
+}
+
+// String returns the version number in the format in which Tor prints it.
+func (v TorVersion) String() string {
+
+	s := fmt.Sprintf("%d.%d.%d.%d", v.Major, v.Minor, v.Micro, v.Patch)
+	if v.Status != "" {
+		s += "-" + v.Status
+	}
+
+	return s
+}
+
+// Compare returns -1 if the version is older than the given version, 1 if it
+// is newer, and 0 if both are equal.  Versions are compared by their numbers
+// first.  If the numbers are equal, a stable release is newer than a release
+// with a status tag, and status tags are compared lexically.
+func (v TorVersion) Compare(other TorVersion) int {
+
+	a := []int{v.Major, v.Minor, v.Micro, v.Patch}
+	b := []int{other.Major, other.Minor, other.Micro, other.Patch}
+	for i := range a {
+		if a[i] < b[i] {
+			return -1
+		} else if a[i] > b[i] {
+			return 1
+		}
+	}
+
+	switch {
+	case v.Status == other.Status:
+		return 0
+	case v.Status == "":
+		return 1
+	case other.Status == "":
+		return -1
+	case v.Status < other.Status:
+		return -1
+	default:
+		return 1
+	}
+}
+
+// MultiError holds several errors that occurred while processing a batch of
+// files.
+type MultiError []error
+
+// Error implements the error interface.
+func (errs MultiError) Error() string {
+
+	msgs := make([]string, len(errs))
+	for i, err := range errs {
+		msgs[i] = err.Error()
+	}
+
+	return fmt.Sprintf("%d error(s): %s", len(errs), strings.Join(msgs, "; "))
+}
+
 // Extracts a string unit from an archive file that can be readily thrown into
 // the respective parser.
 type StringExtractor func(string) (string, bool, error)
@@ -45,6 +429,51 @@ func (a *Annotation) Equals(b *Annotation) bool {
 	return (*a).Type == (*b).Type && (*a).Major == (*b).Major && (*a).Minor == (*b).Minor
 }
 
+// MatchesType checks whether the annotation is of the given type, e.g.,
+// "server-descriptor", regardless of its version.
+func (a *Annotation) MatchesType(typeName string) bool {
+
+	return a.Type == typeName
+}
+
+// AnnotationMatcher decides whether the given, observed type annotation is
+// acceptable.
+type AnnotationMatcher func(observed *Annotation) bool
+
+// MatchAnnotations returns an AnnotationMatcher that only accepts annotations
+// which are exactly equal to one of the given annotations.
+func MatchAnnotations(expected map[Annotation]bool) AnnotationMatcher {
+
+	return func(observed *Annotation) bool {
+		for annotation := range expected {
+			if annotation.Equals(observed) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// MatchAnnotationType returns an AnnotationMatcher that accepts annotations of
+// the given type with any version.
+func MatchAnnotationType(typeName string) AnnotationMatcher {
+
+	return func(observed *Annotation) bool {
+		return observed.MatchesType(typeName)
+	}
+}
+
+// MatchAnnotationMajor returns an AnnotationMatcher that accepts annotations of
+// the given type and major version with any minor version.  For example,
+// MatchAnnotationMajor("server-descriptor", "1") accepts
+// "@type server-descriptor 1.x".
+func MatchAnnotationMajor(typeName, major string) AnnotationMatcher {
+
+	return func(observed *Annotation) bool {
+		return observed.MatchesType(typeName) && observed.Major == major
+	}
+}
+
 // This is the same regexp Stem uses.
 // https://gitweb.torproject.org/stem.git/tree/stem/descriptor/__init__.py?id=1.4.1#n182
 var annotationRegexp = regexp.MustCompile(`^@type (\S+) (\d+)\.(\d+)$`)
@@ -66,6 +495,131 @@ func parseAnnotation(annotationText string) (*Annotation, error) {
 	return annotation, nil
 }
 
+// The annotation types that zoossh knows about.  matchAnnotationType returns
+// these very strings, so branching on known types doesn't allocate memory.
+var knownAnnotationTypes = []string{
+	"server-descriptor",
+	"extra-info",
+	"network-status-consensus-3",
+	"network-status-vote-3",
+	"bridge-network-status",
+	"bridge-server-descriptor",
+	"bridge-extra-info",
+	"bandwidth-file",
+}
+
+// equalFoldASCII checks whether the given byte slice and string are equal
+// under ASCII case folding.  Unlike bytes.EqualFold, it doesn't require
+// converting the string.
+func equalFoldASCII(b []byte, s string) bool {
+
+	if len(b) != len(s) {
+		return false
+	}
+	for i := range b {
+		x, y := b[i], s[i]
+		if 'A' <= x && x <= 'Z' {
+			x += 'a' - 'A'
+		}
+		if 'A' <= y && y <= 'Z' {
+			y += 'a' - 'A'
+		}
+		if x != y {
+			return false
+		}
+	}
+
+	return true
+}
+
+// isDigits returns true if the given byte slice is a non-empty sequence of
+// decimal digits.
+func isDigits(b []byte) bool {
+
+	if len(b) == 0 {
+		return false
+	}
+	for _, c := range b {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+
+	return true
+}
+
+// matchAnnotationType is a fast path for parseAnnotation that only determines
+// the type of the given annotation line, which must lack its line break.  It
+// accepts the same syntax as parseAnnotation, but matches known types
+// case-insensitively and returns them in their canonical form without
+// allocating memory.  Unknown types are returned as is.  The function returns
+// false if the line is no type annotation.
+func matchAnnotationType(line []byte) (string, bool) {
+
+	const prefix = "@type "
+	if len(line) < len(prefix) || string(line[:len(prefix)]) != prefix {
+		return "", false
+	}
+
+	rest := line[len(prefix):]
+	space := bytes.IndexByte(rest, ' ')
+	if space <= 0 {
+		return "", false
+	}
+	typeName, version := rest[:space], rest[space+1:]
+	if bytes.ContainsAny(typeName, "\t\v\f\r") {
+		return "", false
+	}
+
+	// The version takes the form "$major.$minor".
+	dot := bytes.IndexByte(version, '.')
+	if dot < 0 || !isDigits(version[:dot]) || !isDigits(version[dot+1:]) {
+		return "", false
+	}
+
+	for _, known := range knownAnnotationTypes {
+		if equalFoldASCII(typeName, known) {
+			return known, true
+		}
+	}
+
+	return string(typeName), true
+}
+
+// GetAnnotationType reads the type annotation from the given io.Reader and
+// returns only its type, e.g., "server-descriptor".  It is considerably
+// cheaper than GetAnnotation for callers that merely branch on the type of
+// many files.  Known types are matched case-insensitively.  The function may
+// read past the annotation, so the io.Reader should not be used for parsing
+// afterwards.
+func GetAnnotationType(r io.Reader) (string, error) {
+
+	var buf [128]byte
+	n := 0
+
+	for {
+		if i := bytes.IndexByte(buf[:n], '\n'); i >= 0 {
+			line := bytes.TrimSuffix(buf[:i], []byte("\r"))
+			if typeName, ok := matchAnnotationType(line); ok {
+				return typeName, nil
+			}
+			return "", annotationLineError(string(line), fmt.Errorf("bad syntax: %q", line))
+		}
+		if n == len(buf) {
+			return "", fmt.Errorf("type annotation exceeds %d bytes", len(buf))
+		}
+
+		m, err := r.Read(buf[n:])
+		n += m
+		if err == io.EOF && bytes.IndexByte(buf[:n], '\n') < 0 {
+			return "", annotationLineError(string(buf[:n]),
+				fmt.Errorf("truncated type annotation: %q", buf[:n]))
+		} else if err != nil && err != io.EOF {
+			return "", err
+		}
+	}
+}
+
 // Base64ToString decodes the given Base64-encoded string and returns the resulting string.
 // If there are errors during decoding, an error string is returned.
 func Base64ToString(encoded string) (string, error) {
@@ -97,18 +651,119 @@ func readAnnotation(r io.Reader) (*Annotation, io.Reader, error) {
 	// Use ReadSlice rather than ReadBytes in order to get ErrBufferFull
 	// when there is no '\n' byte.
 	slice, err := br.ReadSlice('\n')
-	if err != nil {
+	if err == io.EOF {
+		return nil, nil, annotationLineError(string(slice),
+			fmt.Errorf("truncated type annotation: %q", slice))
+	} else if err != nil {
 		return nil, nil, err
 	}
 
-	// Trim the trailing '\n'.
-	line := string(slice[:len(slice)-1])
+	// Trim the trailing '\n' and, if the file uses CRLF line endings, '\r'.
+	line := strings.TrimSuffix(string(slice[:len(slice)-1]), "\r")
 	annotation, err := parseAnnotation(line)
 	if err != nil {
+		return nil, nil, annotationLineError(line, err)
+	}
+
+	// Callers wrap the reader in a bufio.Reader themselves and rely on getting
+	// the very same reader back, so we have to return a bufio.Reader.
+	return annotation, bufio.NewReader(newCRLFReader(br)), nil
+}
+
+// guessAnnotation works like readAnnotation but for documents that lack a type
+// annotation, e.g., documents that didn't come from CollecTor.  It peeks at the
+// document's first line and returns the annotation that the document's
+// structure suggests.  Network status consensuses and votes start with
+// "network-status-version 3" and router descriptors with "router".  Other
+// documents, including version 2 network statuses and microdescriptor
+// consensuses, result in an error.  Nothing is consumed, so the first line of
+// the returned reader is the document's first line.
+func guessAnnotation(r io.Reader) (*Annotation, io.Reader, error) {
+
+	br := bufio.NewReader(r)
+
+	// The "vote-status" line that tells consensuses and votes apart is the
+	// second line, so the beginning of the document suffices.
+	head, err := br.Peek(512)
+	if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
 		return nil, nil, err
 	}
+	head = bytes.Replace(head, []byte("\r\n"), []byte("\n"), -1)
+
+	firstLine := string(head)
+	if i := strings.IndexByte(firstLine, '\n'); i >= 0 {
+		firstLine = firstLine[:i]
+	}
+
+	var annotation *Annotation
+	switch {
+	case firstLine == "network-status-version 3" && bytes.Contains(head, []byte("\nvote-status vote\n")):
+		annotation = &Annotation{"network-status-vote-3", "1", "0"}
+	case firstLine == "network-status-version 3":
+		annotation = &Annotation{"network-status-consensus-3", "1", "0"}
+	case strings.HasPrefix(firstLine, "router "):
+		annotation = &Annotation{"server-descriptor", "1", "0"}
+	case strings.HasPrefix(firstLine, "network-status-version "):
+		return nil, nil, fmt.Errorf("unsupported network status document: %q", firstLine)
+	default:
+		return nil, nil, fmt.Errorf("document starts with neither \"network-status-version\" nor \"router\": %q", firstLine)
+	}
+
+	return annotation, bufio.NewReader(newCRLFReader(br)), nil
+}
+
+// crlfReader is an io.Reader that turns CRLF line endings into LF line
+// endings, so the parsers don't have to deal with trailing '\r' characters in
+// documents that were saved on Windows.  Lone '\r' characters are retained.
+type crlfReader struct {
+	r       io.Reader
+	err     error
+	pending []byte
+	buf     []byte
+	out     []byte
+
+	// Set if the previous chunk ended with a '\r' that we held back.
+	carriageReturn bool
+}
+
+// newCRLFReader returns a crlfReader that reads from the given io.Reader.
+func newCRLFReader(r io.Reader) *crlfReader {
+
+	return &crlfReader{r: r, buf: make([]byte, 32*1024)}
+}
+
+// Read implements the io.Reader interface.
+func (c *crlfReader) Read(p []byte) (int, error) {
+
+	for len(c.pending) == 0 {
+		if c.err != nil {
+			return 0, c.err
+		}
+
+		var n int
+		n, c.err = c.r.Read(c.buf)
+
+		c.out = c.out[:0]
+		for _, b := range c.buf[:n] {
+			if c.carriageReturn && b != '\n' {
+				c.out = append(c.out, '\r')
+			}
+			c.carriageReturn = b == '\r'
+			if !c.carriageReturn {
+				c.out = append(c.out, b)
+			}
+		}
+		if c.err != nil && c.carriageReturn {
+			c.out = append(c.out, '\r')
+			c.carriageReturn = false
+		}
+		c.pending = c.out
+	}
 
-	return annotation, br, nil
+	n := copy(p, c.pending)
+	c.pending = c.pending[n:]
+
+	return n, nil
 }
 
 // Checks the type annotation in the given io.Reader.  The Annotation struct
@@ -116,16 +771,21 @@ func readAnnotation(r io.Reader) (*Annotation, io.Reader, error) {
 // error string is returned.
 func readAndCheckAnnotation(r io.Reader, expected map[Annotation]bool) (io.Reader, error) {
 
+	return readAndMatchAnnotation(r, MatchAnnotations(expected))
+}
+
+// readAndMatchAnnotation works like readAndCheckAnnotation but lets the given
+// AnnotationMatcher decide which annotations are acceptable.
+func readAndMatchAnnotation(r io.Reader, match AnnotationMatcher) (io.Reader, error) {
+
 	observed, r, err := readAnnotation(r)
 	if err != nil {
 		return nil, err
 	}
 
-	for annotation := range expected {
-		// We support the observed annotation.
-		if annotation.Equals(observed) {
-			return r, nil
-		}
+	// We support the observed annotation.
+	if match(observed) {
+		return r, nil
 	}
 
 	return nil, fmt.Errorf("unexpected file annotation: %s", observed)
@@ -143,7 +803,7 @@ func GetAnnotation(fileName string) (*Annotation, error) {
 
 	annotation, _, err := readAnnotation(fd)
 	if err != nil {
-		return nil, fmt.Errorf("could not read file annotation for %q: %s", fileName, err)
+		return nil, fmt.Errorf("could not read file annotation for %q: %w", fileName, err)
 	}
 
 	return annotation, nil
@@ -154,6 +814,14 @@ func GetAnnotation(fileName string) (*Annotation, error) {
 // annotation, an error string is returned.
 func CheckAnnotation(fd *os.File, expected map[Annotation]bool) error {
 
+	return CheckAnnotationMatch(fd, MatchAnnotations(expected))
+}
+
+// CheckAnnotationMatch works like CheckAnnotation but lets the given
+// AnnotationMatcher decide which annotations are acceptable.  That allows for
+// more lenient checks such as MatchAnnotationType.
+func CheckAnnotationMatch(fd *os.File, match AnnotationMatcher) error {
+
 	before, err := fd.Seek(0, os.SEEK_CUR)
 	if err != nil {
 		return err
@@ -163,7 +831,12 @@ func CheckAnnotation(fd *os.File, expected map[Annotation]bool) error {
 	// following URL for details:
 	// <https://metrics.torproject.org/collector.html#data-formats>
 	scanner := bufio.NewScanner(fd)
-	scanner.Scan()
+	if !scanner.Scan() {
+		if err := scanner.Err(); err != nil {
+			return fmt.Errorf("could not read file annotation: %s", err)
+		}
+		return ErrNoAnnotation
+	}
 	annotation := scanner.Text()
 
 	// Set file descriptor back because NewScanner() reads and buffers large
@@ -175,14 +848,12 @@ func CheckAnnotation(fd *os.File, expected map[Annotation]bool) error {
 
 	observed, err := parseAnnotation(annotation)
 	if err != nil {
-		return err
+		return annotationLineError(annotation, err)
 	}
 
-	for annotation := range expected {
-		// We support the observed annotation.
-		if annotation.Equals(observed) {
-			return nil
-		}
+	// We support the observed annotation.
+	if match(observed) {
+		return nil
 	}
 
 	return fmt.Errorf("unexpected file annotation: %q", annotation)
@@ -193,18 +864,100 @@ func CheckAnnotation(fd *os.File, expected map[Annotation]bool) error {
 // given queue where the receiving end parses them.
 func DissectFile(r io.Reader, extractor bufio.SplitFunc, queue chan QueueUnit) {
 
+	dissectFile(r, extractor, queue, 1)
+}
+
+// dissectFile works like DissectFile but the given firstLine is the line
+// number of the first line in the io.Reader.  That allows us to hand out the
+// correct line numbers when parts of the file were already read, e.g., its
+// type annotation.
+func dissectFile(r io.Reader, extractor bufio.SplitFunc, queue chan QueueUnit, firstLine int) {
+
+	dissectFileUntil(r, extractor, queue, firstLine, nil)
+}
+
+// dissectFileUntil works like dissectFile but stops reading once the given
+// done channel is closed.  The queue is closed after the last read from the
+// io.Reader, so once the queue is drained, the io.Reader is no longer in use.
+// A nil done channel never stops reading.
+func dissectFileUntil(r io.Reader, extractor bufio.SplitFunc, queue chan QueueUnit, firstLine int,
+	done <-chan struct{}) {
+
 	defer close(queue)
 
+	newline := []byte("\n")
+	line, unitLine := firstLine, firstLine
+
+	// Wrap the extractor so we can count the lines that we advance over.  Our
+	// extractors return string chunks that end where the scanner advances to,
+	// so whatever comes before the chunk was skipped.
+	countingExtractor := func(data []byte, atEOF bool) (int, []byte, error) {
+		advance, token, err := extractor(data, atEOF)
+		if token != nil && advance >= len(token) {
+			unitLine = line + bytes.Count(data[:advance-len(token)], newline)
+		}
+		if advance > 0 && advance <= len(data) {
+			line += bytes.Count(data[:advance], newline)
+		}
+		return advance, token, err
+	}
+
 	scanner := bufio.NewScanner(r)
-	scanner.Split(extractor)
+	scanner.Split(countingExtractor)
 
 	for scanner.Scan() {
-		unit := scanner.Text()
-		queue <- QueueUnit{unit, nil}
+		select {
+		case queue <- QueueUnit{scanner.Text(), nil, unitLine}:
+		case <-done:
+			return
+		}
 	}
 
 	if err := scanner.Err(); err != nil {
-		queue <- QueueUnit{"", err}
+		select {
+		case queue <- QueueUnit{"", err, line}:
+		case <-done:
+		}
+	}
+}
+
+// extractByKeyword returns a bufio.SplitFunc that extracts documents which
+// begin with a line starting with the given keyword.  Every document ends
+// where the next one begins, or with the input.  That suits documents which
+// lack a signature, e.g., sanitised bridge descriptors.
+func extractByKeyword(keyword string) bufio.SplitFunc {
+
+	first := []byte(keyword + " ")
+	next := []byte("\n" + keyword + " ")
+
+	return func(data []byte, atEOF bool) (advance int, token []byte, err error) {
+
+		if atEOF && len(data) == 0 {
+			return 0, nil, nil
+		}
+
+		start := 0
+		if !bytes.HasPrefix(data, first) {
+			start = bytes.Index(data, next)
+			if start < 0 {
+				if atEOF {
+					return 0, nil, fmt.Errorf("cannot find beginning of document: %q", next)
+				}
+				// Request more data.
+				return 0, nil, nil
+			}
+			start++
+		}
+
+		end := bytes.Index(data[start:], next)
+		if end >= 0 {
+			return start + end + 1, data[start : start+end+1], nil
+		}
+		if atEOF {
+			return len(data), data[start:], nil
+		}
+		// Request more data.
+		return start, nil, nil
 	}
 }
 
@@ -221,6 +974,71 @@ func StringToPort(portStr string) uint16 {
 	return uint16(portNum)
 }
 
+// The highest subprotocol version that Tor accepts, as defined by
+// MAX_PROTOCOL_VERSION in Tor's protover.c.
+const maxProtocolVersion = 63
+
+// parseProtocols parses the subprotocol version entries of a "proto" or "pr"
+// line, e.g., "Link=1-4 LinkAuth=1,3", into a map from subprotocol name to its
+// supported versions in ascending order.  Versions that overlapping ranges
+// repeat are listed once.  Like Tor, we reject versions above
+// maxProtocolVersion, which keeps ranges from expanding into huge slices.  See
+// dir-spec.txt, Section 2.1.1 for details.
+func parseProtocols(entries []string) (map[string][]uint32, error) {
+
+	protocols := make(map[string][]uint32)
+
+	for _, entry := range entries {
+		if entry == "" {
+			continue
+		}
+		split := strings.SplitN(entry, "=", 2)
+		if len(split) != 2 || split[0] == "" {
+			return nil, fmt.Errorf("malformed subprotocol entry %q", entry)
+		}
+		name := split[0]
+
+		// Versions fit into a bit mask because they don't exceed
+		// maxProtocolVersion.
+		var mask uint64
+		for _, versionRange := range strings.Split(split[1], ",") {
+			if versionRange == "" {
+				continue
+			}
+			bounds := strings.SplitN(versionRange, "-", 2)
+			low, err := strconv.ParseUint(bounds[0], 10, 32)
+			if err != nil {
+				return nil, err
+			}
+			high := low
+			if len(bounds) == 2 {
+				if high, err = strconv.ParseUint(bounds[1], 10, 32); err != nil {
+					return nil, err
+				}
+			}
+			if high < low {
+				return nil, fmt.Errorf("invalid version range %q", versionRange)
+			}
+			if high > maxProtocolVersion {
+				return nil, fmt.Errorf("version range %q exceeds %d", versionRange, maxProtocolVersion)
+			}
+			for version := low; version <= high; version++ {
+				mask |= 1 << version
+			}
+		}
+
+		versions := []uint32{}
+		for version := uint32(0); version <= maxProtocolVersion; version++ {
+			if mask&(1<<version) != 0 {
+				versions = append(versions, version)
+			}
+		}
+		protocols[name] = versions
+	}
+
+	return protocols, nil
+}
+
 // SanitiseFingerprint returns a sanitised version of the given fingerprint by
 // making it upper case and removing leading and trailing white spaces.
 func SanitiseFingerprint(fingerprint Fingerprint) Fingerprint {
@@ -230,6 +1048,35 @@ func SanitiseFingerprint(fingerprint Fingerprint) Fingerprint {
 	return Fingerprint(sanitised)
 }
 
+// Matches hex-encoded fingerprints.
+var hexFingerprintRegexp = regexp.MustCompile(`^[0-9A-Fa-f]{40}$`)
+
+// NormalizeFingerprint turns the given relay fingerprint into its canonical
+// form, i.e., 40 upper case hex characters.  It accepts hex-encoded
+// fingerprints, optionally prefixed by "$" as in Tor's configuration and
+// optionally split into groups by spaces as in "fingerprint" lines, as well as
+// the unpadded 27-character base64 encoding that network statuses use.
+// Anything else results in an error.
+func NormalizeFingerprint(s string) (Fingerprint, error) {
+
+	s = strings.TrimSpace(s)
+
+	if len(s) == 27 {
+		decoded, err := base64.RawStdEncoding.DecodeString(s)
+		if err != nil {
+			return "", fmt.Errorf("invalid base64 fingerprint %q: %s", s, err)
+		}
+		return Fingerprint(strings.ToUpper(hex.EncodeToString(decoded))), nil
+	}
+
+	hexFingerprint := strings.Join(strings.Fields(strings.TrimPrefix(s, "$")), "")
+	if !hexFingerprintRegexp.MatchString(hexFingerprint) {
+		return "", fmt.Errorf("invalid fingerprint %q", s)
+	}
+
+	return Fingerprint(strings.ToUpper(hexFingerprint)), nil
+}
+
 // LoadDescriptorFromDigest takes as input the descriptor directory, a
 // descriptor's digest, and the date the digest was created.  It then attempts
 // to parse and return the descriptor referenced by the digest.  The descriptor
@@ -4,9 +4,12 @@ package zoossh
 
 import (
 	"bytes"
+	"fmt"
 	"io/ioutil"
 	"os"
+	"strings"
 	"testing"
+	"testing/iotest"
 	"time"
 )
 
@@ -19,6 +22,27 @@ const (
 
 	// a newer consensus document that has shared-rand lines
 	sharedRandConsensusFile = "testdata/2017-04-15-00-00-00-consensus"
+
+	// a network status vote of a single directory authority
+	voteFile = "testdata/vote"
+
+	// a sanitised bridge network status
+	bridgeStatusFile = "testdata/bridge-network-status"
+
+	// sanitised bridge descriptors
+	bridgeDescriptorFile = "testdata/bridge-server-descriptors"
+
+	// bridge extra-info descriptors with pluggable transports
+	bridgeExtraInfoFile = "testdata/bridge-extra-infos"
+
+	// small consensus documents with both, only the current, and no
+	// shared-rand lines
+	sharedRandBothFile        = "testdata/shared-rand-both"
+	sharedRandCurrentOnlyFile = "testdata/shared-rand-current-only"
+	sharedRandNeitherFile     = "testdata/shared-rand-neither"
+
+	// a bandwidth file with two relay lines
+	bandwidthFile = "testdata/bandwidth-file"
 )
 
 // Benchmark the time it takes to look up a descriptor.
@@ -162,6 +186,101 @@ func BenchmarkParseAnnotation(b *testing.B) {
 	}
 }
 
+// Benchmark the function matchAnnotationType().  Compare with
+// BenchmarkParseAnnotation.
+func BenchmarkMatchAnnotationType(b *testing.B) {
+
+	line := []byte("@type server-descriptor 1.0")
+	b.ReportAllocs()
+
+	for i := 0; i < b.N; i++ {
+		if _, ok := matchAnnotationType(line); !ok {
+			b.Fatal("Failed to match annotation type.")
+		}
+	}
+}
+
+func TestMatchAnnotationType(t *testing.T) {
+
+	goodTests := []struct {
+		s        string
+		expected string
+	}{
+		{"@type server-descriptor 1.0", "server-descriptor"},
+		{"@type Server-Descriptor 1.0", "server-descriptor"},
+		{"@type NETWORK-STATUS-CONSENSUS-3 1.0", "network-status-consensus-3"},
+		{"@type extra-info 2.0", "extra-info"},
+		{"@type CASE 1.0", "CASE"},
+	}
+	badTests := []string{
+		"",
+		"@type test",
+		"@type 1.0",
+		"@type test 1",
+		"@type test 1.",
+		"@type test .0",
+		"@type test 1.0 more",
+		"@TYPE test 1.0",
+		"@typo test 1.0",
+		"type test 1.0",
+	}
+
+	for _, test := range goodTests {
+		typeName, ok := matchAnnotationType([]byte(test.s))
+		if !ok || typeName != test.expected {
+			t.Errorf("%q resulted in type %q, expected %q", test.s, typeName, test.expected)
+		}
+	}
+	for _, s := range badTests {
+		if _, ok := matchAnnotationType([]byte(s)); ok {
+			t.Errorf("%q was matched", s)
+		}
+	}
+
+	line := []byte("@type bridge-server-descriptor 1.2")
+	allocs := testing.AllocsPerRun(100, func() {
+		matchAnnotationType(line)
+	})
+	if allocs != 0 {
+		t.Errorf("Matching a known annotation type took %.0f allocations.", allocs)
+	}
+}
+
+func TestGetAnnotationType(t *testing.T) {
+
+	typeName, err := GetAnnotationType(iotest.OneByteReader(strings.NewReader("@type Extra-Info 1.0\r\nextra-info")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if typeName != "extra-info" {
+		t.Errorf("Got annotation type %q, expected \"extra-info\".", typeName)
+	}
+
+	for _, input := range []string{
+		"",
+		"@type extra-info 1.0",
+		"bad first line\nmore data\n",
+		"@type " + strings.Repeat("a", 200) + " 1.0\n",
+	} {
+		if _, err := GetAnnotationType(strings.NewReader(input)); err == nil {
+			t.Errorf("%q resulted in no error", input)
+		}
+	}
+
+	// Only run the rest of this test if the descriptor file is there.
+	if _, err := os.Stat(serverDescriptorFile); os.IsNotExist(err) {
+		t.Skipf("skipping because of missing %s", serverDescriptorFile)
+	}
+	fd, err := os.Open(serverDescriptorFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fd.Close()
+	if typeName, err := GetAnnotationType(fd); err != nil || typeName != "server-descriptor" {
+		t.Errorf("Got annotation type %q and error %v for %s.", typeName, err, serverDescriptorFile)
+	}
+}
+
 // Test the function readAnnotation().
 func TestReadAnnotation(t *testing.T) {
 
@@ -188,6 +307,46 @@ func TestReadAnnotation(t *testing.T) {
 	if err == nil {
 		t.Errorf("%q resulted in no error", badInput)
 	}
+
+	// So should truncated annotations.
+	for _, truncated := range []string{"", "@type serv", "@type server-descriptor 1.0"} {
+		_, _, err = readAnnotation(bytes.NewBufferString(truncated))
+		if err == nil {
+			t.Errorf("%q resulted in no error", truncated)
+		}
+	}
+
+	// Annotations with CRLF line endings are fine.
+	if _, _, err = readAnnotation(bytes.NewBufferString("@type test 1.0\r\n")); err != nil {
+		t.Errorf("CRLF line ending resulted in an error: %s", err)
+	}
+}
+
+// Fuzz the functions readAnnotation() and parseAnnotation().  Run with
+// "go test -fuzz FuzzParseAnnotation".
+func FuzzParseAnnotation(f *testing.F) {
+
+	f.Add([]byte("@type server-descriptor 1.0\n"))
+	f.Add([]byte("@type network-status-consensus-3 1.0\r\nnetwork-status-version 3\n"))
+	f.Add([]byte("@type serv"))
+	f.Add([]byte("\n"))
+	f.Add([]byte{})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		annotation, _, err := readAnnotation(bytes.NewReader(data))
+		if err != nil {
+			return
+		}
+
+		// Whatever we parsed must survive a round trip.
+		again, err := parseAnnotation(annotation.String())
+		if err != nil {
+			t.Fatalf("%q resulted in an error: %s", annotation, err)
+		}
+		if !again.Equals(annotation) {
+			t.Errorf("%q did not compare equal to %q", again, annotation)
+		}
+	})
 }
 
 // Test the function GetAnnotation() on a server-descriptor input.
@@ -313,6 +472,41 @@ func TestCheckAnnotationConsensus(t *testing.T) {
 	}
 }
 
+// Test the function CheckAnnotationMatch() with lenient matchers.
+func TestCheckAnnotationMatch(t *testing.T) {
+
+	fd, err := ioutil.TempFile("", "zoossh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(fd.Name())
+	defer fd.Close()
+	fmt.Fprint(fd, "@type server-descriptor 1.7\n")
+
+	check := func(match AnnotationMatcher) error {
+		if _, err := fd.Seek(0, 0); err != nil {
+			t.Fatal(err)
+		}
+		return CheckAnnotationMatch(fd, match)
+	}
+
+	if err := check(MatchAnnotations(descriptorAnnotations)); err == nil {
+		t.Error("Exact matcher accepted unknown minor version.")
+	}
+	if err := check(MatchAnnotationType("server-descriptor")); err != nil {
+		t.Error("Type matcher failed to accept annotation: ", err)
+	}
+	if err := check(MatchAnnotationMajor("server-descriptor", "1")); err != nil {
+		t.Error("Major version matcher failed to accept annotation: ", err)
+	}
+	if err := check(MatchAnnotationMajor("server-descriptor", "2")); err == nil {
+		t.Error("Major version matcher accepted wrong major version.")
+	}
+	if err := check(MatchAnnotationType("network-status-consensus-3")); err == nil {
+		t.Error("Type matcher accepted wrong type.")
+	}
+}
+
 func TestSanitiseFingerprint(t *testing.T) {
 
 	if SanitiseFingerprint(" foo bar\n \t") != "FOO BAR" {
@@ -320,6 +514,40 @@ func TestSanitiseFingerprint(t *testing.T) {
 	}
 }
 
+func TestNormalizeFingerprint(t *testing.T) {
+
+	const expected = Fingerprint("3954B216F50200A352629CFC64F02B30BA9FD03B")
+
+	for _, s := range []string{
+		"3954B216F50200A352629CFC64F02B30BA9FD03B",
+		"3954b216f50200a352629cfc64f02b30ba9fd03b",
+		"$3954B216F50200A352629CFC64F02B30BA9FD03B",
+		"3954 B216 F502 00A3 5262 9CFC 64F0 2B30 BA9F D03B",
+		" OVSyFvUCAKNSYpz8ZPArMLqf0Ds\n",
+	} {
+		fingerprint, err := NormalizeFingerprint(s)
+		if err != nil {
+			t.Errorf("Failed to normalize %q: %s", s, err)
+		} else if fingerprint != expected {
+			t.Errorf("Normalized %q to %s, expected %s.", s, fingerprint, expected)
+		}
+	}
+
+	for _, s := range []string{
+		"",
+		"foo",
+		"3954B216F50200A352629CFC64F02B30BA9FD03",
+		"3954B216F50200A352629CFC64F02B30BA9FD03BA",
+		"3954B216F50200A352629CFC64F02B30BA9FD03X",
+		"$$3954B216F50200A352629CFC64F02B30BA9FD03B",
+		"OVSyFvUCAKNSYpz8ZPArMLqf0D!",
+	} {
+		if _, err := NormalizeFingerprint(s); err == nil {
+			t.Errorf("Invalid fingerprint %q did not raise an error.", s)
+		}
+	}
+}
+
 func TestLoadDescriptorFromDigest(t *testing.T) {
 
 	_, err := LoadDescriptorFromDigest("", "foobar", time.Now())
@@ -351,3 +579,269 @@ func TestLoadDescriptorFromDigest(t *testing.T) {
 		}
 	}
 }
+
+func TestCRLFReader(t *testing.T) {
+
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"foo\r\nbar\r\n", "foo\nbar\n"},
+		{"foo\nbar", "foo\nbar"},
+		{"foo\rbar\r", "foo\rbar\r"},
+		{"foo\r\r\n", "foo\r\n"},
+		{"", ""},
+	}
+
+	for _, test := range tests {
+		// Read one byte at a time to make sure that line endings spanning
+		// two reads are recognised.
+		r := newCRLFReader(iotest.OneByteReader(strings.NewReader(test.input)))
+		output, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(output) != test.expected {
+			t.Errorf("%q was turned into %q, expected %q.", test.input, output, test.expected)
+		}
+	}
+}
+
+func TestSetParseLogger(t *testing.T) {
+
+	var messages []string
+	SetParseLogger(func(level, msg string) {
+		messages = append(messages, level+": "+msg)
+	})
+	defer SetParseLogger(nil)
+
+	// A malformed bandwidth value is tolerated but logged.
+	if _, _, err := ParseRawDescriptor("router foo 1.2.3.4 9001 0 0\nbandwidth 100 foo 100\n"); err != nil {
+		t.Fatal(err)
+	}
+	// A malformed router status is dropped when parsed lazily.
+	_, getStatus, err := LazyParseRawStatus("r foo AAoQ1DAR6kkoo19hBAX5K0QztNw\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if getStatus() != nil {
+		t.Error("Malformed router status was not dropped.")
+	}
+	// Unknown annotations are reported.
+	if _, err := ParseUnknown(strings.NewReader("@type foo 1.0\n")); err == nil {
+		t.Error("Unknown annotation did not raise an error.")
+	}
+
+	if len(messages) != 3 {
+		t.Fatalf("Expected 3 log messages but got %d: %q", len(messages), messages)
+	}
+	for i, prefix := range []string{LogDebug + ": ", LogWarn + ": ", LogWarn + ": "} {
+		if !strings.HasPrefix(messages[i], prefix) {
+			t.Errorf("Expected message %q to start with %q.", messages[i], prefix)
+		}
+	}
+
+	// Without a logger, nothing must happen.
+	SetParseLogger(nil)
+	if _, _, err := ParseRawDescriptor("router foo 1.2.3.4 9001 0 0\nuptime foo\n"); err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 3 {
+		t.Errorf("Expected no further log messages but got %q.", messages[3:])
+	}
+}
+
+func TestWithOnDuplicate(t *testing.T) {
+
+	fingerprint := "fingerprint 0000 0000 0000 0000 0000 0000 0000 0000 0000 0001\n" +
+		"router-signature\n-----BEGIN SIGNATURE-----\nAAAA\n-----END SIGNATURE-----\n"
+	raw := []byte("@type server-descriptor 1.0\n" +
+		"router first 1.2.3.4 9001 0 0\n" + fingerprint +
+		"router second 1.2.3.4 9001 0 0\n" + fingerprint)
+
+	for mode, expected := range map[DuplicateMode]string{DuplicateKeepLast: "second", DuplicateKeepFirst: "first"} {
+		descs, err := ParseDescriptorBytesWithOptions(raw, WithOnDuplicate(mode))
+		if err != nil {
+			t.Fatal(err)
+		}
+		desc, found := descs.Get("0000000000000000000000000000000000000001")
+		if descs.Length() != 1 || !found || desc.Nickname != expected {
+			t.Errorf("Mode %d kept the wrong descriptor.", mode)
+		}
+	}
+
+	_, err := ParseDescriptorBytesWithOptions(raw, WithOnDuplicate(DuplicateError))
+	dupErr, ok := err.(*DuplicateFingerprintError)
+	if !ok {
+		t.Fatalf("Expected *DuplicateFingerprintError but got %v.", err)
+	}
+	if dupErr.Line != 8 || dupErr.Fingerprint != "0000000000000000000000000000000000000001" {
+		t.Errorf("Duplicate reported incorrectly: %s", dupErr)
+	}
+
+	// Without a type annotation, the duplicate starts one line earlier.
+	fd, err := ioutil.TempFile("", "zoossh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(fd.Name())
+	if _, err := fd.Write(raw[bytes.IndexByte(raw, '\n')+1:]); err != nil {
+		t.Fatal(err)
+	}
+	fd.Close()
+	_, err = ParseDescriptorFileNoAnnotationWithOptions(fd.Name(), WithOnDuplicate(DuplicateError))
+	if dupErr, ok := err.(*DuplicateFingerprintError); !ok || dupErr.Line != 7 {
+		t.Errorf("Expected duplicate in line 7 but got %v.", err)
+	}
+
+	// The mode of one call must not leak into the next.
+	descs, err := ParseDescriptorBytes(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if desc, _ := descs.Get("0000000000000000000000000000000000000001"); desc == nil || desc.Nickname != "second" {
+		t.Error("Parsing without options did not keep the last duplicate.")
+	}
+}
+
+func TestWithStrictMode(t *testing.T) {
+
+	descriptor := "router foo 1.2.3.4 9001 0 0\n" +
+		"bandwidth 1 2 3\n" +
+		"published 2017-04-15 00:00:00\n" +
+		"router-signature\n-----BEGIN SIGNATURE-----\nAAAA\n-----END SIGNATURE-----\n"
+	tests := []struct {
+		raw   string
+		line  int
+		field string
+	}{
+		{strings.Replace(descriptor, "bandwidth", "foo bar\nbandwidth", 1), 2, "foo"},
+		{strings.Replace(descriptor, "published 2017-04-15 00:00:00\n", "", 1), 1, "published"},
+		{strings.Replace(descriptor, "bandwidth 1 2 3\n", "bandwidth 1 2 3\nbandwidth 1 2 3\n", 1), 1, "bandwidth"},
+		{"published 2017-04-15 00:00:00\n" + strings.Replace(descriptor, "published 2017-04-15 00:00:00\n", "", 1), 1, "published"},
+		{strings.Replace(descriptor, "router-signature", "router-signature\ncontact foo", 1), 4, "router-signature"},
+		{strings.Replace(descriptor, "bandwidth", "router-sig-ed25519 AAAA\nbandwidth", 1), 2, "router-sig-ed25519"},
+		{strings.SplitN(descriptor, "router-signature", 2)[0], 3, "router-signature"},
+	}
+
+	for _, test := range tests {
+		if _, _, err := ParseRawDescriptor(test.raw); err != nil {
+			t.Errorf("Lenient parsing of %q failed: %s", test.raw, err)
+		}
+
+		_, _, err := ParseRawDescriptorWithOptions(test.raw, WithStrictMode(true))
+		parseErr, ok := err.(*ParseError)
+		if !ok || parseErr.Line != test.line || parseErr.Field != test.field {
+			t.Errorf("Expected error in line %d and field %q for %q but got %v.", test.line, test.field, test.raw, err)
+		}
+	}
+	if _, _, err := ParseRawDescriptorWithOptions(descriptor, WithStrictMode(true)); err != nil {
+		t.Errorf("Strict parsing of valid descriptor failed: %s", err)
+	}
+
+	// Lazily parsed descriptors use the mode that was given at parse time.
+	unknownLine := strings.Replace(descriptor, "bandwidth", "fingerprint 0000 0000 0000 0000 0000 0000 0000 0000 0000 0001\nfoo bar\nbandwidth", 1)
+	_, getStrict, err := LazyParseRawDescriptorWithOptions(unknownLine, WithStrictMode(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, getLenient, err := LazyParseRawDescriptor(unknownLine)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if getStrict() != nil {
+		t.Error("Lazy strict parsing accepted an unknown line.")
+	}
+	if getLenient() == nil {
+		t.Error("Lazy lenient parsing rejected an unknown line.")
+	}
+
+	// Single router statuses are checked as well.
+	status := "r seele AAoQ1DAR6kkoo19hBAX5K0QztNw bdrzhG0Kk/8DUsnSdmzj7DjFQjY 2014-12-08 12:27:05 73.15.150.172 9001 0\n" +
+		"s Fast Running Stable Valid\nw Bandwidth=18\np reject 1-65535\n"
+	if _, _, err := ParseRawStatusWithOptions(status, WithStrictMode(true)); err != nil {
+		t.Errorf("Strict parsing of valid router status failed: %s", err)
+	}
+	misplaced := strings.Replace(status, "w Bandwidth=18\n", "", 1) + "w Bandwidth=18\n"
+	if _, _, err := ParseRawStatus(misplaced); err != nil {
+		t.Errorf("Lenient parsing of router status failed: %s", err)
+	}
+	_, _, err = ParseRawStatusWithOptions(misplaced, WithStrictMode(true))
+	if parseErr, ok := err.(*ParseError); !ok || parseErr.Line != 4 || parseErr.Field != "w" {
+		t.Errorf("Expected error in line 4 and field \"w\" but got %v.", err)
+	}
+	_, getStatus, err := LazyParseRawStatusWithOptions(misplaced, WithStrictMode(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if getStatus() != nil {
+		t.Error("Lazy strict parsing accepted a misplaced line.")
+	}
+
+	// Real documents must pass strict parsing.
+	for _, fileName := range []string{consensusFile, serverDescriptorFile, bridgeDescriptorFile, voteFile} {
+		if _, err := os.Stat(fileName); os.IsNotExist(err) {
+			t.Skipf("skipping because of missing %s", fileName)
+		}
+		if _, err := ParseUnknownFileWithOptions(fileName, WithStrictMode(true)); err != nil {
+			t.Errorf("Strict parsing of %s failed: %s", fileName, err)
+		}
+	}
+
+	// Router status entries must not have unknown or misplaced lines.
+	raw, err := ioutil.ReadFile(consensusFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	i := bytes.Index(raw, []byte("\ns ")) + 1
+	line := bytes.Count(raw[:i], []byte("\n")) + 1
+	// A "w" line before the "s" line puts the latter out of order.
+	for _, test := range []struct {
+		inserted string
+		line     int
+		field    string
+	}{
+		{"foo bar\n", line, "foo"},
+		{"w Bandwidth=1\n", line + 1, "s"},
+	} {
+		modified := append(append(append([]byte(nil), raw[:i]...), test.inserted...), raw[i:]...)
+		_, err = ParseConsensusBytesWithOptions(modified, WithStrictMode(true))
+		parseErr, ok := err.(*ParseError)
+		if !ok || parseErr.Line != test.line || parseErr.Field != test.field {
+			t.Errorf("Expected error in line %d and field %q but got %v.", test.line, test.field, err)
+		}
+	}
+}
+
+func TestTorVersionCompare(t *testing.T) {
+
+	// The versions are in ascending order.
+	versions := []string{"0.2.9.10", "0.4.7.13-alpha", "0.4.7.13-rc", "0.4.7.13", "0.4.7.13 (git-0123456789abcdef)", "0.4.10.1-dev"}
+	for i := 0; i < len(versions)-1; i++ {
+		a, err := ParseTorVersion(versions[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ParseTorVersion(versions[i+1])
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expected := -1
+		if a.String() == b.String() {
+			expected = 0
+		}
+		if cmp := a.Compare(*b); cmp != expected {
+			t.Errorf("Comparing %s to %s resulted in %d, expected %d.", a, b, cmp, expected)
+		}
+		if cmp := b.Compare(*a); cmp != -expected {
+			t.Errorf("Comparing %s to %s resulted in %d, expected %d.", b, a, cmp, -expected)
+		}
+	}
+
+	for _, version := range []string{"", "0.4", "0.4.x.1", "0.4.7.13.1"} {
+		if _, err := ParseTorVersion(version); err == nil {
+			t.Errorf("Malformed version %q did not cause an error.", version)
+		}
+	}
+}
@@ -0,0 +1,179 @@
+// Parses files containing network status votes.
+
+package zoossh
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var voteAnnotations = map[Annotation]bool{
+	// The file format we currently (try to) support.
+	Annotation{"network-status-vote-3", "1", "0"}: true,
+}
+
+// Vote represents a network status vote that a directory authority published.
+// Votes share most of their format with consensuses, so a Vote embeds a
+// Consensus which holds the vote's meta information and router statuses.
+type Vote struct {
+	*Consensus
+
+	// The single field of a "published" line.
+	Published time.Time
+
+	// The key=value pairs of the "flag-thresholds" line, which tell us the
+	// cutoffs that the authority used to assign flags.  Values are kept as
+	// strings because they mix integers, percentages, and booleans.  The map
+	// is nil if the vote has no "flag-thresholds" line.
+	FlagThresholds map[string]string
+
+	// The "shared-rand-commit" lines of the vote's authority section, in the
+	// order in which they appear.  A vote may contain any number of them,
+	// including none.
+	SharedRandCommits []SharedRandCommit
+}
+
+// SharedRandCommit represents a "shared-rand-commit" line of a vote, i.e., a
+// commitment to (and possibly the reveal of) an authority's contribution to
+// the shared random value.
+type SharedRandCommit struct {
+	// The version of the commit protocol, e.g., 1.
+	Version int
+
+	// The hash algorithm of the commit, e.g., "sha3-256".
+	Algorithm string
+
+	// The fingerprint of the authority that made the commit.
+	Identity Fingerprint
+
+	// The decoded commit value.
+	Commit []byte
+
+	// The decoded reveal value, which is nil if the line lacks one.
+	Reveal []byte
+}
+
+// parseSharedRandCommit parses the fields of a "shared-rand-commit" line,
+// i.e., "Version AlgName Identity Commit [Reveal]".
+func parseSharedRandCommit(words []string) (SharedRandCommit, error) {
+
+	var commit SharedRandCommit
+	if len(words) != 4 && len(words) != 5 {
+		return commit, fmt.Errorf("expected 4 or 5 fields but got %d", len(words))
+	}
+
+	version, err := strconv.Atoi(words[0])
+	if err != nil || version < 0 {
+		return commit, fmt.Errorf("malformed version %q", words[0])
+	}
+	commit.Version = version
+	commit.Algorithm = words[1]
+
+	if id, err := hex.DecodeString(words[2]); err != nil || len(id) != 20 {
+		return commit, fmt.Errorf("malformed identity %q", words[2])
+	}
+	commit.Identity = SanitiseFingerprint(Fingerprint(words[2]))
+
+	if commit.Commit, err = base64.StdEncoding.DecodeString(words[3]); err != nil {
+		return commit, fmt.Errorf("malformed commit value: %s", err)
+	}
+	if len(words) == 5 {
+		if commit.Reveal, err = base64.StdEncoding.DecodeString(words[4]); err != nil {
+			return commit, fmt.Errorf("malformed reveal value: %s", err)
+		}
+	}
+
+	return commit, nil
+}
+
+// parseFlagThresholds parses the value of a "flag-thresholds" line, e.g.,
+// "stable-uptime=1213768 guard-wfu=98.000%", into a map of key=value pairs.
+func parseFlagThresholds(line string) (map[string]string, error) {
+
+	thresholds := make(map[string]string)
+	for _, token := range strings.Fields(line) {
+		kv := strings.SplitN(token, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, fmt.Errorf("malformed flag threshold %q", token)
+		}
+		thresholds[kv[0]] = kv[1]
+	}
+
+	return thresholds, nil
+}
+
+// ParseRawVoteStatus parses a raw router status (in string format) that is
+// part of a vote.  In contrast to ParseRawStatus, the Bandwidth field holds
+// the relay's advertised bandwidth and the Measured field the bandwidth that
+// the authority measured.  Relays lacking a measurement are marked as
+// Unmeasured.
+func ParseRawVoteStatus(rawStatus string) (Fingerprint, GetStatus, error) {
+
+	return parseRawStatus(rawStatus, true)
+}
+
+// parseVoteUnchecked parses a document of type "network-status-vote-3".  The
+// input should be without a type annotation; i.e., the type annotation should
+// already have been read and checked to be the correct type.  The given
+// settings apply to parsing.
+func parseVoteUnchecked(r io.Reader, options *parseOptions) (*Vote, error) {
+
+	consensus, _, err := parseNetworkStatusUnchecked(r, ParseRawVoteStatus, options)
+	if err != nil {
+		return nil, err
+	}
+
+	vote := &Vote{Consensus: consensus, SharedRandCommits: consensus.sharedRandCommits}
+	vote.Published, err = time.Parse(publishedTimeLayout, string(consensus.MetaInfo["published"]))
+	if err != nil {
+		return nil, fmt.Errorf("could not parse vote's \"published\" line: %s", err)
+	}
+
+	if line, ok := consensus.MetaInfo["flag-thresholds"]; ok {
+		vote.FlagThresholds, err = parseFlagThresholds(string(line))
+		if err != nil {
+			return nil, fmt.Errorf("could not parse vote's \"flag-thresholds\" line: %s", err)
+		}
+	}
+
+	return vote, nil
+}
+
+// parseVote is a wrapper around parseVoteUnchecked that first reads and checks
+// the type annotation to make sure it belongs to voteAnnotations.
+func parseVote(r io.Reader, options *parseOptions) (*Vote, error) {
+
+	r, err := readAndCheckAnnotation(r, voteAnnotations)
+	if err != nil {
+		return nil, err
+	}
+
+	return parseVoteUnchecked(r, options)
+}
+
+// ParseVoteFile parses the given file and returns a network status vote if
+// parsing was successful.  If there were any errors, an error string is
+// returned.
+func ParseVoteFile(fileName string) (*Vote, error) {
+
+	return ParseVoteFileWithOptions(fileName)
+}
+
+// ParseVoteFileWithOptions works like ParseVoteFile but applies the given
+// options.
+func ParseVoteFileWithOptions(fileName string, opts ...ParseOption) (*Vote, error) {
+
+	fd, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+
+	return parseVote(fd, newParseOptions(opts))
+}
@@ -0,0 +1,135 @@
+// Tests functions from "vote.go".
+
+package zoossh
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestParseVoteFile(t *testing.T) {
+
+	// Only run this test if the vote file is there.
+	if _, err := os.Stat(voteFile); os.IsNotExist(err) {
+		t.Skipf("skipping because of missing %s", voteFile)
+	}
+
+	vote, err := ParseVoteFile(voteFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if vote.Length() != 3 {
+		t.Errorf("Expected 3 router statuses but got %d.", vote.Length())
+	}
+
+	if !vote.Published.Equal(time.Date(2017, time.April, 14, 23, 50, 0, 0, time.UTC)) {
+		t.Error("Vote's publication time parsed incorrectly.")
+	}
+
+	if len(vote.FlagThresholds) != 9 || vote.FlagThresholds["stable-uptime"] != "1213768" ||
+		vote.FlagThresholds["guard-wfu"] != "98.000%" || vote.FlagThresholds["ignoring-advertised-bws"] != "1" {
+		t.Errorf("Vote's flag thresholds parsed incorrectly: %v", vote.FlagThresholds)
+	}
+
+	// moria1 revealed its own commit but not yet the one of dannenberg.
+	if len(vote.SharedRandCommits) != 2 {
+		t.Fatalf("Expected 2 shared random commits but got %d.", len(vote.SharedRandCommits))
+	}
+	commit := vote.SharedRandCommits[0]
+	if commit.Version != 1 || commit.Algorithm != "sha3-256" ||
+		commit.Identity != "D586D18309DED4CD6D57C18FDB97EFA96D330566" ||
+		len(commit.Commit) != 40 || len(commit.Reveal) != 40 {
+		t.Errorf("First shared random commit parsed incorrectly: %+v", commit)
+	}
+	commit = vote.SharedRandCommits[1]
+	if commit.Identity != "14C131DFC5C6F93646BE72FA1401C02A8DF2E8B4" ||
+		len(commit.Commit) != 40 || commit.Reveal != nil {
+		t.Errorf("Second shared random commit parsed incorrectly: %+v", commit)
+	}
+
+	// A vote lists only the voting authority.
+	if len(vote.DirSources) != 1 || vote.DirSources[0].Nickname != "moria1" ||
+		vote.DirSources[0].Contact != "1024D/28988BF5 arma mit edu" {
+		t.Errorf("Vote's authority parsed incorrectly: %+v", vote.DirSources)
+	}
+
+	// seele's advertised and measured bandwidth differ.
+	status, found := vote.Get("000A10D43011EA4928A35F610405F92B4433B4DC")
+	if !found {
+		t.Fatal("Router status not found in vote.")
+	}
+	if status.Bandwidth != 20 || status.Measured != 18 || !status.IsBandwidthMeasured() {
+		t.Errorf("Bandwidth of measured relay parsed incorrectly: %d, %d.", status.Bandwidth, status.Measured)
+	}
+
+	// Karlstad0 lacks a measurement.
+	status, found = vote.Get("9B94CD0B7B8057EAF21BA7F023B7A1C8CA9CE645")
+	if !found {
+		t.Fatal("Router status not found in vote.")
+	}
+	if status.Bandwidth != 2670 || status.Measured != 0 || status.IsBandwidthMeasured() {
+		t.Error("Bandwidth of unmeasured relay parsed incorrectly.")
+	}
+
+	// Votes can also be parsed without knowing their type in advance.
+	objs, err := ParseUnknownFile(voteFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := objs.(*Vote); !ok {
+		t.Errorf("Expected *Vote but got %T.", objs)
+	}
+}
+
+func TestConsensusBandwidthMeasured(t *testing.T) {
+
+	_, getStatus, err := ParseRawStatus(`r seele AAoQ1DAR6kkoo19hBAX5K0QztNw bdrzhG0Kk/8DUsnSdmzj7DjFQjY 2014-12-08 12:27:05 73.15.150.172 9001 0
+w Bandwidth=20 Unmeasured=1`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status := getStatus(); status.Bandwidth != 20 || status.IsBandwidthMeasured() {
+		t.Error("Unmeasured consensus relay parsed incorrectly.")
+	}
+
+	_, getStatus, err = ParseRawStatus(`r seele AAoQ1DAR6kkoo19hBAX5K0QztNw bdrzhG0Kk/8DUsnSdmzj7DjFQjY 2014-12-08 12:27:05 73.15.150.172 9001 0
+w Bandwidth=20`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status := getStatus(); status.Bandwidth != 20 || !status.IsBandwidthMeasured() {
+		t.Error("Measured consensus relay parsed incorrectly.")
+	}
+}
+
+func TestParseFlagThresholds(t *testing.T) {
+
+	thresholds, err := parseFlagThresholds("fast-speed=54000 guard-wfu=98.000%")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(thresholds) != 2 || thresholds["fast-speed"] != "54000" || thresholds["guard-wfu"] != "98.000%" {
+		t.Errorf("Flag thresholds parsed incorrectly: %v", thresholds)
+	}
+
+	for _, line := range []string{"fast-speed", "=54000"} {
+		if _, err := parseFlagThresholds(line); err == nil {
+			t.Errorf("Malformed flag thresholds %q did not cause an error.", line)
+		}
+	}
+}
+
+func TestParseSharedRandCommit(t *testing.T) {
+
+	if _, err := parseSharedRandCommit([]string{"1", "sha3-256", "D586D18309DED4CD6D57C18FDB97EFA96D330566"}); err == nil {
+		t.Error("Expected error for commit lacking its value.")
+	}
+	if _, err := parseSharedRandCommit([]string{"1", "sha3-256", "D586D183", "AAAA"}); err == nil {
+		t.Error("Expected error for truncated identity.")
+	}
+	if _, err := parseSharedRandCommit([]string{"1", "sha3-256", "D586D18309DED4CD6D57C18FDB97EFA96D330566", "!!"}); err == nil {
+		t.Error("Expected error for malformed commit value.")
+	}
+}